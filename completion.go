@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"os"
+	"sort"
+
+	"github.com/benmoss/package-rewriter/pkg/config"
+	"golang.org/x/tools/go/packages"
+)
+
+// runCompletion prints the completion script for a shell
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: package-rewriter completion bash|zsh|fish")
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q (use: bash, zsh, fish)", args[0])
+	}
+	_, err := os.Stdout.Write([]byte(script))
+	return err
+}
+
+// runComplete prints candidates for the completion scripts, one per line:
+// "types <package>" lists the types declared in a package and
+// "profiles <config-file>" lists the profiles a config file defines
+func runComplete(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: package-rewriter __complete types|profiles <arg>")
+	}
+
+	var candidates []string
+	switch args[0] {
+	case "types":
+		names, err := packageTypeNames("", args[1])
+		if err != nil {
+			return err
+		}
+		candidates = names
+	case "profiles":
+		cfg, err := config.LoadConfig(args[1])
+		if err != nil {
+			return err
+		}
+		for name := range cfg.Profiles {
+			candidates = append(candidates, name)
+		}
+		sort.Strings(candidates)
+	default:
+		return fmt.Errorf("unknown completion %q", args[0])
+	}
+
+	for _, candidate := range candidates {
+		fmt.Println(candidate)
+	}
+	return nil
+}
+
+// packageTypeNames returns the exported types declared in a package, sorted.
+// Only the package's syntax is loaded, which keeps completion fast.
+func packageTypeNames(dir, pkgPath string) ([]string, error) {
+	pkgs, err := packages.Load(&packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax,
+		Dir:  dir,
+	}, pkgPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 || len(pkgs[0].Syntax) == 0 {
+		return nil, fmt.Errorf("package not found: %s", pkgPath)
+	}
+
+	var names []string
+	for _, file := range pkgs[0].Syntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				if name := spec.(*ast.TypeSpec).Name.Name; token.IsExported(name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+var completionScripts = map[string]string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+const bashCompletion = `# bash completion for package-rewriter
+# Load with: source <(package-rewriter completion bash)
+
+_package_rewriter() {
+    local cur prev i
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+    if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+        COMPREPLY=($(compgen -W "migrate explore diff-source serve completion" -- "$cur"))
+        return
+    fi
+
+    case "${COMP_WORDS[1]}" in
+    completion)
+        COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+        return
+        ;;
+    migrate)
+        COMPREPLY=($(compgen -W "-w" -- "$cur") $(compgen -f -- "$cur"))
+        return
+        ;;
+    diff-source)
+        case "$prev" in
+        --config|-config) COMPREPLY=($(compgen -f -- "$cur")) ;;
+        --profile|-profile|--module|-module|--from|-from|--to|-to) ;;
+        *) COMPREPLY=($(compgen -W "--config --profile --module --from --to --json" -- "$cur")) ;;
+        esac
+        return
+        ;;
+    serve)
+        [[ $prev != --listen && $prev != -listen ]] && COMPREPLY=($(compgen -W "--listen" -- "$cur"))
+        return
+        ;;
+    explore)
+        if [[ $prev == --type || $prev == -type ]]; then
+            local pkg=""
+            for ((i = 2; i < COMP_CWORD; i++)); do
+                case "${COMP_WORDS[i]}" in
+                --package|-package) pkg="${COMP_WORDS[i+1]}" ;;
+                esac
+            done
+            [[ -n $pkg ]] && COMPREPLY=($(compgen -W "$(package-rewriter __complete types "$pkg" 2>/dev/null)" -- "$cur"))
+        elif [[ $prev != --package && $prev != -package && $prev != --module && $prev != -module && $prev != --output && $prev != --write ]]; then
+            COMPREPLY=($(compgen -W "--package --module --type --output --write" -- "$cur"))
+        fi
+        return
+        ;;
+    esac
+
+    case "$prev" in
+    --config|-config)
+        COMPREPLY=($(compgen -f -- "$cur"))
+        return
+        ;;
+    --output|-output)
+        COMPREPLY=($(compgen -d -- "$cur"))
+        return
+        ;;
+    -v|--v)
+        COMPREPLY=($(compgen -W "debug info warn error" -- "$cur"))
+        return
+        ;;
+    --profile|-profile)
+        local config=""
+        for ((i = 1; i < COMP_CWORD; i++)); do
+            case "${COMP_WORDS[i]}" in
+            --config|-config) config="${COMP_WORDS[i+1]}" ;;
+            esac
+        done
+        [[ -n $config ]] && COMPREPLY=($(compgen -W "$(package-rewriter __complete profiles "$config" 2>/dev/null)" -- "$cur"))
+        return
+        ;;
+    --type|-type)
+        local pkg=""
+        for ((i = 1; i < COMP_CWORD; i++)); do
+            case "${COMP_WORDS[i]}" in
+            --package|-package) pkg="${COMP_WORDS[i+1]}" ;;
+            esac
+        done
+        [[ -n $pkg ]] && COMPREPLY=($(compgen -W "$(package-rewriter __complete types "$pkg" 2>/dev/null)" -- "$cur"))
+        return
+        ;;
+    --package|-package|--module|-module)
+        return
+        ;;
+    esac
+
+    COMPREPLY=($(compgen -W "--config --profile --package --module --type --output -v --auto-require --tidy --print-schema --version --generate" -- "$cur"))
+}
+
+complete -F _package_rewriter package-rewriter
+`
+
+const zshCompletion = `#compdef package-rewriter
+# zsh completion for package-rewriter
+# Load with: source <(package-rewriter completion zsh)
+
+_package_rewriter_types() {
+    local pkg=${opt_args[--package]:-${opt_args[-package]}}
+    [[ -n $pkg ]] || return 1
+    local -a types
+    types=(${(f)"$(package-rewriter __complete types $pkg 2>/dev/null)"})
+    _describe 'type' types
+}
+
+_package_rewriter_profiles() {
+    local config=${opt_args[--config]:-${opt_args[-config]}}
+    [[ -n $config ]] || return 1
+    local -a profiles
+    profiles=(${(f)"$(package-rewriter __complete profiles $config 2>/dev/null)"})
+    _describe 'profile' profiles
+}
+
+_package_rewriter() {
+    if (( CURRENT == 2 )) && [[ ${words[2]} != -* ]]; then
+        _values 'command' 'migrate[rewrite a config file in the current format]' 'explore[explore the closure of root types interactively]' 'diff-source[report upstream changes to extracted types between two versions]' 'serve[serve extraction requests over HTTP]' 'completion[print a shell completion script]'
+        return
+    fi
+
+    case ${words[2]} in
+    completion)
+        _values 'shell' bash zsh fish
+        return
+        ;;
+    migrate)
+        _arguments '-w[write the result to the config file]' '*:config file:_files -g "*.(yaml|yml)"'
+        return
+        ;;
+    diff-source)
+        _arguments \
+            '--config[path to config file]:config file:_files -g "*.(yaml|yml)"' \
+            '--profile[profile in the config file to apply]:profile:_package_rewriter_profiles' \
+            '--module[source module whose versions to compare]:module path:' \
+            '--from[version to compare from]:version:' \
+            '--to[version to compare to]:version:' \
+            '--json[print the changes as JSON]'
+        return
+        ;;
+    serve)
+        _arguments '--listen[address to listen on]:address:'
+        return
+        ;;
+    explore)
+        _arguments \
+            '--package[package path of the root types]:package path:' \
+            '--module[module to search for the package of each root type]:module path:' \
+            '*--type[root type names]:type:_package_rewriter_types' \
+            '--output[output directory recorded in the config]:directory:_files -/' \
+            '--write[default path for the write command]:config file:_files'
+        return
+        ;;
+    esac
+
+    _arguments \
+        '--config[path to config file]:config file:_files -g "*.(yaml|yml)"' \
+        '--profile[profile in the config file to apply]:profile:_package_rewriter_profiles' \
+        '--package[package path to extract from]:package path:' \
+        '--module[module to search for the package of each type]:module path:' \
+        '*--type[type names to extract]:type:_package_rewriter_types' \
+        '--output[output directory for generated code]:directory:_files -/' \
+        '-v[log level]:level:(debug info warn error)' \
+        '--auto-require[get packages the module does not require into a temporary go.mod]' \
+        '--tidy[run go mod tidy after updating replace directives]' \
+        '--print-schema[print the JSON Schema for config files]' \
+        '--version[print the package-rewriter version]' \
+        '--generate[run from a //go:generate directive]'
+}
+
+compdef _package_rewriter package-rewriter
+`
+
+const fishCompletion = `# fish completion for package-rewriter
+# Load with: package-rewriter completion fish | source
+
+function __package_rewriter_flag_value
+    set -l tokens (commandline -opc)
+    for i in (seq (count $tokens))
+        if contains -- $tokens[$i] --$argv[1] -$argv[1]; and test $i -lt (count $tokens)
+            echo $tokens[(math $i + 1)]
+        end
+    end
+end
+
+function __package_rewriter_types
+    set -l pkg (__package_rewriter_flag_value package)[-1]
+    test -n "$pkg"; and package-rewriter __complete types $pkg 2>/dev/null
+end
+
+function __package_rewriter_profiles
+    set -l config (__package_rewriter_flag_value config)[-1]
+    test -n "$config"; and package-rewriter __complete profiles $config 2>/dev/null
+end
+
+complete -c package-rewriter -f
+complete -c package-rewriter -n __fish_use_subcommand -a migrate -d 'Rewrite a config file in the current format'
+complete -c package-rewriter -n __fish_use_subcommand -a explore -d 'Explore the closure of root types interactively'
+complete -c package-rewriter -n __fish_use_subcommand -a diff-source -d 'Report upstream changes to extracted types between two versions'
+complete -c package-rewriter -n __fish_use_subcommand -a serve -d 'Serve extraction requests over HTTP'
+complete -c package-rewriter -n __fish_use_subcommand -a completion -d 'Print a shell completion script'
+complete -c package-rewriter -n '__fish_seen_subcommand_from explore' -l write -r -F -d 'Default path for the write command'
+complete -c package-rewriter -n '__fish_seen_subcommand_from diff-source' -l from -x -d 'Version to compare from'
+complete -c package-rewriter -n '__fish_seen_subcommand_from diff-source' -l to -x -d 'Version to compare to'
+complete -c package-rewriter -n '__fish_seen_subcommand_from diff-source' -l json -d 'Print the changes as JSON'
+complete -c package-rewriter -n '__fish_seen_subcommand_from serve' -l listen -x -d 'Address to listen on (host:port or unix:<path>)'
+complete -c package-rewriter -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'
+complete -c package-rewriter -n '__fish_seen_subcommand_from migrate' -s w -d 'Write the result to the config file'
+complete -c package-rewriter -n '__fish_seen_subcommand_from migrate' -F
+complete -c package-rewriter -l config -r -F -d 'Path to config file (YAML)'
+complete -c package-rewriter -l profile -x -a '(__package_rewriter_profiles)' -d 'Profile in the config file to apply'
+complete -c package-rewriter -l package -x -d 'Package path to extract from'
+complete -c package-rewriter -l module -x -d 'Module to search for the package of each type'
+complete -c package-rewriter -l type -x -a '(__package_rewriter_types)' -d 'Type names to extract'
+complete -c package-rewriter -l output -x -a '(__fish_complete_directories)' -d 'Output directory for generated code'
+complete -c package-rewriter -s v -x -a 'debug info warn error' -d 'Log level'
+complete -c package-rewriter -l auto-require -d "Get packages the module doesn't require into a temporary go.mod"
+complete -c package-rewriter -l tidy -d 'Run go mod tidy after updating replace directives'
+complete -c package-rewriter -l print-schema -d 'Print the JSON Schema for config files'
+complete -c package-rewriter -l version -d 'Print the package-rewriter version'
+complete -c package-rewriter -l generate -d 'Run from a //go:generate directive'
+`
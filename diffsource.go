@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/benmoss/package-rewriter/pkg/config"
+	"github.com/benmoss/package-rewriter/pkg/rewriter"
+)
+
+// runDiffSource reports how the types a config extracts changed upstream
+// between two versions of a source module, without generating code
+func runDiffSource(args []string) error {
+	fs := flag.NewFlagSet("diff-source", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to config file (YAML)")
+	profile := fs.String("profile", "", "Name of a profile in the config file to apply")
+	modulePath := fs.String("module", "", "Source module whose versions to compare")
+	from := fs.String("from", "", "Version to compare from (default: the version your go.mod requires)")
+	to := fs.String("to", "latest", "Version to compare to")
+	asJSON := fs.Bool("json", false, "Print the changes as JSON")
+	fs.Parse(args)
+
+	if *configPath == "" || *modulePath == "" {
+		return fmt.Errorf("usage: package-rewriter diff-source --config <config-file> --module <module> [--from <version>] [--to <version>] [--json]")
+	}
+	cfg, err := config.LoadConfigProfile(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+	if err := addScannedNeeds(cfg, *configPath); err != nil {
+		return err
+	}
+
+	// Only the report goes to stdout
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	changes, err := rewriter.DiffSource(rewriterConfigs(cfg), *modulePath, *from, *to)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if changes == nil {
+			changes = []rewriter.SourceChange{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	printSourceChanges(os.Stdout, changes)
+	return nil
+}
+
+// printSourceChanges writes one line per change
+func printSourceChanges(w io.Writer, changes []rewriter.SourceChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes to extracted types")
+		return
+	}
+	for _, change := range changes {
+		name := change.Type
+		if change.Field != "" {
+			name += "." + change.Field
+		}
+		switch change.Change {
+		case "added":
+			fmt.Fprintf(w, "%s: added (%s)\n", name, change.To)
+		case "removed":
+			fmt.Fprintf(w, "%s: removed (%s)\n", name, change.From)
+		case "retyped":
+			fmt.Fprintf(w, "%s: retyped from %s to %s\n", name, change.From, change.To)
+		case "tag":
+			fmt.Fprintf(w, "%s: tag changed from `%s` to `%s`\n", name, change.From, change.To)
+		}
+	}
+}
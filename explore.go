@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benmoss/package-rewriter/pkg/config"
+	"github.com/benmoss/package-rewriter/pkg/rewriter"
+)
+
+const exploreHelp = `Commands:
+  tree [depth]                   show the dependency tree (default depth 3)
+  prune <type> <field>...        toggle pruning fields of a type
+  substitute <type> [<pkg.Type>] substitute a type with an existing one, or stop substituting it
+  keep <package>                 toggle keeping a package (or parent path) external
+  write [file]                   write the resulting config
+  help                           show this help
+  quit                           exit
+
+Types can be given by a unique suffix of their qualified name (e.g., v1.ObjectMeta).
+`
+
+// runExplore loads the closure of the given root types and lets the user
+// prune, substitute, and keep packages external while watching the closure
+// shrink, then writes the resulting config
+func runExplore(args []string) error {
+	fs := flag.NewFlagSet("explore", flag.ExitOnError)
+	pkgPath := fs.String("package", "", "Package path of the root types")
+	modulePath := fs.String("module", "", "Module to search for the package of each root type, when neither --package nor pkg=Type gives it")
+	var typeNames stringList
+	fs.Var(&typeNames, "type", "Root type name(s), comma-separated and repeatable; pkg=Type1,Type2 names the package inline")
+	outputDir := fs.String("output", "./generated", "Output directory recorded in the written config")
+	configPath := fs.String("write", "rewriter.yaml", "Default path for the write command")
+	fs.Parse(args)
+
+	roots, err := parseTypeFlags(*pkgPath, *modulePath, typeNames, *outputDir)
+	if err != nil {
+		return err
+	}
+	if err := resolveTypePackages(roots, *modulePath, findTypePackages); err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("usage: package-rewriter explore --package <pkg>|--module <module> --type <type>[,<type>...]")
+	}
+
+	// Keep rebuilds from interleaving progress logs with the session
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	s := &exploreSession{
+		roots:      roots,
+		outputDir:  *outputDir,
+		configPath: *configPath,
+		options:    make(map[rewriter.TypeRef]*rewriter.TypeOptions),
+		build:      rewriter.BuildDependencyTree,
+	}
+	return s.run(os.Stdin, os.Stdout)
+}
+
+// exploreSession holds the decisions made so far and the closure they produce
+type exploreSession struct {
+	roots        []*rewriter.Config
+	outputDir    string
+	configPath   string
+	options      map[rewriter.TypeRef]*rewriter.TypeOptions
+	keepExternal []string
+	tree         []*rewriter.DependencyNode
+	build        func([]*rewriter.Config) ([]*rewriter.DependencyNode, error)
+}
+
+func (s *exploreSession) run(in io.Reader, out io.Writer) error {
+	fmt.Fprintln(out, "Loading the closure...")
+	if err := s.rebuild(); err != nil {
+		return err
+	}
+	s.printSummary(out)
+	fmt.Fprint(out, exploreHelp)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return nil
+		}
+		if err := s.command(fields[0], fields[1:], out); err != nil {
+			fmt.Fprintf(out, "Error: %v\n", err)
+		}
+	}
+}
+
+// command runs one command. Decisions that change the closure are rolled
+// back if it can no longer be built with them.
+func (s *exploreSession) command(name string, args []string, out io.Writer) error {
+	switch name {
+	case "help":
+		fmt.Fprint(out, exploreHelp)
+		return nil
+
+	case "tree":
+		depth := 3
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid depth %q", args[0])
+			}
+			depth = n
+		}
+		for _, node := range s.tree {
+			s.printNode(out, node, 0, depth)
+		}
+		return nil
+
+	case "write":
+		path := s.configPath
+		if len(args) > 0 {
+			path = args[0]
+		}
+		data, err := s.config().Marshal()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote %s\n", path)
+		return nil
+	}
+
+	undo, err := s.decide(name, args)
+	if err != nil {
+		return err
+	}
+	if err := s.rebuild(); err != nil {
+		undo()
+		return err
+	}
+	s.printSummary(out)
+	return nil
+}
+
+// decide applies a prune, substitute, or keep decision, returning a function
+// that reverts it
+func (s *exploreSession) decide(name string, args []string) (func(), error) {
+	switch name {
+	case "prune":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("usage: prune <type> <field>...")
+		}
+		ref, err := s.resolveType(args[0])
+		if err != nil {
+			return nil, err
+		}
+		opts := s.typeOptions(ref)
+		previous := opts.Prune
+		pruned := slices.Clone(opts.Prune)
+		for _, field := range args[1:] {
+			if i := slices.Index(pruned, field); i >= 0 {
+				pruned = slices.Delete(pruned, i, i+1)
+			} else {
+				pruned = append(pruned, field)
+			}
+		}
+		opts.Prune = pruned
+		return func() { opts.Prune = previous }, nil
+
+	case "substitute":
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("usage: substitute <type> [<import/path.Type>]")
+		}
+		ref, err := s.resolveType(args[0])
+		if err != nil {
+			return nil, err
+		}
+		opts := s.typeOptions(ref)
+		previous := opts.Substitute
+		opts.Substitute = ""
+		if len(args) == 2 {
+			opts.Substitute = args[1]
+		}
+		return func() { opts.Substitute = previous }, nil
+
+	case "keep":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: keep <package>")
+		}
+		previous := s.keepExternal
+		if i := slices.Index(s.keepExternal, args[0]); i >= 0 {
+			s.keepExternal = slices.Delete(slices.Clone(s.keepExternal), i, i+1)
+		} else {
+			s.keepExternal = append(slices.Clone(s.keepExternal), args[0])
+		}
+		return func() { s.keepExternal = previous }, nil
+	}
+
+	return nil, fmt.Errorf("unknown command %q (try help)", name)
+}
+
+func (s *exploreSession) typeOptions(ref rewriter.TypeRef) *rewriter.TypeOptions {
+	if s.options[ref] == nil {
+		s.options[ref] = &rewriter.TypeOptions{}
+	}
+	return s.options[ref]
+}
+
+// resolveType finds the type a user means by a qualified name or a unique
+// suffix of one, among the closure and the types decisions were made for
+func (s *exploreSession) resolveType(name string) (rewriter.TypeRef, error) {
+	candidates := make(map[rewriter.TypeRef]bool)
+	var walk func(nodes []*rewriter.DependencyNode)
+	walk = func(nodes []*rewriter.DependencyNode) {
+		for _, node := range nodes {
+			candidates[node.Ref] = true
+			walk(node.Children)
+		}
+	}
+	walk(s.tree)
+	for ref := range s.options {
+		candidates[ref] = true
+	}
+
+	var matches []string
+	var match rewriter.TypeRef
+	for ref := range candidates {
+		if strings.Contains(ref.TypeName, ".") {
+			// Methods can't be pruned or substituted
+			continue
+		}
+		if qualified := ref.String(); qualified == name || strings.HasSuffix(qualified, "/"+name) || strings.HasSuffix(qualified, "."+name) {
+			matches = append(matches, qualified)
+			match = ref
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return rewriter.TypeRef{}, fmt.Errorf("no type matching %q in the closure", name)
+	case 1:
+		return match, nil
+	default:
+		sort.Strings(matches)
+		return rewriter.TypeRef{}, fmt.Errorf("%q is ambiguous: %s", name, strings.Join(matches, ", "))
+	}
+}
+
+// configs turns the roots and decisions into a batch for the rewriter
+func (s *exploreSession) configs() []*rewriter.Config {
+	var configs []*rewriter.Config
+	for _, root := range s.roots {
+		cfg := *root
+		cfg.KeepExternal = s.keepExternal
+		ref := rewriter.TypeRef{PackagePath: cfg.PackagePath, TypeName: cfg.TypeName}
+		if opts := s.options[ref]; opts != nil {
+			cfg.Options = *opts
+		}
+		configs = append(configs, &cfg)
+	}
+	for _, ref := range s.optionRefs() {
+		if !s.isRoot(ref) {
+			configs = append(configs, &rewriter.Config{
+				PackagePath:  ref.PackagePath,
+				TypeName:     ref.TypeName,
+				OutputDir:    s.outputDir,
+				KeepExternal: s.keepExternal,
+				Options:      *s.options[ref],
+			})
+		}
+	}
+	return configs
+}
+
+// config returns the config file equivalent of the session
+func (s *exploreSession) config() *config.Config {
+	cfg := &config.Config{
+		APIVersion:   config.CurrentAPIVersion(),
+		Output:       s.outputDir,
+		KeepExternal: s.keepExternal,
+	}
+
+	entries := make(map[string]*config.PackageEntry)
+	var order []string
+	for _, c := range s.configs() {
+		if c.Options.Substitute == "" && len(c.Options.Prune) == 0 && !s.isRoot(rewriter.TypeRef{PackagePath: c.PackagePath, TypeName: c.TypeName}) {
+			continue
+		}
+		entry := entries[c.PackagePath]
+		if entry == nil {
+			entry = &config.PackageEntry{Package: c.PackagePath}
+			entries[c.PackagePath] = entry
+			order = append(order, c.PackagePath)
+		}
+		entry.Types = append(entry.Types, config.TypeEntry{
+			Name:       c.TypeName,
+			Prune:      c.Options.Prune,
+			Substitute: c.Options.Substitute,
+		})
+	}
+	for _, pkgPath := range order {
+		cfg.Packages = append(cfg.Packages, *entries[pkgPath])
+	}
+	return cfg
+}
+
+// optionRefs returns the types decisions were made for, sorted
+func (s *exploreSession) optionRefs() []rewriter.TypeRef {
+	var refs []rewriter.TypeRef
+	for ref, opts := range s.options {
+		if opts.Substitute != "" || len(opts.Prune) > 0 {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+func (s *exploreSession) isRoot(ref rewriter.TypeRef) bool {
+	for _, root := range s.roots {
+		if root.PackagePath == ref.PackagePath && root.TypeName == ref.TypeName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *exploreSession) rebuild() error {
+	tree, err := s.build(s.configs())
+	if err != nil {
+		return err
+	}
+	s.tree = tree
+	return nil
+}
+
+func (s *exploreSession) printSummary(out io.Writer) {
+	decls, lines := 0, 0
+	for _, node := range s.tree {
+		decls += node.Weight
+		lines += node.Size
+	}
+	fmt.Fprintf(out, "Closure: %d declarations, %d lines\n", decls, lines)
+}
+
+func (s *exploreSession) printNode(out io.Writer, node *rewriter.DependencyNode, indent, depth int) {
+	if indent >= depth {
+		return
+	}
+	line := fmt.Sprintf("%s%s (%d decls, %d lines)", strings.Repeat("  ", indent), node.Ref, node.Weight, node.Size)
+	if opts := s.options[node.Ref]; opts != nil && len(opts.Prune) > 0 {
+		line += fmt.Sprintf(" [pruned: %s]", strings.Join(opts.Prune, ", "))
+	}
+	fmt.Fprintln(out, line)
+	for _, child := range node.Children {
+		s.printNode(out, child, indent+1, depth)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/benmoss/package-rewriter/pkg/rewriter"
+)
+
+func TestExploreSession(t *testing.T) {
+	ref := func(name string) rewriter.TypeRef {
+		pkgPath, typeName, _ := strings.Cut(name, ":")
+		return rewriter.TypeRef{PackagePath: pkgPath, TypeName: typeName}
+	}
+
+	// A fake closure: Sink -> Event -> {Stamp, other.Request}. Substituting
+	// Stamp or keeping other external drops it, and pruning a field that
+	// doesn't exist fails the way the rewriter would.
+	build := func(configs []*rewriter.Config) ([]*rewriter.DependencyNode, error) {
+		event := &rewriter.DependencyNode{Ref: ref("example.com/typeopts:Event"), Weight: 1, Size: 8}
+		for _, cfg := range configs {
+			if slices.Contains(cfg.Options.Prune, "Nope") {
+				return nil, fmt.Errorf("can't prune field Nope of %s.%s: no such field", cfg.PackagePath, cfg.TypeName)
+			}
+		}
+		substituted := slices.ContainsFunc(configs, func(cfg *rewriter.Config) bool { return cfg.Options.Substitute != "" })
+		if !substituted {
+			event.Children = append(event.Children, &rewriter.DependencyNode{Ref: ref("example.com/typeopts:Stamp"), Weight: 1, Size: 3})
+		}
+		if !slices.Contains(configs[0].KeepExternal, "example.com/other") {
+			event.Children = append(event.Children, &rewriter.DependencyNode{Ref: ref("example.com/other:Request"), Weight: 1, Size: 3})
+		}
+		for _, child := range event.Children {
+			event.Weight += child.Weight
+			event.Size += child.Size
+		}
+		return []*rewriter.DependencyNode{{
+			Ref:      ref("example.com/typeopts:Sink"),
+			Children: []*rewriter.DependencyNode{event},
+			Weight:   event.Weight + 1,
+			Size:     event.Size + 4,
+		}}, nil
+	}
+
+	configPath := filepath.Join(t.TempDir(), "rewriter.yaml")
+	s := &exploreSession{
+		roots:      []*rewriter.Config{{PackagePath: "example.com/typeopts", TypeName: "Sink", OutputDir: "./generated"}},
+		outputDir:  "./generated",
+		configPath: configPath,
+		options:    make(map[rewriter.TypeRef]*rewriter.TypeOptions),
+		build:      build,
+	}
+
+	script := strings.Join([]string{
+		"tree",
+		"prune Event Response Trace",
+		"substitute Stamp time.Time",
+		"prune Sink Nope",
+		"keep example.com/other",
+		"prune Event Trace",
+		"write",
+		"quit",
+	}, "\n")
+	var out strings.Builder
+	if err := s.run(strings.NewReader(script), &out); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	for _, want := range []string{
+		"Closure: 4 declarations, 18 lines",
+		"  example.com/typeopts.Event (3 decls, 14 lines)",
+		"Closure: 3 declarations, 15 lines",
+		"Error: can't prune field Nope",
+		"Closure: 2 declarations, 12 lines",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q:\n%s", want, out.String())
+		}
+	}
+
+	written, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `apiVersion: v1
+output: ./generated
+keepExternal:
+  - example.com/other
+packages:
+  - package: example.com/typeopts
+    types:
+      - Sink
+      - name: Event
+        prune:
+          - Response
+      - name: Stamp
+        substitute: time.Time
+`
+	if string(written) != expected {
+		t.Errorf("Written config:\n%s\nwant:\n%s", written, expected)
+	}
+}
@@ -3,12 +3,12 @@ module github.com/benmoss/package-rewriter
 go 1.25.0
 
 require (
-	golang.org/x/mod v0.29.0
-	golang.org/x/tools v0.38.0
+	golang.org/x/mod v0.35.0
+	golang.org/x/tools v0.44.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/google/go-cmp v0.7.0 // indirect
-	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sync v0.20.0 // indirect
 )
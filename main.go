@@ -1,33 +1,157 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/benmoss/package-rewriter/pkg/config"
 	"github.com/benmoss/package-rewriter/pkg/rewriter"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		run, ok := map[string]func([]string) error{
+			"migrate":     runMigrate,
+			"explore":     runExplore,
+			"diff-source": runDiffSource,
+			"serve":       runServe,
+			"completion":  runCompletion,
+			"__complete":  runComplete,
+		}[os.Args[1]]
+		if ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var (
-		configFile string
-		pkgPath    string
-		typeName   string
-		outputDir  string
-		verbosity  string
+		configFile  string
+		profile     string
+		pkgPath     string
+		modulePath  string
+		typeNames   stringList
+		outputDir   string
+		verbosity   string
+		schema      bool
+		generate    bool
+		quiet       bool
+		logFormat   string
+		autoRequire bool
+		tidy        bool
+		version     bool
 	)
 
 	flag.StringVar(&configFile, "config", "", "Path to config file (YAML)")
+	flag.StringVar(&profile, "profile", "", "Name of a profile in the config file to apply")
 	flag.StringVar(&pkgPath, "package", "", "Package path to extract from (e.g., github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1)")
-	flag.StringVar(&typeName, "type", "", "Type name to extract (e.g., Application)")
+	flag.StringVar(&modulePath, "module", "", "Module to search for the package of each type, when neither --package nor pkg=Type gives it")
+	flag.Var(&typeNames, "type", "Type name(s) to extract, comma-separated and repeatable (e.g., Application); pkg=Type1,Type2 names the package inline, as does a qualified import/path.Type")
 	flag.StringVar(&outputDir, "output", "./generated", "Output directory for generated code")
 	flag.StringVar(&verbosity, "v", "info", "Log level: debug, info, warn, error")
+	flag.BoolVar(&quiet, "quiet", false, "Only log errors (same as -v error)")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text, json")
+	flag.BoolVar(&autoRequire, "auto-require", false, "Get packages your module doesn't require into a temporary go.mod instead of failing")
+	flag.BoolVar(&tidy, "tidy", false, "Run go mod tidy on the consuming module after updating its replace directives, failing if the generated modules don't resolve")
+	flag.BoolVar(&schema, "print-schema", false, "Print the JSON Schema for config files and exit")
+	flag.BoolVar(&version, "version", false, "Print the package-rewriter version and exit")
+	flag.BoolVar(&generate, "generate", false, "Run from a //go:generate directive: resolve the config next to the directive's file and only print output on failure")
 
 	flag.Parse()
 
-	// Configure slog based on verbosity flag
+	if schema {
+		os.Stdout.Write(config.Schema())
+		return
+	}
+	if version {
+		fmt.Println("package-rewriter", rewriter.Version())
+		return
+	}
+
+	// All progress goes through the logger, so scripts can silence it or
+	// parse it
+	newHandler, err := logHandler(verbosity, logFormat, quiet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(newHandler(os.Stderr)))
+
+	// Under go generate, hold back progress output unless the run fails
+	replay := func() {}
+	if generate {
+		if configFile, err = generateConfigPath(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		replay = captureOutput(newHandler)
+	}
+	fail := func(err error) {
+		replay()
+		// Failures of a known class are logged with their code, for scripts
+		if d, ok := rewriter.DiagnosticOf(err); ok {
+			slog.Error("Failed", "diagnostic", d)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Determine which mode to use: config file or CLI flags
+	if configFile != "" {
+		// Config file mode
+		if err := runFromConfigFile(configFile, profile, tidy); err != nil {
+			fail(err)
+		}
+	} else {
+		// CLI mode
+		configs, err := parseTypeFlags(pkgPath, modulePath, typeNames, outputDir)
+		if err == nil {
+			err = resolveTypePackages(configs, modulePath, findTypePackages)
+		}
+		if err != nil || len(configs) == 0 {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			}
+			fmt.Fprintf(os.Stderr, "Usage:\n")
+			fmt.Fprintf(os.Stderr, "  Config file mode: package-rewriter --config <config-file> [--profile <name>] [--generate] [--tidy] [-v <level>] [--quiet]\n")
+			fmt.Fprintf(os.Stderr, "  CLI mode:         package-rewriter --package <pkg> --type <type>[,<type>...] [--type <pkg>=<type>,...] [--module <module>] [--output <dir>] [--auto-require] [--tidy] [-v <level>] [--quiet]\n")
+			fmt.Fprintf(os.Stderr, "  Migrate config:   package-rewriter migrate [-w] <config-file>\n")
+			fmt.Fprintf(os.Stderr, "  Explore closure:  package-rewriter explore --package <pkg>|--module <module> --type <type>[,<type>...]\n")
+			fmt.Fprintf(os.Stderr, "  Diff upstream:    package-rewriter diff-source --config <config-file> --module <module> [--from <version>] [--to <version>] [--json]\n")
+			fmt.Fprintf(os.Stderr, "  Server:           package-rewriter serve [--listen <host:port>|unix:<path>]\n")
+			fmt.Fprintf(os.Stderr, "  Completion:       package-rewriter completion bash|zsh|fish\n\n")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		for _, cfg := range configs {
+			cfg.AutoRequire = autoRequire
+			cfg.Tidy = tidy
+		}
+		if err := rewriter.RewriteRecursiveBatch(configs); err != nil {
+			fail(err)
+		}
+
+		for _, cfg := range configs {
+			slog.Info("Successfully extracted type", "type", cfg.TypeName, "package", cfg.PackagePath, "output", outputDir)
+		}
+	}
+}
+
+// logHandler returns a constructor for the log handlers the -v, --quiet, and
+// --log-format flags ask for
+func logHandler(verbosity, format string, quiet bool) (func(w io.Writer) slog.Handler, error) {
 	var level slog.Level
 	switch verbosity {
 	case "debug":
@@ -39,77 +163,381 @@ func main() {
 	case "error":
 		level = slog.LevelError
 	default:
-		fmt.Fprintf(os.Stderr, "Invalid verbosity level: %s (use: debug, info, warn, error)\n", verbosity)
-		os.Exit(1)
+		return nil, fmt.Errorf("invalid verbosity level: %s (use: debug, info, warn, error)", verbosity)
+	}
+	if quiet {
+		level = slog.LevelError
 	}
 
-	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: level,
-	})
-	slog.SetDefault(slog.New(handler))
+	switch format {
+	case "text":
+		return func(w io.Writer) slog.Handler {
+			return slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+		}, nil
+	case "json":
+		return func(w io.Writer) slog.Handler {
+			return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s (use: text, json)", format)
+	}
+}
 
-	// Determine which mode to use: config file or CLI flags
-	if configFile != "" {
-		// Config file mode
-		if err := runFromConfigFile(configFile); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
-	} else {
-		// Legacy CLI mode
-		if pkgPath == "" || typeName == "" {
-			fmt.Fprintf(os.Stderr, "Usage:\n")
-			fmt.Fprintf(os.Stderr, "  Config file mode: package-rewriter --config <config-file> [-v <level>]\n")
-			fmt.Fprintf(os.Stderr, "  CLI mode:         package-rewriter --package <pkg> --type <type> [--output <dir>] [-v <level>]\n\n")
-			flag.PrintDefaults()
-			os.Exit(1)
+// generateConfigPath resolves a relative config path against the directory
+// of the file containing the //go:generate directive
+func generateConfigPath(path string) (string, error) {
+	goFile := os.Getenv("GOFILE")
+	if goFile == "" || os.Getenv("GOPACKAGE") == "" {
+		return "", fmt.Errorf("--generate must be run by go generate (GOFILE and GOPACKAGE are not set)")
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return path, nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(goFile))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path), nil
+}
+
+// captureOutput holds back logs in memory, since go generate shows
+// everything a generator prints. The returned function replays them to
+// stderr, for when the run fails.
+func captureOutput(newHandler func(w io.Writer) slog.Handler) func() {
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(newHandler(&buf)))
+	return func() {
+		os.Stderr.Write(buf.Bytes())
+	}
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseTypeFlags turns --type values into rewriter configs. Each value is a
+// comma-separated list of type names in pkgPath, or pkg=Type1,Type2 to name
+// the package inline. Without either, the package is left empty for
+// resolveTypePackages to find in modulePath.
+func parseTypeFlags(pkgPath, modulePath string, values []string, outputDir string) ([]*rewriter.Config, error) {
+	var configs []*rewriter.Config
+	seen := make(map[string]bool)
+	for _, value := range values {
+		defaultPkg, names := pkgPath, value
+		if before, after, ok := strings.Cut(value, "="); ok {
+			defaultPkg, names = before, after
 		}
 
-		cfg := &rewriter.Config{
-			PackagePath: pkgPath,
-			TypeName:    typeName,
-			OutputDir:   outputDir,
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("empty type name in --type %s", value)
+			}
+			// A qualified type, as copied from code, names its package
+			pkg := defaultPkg
+			if strings.Contains(name, "/") {
+				var err error
+				if pkg, name, err = config.ParseTypeRef(name); err != nil {
+					return nil, fmt.Errorf("invalid --type %s: %w", value, err)
+				}
+			}
+			if pkg == "" && modulePath == "" {
+				return nil, fmt.Errorf("no package for --type %s (use --package, --module, pkg=Type, or import/path.Type)", value)
+			}
+			if seen[pkg+"."+name] {
+				continue
+			}
+			seen[pkg+"."+name] = true
+			configs = append(configs, &rewriter.Config{
+				PackagePath: pkg,
+				TypeName:    name,
+				OutputDir:   outputDir,
+			})
 		}
+	}
+	return configs, nil
+}
 
-		if err := rewriter.RewriteRecursive(cfg); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+// findTypePackages finds types in a module required by the current one
+func findTypePackages(modulePath string, typeNames []string) (map[string][]string, error) {
+	return rewriter.FindTypePackages("", modulePath, typeNames)
+}
+
+// resolveTypePackages fills in the package of the configs --type left
+// without one, searching modulePath for the package declaring each type. A
+// type must be declared by exactly one package; otherwise the error lists the
+// candidates, to be picked with pkg=Type.
+func resolveTypePackages(configs []*rewriter.Config, modulePath string, find func(string, []string) (map[string][]string, error)) error {
+	var names []string
+	for _, cfg := range configs {
+		if cfg.PackagePath == "" {
+			names = append(names, cfg.TypeName)
 		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
 
-		fmt.Printf("Successfully extracted %s from %s to %s\n", typeName, pkgPath, outputDir)
+	found, err := find(modulePath, names)
+	if err != nil {
+		return err
+	}
+	for _, cfg := range configs {
+		if cfg.PackagePath != "" {
+			continue
+		}
+		switch candidates := found[cfg.TypeName]; len(candidates) {
+		case 0:
+			return &rewriter.Diagnostic{
+				Code: rewriter.CodeTypeNotFound,
+				Decl: cfg.TypeName,
+				Err:  fmt.Errorf("no package of %s declares a type %s", modulePath, cfg.TypeName),
+			}
+		case 1:
+			cfg.PackagePath = candidates[0]
+			slog.Info("Found type", "type", cfg.TypeName, "package", cfg.PackagePath)
+		default:
+			return fmt.Errorf("type %s is declared by %d packages of %s; pick one with --type <pkg>=%s:\n  %s",
+				cfg.TypeName, len(candidates), modulePath, cfg.TypeName, strings.Join(candidates, "\n  "))
+		}
 	}
+	return nil
 }
 
-func runFromConfigFile(configPath string) error {
+func runFromConfigFile(configPath, profile string, tidy bool) error {
 	// Load config
-	cfg, err := config.LoadConfig(configPath)
+	cfg, err := config.LoadConfigProfile(configPath, profile)
+	if err != nil {
+		return err
+	}
+	cfg.Tidy = cfg.Tidy || tidy
+
+	if err := addScannedNeeds(cfg, configPath); err != nil {
+		return err
+	}
+	slog.Info("Loaded config", "packages", len(cfg.Packages))
+
+	configs := rewriterConfigs(cfg)
+	owner := configOwner(configPath, profile, cfg.Output)
+	for _, c := range configs {
+		c.Owner = owner
+	}
+	slog.Info("Extracting types and functions", "count", len(configs))
+
+	// Process all package/type pairs in a single batch
+	if err := rewriter.RewriteRecursiveBatch(configs); err != nil {
+		return fmt.Errorf("failed to process types: %w", err)
+	}
+
+	slog.Info("All packages processed successfully", "output", cfg.Output)
+
+	return nil
+}
+
+// addScannedNeeds adds the types named by //rewriter:need comments in the
+// directories the config scans, which are relative to the config file
+func addScannedNeeds(cfg *config.Config, configPath string) error {
+	if len(cfg.Scan) == 0 {
+		return nil
+	}
+	var dirs []string
+	for _, dir := range cfg.Scan {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(configPath), dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	needs, err := config.ScanNeeds(dirs, cfg.Output)
 	if err != nil {
 		return err
 	}
+	cfg.AddNeeds(needs)
+	slog.Info("Scanned for needed types", "dirs", len(dirs), "needs", len(needs))
+	if len(cfg.Packages) == 0 {
+		return fmt.Errorf("no package entries, and no //rewriter:need comments found in %s", strings.Join(cfg.Scan, ", "))
+	}
+	return nil
+}
 
-	fmt.Printf("Loaded config: %d package(s) to process\n", len(cfg.Packages))
+// configOwner names a config file and profile in the manifest of the output
+// directory, by its path relative to it, which doesn't depend on where the
+// tool runs from
+func configOwner(configPath, profile, outputDir string) string {
+	owner := configPath
+	absConfig, err1 := filepath.Abs(configPath)
+	absOutput, err2 := filepath.Abs(outputDir)
+	if err1 == nil && err2 == nil {
+		if rel, err := filepath.Rel(absOutput, absConfig); err == nil {
+			owner = rel
+		}
+	}
+	owner = filepath.ToSlash(owner)
+	if profile != "" {
+		owner += "#" + profile
+	}
+	return owner
+}
 
-	// Build list of all rewriter configs
+// rewriterConfigs builds a rewriter config for every type, function, and
+// verbatim package in the config file
+func rewriterConfigs(cfg *config.Config) []*rewriter.Config {
 	var rewriterConfigs []*rewriter.Config
 	for _, pkgEntry := range cfg.Packages {
-		for _, typeName := range pkgEntry.Types {
-			rewriterConfigs = append(rewriterConfigs, &rewriter.Config{
-				PackagePath: pkgEntry.Package,
-				TypeName:    typeName,
-				OutputDir:   cfg.Output,
-			})
+		if pkgEntry.Copy == "all" {
+			rewriterCfg := newRewriterConfig(cfg, pkgEntry)
+			rewriterCfg.CopyAll = true
+			rewriterCfg.ExcludeFiles = pkgEntry.Exclude
+			rewriterConfigs = append(rewriterConfigs, rewriterCfg)
+			continue
+		}
+		for _, typeEntry := range pkgEntry.Types {
+			rewriterCfg := newRewriterConfig(cfg, pkgEntry)
+			rewriterCfg.TypeName = typeEntry.Name
+			rewriterCfg.Options = rewriter.TypeOptions{
+				Prune:       typeEntry.Prune,
+				Fields:      typeEntry.Fields,
+				DropStatus:  typeEntry.DropStatus,
+				Substitute:  typeEntry.Substitute,
+				CopyMethods: typeEntry.CopyMethods,
+				Rename:      typeEntry.Rename,
+				Wrap:        typeEntry.Wrap,
+			}
+			rewriterConfigs = append(rewriterConfigs, rewriterCfg)
+		}
+		for _, funcName := range pkgEntry.Functions {
+			rewriterCfg := newRewriterConfig(cfg, pkgEntry)
+			rewriterCfg.FunctionName = funcName
+			rewriterConfigs = append(rewriterConfigs, rewriterCfg)
 		}
 	}
+	return rewriterConfigs
+}
 
-	fmt.Printf("Total types to extract: %d\n\n", len(rewriterConfigs))
-
-	// Process all package/type pairs in a single batch
-	if err := rewriter.RewriteRecursiveBatch(rewriterConfigs); err != nil {
-		return fmt.Errorf("failed to process types: %w", err)
+// runMigrate rewrites a config file in the current format version, printing
+// the result or, with -w, writing it back to the file
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	write := fs.Bool("w", false, "Write the result to the config file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: package-rewriter migrate [-w] <config-file>")
 	}
+	path := fs.Arg(0)
 
-	fmt.Printf("\n=== All packages processed successfully ===\n")
-	fmt.Printf("Output directory: %s\n", cfg.Output)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	migrated, err := config.Migrate(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
 
+	if !*write {
+		_, err := os.Stdout.Write(migrated)
+		return err
+	}
+	if err := os.WriteFile(path, migrated, 0o644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	slog.Info("Migrated config", "file", path, "apiVersion", config.CurrentAPIVersion())
 	return nil
 }
+
+// newRewriterConfig creates a rewriter config for one entry of the config file,
+// carrying over the run-wide options
+func newRewriterConfig(cfg *config.Config, entry config.PackageEntry) *rewriter.Config {
+	var shims []rewriter.Shim
+	for _, shim := range cfg.Shims {
+		shims = append(shims, rewriter.Shim{Module: shim.Module, Path: shim.Shim, Version: shim.Version})
+	}
+	var publish *rewriter.Publish
+	if cfg.Publish != nil {
+		publish = &rewriter.Publish{
+			Module:  cfg.Publish.Module,
+			Source:  cfg.Publish.Source,
+			Version: cfg.Publish.Version,
+			License: cfg.Publish.License,
+		}
+	}
+	// Validate has checked the emitters and modes
+	var emitters []rewriter.Emitter
+	for _, name := range cfg.Emit {
+		emitter, _ := rewriter.NewEmitter(name)
+		emitters = append(emitters, emitter)
+	}
+	fileMode, _ := config.ParseMode(cfg.FileMode)
+	dirMode, _ := config.ParseMode(cfg.DirMode)
+	goTimeout, _ := config.ParseTimeout(cfg.GoTimeout)
+	var goEnv []string
+	for _, name := range slices.Sorted(maps.Keys(cfg.GoEnv)) {
+		goEnv = append(goEnv, name+"="+cfg.GoEnv[name])
+	}
+	return &rewriter.Config{
+		PackagePath:     entry.Package,
+		Version:         entry.Version,
+		Recursion:       rewriter.Recursion(entry.Recursion),
+		OutputDir:       cfg.Output,
+		CopyMethods:     cfg.CopyMethods,
+		OnUnextractable: rewriter.UnextractablePolicy(cfg.OnUnextractable),
+		Directives:      rewriter.DirectivePolicy(cfg.Directives),
+		Cgo:             rewriter.CgoPolicy(cfg.Cgo),
+		Vars:            rewriter.VarPolicy(cfg.Vars),
+		SuspectFields:   rewriter.SuspectFieldPolicy(cfg.SuspectFields),
+		Preset:          rewriter.Preset(cfg.Preset),
+		GoVersion:       cfg.GoVersion,
+		Toolchain:       cfg.Toolchain,
+		WholePackage:    cfg.WholePackage,
+		ImportPrefix:    cfg.ImportPrefix,
+		AliasTag:        cfg.AliasTag,
+		KeepExternal:    cfg.KeepExternal,
+		Stdlib:          cfg.Stdlib,
+		Shims:           shims,
+
+		StripVersionSuffix:      cfg.StripVersionSuffix,
+		Layout:                  rewriter.Layout(cfg.Layout),
+		UmbrellaModule:          cfg.UmbrellaModule,
+		InModule:                cfg.Standalone != nil && !*cfg.Standalone,
+		ReplaceWith:             cfg.ReplaceWith,
+		SuspectFieldReplacement: cfg.SuspectFieldReplacement,
+		SubstitutePackages:      cfg.SubstitutePackages,
+		Inline:                  cfg.Inline,
+		CollapseModules:         cfg.CollapseModules,
+		CollisionPolicy:         rewriter.CollisionPolicy(cfg.CollisionPolicy),
+		MinimizeModules:         cfg.MinimizeModules,
+		FlattenStructs:          cfg.FlattenStructs,
+		NonSerializableFields:   rewriter.NonSerializablePolicy(cfg.NonSerializableFields),
+		DropDeprecated:          cfg.DropDeprecated,
+		Unexported:              rewriter.UnexportedPolicy(cfg.Unexported),
+		SideEffectImports:       rewriter.SideEffectImportPolicy(cfg.SideEffectImports),
+		SideEffectImportMap:     cfg.SideEffectImportMap,
+		AutoRequire:             cfg.AutoRequire,
+		Tidy:                    cfg.Tidy,
+		GoEnv:                   goEnv,
+		GoTimeout:               goTimeout,
+		Publish:                 publish,
+		Bazel:                   cfg.Bazel,
+		Emitters:                emitters,
+		Validation:              cfg.Validation,
+		Defaults:                cfg.Defaults,
+		GVK:                     cfg.GVK,
+		Builders:                cfg.Builders,
+		Equal:                   cfg.Equal,
+		FieldReport:             cfg.FieldReport,
+		Minify:                  cfg.Minify,
+		PreserveSource:          cfg.PreserveSource,
+		GitAttributes:           cfg.GitAttributes,
+		CodeOwners:              cfg.CodeOwners,
+		FileMode:                fileMode,
+		DirMode:                 dirMode,
+		ReadOnly:                cfg.ReadOnly,
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benmoss/package-rewriter/pkg/config"
+	"github.com/benmoss/package-rewriter/pkg/rewriter"
+)
+
+func TestParseTypeFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkgPath  string
+		values   []string
+		expected []string
+		wantErr  string
+	}{
+		{
+			name:     "single type",
+			pkgPath:  "example.com/foo",
+			values:   []string{"Foo"},
+			expected: []string{"example.com/foo.Foo"},
+		},
+		{
+			name:     "repeated and comma-separated",
+			pkgPath:  "example.com/foo",
+			values:   []string{"Foo", "Bar, Baz", "Foo"},
+			expected: []string{"example.com/foo.Foo", "example.com/foo.Bar", "example.com/foo.Baz"},
+		},
+		{
+			name:     "inline packages",
+			pkgPath:  "example.com/foo",
+			values:   []string{"Foo", "example.com/bar=Bar,Qux"},
+			expected: []string{"example.com/foo.Foo", "example.com/bar.Bar", "example.com/bar.Qux"},
+		},
+		{
+			name:     "qualified types",
+			values:   []string{"github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1.Application", "example.com/bar.Bar,example.com/baz.Baz"},
+			expected: []string{"github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1.Application", "example.com/bar.Bar", "example.com/baz.Baz"},
+		},
+		{
+			name:    "qualified type without a name",
+			values:  []string{"example.com/foo."},
+			wantErr: "is not a type name",
+		},
+		{
+			name:    "no package",
+			values:  []string{"Foo"},
+			wantErr: "no package for --type Foo",
+		},
+		{
+			name:    "empty name",
+			pkgPath: "example.com/foo",
+			values:  []string{"Foo,"},
+			wantErr: "empty type name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := parseTypeFlags(tt.pkgPath, "", tt.values, "./generated")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTypeFlags failed: %v", err)
+			}
+
+			var got []string
+			for _, cfg := range configs {
+				got = append(got, cfg.PackagePath+"."+cfg.TypeName)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolveTypePackages(t *testing.T) {
+	find := func(modulePath string, typeNames []string) (map[string][]string, error) {
+		return map[string][]string{
+			"Application": {modulePath + "/pkg/apis/application/v1alpha1"},
+			"Status":      {modulePath + "/pkg/a", modulePath + "/pkg/b"},
+		}, nil
+	}
+
+	configs, err := parseTypeFlags("", "example.com/mod", []string{"Application", "example.com/other=Status"}, "./generated")
+	if err != nil {
+		t.Fatalf("parseTypeFlags failed: %v", err)
+	}
+	if err := resolveTypePackages(configs, "example.com/mod", find); err != nil {
+		t.Fatalf("resolveTypePackages failed: %v", err)
+	}
+	var got []string
+	for _, cfg := range configs {
+		got = append(got, cfg.PackagePath+"."+cfg.TypeName)
+	}
+	expected := []string{"example.com/mod/pkg/apis/application/v1alpha1.Application", "example.com/other.Status"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	// Ambiguous and unknown names fail, listing the candidates
+	for name, wantErr := range map[string]string{
+		"Status":  "example.com/mod/pkg/a\n  example.com/mod/pkg/b",
+		"Missing": "no package of example.com/mod declares a type Missing",
+	} {
+		configs, err := parseTypeFlags("", "example.com/mod", []string{name}, "./generated")
+		if err != nil {
+			t.Fatalf("parseTypeFlags failed: %v", err)
+		}
+		if err := resolveTypePackages(configs, "example.com/mod", find); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Expected error containing %q for %s, got: %v", wantErr, name, err)
+		}
+	}
+}
+
+func TestGenerateConfigPath(t *testing.T) {
+	if _, err := generateConfigPath("rewriter.yaml"); err == nil {
+		t.Error("Expected an error outside go generate")
+	}
+
+	t.Setenv("GOFILE", "doc.go")
+	t.Setenv("GOPACKAGE", "generated")
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"rewriter.yaml":      filepath.Join(dir, "rewriter.yaml"),
+		"../rewriter.yaml":   filepath.Join(filepath.Dir(dir), "rewriter.yaml"),
+		"/etc/rewriter.yaml": "/etc/rewriter.yaml",
+		"":                   "",
+	} {
+		got, err := generateConfigPath(path)
+		if err != nil {
+			t.Fatalf("generateConfigPath(%q) failed: %v", path, err)
+		}
+		if got != expected {
+			t.Errorf("generateConfigPath(%q): expected %q, got %q", path, expected, got)
+		}
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	log := func(verbosity, format string, quiet bool) string {
+		t.Helper()
+		newHandler, err := logHandler(verbosity, format, quiet)
+		if err != nil {
+			t.Fatalf("logHandler(%q, %q, %v) failed: %v", verbosity, format, quiet, err)
+		}
+		var buf bytes.Buffer
+		logger := slog.New(newHandler(&buf))
+		logger.Info("Loaded config", "packages", 2)
+		logger.Error("Failed")
+		return buf.String()
+	}
+
+	if output := log("info", "text", false); !strings.Contains(output, "msg=\"Loaded config\" packages=2") {
+		t.Errorf("Expected the info record, got:\n%s", output)
+	}
+	// --quiet overrides -v
+	if output := log("debug", "text", true); strings.Contains(output, "Loaded config") || !strings.Contains(output, "msg=Failed") {
+		t.Errorf("Expected --quiet to keep only the error record, got:\n%s", output)
+	}
+
+	output := log("info", "json", false)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two JSON records, got:\n%s", output)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Expected a JSON record, got %q: %v", lines[0], err)
+	}
+	if record["level"] != "INFO" || record["msg"] != "Loaded config" || record["packages"] != 2.0 {
+		t.Errorf("Unexpected JSON record: %v", record)
+	}
+
+	for _, tt := range []struct{ verbosity, format, wantErr string }{
+		{"info", "yaml", "invalid log format: yaml"},
+		{"loud", "text", "invalid verbosity level: loud"},
+	} {
+		if _, err := logHandler(tt.verbosity, tt.format, false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("logHandler(%q, %q): expected %q, got %v", tt.verbosity, tt.format, tt.wantErr, err)
+		}
+	}
+}
+
+func TestConfigOwner(t *testing.T) {
+	for _, tt := range []struct {
+		configPath, profile, outputDir, expected string
+	}{
+		{"rewriter.yaml", "", "generated", "../rewriter.yaml"},
+		{"teams/a.yaml", "ci", "generated", "../teams/a.yaml#ci"},
+		{"gen/rewriter.yaml", "", "gen", "rewriter.yaml"},
+	} {
+		if got := configOwner(tt.configPath, tt.profile, tt.outputDir); got != tt.expected {
+			t.Errorf("configOwner(%q, %q, %q): expected %q, got %q", tt.configPath, tt.profile, tt.outputDir, tt.expected, got)
+		}
+	}
+}
+
+func TestRewriterConfigs(t *testing.T) {
+	cfg, err := config.ParseConfig("rewriter.yaml", []byte(`
+output: ./generated
+validation: true
+packages:
+  - package: example.com/foo
+    types: [Foo]
+    functions: [NewFoo]
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := rewriterConfigs(cfg)
+	if len(configs) != 2 {
+		t.Fatalf("Expected a config for the type and the function, got %d", len(configs))
+	}
+	for _, c := range configs {
+		if !c.Validation {
+			t.Errorf("validation: true didn't reach the config for %s%s", c.TypeName, c.FunctionName)
+		}
+	}
+}
+
+func TestPackageTypeNames(t *testing.T) {
+	names, err := packageTypeNames(filepath.Join("pkg", "rewriter", "testdata", "fixture"), "example.com/fixture/typeopts")
+	if err != nil {
+		t.Fatalf("packageTypeNames failed: %v", err)
+	}
+	if expected := []string{"Event", "Sink", "Stamp"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
+
+func TestServeExtract(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("pkg", "rewriter", "testdata", "fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{cache: rewriter.NewPackageCache()}
+	ts := httptest.NewServer(http.HandlerFunc(s.handleExtract))
+	defer ts.Close()
+
+	extract := func(body string) (int, extractResponse) {
+		t.Helper()
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result extractResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, result
+	}
+
+	body := fmt.Sprintf(`{"dir": %q, "config": {"output": "unused", "packages": [{"package": "example.com/fixture/other", "types": ["Request"]}]}}`, dir)
+	// The second request is served with the packages the first one loaded
+	for i := 0; i < 2; i++ {
+		status, result := extract(body)
+		if status != http.StatusOK {
+			t.Fatalf("Request %d: expected status 200, got %d: %s", i, status, result.Error)
+		}
+		if types := result.Files["example.com/fixture/other/types.go"]; !strings.Contains(types, "type Request struct") {
+			t.Errorf("Request %d: expected the extracted type, got files %v", i, result.Files)
+		}
+	}
+
+	status, result := extract(fmt.Sprintf(`{"dir": %q, "config": "output: unused\npackages: []\n"}`, dir))
+	if status != http.StatusUnprocessableEntity || !strings.Contains(result.Error, "at least one package entry is required") {
+		t.Errorf("Expected an invalid config to be reported, got %d: %q", status, result.Error)
+	}
+
+	// Settings that run programs or read other files are the server's alone
+	for config, wantErr := range map[string]string{
+		`{"output": "unused", "goEnv": {"GOFLAGS": "-toolexec=/bin/true"}, "packages": []}`:                   "request.yaml:1:31: goEnv: can't be set here",
+		`{"output": "unused", "include": ["/etc/rewriter.yaml"]}`:                                             "include: can't be set here",
+		`{"output": "unused", "profiles": {"ci": {"tidy": true}}}`:                                            "profiles.ci.tidy: can't be set here",
+		`{"output": "${HOME}", "packages": [{"package": "example.com/fixture/other", "types": ["Request"]}]}`: "environment references like ${HOME} aren't allowed",
+	} {
+		status, result := extract(fmt.Sprintf(`{"dir": %q, "config": %s}`, dir, config))
+		if status != http.StatusUnprocessableEntity || !strings.Contains(result.Error, wantErr) {
+			t.Errorf("Expected %q for %s, got %d: %q", wantErr, config, status, result.Error)
+		}
+	}
+
+	// Web pages can send simple requests across origins, which carry an
+	// Origin header or another content type
+	for _, tt := range []struct {
+		contentType, origin string
+		want                int
+	}{
+		{"text/plain", "", http.StatusUnsupportedMediaType},
+		{"application/json", "https://example.com", http.StatusForbidden},
+		{"application/json; charset=utf-8", "", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Content-Type %q, Origin %q: expected status %d, got %d", tt.contentType, tt.origin, tt.want, resp.StatusCode)
+		}
+	}
+}
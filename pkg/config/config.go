@@ -2,33 +2,331 @@ package config
 
 import (
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/version"
+	"maps"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the configuration file structure
 type Config struct {
-	Output   string         `yaml:"output"`
-	Packages []PackageEntry `yaml:"packages"`
+	APIVersion      string         `yaml:"apiVersion,omitempty"` // config format version; defaults to v1
+	Output          string         `yaml:"output,omitempty"`
+	CopyMethods     bool           `yaml:"copyMethods,omitempty"`     // copy methods of extracted types
+	OnUnextractable string         `yaml:"onUnextractable,omitempty"` // "fail" (default) or "drop" functions/methods with unextractable dependencies
+	Directives      string         `yaml:"directives,omitempty"`      // "strip" (default) or "fail" on compiler directives in copied declarations
+	Cgo             string         `yaml:"cgo,omitempty"`             // "fail" (default) or "stop" recursion at packages that require cgo
+	Vars            string         `yaml:"vars,omitempty"`            // "copy" (default) or "skip" package-level variables referenced by copied code
+	SuspectFields   string         `yaml:"suspectFields,omitempty"`   // "keep" (default), "replace", or "fail" on fields typed unsafe.Pointer, reflect.Value, sync.Mutex, and the like
+	GoVersion       string         `yaml:"goVersion,omitempty"`       // target Go version for generated code (e.g., "1.17"); defaults to the source module's
+	Toolchain       string         `yaml:"toolchain,omitempty"`       // toolchain directive of generated go.mod files (e.g., "go1.22.5"); defaults to the source module's
+	WholePackage    int            `yaml:"wholePackage,omitempty"`    // percentage of a package's types above which all of them are copied
+	ImportPrefix    string         `yaml:"importPrefix,omitempty"`    // place generated packages under this import path inside the consuming module
+	AliasTag        string         `yaml:"aliasTag,omitempty"`        // build tag selecting an alias flavor that refers to the original packages
+	KeepExternal    []string       `yaml:"keepExternal,omitempty"`    // packages (or parent paths) kept as real dependencies instead of being extracted
+	Stdlib          []string       `yaml:"stdlib,omitempty"`          // packages (or parent paths) treated like the standard library: imported as they are, never extracted or required
+	Shims           []ShimEntry    `yaml:"shims,omitempty"`           // published modules used in place of the source modules they were generated from
+	Preset          string         `yaml:"preset,omitempty"`          // curated per-type options for the types of a large SDK with custom marshaling: "kubernetes", "aws", or "gcp"
+	Packages        []PackageEntry `yaml:"packages,omitempty"`
+
+	// StripVersionSuffix writes modules like example.com/foo/v3 to
+	// <output>/example.com/foo, keeping the module path in go.mod
+	StripVersionSuffix bool `yaml:"stripVersionSuffix,omitempty"`
+
+	// Layout is "module-path" (default), "third-party", which places
+	// generated modules under third_party/generated with a module-map.json,
+	// "umbrella", which generates one module at the output root, with the
+	// path umbrellaModule, holding every package, or "internal", which
+	// generates packages inside the consuming module under internal/
+	Layout         string `yaml:"layout,omitempty"`
+	UmbrellaModule string `yaml:"umbrellaModule,omitempty"`
+
+	// Standalone, when false, generates plain packages inside the consuming
+	// module with no go.mod files or replace directives, under importPrefix
+	// or the import path of the output directory
+	Standalone *bool `yaml:"standalone,omitempty"`
+
+	// ReplaceWith maps generated modules to the module@version consumers'
+	// replace directives point at, instead of the output directory
+	ReplaceWith map[string]string `yaml:"replaceWith,omitempty"`
+
+	// Publish generates one module ready for publishing instead of a
+	// module per source module
+	Publish *PublishEntry `yaml:"publish,omitempty"`
+
+	// Inline lists types ("import/path.Name") copied into each generated
+	// package that refers to them, instead of being extracted into their own
+	Inline []string `yaml:"inline,omitempty"`
+
+	// SubstitutePackages maps source packages (or parent paths) to the
+	// import path generated code uses instead of extracting them
+	SubstitutePackages map[string]string `yaml:"substitutePackages,omitempty"`
+
+	// CollapseModules merges generated modules with fewer types than this
+	// into the package importing them, renaming colliding types by
+	// CollisionPolicy: "shortest" (default), "path", or "number"
+	CollapseModules int    `yaml:"collapseModules,omitempty"`
+	CollisionPolicy string `yaml:"collisionPolicy,omitempty"`
+
+	// MinimizeModules collapses every generated module that can be,
+	// whatever its size
+	MinimizeModules bool `yaml:"minimizeModules,omitempty"`
+
+	// FlattenStructs turns struct types referenced once, from a field of
+	// another struct type in their package, into anonymous structs
+	FlattenStructs bool `yaml:"flattenStructs,omitempty"`
+
+	// SuspectFieldReplacement is the type suspect fields get with
+	// suspectFields: replace; it can't refer to other packages
+	SuspectFieldReplacement string `yaml:"suspectFieldReplacement,omitempty"`
+
+	// NonSerializableFields is "keep" (default), "strip", or "fail" on struct
+	// fields holding channels, functions, or contexts
+	NonSerializableFields string `yaml:"nonSerializableFields,omitempty"`
+
+	// DropDeprecated leaves out struct fields whose doc comments have a
+	// "Deprecated:" paragraph
+	DropDeprecated bool `yaml:"dropDeprecated,omitempty"`
+
+	// Unexported is "keep" (default), "prune", or "fail" on exported types
+	// exposing unexported fields or types
+	Unexported string `yaml:"unexported,omitempty"`
+
+	// SideEffectImports is "warn" (default), "keep", or "drop" for the blank
+	// imports of the source files declarations are copied from
+	SideEffectImports string `yaml:"sideEffectImports,omitempty"`
+
+	// SideEffectImportMap maps blank imports to the package imported instead,
+	// or to "" to drop them, overriding SideEffectImports
+	SideEffectImportMap map[string]string `yaml:"sideEffectImportMap,omitempty"`
+
+	// Bazel writes a BUILD.bazel file with a go_library rule next to each
+	// generated package
+	Bazel bool `yaml:"bazel,omitempty"`
+
+	// Emit lists the output formats written from the extracted closure, "go",
+	// "docs", or "index"; empty writes the Go packages alone
+	Emit []string `yaml:"emit,omitempty"`
+
+	// Validation generates Validate methods from the kubebuilder validation
+	// markers of extracted types
+	Validation bool `yaml:"validation,omitempty"`
+
+	// Defaults generates Default methods from the kubebuilder default markers
+	// of extracted types
+	Defaults bool `yaml:"defaults,omitempty"`
+
+	// GVK generates Group, Version, and Kind constants and GroupVersionKind
+	// methods for types embedding TypeMeta or ObjectMeta
+	GVK bool `yaml:"gvk,omitempty"`
+	// Builders generates a New constructor and chainable With methods for
+	// each struct type the configs asked for
+	Builders bool `yaml:"builders,omitempty"`
+	// Equal generates Equal methods comparing struct types field by field,
+	// without reflection
+	Equal bool `yaml:"equal,omitempty"`
+
+	// FieldReport lists the fields that differ from upstream in
+	// field-report.json and in the doc comments of their types
+	FieldReport bool `yaml:"fieldReport,omitempty"`
+
+	// Minify strips comments, markers, and blank lines from the generated
+	// files
+	Minify bool `yaml:"minify,omitempty"`
+
+	// PreserveSource copies declarations from their source files, keeping
+	// every comment and their formatting
+	PreserveSource bool `yaml:"preserveSource,omitempty"`
+
+	// GitAttributes marks the generated files as linguist-generated in a
+	// .gitattributes in the output directory
+	GitAttributes bool `yaml:"gitattributes,omitempty"`
+
+	// CodeOwners are assigned the output directory in the repository's
+	// CODEOWNERS file
+	CodeOwners []string `yaml:"codeowners,omitempty"`
+
+	// FileMode and DirMode are the octal permissions (e.g., "0640") of
+	// generated files and of the directories created for them
+	FileMode string `yaml:"fileMode,omitempty"`
+	DirMode  string `yaml:"dirMode,omitempty"`
+
+	// ReadOnly clears the write bits of generated files
+	ReadOnly bool `yaml:"readOnly,omitempty"`
+
+	// AutoRequire gets source packages the consuming module doesn't
+	// require into a temporary copy of its go.mod, instead of failing
+	AutoRequire bool `yaml:"autoRequire,omitempty"`
+
+	// Tidy runs go mod tidy on the consuming module after its replace
+	// directives are updated, failing if the generated modules don't
+	// resolve
+	Tidy bool `yaml:"tidy,omitempty"`
+
+	// GoEnv sets environment variables for the go commands the rewriter
+	// runs, such as GOPROXY or GOFLAGS, overriding the process environment
+	GoEnv map[string]string `yaml:"goEnv,omitempty"`
+
+	// GoTimeout bounds each go command the rewriter runs, as a Go duration
+	// (e.g., "5m"; defaults to 10m)
+	GoTimeout string `yaml:"goTimeout,omitempty"`
+
+	// Scan lists directories, relative to the config file, whose Go files
+	// are searched for //rewriter:need comments naming more types to
+	// extract
+	Scan []string `yaml:"scan,omitempty"`
+
+	// Types lists fully-qualified types (import/path.TypeName) to extract,
+	// as well as those of the package entries
+	Types []string `yaml:"types,omitempty"`
+
+	// Include lists config files, relative to this one, whose settings
+	// this file builds on.
+	Include []string `yaml:"include,omitempty"`
+
+	// Profiles are named overlays selected with --profile. Any top-level
+	// field set in a profile replaces the base value.
+	Profiles map[string]yaml.Node `yaml:"profiles,omitempty"`
+
+	// positions records where each field was set, for error messages
+	positions map[string]position
 }
 
 // PackageEntry represents a package and its types to extract
 type PackageEntry struct {
-	Package string   `yaml:"package"`
-	Types   []string `yaml:"types"`
+	Package   string      `yaml:"package,omitempty"`
+	Types     []TypeEntry `yaml:"types,omitempty"`
+	Functions []string    `yaml:"functions,omitempty"` // functions to copy along with the helpers, consts, vars, and types they use
+	Copy      string      `yaml:"copy,omitempty"`      // "all" copies the package's files verbatim instead of extracting types
+	Exclude   []string    `yaml:"exclude,omitempty"`   // file name patterns left out when copying verbatim (e.g., zz_generated.*.go)
+	Version   string      `yaml:"version,omitempty"`   // version of the package to get with autoRequire (defaults to latest)
+	Recursion string      `yaml:"recursion,omitempty"` // "all" (default) follows dependencies across packages, "package" within the package, "local" within the package keeping other packages as real dependencies, "type" not at all
+}
+
+// ShimEntry maps a source module to a published module of trimmed types
+// generated from it, which is required instead of generating another copy
+type ShimEntry struct {
+	Module  string `yaml:"module,omitempty"`  // source module path
+	Shim    string `yaml:"shim,omitempty"`    // module path of the shim
+	Version string `yaml:"version,omitempty"` // version of the shim to require
+}
+
+// PublishEntry describes the module generated for publishing
+type PublishEntry struct {
+	Module  string `yaml:"module,omitempty"`  // module path of the published module
+	Source  string `yaml:"source,omitempty"`  // source module whose packages keep their relative paths
+	Version string `yaml:"version,omitempty"` // version stamped into the module
+	License string `yaml:"license,omitempty"` // license file to copy (defaults to the source module's)
+}
+
+// TypeEntry is a type to extract, written either as just its name or as a
+// mapping with per-type options
+type TypeEntry struct {
+	Name        string   `yaml:"name,omitempty"`
+	Prune       []string `yaml:"prune,omitempty"`       // struct fields left out of the type, along with their dependencies
+	Fields      []string `yaml:"fields,omitempty"`      // struct fields the type is reduced to, by Go or JSON name; "spec.project" selects within a field's type
+	DropStatus  bool     `yaml:"dropStatus,omitempty"`  // leave out the Status field, along with its dependencies
+	Substitute  string   `yaml:"substitute,omitempty"`  // existing type ("import/path.Name") used wherever this one is referenced, instead of extracting it
+	CopyMethods *bool    `yaml:"copyMethods,omitempty"` // overrides the top-level copyMethods for this type
+	Rename      string   `yaml:"rename,omitempty"`      // name of the type in generated code
+	Wrap        bool     `yaml:"wrap,omitempty"`        // replace the type with a small wrapper reproducing its wire format, holding the substitute if set
+}
+
+// MarshalYAML writes an entry without options as just its name
+func (e TypeEntry) MarshalYAML() (any, error) {
+	if len(e.Prune) == 0 && len(e.Fields) == 0 && !e.DropStatus && e.Substitute == "" && e.CopyMethods == nil && e.Rename == "" && !e.Wrap {
+		return e.Name, nil
+	}
+	type plain TypeEntry
+	return plain(e), nil
+}
+
+// UnmarshalYAML accepts a plain type name as well as a mapping
+func (e *TypeEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&e.Name)
+	}
+	type plain TypeEntry
+	return node.Decode((*plain)(e))
 }
 
 // LoadConfig loads the configuration from a YAML file
 func LoadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+	return LoadConfigProfile(path, "")
+}
+
+// LoadConfigProfile loads the configuration from a YAML file and applies
+// the named profile on top of it, if any
+func LoadConfigProfile(path, profile string) (*Config, error) {
+	var cfg Config
+	if err := loadFile(path, &cfg, nil); err != nil {
+		return nil, err
 	}
+	return finishConfig(&cfg, profile)
+}
 
+// ParseConfig loads the configuration from data as if it had been read from
+// the file at path, which includes are resolved against and errors refer to,
+// and applies the named profile, if any
+func ParseConfig(path string, data []byte, profile string) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if err := loadData(path, data, &cfg, []string{abs}); err != nil {
+		return nil, err
+	}
+	return finishConfig(&cfg, profile)
+}
+
+// ParseRequestConfig parses config data a client sent, like ParseConfig,
+// but fails before reading anything else if the data sets one of the denied
+// top-level fields, in the config or in any profile, or has ${VAR}
+// references, which would read the environment of the process parsing it
+func ParseRequestConfig(path string, data []byte, profile string, denied []string) (*Config, error) {
+	if m := envVarPattern.Find(data); m != nil {
+		return nil, fmt.Errorf("%s: environment references like %s aren't allowed", path, m)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if len(doc.Content) > 0 {
+		positions := make(map[string]position)
+		checkFields(path, doc.Content[0], reflect.TypeOf(Config{}), "", positions)
+		for _, fieldPath := range slices.Sorted(maps.Keys(positions)) {
+			field := fieldPath
+			if rest, ok := strings.CutPrefix(fieldPath, "profiles."); ok {
+				_, field, _ = strings.Cut(rest, ".")
+			}
+			if slices.Contains(denied, field) {
+				return nil, &FieldError{Field: fieldPath, Pos: positions[fieldPath].String(), Msg: "can't be set here"}
+			}
+		}
+	}
+	return ParseConfig(path, data, profile)
+}
+
+// finishConfig applies the named profile and validates the result
+func finishConfig(cfg *Config, profile string) (*Config, error) {
+	if profile != "" {
+		if err := cfg.ApplyProfile(profile); err != nil {
+			return nil, err
+		}
 	}
 
 	// Validate config
@@ -36,27 +334,434 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	return &cfg, nil
+	// Qualified types become package entries, validated above
+	for _, ref := range cfg.Types {
+		pkgPath, typeName, _ := ParseTypeRef(ref)
+		cfg.AddNeeds([]Need{{Package: pkgPath, Type: typeName}})
+	}
+
+	return cfg, nil
+}
+
+// ApplyProfile overlays the named profile onto the config
+func (c *Config) ApplyProfile(name string) error {
+	node, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for profileName := range c.Profiles {
+			names = append(names, profileName)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("profile %q not found (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	profiles := c.Profiles
+	if err := node.Decode(c); err != nil {
+		return fmt.Errorf("failed to apply profile %q: %w", name, err)
+	}
+	// Profiles can't define profiles of their own
+	c.Profiles = profiles
+
+	// Fields set by the profile are now located in the profile
+	overlay := make(map[string]position)
+	checkFields(c.positions["profiles."+name].file, &node, reflect.TypeOf(Config{}), "", overlay)
+	delete(overlay, "")
+	for fieldPath := range c.positions {
+		if _, ok := overlay[topLevelField(fieldPath)]; ok {
+			delete(c.positions, fieldPath)
+		}
+	}
+	if c.positions == nil {
+		c.positions = make(map[string]position)
+	}
+	for fieldPath, pos := range overlay {
+		c.positions[fieldPath] = pos
+	}
+	return nil
 }
 
 // Validate checks if the config is valid
 func (c *Config) Validate() error {
 	if c.Output == "" {
-		return fmt.Errorf("output directory is required")
+		return c.fieldError("output", "required")
+	}
+
+	switch c.OnUnextractable {
+	case "", "fail", "drop":
+	default:
+		return c.fieldError("onUnextractable", "invalid value %q (use: fail, drop)", c.OnUnextractable)
+	}
+
+	switch c.Directives {
+	case "", "strip", "fail":
+	default:
+		return c.fieldError("directives", "invalid value %q (use: strip, fail)", c.Directives)
+	}
+
+	switch c.Cgo {
+	case "", "fail", "stop":
+	default:
+		return c.fieldError("cgo", "invalid value %q (use: fail, stop)", c.Cgo)
+	}
+
+	switch c.Vars {
+	case "", "copy", "skip":
+	default:
+		return c.fieldError("vars", "invalid value %q (use: copy, skip)", c.Vars)
 	}
 
-	if len(c.Packages) == 0 {
-		return fmt.Errorf("at least one package entry is required")
+	switch c.Preset {
+	case "", "aws", "gcp", "kubernetes":
+	default:
+		return c.fieldError("preset", "invalid value %q (use: aws, gcp, kubernetes)", c.Preset)
+	}
+
+	switch c.SuspectFields {
+	case "", "keep", "replace", "fail":
+	default:
+		return c.fieldError("suspectFields", "invalid value %q (use: keep, replace, fail)", c.SuspectFields)
+	}
+	if c.SuspectFieldReplacement != "" {
+		if c.SuspectFields != "replace" {
+			return c.fieldError("suspectFieldReplacement", "only used with suspectFields: replace")
+		}
+		if err := checkReplacementType(c.SuspectFieldReplacement); err != nil {
+			return c.fieldError("suspectFieldReplacement", "%v", err)
+		}
+	}
+
+	switch c.NonSerializableFields {
+	case "", "keep", "strip", "fail":
+	default:
+		return c.fieldError("nonSerializableFields", "invalid value %q (use: keep, strip, fail)", c.NonSerializableFields)
+	}
+
+	switch c.Unexported {
+	case "", "keep", "prune", "fail":
+	default:
+		return c.fieldError("unexported", "invalid value %q (use: keep, prune, fail)", c.Unexported)
+	}
+
+	switch c.SideEffectImports {
+	case "", "warn", "keep", "drop":
+	default:
+		return c.fieldError("sideEffectImports", "invalid value %q (use: warn, keep, drop)", c.SideEffectImports)
+	}
+
+	if c.GoVersion != "" && !version.IsValid("go"+strings.TrimPrefix(c.GoVersion, "go")) {
+		return c.fieldError("goVersion", "invalid version %q (e.g., 1.21)", c.GoVersion)
+	}
+
+	if c.Toolchain != "" && !version.IsValid("go"+strings.TrimPrefix(c.Toolchain, "go")) {
+		return c.fieldError("toolchain", "invalid toolchain %q (e.g., go1.22.5)", c.Toolchain)
+	}
+
+	if c.WholePackage < 0 || c.WholePackage > 100 {
+		return c.fieldError("wholePackage", "must be a percentage between 0 and 100, got %d", c.WholePackage)
+	}
+
+	inModule := c.Standalone != nil && !*c.Standalone
+	if c.AliasTag != "" && c.ImportPrefix == "" && c.Layout != "internal" && !inModule {
+		return c.fieldError("aliasTag", "requires importPrefix, since aliases can't refer to the package they replace")
+	}
+
+	if c.StripVersionSuffix && c.ImportPrefix != "" {
+		return c.fieldError("stripVersionSuffix", "can't be combined with importPrefix, which doesn't generate modules")
+	}
+
+	switch c.Layout {
+	case "", "module-path":
+	case "third-party":
+		if c.ImportPrefix != "" {
+			return c.fieldError("layout", "can't be combined with importPrefix, which doesn't generate modules")
+		}
+	case "umbrella":
+		if c.ImportPrefix != "" {
+			return c.fieldError("layout", "can't be combined with importPrefix, which doesn't generate modules")
+		}
+		if err := module.CheckPath(c.UmbrellaModule); err != nil {
+			return c.fieldError("umbrellaModule", "invalid module path %q: %v", c.UmbrellaModule, err)
+		}
+	case "internal":
+		if c.ImportPrefix != "" && !slices.Contains(strings.Split(c.ImportPrefix, "/"), "internal") {
+			return c.fieldError("importPrefix", "%q must have an internal element with layout: internal", c.ImportPrefix)
+		}
+	default:
+		return c.fieldError("layout", "invalid value %q (use: internal, module-path, third-party, umbrella)", c.Layout)
+	}
+	if c.UmbrellaModule != "" && c.Layout != "umbrella" {
+		return c.fieldError("umbrellaModule", "requires layout: umbrella")
+	}
+	switch {
+	case inModule && (c.Layout == "third-party" || c.Layout == "umbrella"):
+		return c.fieldError("standalone", "can't be false with layout: %s, which generates modules", c.Layout)
+	case inModule && (c.StripVersionSuffix || c.CollapseModules > 0 || c.MinimizeModules):
+		return c.fieldError("standalone", "can't be false with stripVersionSuffix, collapseModules, or minimizeModules, which need generated modules")
+	case c.Standalone != nil && *c.Standalone && (c.ImportPrefix != "" || c.Layout == "internal"):
+		return c.fieldError("standalone", "can't be true with importPrefix or layout: internal, which don't generate modules")
+	}
+
+	for _, modulePath := range slices.Sorted(maps.Keys(c.ReplaceWith)) {
+		field := "replaceWith." + modulePath
+		if err := module.CheckPath(modulePath); err != nil {
+			return c.fieldError(field, "invalid module path %q: %v", modulePath, err)
+		}
+		path, version, ok := strings.Cut(c.ReplaceWith[modulePath], "@")
+		if !ok {
+			return c.fieldError(field, "invalid replacement %q (use: module/path@version)", c.ReplaceWith[modulePath])
+		}
+		if err := module.Check(path, version); err != nil {
+			return c.fieldError(field, "invalid replacement %q: %v", c.ReplaceWith[modulePath], err)
+		}
+	}
+
+	if err := c.validatePublish(); err != nil {
+		return err
+	}
+
+	if _, err := ParseMode(c.FileMode); err != nil {
+		return c.fieldError("fileMode", "%v", err)
+	}
+	if _, err := ParseMode(c.DirMode); err != nil {
+		return c.fieldError("dirMode", "%v", err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.GoEnv)) {
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			return c.fieldError("goEnv", "invalid variable name %q", name)
+		}
+	}
+	if _, err := ParseTimeout(c.GoTimeout); err != nil {
+		return c.fieldError("goTimeout", "%v", err)
+	}
+
+	for i, owner := range c.CodeOwners {
+		if !strings.Contains(owner, "@") || strings.ContainsAny(owner, " \t") {
+			return c.fieldError(fmt.Sprintf("codeowners[%d]", i), "invalid owner %q (use @user, @org/team, or an email address)", owner)
+		}
+	}
+
+	for i, name := range c.Emit {
+		switch name {
+		case "docs", "go", "index":
+		default:
+			return c.fieldError(fmt.Sprintf("emit[%d]", i), "invalid value %q (use: docs, go, index)", name)
+		}
+	}
+
+	for i, entry := range c.Stdlib {
+		if err := module.CheckImportPath(entry); err != nil {
+			return c.fieldError(fmt.Sprintf("stdlib[%d]", i), "invalid package path %q: %v", entry, err)
+		}
+	}
+
+	for i, ref := range c.Inline {
+		if j := strings.LastIndex(ref, "."); j <= 0 || strings.LastIndex(ref, "/") > j || !token.IsIdentifier(ref[j+1:]) {
+			return c.fieldError(fmt.Sprintf("inline[%d]", i), "invalid type %q (use: import/path.TypeName)", ref)
+		}
+	}
+
+	for _, source := range slices.Sorted(maps.Keys(c.SubstitutePackages)) {
+		replacement := c.SubstitutePackages[source]
+		field := "substitutePackages." + source
+		if err := module.CheckImportPath(source); err != nil {
+			return c.fieldError(field, "invalid package path %q: %v", source, err)
+		}
+		if err := module.CheckImportPath(replacement); err != nil {
+			return c.fieldError(field, "invalid import path %q: %v", replacement, err)
+		}
+		if replacement == source || strings.HasPrefix(replacement, source+"/") {
+			return c.fieldError(field, "can't be substituted by %s, which it contains", replacement)
+		}
+	}
+
+	if c.CollapseModules < 0 {
+		return c.fieldError("collapseModules", "must not be negative, got %d", c.CollapseModules)
+	}
+	if c.CollapseModules > 0 && c.ImportPrefix != "" {
+		return c.fieldError("collapseModules", "can't be combined with importPrefix, which doesn't generate modules")
+	}
+	if c.FlattenStructs && (c.Validation || c.Defaults) {
+		return c.fieldError("flattenStructs", "can't be combined with validation or defaults, which generate methods on the nested types")
+	}
+	if c.MinimizeModules && c.ImportPrefix != "" {
+		return c.fieldError("minimizeModules", "can't be combined with importPrefix, which doesn't generate modules")
+	}
+	switch c.CollisionPolicy {
+	case "", "shortest", "path", "number":
+	default:
+		return c.fieldError("collisionPolicy", "invalid value %q (use: shortest, path, number)", c.CollisionPolicy)
+	}
+
+	shimmed := make(map[string]bool)
+	for i, shim := range c.Shims {
+		field := fmt.Sprintf("shims[%d]", i)
+		switch {
+		case shim.Module == "":
+			return c.fieldError(field+".module", "required")
+		case shim.Shim == "":
+			return c.fieldError(field+".shim", "required")
+		case !semver.IsValid(shim.Version):
+			return c.fieldError(field+".version", "invalid version %q (e.g., v0.3.0)", shim.Version)
+		case shimmed[shim.Module]:
+			return c.fieldError(field+".module", "module %s already has a shim", shim.Module)
+		}
+		shimmed[shim.Module] = true
+	}
+
+	if len(c.Packages) == 0 && len(c.Types) == 0 && len(c.Scan) == 0 {
+		return c.fieldError("packages", "at least one package entry is required, unless types are listed or directories are scanned for them")
+	}
+
+	for i, ref := range c.Types {
+		if _, _, err := ParseTypeRef(ref); err != nil {
+			return c.fieldError(fmt.Sprintf("types[%d]", i), "invalid type: %v", err)
+		}
 	}
 
 	for i, pkg := range c.Packages {
+		field := fmt.Sprintf("packages[%d]", i)
 		if pkg.Package == "" {
-			return fmt.Errorf("package path is required for entry %d", i)
+			return c.fieldError(field+".package", "required")
+		}
+		if pkg.Version != "" && !c.AutoRequire {
+			return c.fieldError(field+".version", "only used with autoRequire; require the module in go.mod to pick its version")
 		}
-		if len(pkg.Types) == 0 {
-			return fmt.Errorf("at least one type is required for package %s", pkg.Package)
+		switch pkg.Copy {
+		case "":
+			if len(pkg.Types) == 0 && len(pkg.Functions) == 0 {
+				return c.fieldError(field, "at least one type or function is required for package %s", pkg.Package)
+			}
+		case "all":
+			if len(pkg.Types) > 0 {
+				return c.fieldError(field+".types", "can't be combined with copy: all")
+			}
+			if len(pkg.Functions) > 0 {
+				return c.fieldError(field+".functions", "can't be combined with copy: all")
+			}
+		default:
+			return c.fieldError(field+".copy", "invalid value %q (use: all)", pkg.Copy)
 		}
+		switch pkg.Recursion {
+		case "", "all":
+		case "package", "local", "type":
+			if pkg.Copy != "" {
+				return c.fieldError(field+".recursion", "can't be combined with copy: %s", pkg.Copy)
+			}
+		default:
+			return c.fieldError(field+".recursion", "invalid value %q (use: all, local, package, type)", pkg.Recursion)
+		}
+		for j, typeEntry := range pkg.Types {
+			if err := c.validateType(fmt.Sprintf("%s.types[%d]", field, j), typeEntry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseMode parses octal permissions like fileMode and dirMode; "" is 0
+func ParseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil || mode == 0 || mode > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q (e.g., 0640)", s)
 	}
+	return os.FileMode(mode), nil
+}
 
+// ParseTimeout parses a duration like goTimeout; "" is 0
+func ParseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q (e.g., 5m)", s)
+	}
+	return timeout, nil
+}
+
+// checkReplacementType checks that s is a type expression that doesn't need
+// any imports
+func checkReplacementType(s string) error {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return fmt.Errorf("invalid type %q: %v", s, err)
+	}
+	var qualified bool
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if _, ok := n.(*ast.SelectorExpr); ok {
+			qualified = true
+		}
+		return !qualified
+	})
+	if qualified {
+		return fmt.Errorf("type %q can't refer to other packages", s)
+	}
+	return nil
+}
+
+func (c *Config) validatePublish() error {
+	p := c.Publish
+	if p == nil {
+		return nil
+	}
+	switch {
+	case p.Module == "":
+		return c.fieldError("publish.module", "required")
+	case p.Source == "":
+		return c.fieldError("publish.source", "required")
+	case !semver.IsValid(p.Version):
+		return c.fieldError("publish.version", "invalid version %q (e.g., v0.3.0)", p.Version)
+	case c.ImportPrefix != "":
+		return c.fieldError("publish", "can't be combined with importPrefix")
+	case c.StripVersionSuffix:
+		return c.fieldError("publish", "can't be combined with stripVersionSuffix")
+	case c.Layout == "third-party", c.Layout == "umbrella", c.Layout == "internal":
+		return c.fieldError("publish", "can't be combined with layout: %s", c.Layout)
+	case c.Standalone != nil && !*c.Standalone:
+		return c.fieldError("publish", "can't be combined with standalone: false")
+	}
+	_, pathMajor, ok := module.SplitPathVersion(p.Module)
+	if !ok {
+		return c.fieldError("publish.module", "invalid module path %q", p.Module)
+	}
+	if err := module.CheckPathMajor(p.Version, pathMajor); err != nil {
+		return c.fieldError("publish.version", "%v", err)
+	}
+	return nil
+}
+
+func (c *Config) validateType(field string, entry TypeEntry) error {
+	if entry.Name == "" {
+		return c.fieldError(field+".name", "required")
+	}
+	if entry.Wrap && (len(entry.Prune) > 0 || len(entry.Fields) > 0 || entry.DropStatus || entry.Rename != "" || entry.CopyMethods != nil) {
+		return c.fieldError(field+".wrap", "a wrapped type is replaced with its wrapper, so it can't also be pruned, have fields selected, drop its status, be renamed, or have its methods copied")
+	}
+	if entry.Substitute != "" {
+		if len(entry.Prune) > 0 || len(entry.Fields) > 0 || entry.DropStatus || entry.Rename != "" || entry.CopyMethods != nil {
+			return c.fieldError(field+".substitute", "a substituted type isn't extracted, so it can't also be pruned, have fields selected, drop its status, be renamed, or have its methods copied")
+		}
+		i := strings.LastIndex(entry.Substitute, ".")
+		if i <= 0 || strings.LastIndex(entry.Substitute, "/") > i {
+			return c.fieldError(field+".substitute", "invalid type %q (use: import/path.TypeName)", entry.Substitute)
+		}
+	}
+	if len(entry.Fields) > 0 && (len(entry.Prune) > 0 || entry.DropStatus) {
+		return c.fieldError(field+".fields", "can't be combined with prune or dropStatus, which leave out fields instead")
+	}
+	for i, path := range entry.Fields {
+		if slices.Contains(strings.Split(path, "."), "") {
+			return c.fieldError(fmt.Sprintf("%s.fields[%d]", field, i), "invalid field path %q (use: field or field.nested)", path)
+		}
+	}
+	if entry.Rename != "" && !token.IsIdentifier(entry.Rename) {
+		return c.fieldError(field+".rename", "invalid name %q", entry.Rename)
+	}
 	return nil
 }
@@ -0,0 +1,612 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rewriter.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	path := writeConfig(t, `
+output: ./generated
+goVersion: "1.21"
+packages:
+  - package: example.com/foo
+    types: [Foo]
+profiles:
+  minimal:
+    output: ./generated-min
+    keepExternal:
+      - k8s.io/apimachinery
+  full:
+    packages:
+      - package: example.com/foo
+        types: [Foo, Bar]
+`)
+
+	tests := []struct {
+		name         string
+		profile      string
+		wantOutput   string
+		wantExternal []string
+		wantTypes    []string
+		wantErr      string
+	}{
+		{
+			name:       "no profile",
+			wantOutput: "./generated",
+			wantTypes:  []string{"Foo"},
+		},
+		{
+			name:         "overlay output and kept packages",
+			profile:      "minimal",
+			wantOutput:   "./generated-min",
+			wantExternal: []string{"k8s.io/apimachinery"},
+			wantTypes:    []string{"Foo"},
+		},
+		{
+			name:       "overlay packages",
+			profile:    "full",
+			wantOutput: "./generated",
+			wantTypes:  []string{"Foo", "Bar"},
+		},
+		{
+			name:    "unknown profile",
+			profile: "release",
+			wantErr: `profile "release" not found (available: full, minimal)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfigProfile(path, tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigProfile failed: %v", err)
+			}
+
+			if cfg.Output != tt.wantOutput {
+				t.Errorf("Output: expected %q, got %q", tt.wantOutput, cfg.Output)
+			}
+			if !reflect.DeepEqual(cfg.KeepExternal, tt.wantExternal) {
+				t.Errorf("KeepExternal: expected %v, got %v", tt.wantExternal, cfg.KeepExternal)
+			}
+			var types []string
+			for _, entry := range cfg.Packages[0].Types {
+				types = append(types, entry.Name)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("Types: expected %v, got %v", tt.wantTypes, types)
+			}
+			// Base settings not mentioned in the profile are kept
+			if cfg.GoVersion != "1.21" {
+				t.Errorf("GoVersion: expected 1.21, got %q", cfg.GoVersion)
+			}
+		})
+	}
+}
+
+func TestLoadConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"shared/base.yaml": `
+output: ./generated
+goVersion: "1.21"
+packages:
+  - package: example.com/shared
+    types: [Common]
+`,
+		"rewriter.yaml": `
+include:
+  - shared/base.yaml
+output: ${OUTPUT_ROOT}/generated
+importPrefix: ${IMPORT_PREFIX:-example.com/consumer/generated}
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+		"cycle-a.yaml": "include: [cycle-b.yaml]\n",
+		"cycle-b.yaml": "include: [cycle-a.yaml]\n",
+		"unset.yaml":   "output: ${PACKAGE_REWRITER_UNSET}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("OUTPUT_ROOT", "/tmp/repo")
+
+	cfg, err := LoadConfig(filepath.Join(dir, "rewriter.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Output != "/tmp/repo/generated" {
+		t.Errorf("Output: expected the including file's setting with OUTPUT_ROOT expanded, got %q", cfg.Output)
+	}
+	if cfg.ImportPrefix != "example.com/consumer/generated" {
+		t.Errorf("ImportPrefix: expected the default for an unset variable, got %q", cfg.ImportPrefix)
+	}
+	if cfg.GoVersion != "1.21" {
+		t.Errorf("GoVersion: expected 1.21 from the included file, got %q", cfg.GoVersion)
+	}
+	var pkgs []string
+	for _, entry := range cfg.Packages {
+		pkgs = append(pkgs, entry.Package)
+	}
+	if want := []string{"example.com/shared", "example.com/foo"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("Packages: expected %v, got %v", want, pkgs)
+	}
+
+	for name, wantErr := range map[string]string{
+		"cycle-a.yaml": "include cycle",
+		"unset.yaml":   "PACKAGE_REWRITER_UNSET is not set",
+	} {
+		if _, err := LoadConfig(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got: %v", name, wantErr, err)
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name: "unknown field",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    typs: [Foo]
+`,
+			wantErr: "rewriter.yaml:4:5: packages[0].typs: unknown field (did you mean types?)",
+		},
+		{
+			name: "unknown field in profile",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    types: [Foo]
+profiles:
+  minimal:
+    keepExternals: [k8s.io/apimachinery]
+`,
+			wantErr: "rewriter.yaml:7:5: profiles.minimal.keepExternals: unknown field (did you mean keepExternal?)",
+		},
+		{
+			name: "invalid value",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    types: [Foo]
+  - package: example.com/bar
+    copy: some
+`,
+			wantErr: `rewriter.yaml:6:11: packages[1].copy: invalid value "some" (use: all)`,
+		},
+		{
+			name: "substitute with other options",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    types:
+      - Foo
+      - name: Time
+        substitute: time.Time
+        rename: Stamp
+`,
+			wantErr: "rewriter.yaml:7:21: packages[0].types[1].substitute: a substituted type isn't extracted",
+		},
+		{
+			name: "unknown preset",
+			content: `output: ./generated
+preset: k8s
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:2:9: preset: invalid value "k8s" (use: aws, gcp, kubernetes)`,
+		},
+		{
+			name: "unknown emitter",
+			content: `output: ./generated
+emit: [go, proto]
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:2:12: emit[1]: invalid value "proto" (use: docs, go, index)`,
+		},
+		{
+			name: "internal layout with public import prefix",
+			content: `output: ./generated
+layout: internal
+importPrefix: example.com/me/generated
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:3:15: importPrefix: "example.com/me/generated" must have an internal element with layout: internal`,
+		},
+		{
+			name: "standalone false with umbrella layout",
+			content: `output: ./generated
+layout: umbrella
+umbrellaModule: example.com/generated
+standalone: false
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:4:13: standalone: can't be false with layout: umbrella, which generates modules`,
+		},
+		{
+			name: "unknown recursion",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    types: [Foo]
+    recursion: shallow
+`,
+			wantErr: `rewriter.yaml:5:16: packages[0].recursion: invalid value "shallow" (use: all, local, package, type)`,
+		},
+		{
+			name: "copy all with types",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    copy: all
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:5:12: packages[0].types: can't be combined with copy: all`,
+		},
+		{
+			name: "copy all with functions",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    copy: all
+    functions: [NewFoo]
+`,
+			wantErr: `rewriter.yaml:5:16: packages[0].functions: can't be combined with copy: all`,
+		},
+		{
+			name: "wrap with other options",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+    types:
+      - name: Time
+        wrap: true
+        rename: Stamp
+`,
+			wantErr: "rewriter.yaml:6:15: packages[0].types[0].wrap: a wrapped type is replaced with its wrapper",
+		},
+		{
+			name: "conflicting settings",
+			content: `output: ./generated
+importPrefix: example.com/consumer/generated
+stripVersionSuffix: true
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: "rewriter.yaml:3:21: stripVersionSuffix: can't be combined with importPrefix",
+		},
+		{
+			name: "qualified suspect field replacement",
+			content: `output: ./generated
+suspectFields: replace
+suspectFieldReplacement: json.RawMessage
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:3:26: suspectFieldReplacement: type "json.RawMessage" can't refer to other packages`,
+		},
+		{
+			name: "invalid code owner",
+			content: `output: ./generated
+codeowners: ["@org/team", "platform team"]
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:2:27: codeowners[1]: invalid owner "platform team"`,
+		},
+		{
+			name: "invalid file mode",
+			content: `output: ./generated
+fileMode: "0648"
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:2:11: fileMode: invalid permissions "0648" (e.g., 0640)`,
+		},
+		{
+			name: "invalid go timeout",
+			content: `output: ./generated
+goTimeout: 10
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:2:12: goTimeout: invalid timeout "10" (e.g., 5m)`,
+		},
+		{
+			name: "shim without a version",
+			content: `output: ./generated
+shims:
+  - module: example.com/foo
+    shim: example.com/foo-types
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`,
+			wantErr: `rewriter.yaml:3:5: shims[0].version: invalid version ""`,
+		},
+		{
+			name: "published version without the major version suffix",
+			content: `output: ./argo-types
+publish:
+  module: example.com/platform/argo-types
+  source: github.com/argoproj/argo-cd/v3
+  version: v2.0.0
+packages:
+  - package: github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1
+    types: [Application]
+`,
+			wantErr: "rewriter.yaml:5:12: publish.version: ",
+		},
+		{
+			name: "missing field located at its entry",
+			content: `output: ./generated
+packages:
+  - package: example.com/foo
+`,
+			wantErr: "rewriter.yaml:3:5: packages[0]: at least one type or function is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestSchemaCoversConfig keeps the published schema in sync with the fields
+// the loader accepts
+func TestSchemaCoversConfig(t *testing.T) {
+	var schema struct {
+		Properties map[string]any `json:"properties"`
+		Defs       map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema(), &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+
+	check := func(typ reflect.Type, properties ...map[string]any) {
+		for name := range yamlFields(typ) {
+			found := false
+			for _, props := range properties {
+				_, ok := props[name]
+				found = found || ok
+			}
+			if !found {
+				t.Errorf("Schema is missing %s field %q", typ.Name(), name)
+			}
+		}
+	}
+	check(reflect.TypeOf(Config{}), schema.Properties, schema.Defs["settings"].Properties)
+	check(reflect.TypeOf(PackageEntry{}), schema.Defs["packageEntry"].Properties)
+	check(reflect.TypeOf(TypeEntry{}), schema.Defs["typeEntry"].Properties)
+	check(reflect.TypeOf(ShimEntry{}), schema.Defs["shimEntry"].Properties)
+	check(reflect.TypeOf(PublishEntry{}), schema.Defs["publishEntry"].Properties)
+}
+
+func TestMigrate(t *testing.T) {
+	// Pretend a v2 renamed output to outputDir
+	defer func(versions []string) { apiVersions = versions }(apiVersions)
+	apiVersions = append(apiVersions, "v2")
+	migrations["v1"] = func(root *yaml.Node) error {
+		if key := mappingKey(root, "output"); key != nil {
+			key.Value = "outputDir"
+		}
+		return nil
+	}
+	defer delete(migrations, "v1")
+
+	migrated, err := Migrate([]byte(`# Shared extraction settings
+output: ${OUTPUT_ROOT}/generated # relative to the repo
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`))
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	want := `apiVersion: v2
+# Shared extraction settings
+outputDir: ${OUTPUT_ROOT}/generated # relative to the repo
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`
+	if string(migrated) != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, migrated)
+	}
+
+	if _, err := Migrate([]byte("apiVersion: v3\n")); err == nil || !strings.Contains(err.Error(), `unsupported apiVersion "v3"`) {
+		t.Errorf("Expected unsupported apiVersion error, got: %v", err)
+	}
+}
+
+// mappingKey returns the key node for key in a mapping node, or nil
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+func TestLoadConfigTypeEntries(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+output: ./generated
+packages:
+  - package: example.com/foo
+    types:
+      - Foo
+      - name: Bar
+        prune: [Status]
+        rename: FooBar
+        copyMethods: false
+      - name: Time
+        substitute: time.Time
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	copyMethods := false
+	expected := []TypeEntry{
+		{Name: "Foo"},
+		{Name: "Bar", Prune: []string{"Status"}, Rename: "FooBar", CopyMethods: &copyMethods},
+		{Name: "Time", Substitute: "time.Time"},
+	}
+	if !reflect.DeepEqual(cfg.Packages[0].Types, expected) {
+		t.Errorf("Types:\n got: %+v\nwant: %+v", cfg.Packages[0].Types, expected)
+	}
+}
+
+func TestLoadConfigQualifiedTypes(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+output: ./generated
+types:
+  - github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1.Application
+  - example.com/foo.Foo
+  - example.com/foo.Bar
+packages:
+  - package: example.com/foo
+    types: [Foo]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	// Qualified types join the entry of their package, or get their own
+	expected := []PackageEntry{
+		{Package: "example.com/foo", Types: []TypeEntry{{Name: "Foo"}, {Name: "Bar"}}},
+		{Package: "github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1", Types: []TypeEntry{{Name: "Application"}}},
+	}
+	if !reflect.DeepEqual(cfg.Packages, expected) {
+		t.Errorf("Packages:\n got: %+v\nwant: %+v", cfg.Packages, expected)
+	}
+
+	if _, err := LoadConfig(writeConfig(t, "output: ./generated\ntypes: [Application]\n")); err == nil || !strings.Contains(err.Error(), `types[0]: invalid type: "Application" is not a qualified type`) {
+		t.Errorf("Expected an error for an unqualified type, got: %v", err)
+	}
+}
+
+func TestScanNeeds(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app/main.go": `package main
+
+//rewriter:need example.com/foo.Foo example.com/bar/v2.Bar
+func main() {}
+`,
+		"app/handler/handler.go": `package handler
+
+// Bar is needed twice, and so is only extracted once
+//rewriter:need example.com/bar/v2.Bar
+//rewriter:need example.com/foo.Extra
+// rewriter:need example.com/ignored.NotADirective
+type Handler struct{}
+`,
+		"app/vendor/example.com/x/x.go":  "package x\n\n//rewriter:need example.com/x.Vendored\n",
+		"app/testdata/x.go":              "package x\n\n//rewriter:need example.com/x.Fixture\n",
+		"app/generated/example.com/y.go": "package y\n\n//rewriter:need example.com/y.Generated\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	needs, err := ScanNeeds([]string{filepath.Join(dir, "app")}, filepath.Join(dir, "app/generated"))
+	if err != nil {
+		t.Fatalf("ScanNeeds failed: %v", err)
+	}
+	var got []string
+	for _, need := range needs {
+		got = append(got, need.Package+"."+need.Type)
+	}
+	expected := []string{
+		"example.com/bar/v2.Bar",
+		"example.com/bar/v2.Bar",
+		"example.com/foo.Extra",
+		"example.com/foo.Foo",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Needs:\n got: %v\nwant: %v", got, expected)
+	}
+
+	cfg := &Config{Packages: []PackageEntry{{Package: "example.com/foo", Types: []TypeEntry{{Name: "Foo", Rename: "MyFoo"}}}}}
+	cfg.AddNeeds(needs)
+	expectedPackages := []PackageEntry{
+		{Package: "example.com/foo", Types: []TypeEntry{{Name: "Foo", Rename: "MyFoo"}, {Name: "Extra"}}},
+		{Package: "example.com/bar/v2", Types: []TypeEntry{{Name: "Bar"}}},
+	}
+	if !reflect.DeepEqual(cfg.Packages, expectedPackages) {
+		t.Errorf("Packages:\n got: %+v\nwant: %+v", cfg.Packages, expectedPackages)
+	}
+
+	// Malformed references are reported with their position
+	bad := filepath.Join(dir, "bad")
+	if err := os.MkdirAll(bad, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bad, "bad.go"), []byte("package bad\n\n//rewriter:need Foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScanNeeds([]string{bad}); err == nil || !strings.Contains(err.Error(), "bad.go:3: invalid rewriter:need") {
+		t.Errorf("Expected an error for a malformed reference, got: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVarPattern matches ${VAR} and ${VAR:-default}
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} references with the value of the environment
+// variable. ${VAR:-default} falls back to default when VAR is unset or empty;
+// a plain reference to an unset variable is an error.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	expanded := envVarPattern.ReplaceAllFunc(data, func(ref []byte) []byte {
+		m := envVarPattern.FindSubmatch(ref)
+		if value := os.Getenv(string(m[1])); value != "" {
+			return []byte(value)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		missing = append(missing, string(m[1]))
+		return ref
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variable %s is not set", missing[0])
+	}
+	return expanded, nil
+}
+
+// loadFile decodes the config file at path onto cfg, after first decoding
+// the files it includes. Settings in a file override those from its
+// includes, while package entries are combined. stack holds the files
+// currently being loaded, to catch include cycles.
+func loadFile(path string, cfg *Config, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, loading := range stack {
+		if loading == abs {
+			return fmt.Errorf("include cycle at %s", path)
+		}
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return loadData(path, data, cfg, stack)
+}
+
+// loadData decodes config data read from path onto cfg, like loadFile
+func loadData(path string, data []byte, cfg *Config, stack []string) error {
+	data, err := expandEnv(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		// Empty file
+		return nil
+	}
+
+	// Older formats are upgraded in memory; `package-rewriter migrate`
+	// rewrites the file itself
+	from, err := migrateNode(doc.Content[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if from != CurrentAPIVersion() {
+		slog.Warn("Config file uses an older format; run package-rewriter migrate to update it",
+			"file", path, "apiVersion", from, "current", CurrentAPIVersion())
+	}
+
+	positions := make(map[string]position)
+	if errs := checkFields(path, doc.Content[0], reflect.TypeOf(Config{}), "", positions); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	var file struct {
+		Include []string `yaml:"include"`
+	}
+	if err := doc.Decode(&file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// Include paths are relative to the file that includes them
+	for _, include := range file.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := loadFile(include, cfg, stack); err != nil {
+			return err
+		}
+	}
+
+	included := cfg.Packages
+	cfg.Packages = nil
+	if err := doc.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	cfg.Packages = append(included, cfg.Packages...)
+	cfg.Include = nil
+
+	// Package entries from this file follow those from its includes
+	if cfg.positions == nil {
+		cfg.positions = make(map[string]position)
+	}
+	for fieldPath, pos := range positions {
+		var i int
+		var rest string
+		if n, _ := fmt.Sscanf(fieldPath, "packages[%d]", &i); n == 1 {
+			_, rest, _ = strings.Cut(fieldPath, "]")
+			fieldPath = fmt.Sprintf("packages[%d]%s", i+len(included), rest)
+		}
+		cfg.positions[fieldPath] = pos
+	}
+	return nil
+}
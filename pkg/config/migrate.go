@@ -0,0 +1,105 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiVersions lists the config format versions, oldest first. Files that
+// don't declare an apiVersion are v1.
+var apiVersions = []string{"v1"}
+
+// migrations upgrade a config document from the version they're keyed by to
+// the next one in apiVersions. A breaking format change adds a version and
+// the migration from the one before it.
+var migrations = map[string]func(root *yaml.Node) error{}
+
+// CurrentAPIVersion returns the config format version this build reads and
+// writes
+func CurrentAPIVersion() string {
+	return apiVersions[len(apiVersions)-1]
+}
+
+// migrateNode upgrades the config document root in place to the current
+// format version, returning the version it was written in
+func migrateNode(root *yaml.Node) (string, error) {
+	if root.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("config must be a mapping")
+	}
+
+	from := apiVersions[0]
+	versionNode := mappingValue(root, "apiVersion")
+	if versionNode != nil {
+		from = versionNode.Value
+	}
+	start := slices.Index(apiVersions, from)
+	if start < 0 {
+		return "", fmt.Errorf("unsupported apiVersion %q (this version of package-rewriter reads up to %s)", from, CurrentAPIVersion())
+	}
+
+	for _, version := range apiVersions[start : len(apiVersions)-1] {
+		if migrate := migrations[version]; migrate != nil {
+			if err := migrate(root); err != nil {
+				return "", fmt.Errorf("failed to migrate config from %s: %w", version, err)
+			}
+		}
+	}
+
+	if versionNode == nil {
+		versionNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str"}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "apiVersion"}
+		root.Content = append([]*yaml.Node{key, versionNode}, root.Content...)
+	}
+	versionNode.Value = CurrentAPIVersion()
+	return from, nil
+}
+
+// Migrate rewrites a config file's contents in the current format version.
+// Includes and ${VAR} references are left as they are; included files are
+// migrated separately.
+func Migrate(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+	if _, err := migrateNode(doc.Content[0]); err != nil {
+		return nil, err
+	}
+
+	return encodeYAML(&doc)
+}
+
+// Marshal writes the config in the YAML format LoadConfig reads
+func (c *Config) Marshal() ([]byte, error) {
+	return encodeYAML(c)
+}
+
+// encodeYAML encodes v with the two-space indentation used in config files
+func encodeYAML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mappingValue returns the value for key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// needDirective starts the comments declaring the types code needs:
+//
+//	//rewriter:need github.com/foo/bar.Type [github.com/foo/baz.Other ...]
+const needDirective = "//rewriter:need "
+
+// Need is a type declared needed by a //rewriter:need comment
+type Need struct {
+	Package string
+	Type    string
+	Pos     string // file:line of the comment
+}
+
+// ScanNeeds reads the //rewriter:need comments of the Go files in dirs and
+// their subdirectories, sorted by package and type. Like the go command, it
+// skips vendor and testdata directories and those starting with . or _, as
+// well as the directories in exclude, such as the output directory.
+func ScanNeeds(dirs []string, exclude ...string) ([]Need, error) {
+	excluded := make(map[string]bool)
+	for _, dir := range exclude {
+		if abs, err := filepath.Abs(dir); err == nil {
+			excluded[abs] = true
+		}
+	}
+
+	var needs []Need
+	fset := token.NewFileSet()
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				name := d.Name()
+				abs, _ := filepath.Abs(path)
+				if path != dir && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) || excluded[abs] {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, ".go") {
+				return nil
+			}
+			file, err := parser.ParseFile(fset, path, nil, parser.ParseComments|parser.SkipObjectResolution)
+			if err != nil {
+				return err
+			}
+			for _, group := range file.Comments {
+				for _, comment := range group.List {
+					refs, ok := strings.CutPrefix(comment.Text, needDirective)
+					if !ok {
+						continue
+					}
+					pos := fset.Position(comment.Pos())
+					for _, ref := range strings.Fields(refs) {
+						need, err := parseNeed(ref)
+						if err != nil {
+							return fmt.Errorf("%s:%d: %w", pos.Filename, pos.Line, err)
+						}
+						need.Pos = fmt.Sprintf("%s:%d", pos.Filename, pos.Line)
+						needs = append(needs, need)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", dir, err)
+		}
+	}
+
+	sort.SliceStable(needs, func(i, j int) bool {
+		if needs[i].Package != needs[j].Package {
+			return needs[i].Package < needs[j].Package
+		}
+		return needs[i].Type < needs[j].Type
+	})
+	return needs, nil
+}
+
+// parseNeed splits import/path.Type
+func parseNeed(ref string) (Need, error) {
+	pkgPath, typeName, err := ParseTypeRef(ref)
+	if err != nil {
+		return Need{}, fmt.Errorf("invalid rewriter:need: %w", err)
+	}
+	return Need{Package: pkgPath, Type: typeName}, nil
+}
+
+// ParseTypeRef splits a fully-qualified type, import/path.TypeName, as
+// written in Go source and error messages
+func ParseTypeRef(ref string) (string, string, error) {
+	i := strings.LastIndex(ref, ".")
+	if i <= 0 || strings.LastIndex(ref, "/") > i {
+		return "", "", fmt.Errorf("%q is not a qualified type (use: import/path.TypeName)", ref)
+	}
+	pkgPath, typeName := ref[:i], ref[i+1:]
+	if err := module.CheckImportPath(pkgPath); err != nil {
+		return "", "", fmt.Errorf("%q: %w", ref, err)
+	}
+	if !token.IsIdentifier(typeName) {
+		return "", "", fmt.Errorf("%q: %q is not a type name", ref, typeName)
+	}
+	return pkgPath, typeName, nil
+}
+
+// AddNeeds adds the types in needs to the package entries, unless the
+// config already extracts them
+func (c *Config) AddNeeds(needs []Need) {
+	for _, need := range needs {
+		i := slices.IndexFunc(c.Packages, func(entry PackageEntry) bool {
+			return entry.Package == need.Package
+		})
+		if i < 0 {
+			c.Packages = append(c.Packages, PackageEntry{Package: need.Package})
+			i = len(c.Packages) - 1
+		}
+		entry := &c.Packages[i]
+		if entry.Copy == "all" || slices.ContainsFunc(entry.Types, func(t TypeEntry) bool { return t.Name == need.Type }) {
+			continue
+		}
+		entry.Types = append(entry.Types, TypeEntry{Name: need.Type})
+	}
+}
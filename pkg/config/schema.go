@@ -0,0 +1,186 @@
+package config
+
+import (
+	_ "embed"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed schema.json
+var schemaJSON []byte
+
+// Schema returns the JSON Schema describing the config file format
+func Schema() []byte {
+	return schemaJSON
+}
+
+// FieldError is a config error in a specific field, located in the config
+// file when the field (or the entry containing it) was set there
+type FieldError struct {
+	Field string // e.g., packages[2].copy
+	Pos   string // file:line:column, if known
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	msg := e.Msg
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Pos != "" {
+		msg = e.Pos + ": " + msg
+	}
+	return msg
+}
+
+// position is where a value was set in a config file
+type position struct {
+	file         string
+	line, column int
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.file, p.line, p.column)
+}
+
+// fieldError returns a FieldError for field, located at the closest
+// enclosing value that was set in a config file
+func (c *Config) fieldError(field, format string, args ...any) error {
+	err := &FieldError{Field: field, Msg: fmt.Sprintf(format, args...)}
+	for path := field; ; path = parentPath(path) {
+		if pos, ok := c.positions[path]; ok {
+			err.Pos = pos.String()
+			break
+		}
+		if path == "" {
+			break
+		}
+	}
+	return err
+}
+
+// parentPath strips the last element from a field path:
+// packages[2].copy -> packages[2] -> packages -> ""
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// topLevelField returns the first element of a field path
+func topLevelField(path string) string {
+	if i := strings.IndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// checkFields walks node alongside the Go type it decodes into, recording
+// the position of every value under its field path and reporting keys that
+// don't match any field, so a typo like `typs:` fails instead of silently
+// leaving the field empty
+func checkFields(file string, node *yaml.Node, t reflect.Type, path string, positions map[string]position) []error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	positions[path] = position{file: file, line: node.Line, column: node.Column}
+
+	var errs []error
+	switch {
+	case t == reflect.TypeOf(yaml.Node{}):
+		// The only raw nodes are profiles, which overlay the config itself
+		return checkFields(file, node, reflect.TypeOf(Config{}), path, positions)
+
+	case t.Kind() == reflect.Pointer:
+		return checkFields(file, node, t.Elem(), path, positions)
+
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldPath := joinPath(path, key.Value)
+			field, ok := fields[key.Value]
+			if !ok {
+				msg := "unknown field"
+				if suggestion := closestField(key.Value, fields); suggestion != "" {
+					msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+				}
+				pos := position{file: file, line: key.Line, column: key.Column}
+				errs = append(errs, &FieldError{Field: fieldPath, Pos: pos.String(), Msg: msg})
+				continue
+			}
+			errs = append(errs, checkFields(file, value, field, fieldPath, positions)...)
+		}
+
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			errs = append(errs, checkFields(file, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), positions)...)
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			errs = append(errs, checkFields(file, value, t.Elem(), joinPath(path, key.Value), positions)...)
+		}
+	}
+	return errs
+}
+
+// yamlFields maps the YAML keys of a struct to the types of their fields
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// closestField suggests the known field a mistyped key was most likely
+// meant to be, or "" if none is close
+func closestField(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		d := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
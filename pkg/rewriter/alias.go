@@ -0,0 +1,102 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/build/constraint"
+	"go/format"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// generateAliasFile writes alias.go, the alias flavor of a generated package.
+// It's only built with the alias tag, in which case the copied declarations
+// are excluded and each exported type and constant refers to the original
+// package instead, so consumers can switch between the trimmed copies and
+// the real dependency without changing imports.
+func (r *RecursiveRewriter) generateAliasFile(pkgInfo *PackageInfo, outputPath string, names []string) error {
+	scope := pkgInfo.Pkg.Types.Scope()
+
+	var typeLines, constLines []string
+	for _, name := range names {
+		if strings.Contains(name, ".") || !token.IsExported(name) {
+			// Methods come along with their type; unexported names can't be referenced
+			continue
+		}
+		switch obj := scope.Lookup(name).(type) {
+		case *types.TypeName:
+			if isGenericType(obj) {
+				slog.Warn("Skipping generic type in alias flavor", "package", pkgInfo.Pkg.PkgPath, "type", name)
+				continue
+			}
+			typeLines = append(typeLines, fmt.Sprintf("\t%s = upstream.%s", r.renamedType(pkgInfo.Pkg.PkgPath, name), name))
+		case *types.Const:
+			constLines = append(constLines, fmt.Sprintf("\t%s = upstream.%s", name, name))
+		case nil:
+			continue
+		default:
+			slog.Warn("Skipping function or variable in alias flavor", "package", pkgInfo.Pkg.PkgPath, "name", name)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "//go:build %s\n\n", r.config.AliasTag)
+	buf.WriteString(generatedHeader(pkgInfo.Pkg.PkgPath))
+	fmt.Fprintf(&buf, "package %s\n\nimport upstream %q\n", pkgInfo.Pkg.Name, pkgInfo.Pkg.PkgPath)
+	if len(constLines) > 0 {
+		fmt.Fprintf(&buf, "\nconst (\n%s\n)\n", strings.Join(constLines, "\n"))
+	}
+	if len(typeLines) > 0 {
+		fmt.Fprintf(&buf, "\ntype (\n%s\n)\n", strings.Join(typeLines, "\n"))
+	}
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format alias file for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+
+	outputFile := filepath.Join(outputPath, "alias.go")
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "aliases", len(typeLines)+len(constLines))
+	return nil
+}
+
+func isGenericType(obj *types.TypeName) bool {
+	switch t := obj.Type().(type) {
+	case *types.Named:
+		return t.TypeParams().Len() > 0
+	case *types.Alias:
+		return t.TypeParams().Len() > 0
+	}
+	return false
+}
+
+// excludeFromAliasBuild adds "!<tag>" to a copied file's build constraint
+// so it's left out of the alias flavor
+func excludeFromAliasBuild(content []byte, tag string) []byte {
+	excluded := &constraint.NotExpr{X: &constraint.TagExpr{Tag: tag}}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(trimmed) {
+			continue
+		}
+		expr, err := constraint.Parse(trimmed)
+		if err != nil {
+			break
+		}
+		lines[i] = "//go:build " + (&constraint.AndExpr{X: expr, Y: excluded}).String() + "\n"
+		return []byte(strings.Join(lines, ""))
+	}
+
+	return append([]byte("//go:build "+excluded.String()+"\n\n"), content...)
+}
@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAliasFlavor(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated code")
+	}
+
+	consumer := t.TempDir()
+	r := newFixtureRewriter(t)
+	r.config.OutputDir = filepath.Join(consumer, "generated")
+	r.config.ImportPrefix = "example.com/consumer/generated"
+	r.config.AliasTag = "upstream"
+	if err := r.queuePackageCopy("example.com/fixture/leaf", []string{"zz_*.go"}); err != nil {
+		t.Fatalf("queuePackageCopy failed: %v", err)
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/ifaces", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	ifacesDir := filepath.Join(r.config.OutputDir, "example.com/fixture/ifaces")
+	types, err := os.ReadFile(filepath.Join(ifacesDir, "types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"//go:build !upstream\n", `"example.com/consumer/generated/example.com/fixture/other"`} {
+		if !strings.Contains(string(types), want) {
+			t.Errorf("types.go missing %q:\n%s", want, types)
+		}
+	}
+
+	alias, err := os.ReadFile(filepath.Join(ifacesDir, "alias.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"//go:build upstream\n", `import upstream "example.com/fixture/ifaces"`, "Holder  = upstream.Holder"} {
+		if !strings.Contains(string(alias), want) {
+			t.Errorf("alias.go missing %q:\n%s", want, alias)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod")); !os.IsNotExist(err) {
+		t.Errorf("Expected no go.mod with an import prefix, got err=%v", err)
+	}
+
+	// Both flavors must build inside the consuming module
+	goMod := fmt.Sprintf(`module example.com/consumer
+
+go 1.22
+
+require (
+	example.com/fixture v0.0.0
+	example.com/cgomod v0.0.0
+)
+
+replace example.com/fixture => %s
+
+replace example.com/cgomod => %s
+`, r.config.Dir, filepath.Join(r.config.Dir, "..", "cgomod"))
+	if err := os.WriteFile(filepath.Join(consumer, "go.mod"), []byte(goMod), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tags := range []string{"", "upstream"} {
+		cmd := exec.Command("go", "build", "-tags", tags, "./...")
+		cmd.Dir = consumer
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("Building with tags %q failed: %v\n%s", tags, err, output)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log/slog"
+	"strings"
+)
+
+// sourceAnnotations are the "+rewriter:" comments teams controlling a source
+// package can add to steer extraction without configuring it:
+//
+//	// +rewriter:skip
+//	// +rewriter:substitute=import/path.TypeName
+//
+// A skipped struct field is left out of its type. A skipped type is never
+// extracted, and struct fields referring to it are left out instead. A
+// substituted type is handled like a type configured with substitute.
+type sourceAnnotations struct {
+	skip       bool
+	substitute string
+}
+
+// parseAnnotations reads the +rewriter: annotations from comment groups
+func parseAnnotations(groups ...*ast.CommentGroup) sourceAnnotations {
+	var a sourceAnnotations
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		for _, comment := range group.List {
+			text, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(comment.Text, "//")), "+rewriter:")
+			if !ok {
+				continue
+			}
+			name, value, _ := strings.Cut(text, "=")
+			switch strings.TrimSpace(name) {
+			case "skip":
+				a.skip = true
+			case "substitute":
+				a.substitute = strings.TrimSpace(value)
+			}
+		}
+	}
+	return a
+}
+
+// typeAnnotations returns the annotations on the declaration of a type
+// referenced from extracted code. Only packages declarations are extracted
+// from are consulted, parsing them if they weren't loaded yet: a package
+// whose referenced types are all skipped or substituted is never
+// type-checked.
+func (r *RecursiveRewriter) typeAnnotations(obj *types.TypeName) sourceAnnotations {
+	if obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+		return sourceAnnotations{}
+	}
+	pkgPath := obj.Pkg().Path()
+	if r.isStdlib(pkgPath) || r.external[pkgPath] != nil || r.isVerbatim(pkgPath) || r.isKeptExternal(pkgPath) || r.inShimModule(pkgPath) {
+		return sourceAnnotations{}
+	}
+	if _, ok := r.packageSubstitute(pkgPath); ok {
+		return sourceAnnotations{}
+	}
+	pkgInfo, err := r.parsePackageInfo(pkgPath)
+	if err != nil {
+		// Extracting the type reports the error
+		return sourceAnnotations{}
+	}
+	site, ok := pkgInfo.lookup(obj.Name())
+	if !ok {
+		return sourceAnnotations{}
+	}
+	spec, ok := site.spec.(*ast.TypeSpec)
+	if !ok {
+		return sourceAnnotations{}
+	}
+	return declAnnotations(site.decl.(*ast.GenDecl), spec)
+}
+
+// declAnnotations reads the annotations documenting a type declaration,
+// which are on the declaration itself unless it's part of a group
+func declAnnotations(genDecl *ast.GenDecl, spec *ast.TypeSpec) sourceAnnotations {
+	if len(genDecl.Specs) == 1 {
+		return parseAnnotations(genDecl.Doc, spec.Doc)
+	}
+	return parseAnnotations(spec.Doc)
+}
+
+// referencedTypes returns the package-level types referenced within node
+func referencedTypes(info *types.Info, node ast.Node) []*types.TypeName {
+	if info == nil {
+		return nil
+	}
+	var refs []*types.TypeName
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			if obj, ok := info.Uses[ident].(*types.TypeName); ok && obj.Pkg() != nil {
+				refs = append(refs, obj)
+			}
+		}
+		return true
+	})
+	return refs
+}
+
+// substituteAnnotated records the substitutes annotated on the types node
+// refers to, so substituteTypes replaces them like configured ones. A
+// substitute configured for the type takes precedence.
+func (r *RecursiveRewriter) substituteAnnotated(pkgInfo *PackageInfo, node ast.Node) error {
+	for _, obj := range referencedTypes(pkgInfo.Pkg.TypesInfo, node) {
+		typeRef := TypeRef{PackagePath: obj.Pkg().Path(), TypeName: obj.Name()}
+		if _, ok := r.substitutes[typeRef.String()]; ok {
+			continue
+		}
+		substitute := r.typeAnnotations(obj).substitute
+		if substitute == "" || r.typeOptions[typeRef.String()].Substitute != "" {
+			continue
+		}
+		opts := r.typeOptions[typeRef.String()]
+		opts.Substitute = substitute
+		if err := r.setTypeOptions(typeRef, opts); err != nil {
+			return fmt.Errorf("+rewriter:substitute: %w", err)
+		}
+		slog.Info("Substituting annotated type", "type", typeRef.String(), "substitute", substitute)
+	}
+	return nil
+}
+
+// checkAnnotations rejects extracting a type annotated to be skipped or
+// substituted, which happens when it's a root or is referenced other than
+// through a struct field
+func (r *RecursiveRewriter) checkAnnotations(pkgInfo *PackageInfo, typeRef TypeRef) error {
+	obj, ok := pkgInfo.Pkg.Types.Scope().Lookup(typeRef.TypeName).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+	a := r.typeAnnotations(obj)
+	switch {
+	case a.skip:
+		return fmt.Errorf("%s is marked +rewriter:skip", typeRef)
+	case a.substitute != "":
+		return fmt.Errorf("%s is marked +rewriter:substitute, which only applies to references from extracted declarations", typeRef)
+	}
+	return nil
+}
+
+// dropSkippedFields removes the struct fields annotated +rewriter:skip, or
+// whose type refers to a type annotated so, including those of nested struct
+// types, before the type is walked for dependencies
+func (r *RecursiveRewriter) dropSkippedFields(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) {
+	if st, ok := spec.Type.(*ast.StructType); ok {
+		r.dropSkippedStruct(pkgInfo, typeRef, st, typeRef.String())
+	}
+}
+
+func (r *RecursiveRewriter) dropSkippedStruct(pkgInfo *PackageInfo, typeRef TypeRef, st *ast.StructType, path string) {
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		names := []string{embeddedFieldName(field.Type)}
+		if len(field.Names) > 0 {
+			names = names[:0]
+			for _, ident := range field.Names {
+				names = append(names, ident.Name)
+			}
+		}
+
+		reason := ""
+		if parseAnnotations(field.Doc, field.Comment).skip {
+			reason = "+rewriter:skip"
+		} else if obj := r.skippedReference(pkgInfo, field.Type); obj != nil {
+			reason = obj.Name() + " is marked +rewriter:skip"
+		}
+		if reason == "" {
+			ast.Inspect(field.Type, func(n ast.Node) bool {
+				if nested, ok := n.(*ast.StructType); ok {
+					r.dropSkippedStruct(pkgInfo, typeRef, nested, path+"."+names[0])
+					return false
+				}
+				return true
+			})
+			kept = append(kept, field)
+			continue
+		}
+		for _, name := range names {
+			slog.Info("Dropped skipped field", "field", path+"."+name)
+			r.recordFieldChange(typeRef, path+"."+name, fieldRemoved, types.ExprString(field.Type), "", reason)
+		}
+	}
+	st.Fields.List = kept
+}
+
+// skippedReference returns the first type annotated +rewriter:skip that a
+// field's type refers to, outside of nested struct types, whose own fields
+// are dropped instead
+func (r *RecursiveRewriter) skippedReference(pkgInfo *PackageInfo, expr ast.Expr) *types.TypeName {
+	if pkgInfo.Pkg.TypesInfo == nil {
+		return nil
+	}
+	var skipped *types.TypeName
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.StructType:
+			return false
+		case *ast.Ident:
+			if obj, ok := pkgInfo.Pkg.TypesInfo.Uses[n].(*types.TypeName); ok && skipped == nil && r.typeAnnotations(obj).skip {
+				skipped = obj
+			}
+		}
+		return skipped == nil
+	})
+	return skipped
+}
@@ -0,0 +1,212 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bazelWorkspaceFiles mark the root of a Bazel workspace
+var bazelWorkspaceFiles = []string{"MODULE.bazel", "REPO.bazel", "WORKSPACE.bazel", "WORKSPACE"}
+
+// generateBuildFiles writes a BUILD.bazel file with a go_library rule next
+// to each generated package, following Gazelle's conventions: rules are
+// named after the last element of their import path, generated packages are
+// referenced by their path in the workspace, and other modules through the
+// go_repository names Gazelle derives from their module path.
+func (r *RecursiveRewriter) generateBuildFiles(pkgPaths []string) error {
+	outputDir, err := filepath.Abs(r.config.OutputDir)
+	if err != nil {
+		return err
+	}
+	root := bazelWorkspaceRoot(outputDir)
+
+	// Labels of the generated packages, by the import path generated code uses
+	labels := make(map[string]string)
+	for _, pkgPath := range pkgPaths {
+		if pkgInfo := r.packages[pkgPath]; pkgInfo.hasOutput() {
+			dir, err := filepath.Rel(root, filepath.Join(outputDir, pkgInfo.OutputSubdir))
+			if err != nil {
+				return err
+			}
+			importPath := r.importPath(pkgPath)
+			labels[importPath] = bazelLabel("", filepath.ToSlash(dir), path.Base(importPath))
+		}
+	}
+
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+		if !pkgInfo.hasOutput() {
+			continue
+		}
+		dir := filepath.Join(outputDir, pkgInfo.OutputSubdir)
+
+		srcs, imports, err := goFileImports(dir)
+		if err != nil {
+			return err
+		}
+		var deps []string
+		for _, importPath := range imports {
+			if r.isStdlib(importPath) {
+				continue
+			}
+			if label, ok := labels[importPath]; ok {
+				deps = append(deps, label)
+				continue
+			}
+			deps = append(deps, r.externalLabel(importPath))
+		}
+		sort.Strings(deps)
+
+		importPath := r.importPath(pkgPath)
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Code generated by package-rewriter %s. DO NOT EDIT.\n\n", Version())
+		b.WriteString("load(\"@io_bazel_rules_go//go:def.bzl\", \"go_library\")\n\n")
+		b.WriteString("go_library(\n")
+		fmt.Fprintf(&b, "    name = %q,\n", path.Base(importPath))
+		writeStarlarkList(&b, "srcs", srcs)
+		fmt.Fprintf(&b, "    importpath = %q,\n", importPath)
+		b.WriteString("    visibility = [\"//visibility:public\"],\n")
+		writeStarlarkList(&b, "deps", deps)
+		b.WriteString(")\n")
+
+		buildFile := filepath.Join(dir, "BUILD.bazel")
+		if err := r.writeOutputFile(buildFile, []byte(b.String())); err != nil {
+			return err
+		}
+		slog.Debug("Generated", "file", buildFile, "deps", len(deps))
+	}
+	return nil
+}
+
+// externalLabel returns the label of a package that isn't generated, in the
+// go_repository of the longest known module path containing it
+func (r *RecursiveRewriter) externalLabel(importPath string) string {
+	modulePath := ""
+	consider := func(candidate string) {
+		if (importPath == candidate || strings.HasPrefix(importPath, candidate+"/")) && len(candidate) > len(modulePath) {
+			modulePath = candidate
+		}
+	}
+	for candidate := range r.modules {
+		consider(candidate)
+	}
+	for _, mod := range r.external {
+		consider(mod.Path)
+	}
+	if modulePath == "" {
+		modulePath = importPath
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(importPath, modulePath), "/")
+	return bazelLabel(bazelRepoName(modulePath), rel, path.Base(importPath))
+}
+
+// bazelLabel formats a label, leaving out the name when it matches the last
+// element of the package directory, as Gazelle does
+func bazelLabel(repo, dir, name string) string {
+	label := "//" + dir
+	if repo != "" {
+		label = "@" + repo + label
+	}
+	if path.Base(dir) != name {
+		label += ":" + name
+	}
+	return label
+}
+
+// bazelRepoName returns the go_repository name Gazelle derives from a module
+// path: the host's components reversed, then the path, joined with
+// underscores (e.g., github.com/argoproj/argo-cd becomes
+// com_github_argoproj_argo_cd)
+func bazelRepoName(modulePath string) string {
+	host, rest, _ := strings.Cut(modulePath, "/")
+	hostParts := strings.Split(host, ".")
+	for i, j := 0, len(hostParts)-1; i < j; i, j = i+1, j-1 {
+		hostParts[i], hostParts[j] = hostParts[j], hostParts[i]
+	}
+	name := strings.Join(hostParts, "_")
+	if rest != "" {
+		name += "_" + rest
+	}
+	return strings.Map(func(c rune) rune {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '_':
+			return c
+		case 'A' <= c && c <= 'Z':
+			return c - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// bazelWorkspaceRoot returns the closest directory above dir that holds a
+// Bazel workspace file, or the current directory if there's none
+func bazelWorkspaceRoot(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, name := range bazelWorkspaceFiles {
+			if _, err := os.Stat(filepath.Join(d, name)); err == nil {
+				return d
+			}
+		}
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	wd, _ := os.Getwd()
+	slog.Warn("No Bazel workspace found above the output directory, labels are relative to the current directory", "dir", dir)
+	return wd
+}
+
+// goFileImports returns the Go files in dir and the packages they import,
+// both sorted
+func goFileImports(dir string) (files, imports []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, filename := range matches {
+		f, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, filepath.Base(filename))
+		for _, imp := range f.Imports {
+			importPath, err := strconv.Unquote(imp.Path.Value)
+			if err == nil && importPath != "C" && !seen[importPath] {
+				seen[importPath] = true
+				imports = append(imports, importPath)
+			}
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(imports)
+	return files, imports, nil
+}
+
+// writeStarlarkList writes a list attribute the way buildifier formats it,
+// leaving it out when empty
+func writeStarlarkList(b *strings.Builder, name string, values []string) {
+	switch len(values) {
+	case 0:
+		return
+	case 1:
+		fmt.Fprintf(b, "    %s = [%q],\n", name, values[0])
+		return
+	}
+	fmt.Fprintf(b, "    %s = [\n", name)
+	for _, value := range values {
+		fmt.Fprintf(b, "        %q,\n", value)
+	}
+	b.WriteString("    ],\n")
+}
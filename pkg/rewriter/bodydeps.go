@@ -0,0 +1,266 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log/slog"
+	"sort"
+)
+
+// UnextractablePolicy controls what happens to a copied function or method
+// when one of its dependencies can't be extracted
+type UnextractablePolicy string
+
+const (
+	// UnextractableFail stops the run with an error naming the dependency (the default)
+	UnextractableFail UnextractablePolicy = "fail"
+	// UnextractableDrop leaves the function or method out of the output with a warning
+	UnextractableDrop UnextractablePolicy = "drop"
+)
+
+// collectFuncDecl stores a function or method and analyzes its signature and body
+func (r *RecursiveRewriter) collectFuncDecl(pkgInfo *PackageInfo, name string, decl *ast.FuncDecl, file *ast.File) error {
+	if decl.Body == nil {
+		return fmt.Errorf("function %s has no Go body (implemented in assembly or linked by name)", name)
+	}
+
+	if err := r.substituteAnnotated(pkgInfo, decl); err != nil {
+		return err
+	}
+	r.substituteTypes(pkgInfo, decl)
+	if err := r.inlineTypes(pkgInfo, decl); err != nil {
+		return err
+	}
+	info := r.collectDecl(pkgInfo, name, decl, file, decl.Doc)
+	if recvName := receiverTypeName(decl); recvName != "" {
+		r.queueType(pkgInfo.Pkg.PkgPath, recvName)
+	}
+	r.walkFieldListForDeps(pkgInfo, decl.Type.TypeParams)
+	r.walkTypeForDeps(pkgInfo, decl.Type)
+	r.walkExprForDeps(pkgInfo, info, decl.Body)
+	return nil
+}
+
+// extractMethod collects the method methodName declared on type recvName
+func (r *RecursiveRewriter) extractMethod(pkgInfo *PackageInfo, recvName, methodName string) error {
+	if site, ok := pkgInfo.lookup(recvName + "." + methodName); ok {
+		return r.collectFuncDecl(pkgInfo, recvName+"."+methodName, site.decl.(*ast.FuncDecl), site.file)
+	}
+	return &Diagnostic{
+		Code:    CodeTypeNotFound,
+		Package: pkgInfo.Pkg.PkgPath,
+		Decl:    TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: recvName + "." + methodName}.String(),
+		Err:     fmt.Errorf("method %s.%s not found in package %s", recvName, methodName, pkgInfo.Pkg.PkgPath),
+	}
+}
+
+// queueMethods queues every method declared on typeName so it can be copied
+func (r *RecursiveRewriter) queueMethods(pkgInfo *PackageInfo, typeName string) {
+	for _, methodName := range pkgInfo.methodNames(typeName) {
+		r.queueOptional(TypeRef{
+			PackagePath: pkgInfo.Pkg.PkgPath,
+			TypeName:    typeName + "." + methodName,
+		})
+	}
+}
+
+// receiverTypeName returns the name of a method's receiver base type,
+// e.g. "List" for func (l *List[T]) Len() int
+func receiverTypeName(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return ""
+	}
+	expr := decl.Recv.List[0].Type
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			expr = t.X
+		case *ast.ParenExpr:
+			expr = t.X
+		case *ast.IndexExpr:
+			expr = t.X
+		case *ast.IndexListExpr:
+			expr = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// walkExprForDeps queues every package-level declaration referenced from an
+// expression or statement tree, such as a function body or a variable's
+// initializer. Calls, composite literals, selectors, conversions, and type
+// assertions are all resolved through the type checker, so references to
+// locals and fields are ignored while method calls queue the method itself.
+// Dependencies found here are recorded on owner and are optional: if one
+// can't be extracted, owner is dropped or the run fails depending on the
+// configured UnextractablePolicy.
+func (r *RecursiveRewriter) walkExprForDeps(pkgInfo *PackageInfo, owner *DeclInfo, node ast.Node) {
+	info := pkgInfo.Pkg.TypesInfo
+	if node == nil {
+		return
+	}
+	if info == nil {
+		r.walkSyntaxForDeps(pkgInfo, owner, node)
+		return
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if ident, ok := n.X.(*ast.Ident); ok {
+				if pkgName, ok := info.Uses[ident].(*types.PkgName); ok {
+					// Qualified reference to another package (e.g., strings.ToLower)
+					pkgPath := pkgName.Imported().Path()
+					ref := TypeRef{PackagePath: pkgPath, TypeName: n.Sel.Name}
+					if pkgPath == "C" {
+						r.markUnextractable(owner, ref, "cgo reference")
+						return false
+					}
+					r.queueDep(owner, ref)
+					r.recordImport(pkgInfo, pkgPath, ident.Name)
+					return false
+				}
+			}
+
+			// Method calls and method values need the method declaration too
+			if sel := info.Selections[n]; sel != nil && sel.Kind() != types.FieldVal {
+				if fn, ok := sel.Obj().(*types.Func); ok {
+					r.queueMethodDep(owner, fn)
+				}
+			}
+
+		case *ast.Ident:
+			obj := info.Uses[n]
+			if obj == nil || obj.Pkg() != pkgInfo.Pkg.Types || obj.Parent() != pkgInfo.Pkg.Types.Scope() {
+				return true
+			}
+			r.queueDep(owner, TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: n.Name})
+		}
+		return true
+	})
+}
+
+// queueMethodDep queues the declaration of a concrete method used by owner
+func (r *RecursiveRewriter) queueMethodDep(owner *DeclInfo, fn *types.Func) {
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return
+	}
+
+	recv := sig.Recv().Type()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok || types.IsInterface(named) {
+		// Interface methods have no body to copy
+		return
+	}
+
+	obj := named.Origin().Obj()
+	if obj.Pkg() == nil || r.isStdlib(obj.Pkg().Path()) {
+		return
+	}
+	r.queueDep(owner, TypeRef{
+		PackagePath: obj.Pkg().Path(),
+		TypeName:    obj.Name() + "." + fn.Name(),
+	})
+}
+
+// queueDep records ref as a dependency of owner and queues it. Without an
+// owner the dependency is required, as for types.
+func (r *RecursiveRewriter) queueDep(owner *DeclInfo, ref TypeRef) {
+	if owner == nil {
+		r.queueType(ref.PackagePath, ref.TypeName)
+		return
+	}
+	owner.Deps = append(owner.Deps, ref)
+	r.queueOptional(ref)
+}
+
+func (r *RecursiveRewriter) markUnextractable(owner *DeclInfo, ref TypeRef, reason string) {
+	r.unextractable[ref.String()] = reason
+	if owner != nil {
+		owner.Deps = append(owner.Deps, ref)
+	}
+}
+
+// dropUnextractable removes declarations that depend, directly or through
+// other copied functions, on something that couldn't be extracted. Roots and
+// type dependencies can never be dropped, so those fail the run instead.
+func (r *RecursiveRewriter) dropUnextractable() error {
+	for key, reason := range r.unextractable {
+		if r.requiredTypes[key] {
+			return unextractableError(key, fmt.Errorf("failed to extract %s: %s", key, reason))
+		}
+	}
+
+	var pkgPaths []string
+	for pkgPath := range r.packages {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	for changed := true; changed; {
+		changed = false
+		for _, pkgPath := range pkgPaths {
+			pkgInfo := r.packages[pkgPath]
+
+			var names []string
+			for name := range pkgInfo.Decls {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				if pkgInfo.Decls[name] == nil {
+					continue
+				}
+				ref := TypeRef{PackagePath: pkgPath, TypeName: name}
+				for _, dep := range pkgInfo.Decls[name].Deps {
+					reason, bad := r.unextractable[dep.String()]
+					if !bad {
+						continue
+					}
+
+					if r.requiredTypes[ref.String()] || r.config.OnUnextractable != UnextractableDrop {
+						return unextractableError(ref.String(), fmt.Errorf("%s depends on %s, which can't be extracted: %s", ref, dep, reason))
+					}
+					// A constant group is dropped as a whole: removing some of
+					// its specs would change the iota values and implicit
+					// expressions of the rest
+					group := declGroup(pkgInfo, name)
+					for _, member := range group {
+						memberRef := TypeRef{PackagePath: pkgPath, TypeName: member}
+						if r.requiredTypes[memberRef.String()] {
+							return unextractableError(memberRef.String(), fmt.Errorf("%s shares a constant group with %s, which depends on %s, which can't be extracted: %s", memberRef, ref, dep, reason))
+						}
+					}
+					for _, member := range group {
+						memberRef := TypeRef{PackagePath: pkgPath, TypeName: member}
+						slog.Warn("Dropping declaration with unextractable dependency",
+							"code", CodeMethodUnextractable,
+							"declaration", memberRef.String(),
+							"dependency", dep.String(),
+							"reason", reason)
+						delete(pkgInfo.Decls, member)
+						r.unextractable[memberRef.String()] = fmt.Sprintf("depends on %s", dep)
+					}
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unextractableError is the diagnostic for a declaration that depends on
+// something that can't be extracted
+func unextractableError(decl string, err error) *Diagnostic {
+	return &Diagnostic{Code: CodeMethodUnextractable, Decl: decl, Err: err}
+}
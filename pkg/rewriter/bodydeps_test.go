@@ -0,0 +1,57 @@
+package rewriter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBodyDeps_MethodCalls(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/methods", TypeName: "Describe"})
+
+	expected := []string{
+		"example.com/fixture/methods.Describe",
+		"example.com/fixture/methods.Store",
+		"example.com/fixture/methods.Store.Count",
+		"example.com/fixture/other.Request",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+func TestBodyDeps_UnextractablePolicy(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.CopyMethods = true
+		r.config.OnUnextractable = UnextractableDrop
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/methods", TypeName: "Store"})
+
+		// Fast calls a body-less function and Total calls Fast, so both are dropped
+		expected := []string{
+			"example.com/fixture/methods.Store",
+			"example.com/fixture/methods.Store.Add",
+			"example.com/fixture/methods.Store.Count",
+			"example.com/fixture/methods.Store.touch",
+			"example.com/fixture/other.Request",
+		}
+		if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.CopyMethods = true
+		r.queueType("example.com/fixture/methods", "Store")
+
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the body-less dependency, got nil")
+		}
+		if !strings.Contains(err.Error(), "fastCount") {
+			t.Errorf("Expected error to name fastCount, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"log/slog"
+	"path/filepath"
+)
+
+// buildersFile is written next to types.go in packages with root types
+const buildersFile = "builders.go"
+
+// generateBuilders writes a constructor for each struct type the configs
+// asked for, and a With method for each of its exported fields, setting it
+// and returning the value, so values can be built in one expression:
+//
+//	NewApplication().WithSpec(spec).WithStatus(status)
+//
+// Names the type or package already uses are skipped, with a warning.
+func (r *RecursiveRewriter) generateBuilders(pkgInfo *PackageInfo, outputPath string) error {
+	var roots []*markedType
+	for _, mt := range r.markedTypes(pkgInfo) {
+		key := TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: mt.obj.Name()}.String()
+		if _, queued := r.parents[key]; queued || !r.requiredTypes[key] {
+			continue
+		}
+		if _, ok := mt.spec.Type.(*ast.StructType); ok {
+			roots = append(roots, mt)
+		}
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	aliases := make(map[string]bool) // import aliases the field types use
+	for _, mt := range roots {
+		if constructor := "New" + mt.name; pkgInfo.Decls[constructor] != nil {
+			slog.Warn("Skipping constructor: the package already declares it", "package", pkgInfo.Pkg.PkgPath, "name", constructor)
+		} else {
+			fmt.Fprintf(&body, "\n// %s returns an empty %s, to fill in with its With methods\n", constructor, mt.name)
+			fmt.Fprintf(&body, "func %s() *%s {\n\treturn &%s{}\n}\n", constructor, mt.name, mt.name)
+		}
+
+		taken := make(map[string]bool)
+		for _, f := range mt.fields {
+			taken[f.goName] = true
+		}
+		for _, f := range mt.fields {
+			method := "With" + f.goName
+			if taken[method] || pkgInfo.Decls[mt.obj.Name()+"."+method] != nil {
+				slog.Warn("Skipping builder method: the type already has a field or method by its name", "type", mt.name, "method", method)
+				continue
+			}
+			var typ bytes.Buffer
+			if err := format.Node(&typ, r.fset, f.field.Type); err != nil {
+				return err
+			}
+			ast.Inspect(f.field.Type, func(n ast.Node) bool {
+				if sel, ok := n.(*ast.SelectorExpr); ok {
+					if ident, ok := sel.X.(*ast.Ident); ok {
+						aliases[ident.Name] = true
+					}
+				}
+				return true
+			})
+			fmt.Fprintf(&body, "\n// %s sets %s and returns in, for chaining\n", method, f.goName)
+			fmt.Fprintf(&body, "func (in *%s) %s(value %s) *%s {\n\tin.%s = value\n\treturn in\n}\n", mt.name, method, typ.String(), mt.name, f.goName)
+		}
+	}
+
+	// Field types are written as in types.go, so they need the same imports
+	used := make(map[string]map[string]bool)
+	for importPath, importAliases := range pkgInfo.Imports {
+		for alias := range importAliases {
+			if aliases[alias] {
+				if used[importPath] == nil {
+					used[importPath] = make(map[string]bool)
+				}
+				used[importPath][alias] = true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	r.writeMarkerFileHeader(&buf, pkgInfo, nil)
+	if imports := r.importDecl(&PackageInfo{Imports: used}); imports != "" {
+		buf.WriteString("\n" + imports)
+	}
+	buf.Write(body.Bytes())
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format builders for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+	outputFile := filepath.Join(outputPath, buildersFile)
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "types", len(roots))
+	return nil
+}
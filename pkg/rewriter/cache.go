@@ -0,0 +1,110 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// PackageCache keeps loaded packages across the runs that share it, such as
+// the requests of a long-running server or the jobs of RunJobs, so they
+// aren't loaded again. Only packages that are consulted (substitutes,
+// packages kept external or provided by a shim, and those imported for their
+// side effects) are cached, until one of their files changes: nothing
+// modifies them, so concurrent runs can share them. Extraction rewrites the
+// syntax trees of the packages it extracts from, so every run loads its own.
+// The cache and its FileSet are safe for concurrent use.
+type PackageCache struct {
+	mu      sync.Mutex
+	fset    *token.FileSet
+	entries map[string]*cachedPackage
+}
+
+type cachedPackage struct {
+	pkg      *packages.Package
+	modTimes map[string]time.Time // of the package's files when it was loaded
+}
+
+// NewPackageCache creates an empty package cache
+func NewPackageCache() *PackageCache {
+	return &PackageCache{
+		fset:    token.NewFileSet(),
+		entries: make(map[string]*cachedPackage),
+	}
+}
+
+// get returns the cached package for key, unless its files changed since it
+// was loaded
+func (c *PackageCache) get(key string) *packages.Package {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	for filename, modTime := range entry.modTimes {
+		if info, err := os.Stat(filename); err != nil || !info.ModTime().Equal(modTime) {
+			delete(c.entries, key)
+			return nil
+		}
+	}
+	return entry.pkg
+}
+
+func (c *PackageCache) put(key string, pkg *packages.Package) {
+	modTimes := make(map[string]time.Time)
+	// Packages loaded in consultMode only have their GoFiles
+	for _, filename := range append(pkg.GoFiles, pkg.CompiledGoFiles...) {
+		if info, err := os.Stat(filename); err == nil {
+			modTimes[filename] = info.ModTime()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &cachedPackage{pkg: pkg, modTimes: modTimes}
+}
+
+// cacheKey identifies a package load: the same path can resolve differently
+// from another directory, or with other flags or environment
+func (r *RecursiveRewriter) cacheKey(pkgPath string, mode packages.LoadMode) string {
+	return fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s", r.config.Dir, mode, strings.Join(r.buildFlags, " "), strings.Join(r.config.GoEnv, "\x00"), pkgPath)
+}
+
+// loadPackage loads a single package in the given mode, from the cache if
+// there is one
+func (r *RecursiveRewriter) loadPackage(pkgPath string, mode packages.LoadMode) (*packages.Package, error) {
+	cache := r.config.Cache
+	if mode&packages.NeedSyntax != 0 {
+		// Syntax trees are modified by extraction, and by explore
+		cache = nil
+	}
+	if cache != nil {
+		if pkg := cache.get(r.cacheKey(pkgPath, mode)); pkg != nil {
+			return pkg, nil
+		}
+	}
+
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       mode,
+		Fset:       r.fset,
+		Dir:        r.config.Dir,
+		BuildFlags: r.buildFlags,
+		Env:        r.goEnviron(),
+	}, pkgPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("package not found: %s", pkgPath)
+	}
+
+	if cache != nil && len(pkgs[0].Errors) == 0 {
+		cache.put(r.cacheKey(pkgPath, mode), pkgs[0])
+	}
+	return pkgs[0], nil
+}
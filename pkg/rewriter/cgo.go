@@ -0,0 +1,87 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// CgoPolicy controls what happens when the closure reaches a package that
+// requires cgo, which can't be copied into a generated pure Go module
+type CgoPolicy string
+
+const (
+	// CgoFail stops the run with an error naming the dependency path (the default)
+	CgoFail CgoPolicy = "fail"
+	// CgoStop stops recursion at the package and keeps it as a real dependency
+	// of the generated module
+	CgoStop CgoPolicy = "stop"
+)
+
+// usesCgo reports whether any of the package's source files import "C".
+// The syntax trees can't be used for this since cgo files are replaced by
+// their preprocessed output, so the original files' imports are parsed.
+func usesCgo(pkg *packages.Package) bool {
+	fset := token.NewFileSet()
+	for _, filename := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, imp := range file.Imports {
+			if path, err := strconv.Unquote(imp.Path.Value); err == nil && path == "C" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleCgoPackage applies the cgo policy to a type reached in a cgo package
+func (r *RecursiveRewriter) handleCgoPackage(typeRef TypeRef, pkgInfo *PackageInfo) error {
+	path := r.dependencyPath(typeRef)
+
+	if r.config.Cgo != CgoStop {
+		return fmt.Errorf("package %s requires cgo and can't be extracted (reached via %s); substitute the types that reference it or set cgo: stop to keep it as a real dependency",
+			typeRef.PackagePath, path)
+	}
+
+	if pkgInfo.Pkg.Module == nil || pkgInfo.Pkg.Module.Version == "" {
+		return fmt.Errorf("package %s requires cgo and its module version is unknown, so it can't be kept as a dependency (reached via %s)",
+			typeRef.PackagePath, path)
+	}
+
+	slog.Warn("Package requires cgo, keeping it as a real dependency instead of extracting it",
+		"package", typeRef.PackagePath,
+		"module", pkgInfo.Pkg.Module.Path+"@"+pkgInfo.Pkg.Module.Version,
+		"reachedVia", path,
+		"hint", "substitute the types that reference it to drop the dependency")
+	r.external[typeRef.PackagePath] = pkgInfo.Pkg.Module
+	return nil
+}
+
+// dependencyPath describes how typeRef was reached from a root, e.g.
+// "a.Root -> a.Child -> b.Leaf"
+func (r *RecursiveRewriter) dependencyPath(typeRef TypeRef) string {
+	chain := []string{typeRef.String()}
+	seen := map[string]bool{typeRef.String(): true}
+	for {
+		parent, ok := r.parents[typeRef.String()]
+		if !ok || seen[parent.String()] {
+			break
+		}
+		seen[parent.String()] = true
+		chain = append(chain, parent.String())
+		typeRef = parent
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return strings.Join(chain, " -> ")
+}
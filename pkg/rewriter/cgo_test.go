@@ -0,0 +1,57 @@
+package rewriter
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCgoPolicy(t *testing.T) {
+	if !build.Default.CgoEnabled {
+		t.Skip("cgo is disabled")
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.queueType("example.com/fixture/cgouser", "Wrapper")
+
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the cgo dependency, got nil")
+		}
+		if want := "example.com/fixture/cgouser.Wrapper -> example.com/cgomod.Handle"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain dependency path %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.Cgo = CgoStop
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/cgouser", TypeName: "Wrapper"})
+
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+
+		types, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/cgouser", "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(types), `"example.com/cgomod"`) {
+			t.Errorf("Expected the cgo package to stay imported:\n%s", types)
+		}
+
+		goMod, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(goMod), "example.com/cgomod v0.0.0") {
+			t.Errorf("Expected go.mod to require the cgo module:\n%s", goMod)
+		}
+		if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/cgomod")); !os.IsNotExist(err) {
+			t.Errorf("Expected no output for the cgo module, got err=%v", err)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// prepareCollapse picks the generated modules merged into their importer by
+// CollapseModules, and renames their types that would collide there. It
+// returns the packages merged into each importer, following chains of
+// collapsed modules to the package that remains. It runs before
+// applyRenames, so the renames reach every reference.
+func (r *RecursiveRewriter) prepareCollapse() map[string][]string {
+	if r.config.CollapseModules <= 0 && !r.config.MinimizeModules {
+		return nil
+	}
+
+	var modulePaths []string
+	for modulePath := range r.modules {
+		modulePaths = append(modulePaths, modulePath)
+	}
+	sort.Strings(modulePaths)
+
+	into := make(map[string]string) // collapsed package to its importer
+	for _, modulePath := range modulePaths {
+		pkgPath, importer, ok := r.collapsible(r.modules[modulePath])
+		if ok && (r.config.MinimizeModules || countTypes(r.packages[pkgPath]) < r.config.CollapseModules) {
+			into[pkgPath] = importer
+		}
+	}
+
+	groups := make(map[string][]string)
+	for pkgPath := range into {
+		target := into[pkgPath]
+		for into[target] != "" {
+			target = into[target]
+		}
+		groups[target] = append(groups[target], pkgPath)
+	}
+	for target, members := range groups {
+		sort.Strings(members)
+		if alias, paths := r.aliasConflict(append([]string{target}, members...)); alias != "" {
+			slog.Info("Not collapsing modules: their imports would conflict", "into", target, "packages", members, "alias", alias, "conflictingPackages", paths)
+			delete(groups, target)
+			continue
+		}
+		if err := r.renameCollisions(append([]string{target}, members...), target, r.config.CollisionPolicy); err != nil {
+			slog.Info("Not collapsing modules", "into", target, "packages", members, "reason", err)
+			delete(groups, target)
+		}
+	}
+	return groups
+}
+
+// collapsible reports whether a generated module can be merged into the
+// package importing it, whatever its size: it has a single generated
+// package, with none of the types the configs asked for, and exactly one
+// other generated package imports it
+func (r *RecursiveRewriter) collapsible(moduleInfo *ModuleInfo) (string, string, bool) {
+	pkgInfo := r.modulePackage(moduleInfo)
+	if pkgInfo == nil || pkgInfo.WholePackage || r.hasRoots(pkgInfo) {
+		return "", "", false
+	}
+	pkgPath := pkgInfo.Pkg.PkgPath
+
+	var importers []string
+	for path, other := range r.packages {
+		if path == pkgPath || !other.hasOutput() {
+			continue
+		}
+		if other.Verbatim && other.Pkg.Imports[pkgPath] != nil || other.Imports[pkgPath] != nil {
+			importers = append(importers, path)
+		}
+	}
+	if len(importers) != 1 || r.packages[importers[0]].Verbatim {
+		return "", "", false
+	}
+	return pkgPath, importers[0], true
+}
+
+// modulePackage returns the single package generated in a module, unless it
+// has several or its package is copied verbatim
+func (r *RecursiveRewriter) modulePackage(moduleInfo *ModuleInfo) *PackageInfo {
+	if r.isStdlib(moduleInfo.Path) {
+		return nil
+	}
+	var found *PackageInfo
+	for _, pkgPath := range moduleInfo.Packages {
+		if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() {
+			if found != nil {
+				return nil
+			}
+			found = pkgInfo
+		}
+	}
+	if found == nil || found.Verbatim || found.Pkg.TypesInfo == nil {
+		return nil
+	}
+	return found
+}
+
+// hasRoots reports whether a package declares any of the types the configs
+// asked for, which consumers import from it
+func (r *RecursiveRewriter) hasRoots(pkgInfo *PackageInfo) bool {
+	for name := range pkgInfo.Decls {
+		key := TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: name}.String()
+		if _, queued := r.parents[key]; !queued && r.requiredTypes[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// countTypes counts the types a package declares in generated code
+func countTypes(pkgInfo *PackageInfo) int {
+	count := 0
+	for _, declInfo := range pkgInfo.Decls {
+		if genDecl, ok := declInfo.Decl.(*ast.GenDecl); ok && genDecl.Tok == token.TYPE {
+			count++
+		}
+	}
+	return count
+}
+
+// aliasConflict returns an alias the packages import different packages
+// under, other than each other, and those packages, if any
+func (r *RecursiveRewriter) aliasConflict(pkgPaths []string) (string, []string) {
+	merged := make(map[string]bool)
+	for _, pkgPath := range pkgPaths {
+		merged[pkgPath] = true
+	}
+	byAlias := make(map[string]string)
+	for _, pkgPath := range pkgPaths {
+		for importPath, aliases := range r.packages[pkgPath].Imports {
+			if merged[importPath] {
+				continue
+			}
+			for alias := range aliases {
+				if other, exists := byAlias[alias]; exists && other != importPath && alias != "_" {
+					return alias, []string{other, importPath}
+				}
+				byAlias[alias] = importPath
+			}
+		}
+	}
+	return "", nil
+}
+
+// collapseModules moves the declarations of collapsed packages into the
+// package they're merged into, unqualifying the references between them,
+// and leaves the collapsed packages, and so their modules, without output
+func (r *RecursiveRewriter) collapseModules(groups map[string][]string) {
+	var targets []string
+	for target := range groups {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		members := groups[target]
+		merged := make(map[string]bool)
+		for _, pkgPath := range members {
+			merged[pkgPath] = true
+		}
+		targetInfo := r.packages[target]
+		for _, pkgPath := range append([]string{target}, members...) {
+			r.unqualify(r.packages[pkgPath], merged)
+		}
+
+		for _, pkgPath := range members {
+			pkgInfo := r.packages[pkgPath]
+			for name, declInfo := range pkgInfo.Decls {
+				// Methods are keyed by their receiver, which may be renamed
+				key := r.renamedType(pkgPath, name)
+				if recv, method, ok := strings.Cut(name, "."); ok {
+					key = r.renamedType(pkgPath, recv) + "." + method
+				}
+				targetInfo.Decls[key] = declInfo
+			}
+			for importPath, aliases := range pkgInfo.Imports {
+				for alias := range aliases {
+					if !merged[importPath] {
+						r.recordImport(targetInfo, importPath, alias)
+					}
+				}
+			}
+			delete(targetInfo.Imports, pkgPath)
+			pkgInfo.Decls = make(map[string]*DeclInfo)
+			pkgInfo.Imports = make(map[string]map[string]bool)
+			slog.Info("Collapsed module", "module", pkgInfo.ModulePath, "into", target)
+		}
+	}
+}
+
+// unqualify replaces references in a package's declarations to the types of
+// the merged packages with their bare names
+func (r *RecursiveRewriter) unqualify(pkgInfo *PackageInfo, merged map[string]bool) {
+	for _, declInfo := range pkgInfo.Decls {
+		astutil.Apply(declInfo.Decl, func(c *astutil.Cursor) bool {
+			sel, ok := c.Node().(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if merged[selectorImportPath(pkgInfo, sel)] {
+				c.Replace(sel.Sel)
+				return false
+			}
+			return true
+		}, nil)
+	}
+}
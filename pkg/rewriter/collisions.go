@@ -0,0 +1,227 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CollisionPolicy picks the new names of declarations whose names collide
+// when the declarations of several packages are merged into one
+type CollisionPolicy string
+
+const (
+	// CollisionSuffixShortest appends the fewest trailing elements of the
+	// package path that tell the colliding names apart, so ObjectMeta from
+	// k8s.io/apimachinery/pkg/apis/meta/v1 becomes ObjectMetaV1, or
+	// ObjectMetaMetaV1 next to another package ending in v1 (the default)
+	CollisionSuffixShortest CollisionPolicy = "shortest"
+	// CollisionSuffixPath appends the whole package path, which keeps names
+	// stable as other colliding packages come and go:
+	// ObjectMetaK8sIoApimachineryPkgApisMetaV1
+	CollisionSuffixPath CollisionPolicy = "path"
+	// CollisionSuffixNumber keeps the name in the package sorting first and
+	// numbers the others in path order: ObjectMeta, ObjectMeta2, ...
+	CollisionSuffixNumber CollisionPolicy = "number"
+)
+
+// ResolveCollisions returns new names for the declarations among decls whose
+// names collide once they share a package, keyed by declaration. The
+// declarations of primary, the package the others are merged into, keep
+// their names; pass "" if there's none. Every other colliding declaration is
+// renamed by the policy, to a name that isn't declared or assigned anywhere
+// else in decls, falling back to a number when the path doesn't tell names
+// apart. The result depends only on the set of declarations, not their
+// order.
+func ResolveCollisions(decls []TypeRef, policy CollisionPolicy, primary string) (map[TypeRef]string, error) {
+	switch policy {
+	case "":
+		policy = CollisionSuffixShortest
+	case CollisionSuffixShortest, CollisionSuffixPath, CollisionSuffixNumber:
+	default:
+		return nil, fmt.Errorf("unknown collision policy %q (use: %s, %s, %s)", policy, CollisionSuffixShortest, CollisionSuffixPath, CollisionSuffixNumber)
+	}
+
+	byName := make(map[string][]string) // name to the paths of the packages declaring it
+	taken := make(map[string]bool)
+	for _, decl := range decls {
+		if !slices.Contains(byName[decl.TypeName], decl.PackagePath) {
+			byName[decl.TypeName] = append(byName[decl.TypeName], decl.PackagePath)
+		}
+		taken[decl.TypeName] = true
+	}
+	names := make([]string, 0, len(byName))
+	for name, pkgPaths := range byName {
+		if len(pkgPaths) > 1 {
+			names = append(names, name)
+			sort.Strings(pkgPaths)
+		}
+	}
+	sort.Strings(names)
+
+	renames := make(map[TypeRef]string)
+	for _, name := range names {
+		var renamed []string // paths of the packages whose declaration is renamed
+		for _, pkgPath := range byName[name] {
+			if pkgPath != primary {
+				renamed = append(renamed, pkgPath)
+			}
+		}
+		if policy == CollisionSuffixNumber && !slices.Contains(byName[name], primary) {
+			renamed = renamed[1:]
+		}
+
+		var candidates map[string]string
+		switch policy {
+		case CollisionSuffixShortest:
+			candidates = shortestSuffixes(name, renamed, taken)
+		case CollisionSuffixPath:
+			candidates = make(map[string]string)
+			for _, pkgPath := range renamed {
+				candidates[pkgPath] = name + pathSuffix(pkgPath, -1)
+			}
+		case CollisionSuffixNumber:
+			candidates = make(map[string]string)
+		}
+
+		for _, pkgPath := range renamed {
+			newName := candidates[pkgPath]
+			if newName == "" || taken[newName] {
+				newName = numberedName(name, taken)
+			}
+			taken[newName] = true
+			renames[TypeRef{PackagePath: pkgPath, TypeName: name}] = newName
+		}
+	}
+	return renames, nil
+}
+
+// shortestSuffixes suffixes name with the fewest trailing path elements of
+// each package that make the names distinct from each other and from taken.
+// Packages no suffix tells apart are left out.
+func shortestSuffixes(name string, pkgPaths []string, taken map[string]bool) map[string]string {
+	depth := make(map[string]int)
+	for _, pkgPath := range pkgPaths {
+		depth[pkgPath] = 1
+	}
+	for {
+		candidates := make(map[string]string)
+		count := make(map[string]int)
+		for _, pkgPath := range pkgPaths {
+			candidate := name + pathSuffix(pkgPath, depth[pkgPath])
+			candidates[pkgPath] = candidate
+			count[candidate]++
+		}
+
+		grew := false
+		for _, pkgPath := range pkgPaths {
+			candidate := candidates[pkgPath]
+			if count[candidate] == 1 && !taken[candidate] {
+				continue
+			}
+			if depth[pkgPath] < len(strings.Split(pkgPath, "/")) {
+				depth[pkgPath]++
+				grew = true
+			} else {
+				delete(candidates, pkgPath)
+			}
+		}
+		if !grew {
+			// Drop what still collides, so it's numbered instead
+			for pkgPath, candidate := range candidates {
+				if count[candidate] > 1 || taken[candidate] {
+					delete(candidates, pkgPath)
+				}
+			}
+			return candidates
+		}
+	}
+}
+
+// pathSuffix turns the last n elements of a package path (all of them if n
+// < 0) into an identifier suffix, capitalizing each word: "meta/v1" becomes
+// "MetaV1" and "k8s.io/api-server" "K8sIoApiServer"
+func pathSuffix(pkgPath string, n int) string {
+	elems := strings.Split(pkgPath, "/")
+	if n >= 0 && n < len(elems) {
+		elems = elems[len(elems)-n:]
+	}
+	var b strings.Builder
+	for _, elem := range elems {
+		words := strings.FieldsFunc(elem, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			first, size := utf8.DecodeRuneInString(word)
+			b.WriteRune(unicode.ToUpper(first))
+			b.WriteString(word[size:])
+		}
+	}
+	return b.String()
+}
+
+// numberedName returns name followed by the lowest number from 2 up that
+// isn't taken
+func numberedName(name string, taken map[string]bool) string {
+	for i := 2; ; i++ {
+		if candidate := name + strconv.Itoa(i); !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// renameCollisions renames the extracted types of pkgPaths whose names
+// collide, as they would once the packages are merged into primary. The new
+// names are recorded as renames, so applyRenames updates every reference to
+// them. Types the config renames are compared by their configured name.
+func (r *RecursiveRewriter) renameCollisions(pkgPaths []string, primary string, policy CollisionPolicy) error {
+	var decls []TypeRef
+	original := make(map[TypeRef]string) // name in generated code to the declared one
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+		if pkgInfo == nil {
+			continue
+		}
+		for name := range pkgInfo.Decls {
+			// Methods are keyed by their receiver
+			if strings.Contains(name, ".") {
+				continue
+			}
+			ref := TypeRef{PackagePath: pkgPath, TypeName: r.renamedType(pkgPath, name)}
+			decls = append(decls, ref)
+			original[ref] = name
+		}
+	}
+
+	renames, err := ResolveCollisions(decls, policy, primary)
+	if err != nil {
+		return err
+	}
+	refs := make([]TypeRef, 0, len(renames))
+	for ref := range renames {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	// Check every rename before recording any, so nothing is renamed on error
+	for _, ref := range refs {
+		name := original[ref]
+		genDecl, ok := r.packages[ref.PackagePath].Decls[name].Decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			return fmt.Errorf("%s.%s collides with a declaration of another package, and only types can be renamed", ref.PackagePath, name)
+		}
+	}
+	for _, ref := range refs {
+		name := original[ref]
+		key := TypeRef{PackagePath: ref.PackagePath, TypeName: name}.String()
+		opts := r.typeOptions[key]
+		opts.Rename = renames[ref]
+		r.typeOptions[key] = opts
+	}
+	return nil
+}
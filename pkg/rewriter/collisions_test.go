@@ -0,0 +1,243 @@
+package rewriter
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveCollisions(t *testing.T) {
+	const (
+		metaV1 = "k8s.io/apimachinery/pkg/apis/meta/v1"
+		coreV1 = "k8s.io/api/core/v1"
+		appsV1 = "k8s.io/api/apps/v1"
+		argo   = "github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1"
+	)
+
+	tests := []struct {
+		name    string
+		decls   []TypeRef
+		policy  CollisionPolicy
+		primary string
+		want    map[TypeRef]string
+		wantErr string
+	}{
+		{
+			name: "no collisions",
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "ObjectMeta"},
+				{PackagePath: coreV1, TypeName: "Pod"},
+			},
+			want: map[TypeRef]string{},
+		},
+		{
+			name: "the same declaration listed twice doesn't collide",
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "ObjectMeta"},
+				{PackagePath: metaV1, TypeName: "ObjectMeta"},
+			},
+			want: map[TypeRef]string{},
+		},
+		{
+			name: "last path element tells names apart",
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: argo, TypeName: "Status"},
+			},
+			want: map[TypeRef]string{
+				{PackagePath: metaV1, TypeName: "Status"}: "StatusV1",
+				{PackagePath: argo, TypeName: "Status"}:   "StatusV1alpha1",
+			},
+		},
+		{
+			name: "more path elements where the last one is shared",
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: coreV1, TypeName: "Status"},
+				{PackagePath: argo, TypeName: "Status"},
+			},
+			want: map[TypeRef]string{
+				{PackagePath: metaV1, TypeName: "Status"}: "StatusMetaV1",
+				{PackagePath: coreV1, TypeName: "Status"}: "StatusCoreV1",
+				{PackagePath: argo, TypeName: "Status"}:   "StatusV1alpha1",
+			},
+		},
+		{
+			name: "the primary package keeps its names",
+			decls: []TypeRef{
+				{PackagePath: argo, TypeName: "Status"},
+				{PackagePath: metaV1, TypeName: "Status"},
+			},
+			primary: argo,
+			want: map[TypeRef]string{
+				{PackagePath: metaV1, TypeName: "Status"}: "StatusV1",
+			},
+		},
+		{
+			name: "suffixes skip names declared elsewhere",
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: coreV1, TypeName: "StatusV1"},
+				{PackagePath: argo, TypeName: "Status"},
+			},
+			primary: argo,
+			want: map[TypeRef]string{
+				{PackagePath: metaV1, TypeName: "Status"}: "StatusMetaV1",
+			},
+		},
+		{
+			name: "suffixes skip names assigned to earlier collisions",
+			decls: []TypeRef{
+				{PackagePath: "example.com/a/x", TypeName: "T"},
+				{PackagePath: "example.com/b/x", TypeName: "T"},
+				{PackagePath: "example.com/a/x", TypeName: "TX"},
+				{PackagePath: "example.com/c/y", TypeName: "TX"},
+			},
+			primary: "example.com/b/x",
+			want: map[TypeRef]string{
+				{PackagePath: "example.com/a/x", TypeName: "T"}:  "TAX",
+				{PackagePath: "example.com/a/x", TypeName: "TX"}: "TXX",
+				{PackagePath: "example.com/c/y", TypeName: "TX"}: "TXY",
+			},
+		},
+		{
+			name: "paths are turned into identifiers",
+			decls: []TypeRef{
+				{PackagePath: "example.com/api-server/v2", TypeName: "Config"},
+				{PackagePath: "example.com/api_client/v2", TypeName: "Config"},
+			},
+			want: map[TypeRef]string{
+				{PackagePath: "example.com/api-server/v2", TypeName: "Config"}: "ConfigApiServerV2",
+				{PackagePath: "example.com/api_client/v2", TypeName: "Config"}: "ConfigApiClientV2",
+			},
+		},
+		{
+			name: "paths no suffix tells apart are numbered",
+			decls: []TypeRef{
+				{PackagePath: "example.com/a-b", TypeName: "T"},
+				{PackagePath: "example.com/a_b", TypeName: "T"},
+				{PackagePath: "example.com/primary", TypeName: "T"},
+			},
+			primary: "example.com/primary",
+			want: map[TypeRef]string{
+				{PackagePath: "example.com/a-b", TypeName: "T"}: "T2",
+				{PackagePath: "example.com/a_b", TypeName: "T"}: "T3",
+			},
+		},
+		{
+			name:   "whole path",
+			policy: CollisionSuffixPath,
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: argo, TypeName: "Status"},
+			},
+			primary: argo,
+			want: map[TypeRef]string{
+				{PackagePath: metaV1, TypeName: "Status"}: "StatusK8sIoApimachineryPkgApisMetaV1",
+			},
+		},
+		{
+			name:   "numbers without a primary package",
+			policy: CollisionSuffixNumber,
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: coreV1, TypeName: "Status"},
+				{PackagePath: argo, TypeName: "Status"},
+			},
+			want: map[TypeRef]string{
+				{PackagePath: coreV1, TypeName: "Status"}: "Status2",
+				{PackagePath: metaV1, TypeName: "Status"}: "Status3",
+			},
+		},
+		{
+			name:   "numbers after the primary package",
+			policy: CollisionSuffixNumber,
+			decls: []TypeRef{
+				{PackagePath: metaV1, TypeName: "Status"},
+				{PackagePath: coreV1, TypeName: "Status"},
+				{PackagePath: argo, TypeName: "Status"},
+				{PackagePath: appsV1, TypeName: "Status2"},
+			},
+			primary: metaV1,
+			want: map[TypeRef]string{
+				{PackagePath: argo, TypeName: "Status"}:   "Status3",
+				{PackagePath: coreV1, TypeName: "Status"}: "Status4",
+			},
+		},
+		{
+			name:    "unknown policy",
+			policy:  "random",
+			wantErr: `unknown collision policy "random"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveCollisions(tt.decls, tt.policy, tt.primary)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveCollisions failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+
+			// The order of the declarations doesn't matter
+			shuffled := append([]TypeRef(nil), tt.decls...)
+			for i := 0; i < 10; i++ {
+				rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+				if again, _ := ResolveCollisions(shuffled, tt.policy, tt.primary); !reflect.DeepEqual(again, got) {
+					t.Fatalf("Expected %v for %v, got %v", got, shuffled, again)
+				}
+			}
+
+			// No two declarations end up with the same name
+			final := make(map[string]TypeRef)
+			for _, decl := range tt.decls {
+				name := decl.TypeName
+				if newName, ok := got[decl]; ok {
+					name = newName
+				}
+				if other, ok := final[name]; ok && other != decl {
+					t.Errorf("%s and %s are both named %s", other, decl, name)
+				}
+				final[name] = decl
+			}
+		})
+	}
+}
+
+func TestRenameCollisions(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"},
+		TypeRef{PackagePath: "example.com/fixture/phases", TypeName: "Status"},
+	)
+	if err := r.renameCollisions([]string{"example.com/fixture/crd", "example.com/fixture/phases"}, "example.com/fixture/crd", CollisionSuffixShortest); err != nil {
+		t.Fatalf("renameCollisions failed: %v", err)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	files := readTree(t, r.config.OutputDir)
+	phases := files[filepath.Join("example.com", "fixture", "phases", "types.go")]
+	for _, want := range []string{"type PhasePhases kinds.Kind", "type StatusPhases struct", "Phase PhasePhases"} {
+		if !strings.Contains(phases, want) {
+			t.Errorf("Expected phases to contain %q, got:\n%s", want, phases)
+		}
+	}
+	crd := files[filepath.Join("example.com", "fixture", "crd", "types.go")]
+	for _, want := range []string{"type Phase string", "type Status struct", "Status *Status"} {
+		if !strings.Contains(crd, want) {
+			t.Errorf("Expected crd to keep %q, got:\n%s", want, crd)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"go/version"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// defaultGoVersion is the go directive written to generated go.mod files
+// when no target version is configured and the source module has none
+const defaultGoVersion = "1.21"
+
+// normalizeGoVersion accepts "1.17" or "go1.17" and returns "go1.17", or ""
+// if the version isn't valid
+func normalizeGoVersion(v string) string {
+	if !strings.HasPrefix(v, "go") {
+		v = "go" + v
+	}
+	if !version.IsValid(v) {
+		return ""
+	}
+	return v
+}
+
+// goDirectives returns the go and toolchain directives of a generated
+// go.mod. A configured target version replaces the source module's
+// directives, and a configured toolchain replaces its toolchain. The
+// toolchain is left out when it's implied by the go version.
+func (r *RecursiveRewriter) goDirectives(moduleInfo *ModuleInfo) (goVersion, toolchain string) {
+	switch {
+	case r.config.GoVersion != "":
+		goVersion = strings.TrimPrefix(normalizeGoVersion(r.config.GoVersion), "go")
+	case moduleInfo.GoVersion != "":
+		goVersion, toolchain = moduleInfo.GoVersion, moduleInfo.Toolchain
+	default:
+		goVersion = defaultGoVersion
+	}
+	if r.config.Toolchain != "" {
+		toolchain = normalizeGoVersion(r.config.Toolchain)
+	}
+	if toolchain != "" && version.Compare(toolchain, "go"+goVersion) <= 0 {
+		toolchain = ""
+	}
+	return goVersion, toolchain
+}
+
+// sourceGoDirectives reads the go and toolchain directives of a source
+// module's go.mod, if it has one
+func sourceGoDirectives(mod *packages.Module) (goVersion, toolchain string) {
+	if mod == nil {
+		return "", ""
+	}
+	goVersion = mod.GoVersion
+	if mod.GoMod == "" {
+		return goVersion, ""
+	}
+	content, err := os.ReadFile(mod.GoMod)
+	if err != nil {
+		return goVersion, ""
+	}
+	file, err := modfile.Parse(mod.GoMod, content, nil)
+	if err != nil {
+		return goVersion, ""
+	}
+	if file.Go != nil {
+		goVersion = file.Go.Version
+	}
+	if file.Toolchain != nil {
+		toolchain = file.Toolchain.Name
+	}
+	return goVersion, toolchain
+}
+
+// applyGoVersion makes every collected declaration compatible with the
+// configured target Go version. Constructs with an older equivalent are
+// rewritten (any becomes interface{}); anything else newer than the target
+// fails the run, naming the declaration and the version it requires.
+func (r *RecursiveRewriter) applyGoVersion() error {
+	if r.config.GoVersion == "" {
+		return nil
+	}
+	target := normalizeGoVersion(r.config.GoVersion)
+	if target == "" {
+		return fmt.Errorf("invalid target Go version %q", r.config.GoVersion)
+	}
+
+	var pkgPaths []string
+	for pkgPath := range r.packages {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+
+		var names []string
+		for name := range pkgInfo.Decls {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			info := pkgInfo.Decls[name]
+			decl, err := rewriteForGoVersion(pkgInfo.Pkg.TypesInfo, info.Decl, target)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", pkgPath, name, err)
+			}
+			info.Decl = decl
+		}
+	}
+	return nil
+}
+
+// rewriteForGoVersion returns decl adjusted for the target version, or an
+// error describing the first construct that the target doesn't support
+func rewriteForGoVersion(info *types.Info, decl ast.Decl, target string) (ast.Decl, error) {
+	var unsupported error
+	require := func(feature, minVersion string) bool {
+		if version.Compare(target, minVersion) >= 0 {
+			return true
+		}
+		if unsupported == nil {
+			unsupported = fmt.Errorf("uses %s, which requires %s (target is %s)", feature, minVersion, target)
+		}
+		return false
+	}
+
+	result := astutil.Apply(decl, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.TypeSpec:
+			if n.TypeParams != nil {
+				if n.Assign.IsValid() {
+					require("generic type aliases", "go1.24")
+				} else {
+					require("generics", "go1.18")
+				}
+			}
+
+		case *ast.FuncType:
+			if n.TypeParams != nil {
+				require("generics", "go1.18")
+			}
+
+		case *ast.Ident:
+			if info == nil {
+				break
+			}
+			if _, ok := info.Instances[n]; ok {
+				require("generics", "go1.18")
+			}
+			obj := info.Uses[n]
+			if obj == nil || obj.Pkg() != nil {
+				break
+			}
+			// Predeclared identifiers are compared by name since the
+			// universe may hold more than one object for "any"
+			switch obj.Name() {
+			case "any":
+				if version.Compare(target, "go1.18") < 0 {
+					// Keep the original position so the printer lays it out on one line
+					c.Replace(&ast.InterfaceType{
+						Interface: n.Pos(),
+						Methods:   &ast.FieldList{Opening: n.Pos(), Closing: n.Pos()},
+					})
+				}
+			case "comparable":
+				require("generics", "go1.18")
+			case "min", "max", "clear":
+				if _, ok := obj.(*types.Builtin); ok {
+					require("the "+n.Name+" builtin", "go1.21")
+				}
+			}
+
+		case *ast.RangeStmt:
+			if info == nil {
+				break
+			}
+			switch t := info.TypeOf(n.X).(type) {
+			case *types.Basic:
+				if t.Info()&types.IsInteger != 0 {
+					require("range over integers", "go1.22")
+				}
+			case *types.Signature:
+				require("range over functions", "go1.23")
+			}
+
+		case *ast.BasicLit:
+			if n.Kind == token.INT || n.Kind == token.FLOAT || n.Kind == token.IMAG {
+				lit := strings.ToLower(n.Value)
+				if strings.Contains(lit, "_") || strings.HasPrefix(lit, "0b") || strings.HasPrefix(lit, "0o") {
+					require("binary, octal 0o, or underscore-separated number literals", "go1.13")
+				}
+			}
+		}
+		return true
+	}, nil)
+
+	if unsupported != nil {
+		return nil, unsupported
+	}
+	return result.(ast.Decl), nil
+}
@@ -0,0 +1,128 @@
+package rewriter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyGoVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		root      string
+		goVersion string
+		wantErr   string
+		wantTypes string
+	}{
+		{
+			name:      "any is rewritten for go1.17",
+			root:      "Bag",
+			goVersion: "1.17",
+			wantTypes: "Items []interface{}",
+		},
+		{
+			name:      "any is kept for go1.18",
+			root:      "Bag",
+			goVersion: "go1.18",
+			wantTypes: "Items []any",
+		},
+		{
+			name:      "generics are rejected for go1.17",
+			root:      "Box",
+			goVersion: "1.17",
+			wantErr:   "uses generics, which requires go1.18",
+		},
+		{
+			name:      "range over int is rejected for go1.21",
+			root:      "Sum",
+			goVersion: "1.21",
+			wantErr:   "uses range over integers, which requires go1.22",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			r.config.GoVersion = tt.goVersion
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/compat", TypeName: tt.root})
+
+			err := r.generateOutput()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateOutput failed: %v", err)
+			}
+
+			types, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/compat", "types.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(types), tt.wantTypes) {
+				t.Errorf("Generated output missing %q:\n%s", tt.wantTypes, types)
+			}
+
+			goMod, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "go " + strings.TrimPrefix(tt.goVersion, "go") + "\n"; !strings.Contains(string(goMod), want) {
+				t.Errorf("Expected go.mod to contain %q:\n%s", want, goMod)
+			}
+		})
+	}
+}
+
+func TestGoDirectives(t *testing.T) {
+	tests := []struct {
+		name      string
+		goVersion string
+		toolchain string
+		want      string
+	}{
+		{
+			name: "source module's directives",
+			want: "go 1.22\n\ntoolchain go1.22.5\n",
+		},
+		{
+			name:      "target version replaces both",
+			goVersion: "1.21",
+			want:      "go 1.21\n",
+		},
+		{
+			name:      "configured toolchain",
+			toolchain: "go1.23.1",
+			want:      "go 1.22\n\ntoolchain go1.23.1\n",
+		},
+		{
+			name:      "toolchain implied by the go version",
+			goVersion: "1.23",
+			toolchain: "1.22.5",
+			want:      "go 1.23\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			r.config.GoVersion = tt.goVersion
+			r.config.Toolchain = tt.toolchain
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/compat", TypeName: "Bag"})
+			if err := r.generateOutput(); err != nil {
+				t.Fatalf("generateOutput failed: %v", err)
+			}
+
+			goMod, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "module example.com/fixture\n\n" + tt.want; string(goMod) != want {
+				t.Errorf("Expected go.mod:\n%s\ngot:\n%s", want, goMod)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// checkDanglingImports fails if a declaration of the package refers to
+// something generated code can't import: a package that was neither
+// extracted nor kept external, or a name its extracted package doesn't
+// declare. Left alone, the import would be dropped and the generated code
+// wouldn't compile.
+func (r *RecursiveRewriter) checkDanglingImports(pkgInfo *PackageInfo) error {
+	info := pkgInfo.Pkg.TypesInfo
+	if info == nil {
+		return nil
+	}
+
+	seen := make(map[ast.Decl]bool)
+	for _, name := range sortedDeclNames(pkgInfo) {
+		decl := pkgInfo.Decls[name].Decl
+		if seen[decl] {
+			continue
+		}
+		seen[decl] = true
+
+		// Report struct fields by name, and anything else by declaration
+		check := func(location string, node ast.Node) error {
+			var err error
+			ast.Inspect(node, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if !ok || err != nil {
+					return err == nil
+				}
+				importPath := selectorImportPath(pkgInfo, sel)
+				if importPath == "" {
+					return true
+				}
+				if reason := r.danglingReason(importPath, sel.Sel.Name); reason != "" {
+					typeRef := TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: name}
+					err = &Diagnostic{
+						Code:    CodeDanglingImport,
+						Package: pkgInfo.Pkg.PkgPath,
+						Decl:    typeRef.String(),
+						Err: fmt.Errorf("%s.%s refers to %s.%s, but %s (reached via %s)",
+							pkgInfo.Pkg.PkgPath, location, importPath, sel.Sel.Name, reason, r.dependencyPath(typeRef)),
+					}
+				}
+				return err == nil
+			})
+			return err
+		}
+
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			if err := check(name, decl); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				if err := check(ts.Name.Name, ts); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, field := range st.Fields.List {
+				fieldName := embeddedFieldName(field.Type)
+				if len(field.Names) > 0 {
+					fieldName = field.Names[0].Name
+				}
+				if err := check(ts.Name.Name+"."+fieldName, field.Type); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// danglingReason explains why generated code can't refer to name in the
+// package at importPath, or returns "" if it can
+func (r *RecursiveRewriter) danglingReason(importPath, name string) string {
+	if r.isStdlib(importPath) || importPath == "C" || r.external[importPath] != nil {
+		return ""
+	}
+	if _, ok := r.shimmed[importPath]; ok {
+		// Substituted by a standard library package
+		return ""
+	}
+	target := r.packages[importPath]
+	if target == nil || !target.hasOutput() {
+		return importPath + " was neither extracted nor kept external"
+	}
+	if target.Verbatim {
+		return ""
+	}
+	for declName := range target.Decls {
+		// Methods are keyed by their receiver
+		if !strings.Contains(declName, ".") && r.renamedType(importPath, declName) == name {
+			return ""
+		}
+	}
+	return "it wasn't extracted"
+}
+
+// checkImportCycles fails if generated packages would import each other,
+// which the source packages can't, but renaming, collapsing, and
+// substitution could make them do. Go rejects import cycles, so the output
+// wouldn't build.
+func (r *RecursiveRewriter) checkImportCycles() error {
+	var pkgPaths []string
+	for pkgPath, pkgInfo := range r.packages {
+		if pkgInfo.hasOutput() {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+
+	imports := func(pkgPath string) []string {
+		pkgInfo := r.packages[pkgPath]
+		var paths []string
+		if pkgInfo.Verbatim {
+			for importPath := range pkgInfo.Pkg.Imports {
+				paths = append(paths, importPath)
+			}
+		} else {
+			for importPath := range pkgInfo.Imports {
+				paths = append(paths, importPath)
+			}
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// Depth-first, with the packages on the current path in order
+	done := make(map[string]bool)
+	onPath := make(map[string]bool)
+	var path []string
+	var visit func(pkgPath string) error
+	visit = func(pkgPath string) error {
+		if onPath[pkgPath] {
+			i := slices.Index(path, pkgPath)
+			cycle := append(slices.Clone(path[i:]), pkgPath)
+			return &Diagnostic{
+				Code:    CodeCycleDetected,
+				Package: pkgPath,
+				Err:     fmt.Errorf("generated packages would import each other: %s", strings.Join(cycle, " -> ")),
+			}
+		}
+		if done[pkgPath] {
+			return nil
+		}
+		onPath[pkgPath] = true
+		path = append(path, pkgPath)
+		for _, importPath := range imports(pkgPath) {
+			if other, ok := r.packages[importPath]; ok && importPath != pkgPath && other.hasOutput() {
+				if err := visit(importPath); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		onPath[pkgPath] = false
+		done[pkgPath] = true
+		return nil
+	}
+	for _, pkgPath := range pkgPaths {
+		if err := visit(pkgPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
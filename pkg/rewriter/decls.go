@@ -0,0 +1,212 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+)
+
+// VarPolicy controls whether package-level variables referenced by copied
+// functions and methods, such as defaults and sentinel errors, are copied
+type VarPolicy string
+
+const (
+	// VarsCopy copies the variable along with the dependencies of its
+	// initializer (the default)
+	VarsCopy VarPolicy = "copy"
+	// VarsSkip treats variables as unextractable, so declarations using one
+	// are dropped or fail the run according to the UnextractablePolicy
+	VarsSkip VarPolicy = "skip"
+)
+
+// extractValueDecl looks for a top-level function, constant, or variable
+// named name and collects it along with its dependencies. It reports
+// whether a matching declaration was found.
+func (r *RecursiveRewriter) extractValueDecl(pkgInfo *PackageInfo, name string) (bool, error) {
+	// Methods are indexed through their receiver type, not by name
+	site, ok := pkgInfo.lookup(name)
+	if !ok {
+		return false, nil
+	}
+	switch d := site.decl.(type) {
+	case *ast.FuncDecl:
+		return true, r.collectFuncDecl(pkgInfo, name, d, site.file)
+	case *ast.GenDecl:
+		vs, ok := site.spec.(*ast.ValueSpec)
+		if !ok {
+			return false, nil
+		}
+		if d.Tok == token.VAR && r.config.Vars == VarsSkip {
+			return true, fmt.Errorf("package-level variable %s isn't copied (vars: skip)", name)
+		}
+		if err := r.substituteAnnotated(pkgInfo, d); err != nil {
+			return true, err
+		}
+		if err := r.inlineTypes(pkgInfo, d); err != nil {
+			return true, err
+		}
+		r.collectValueDecl(pkgInfo, d, vs, site.file)
+		return true, nil
+	}
+	return false, nil
+}
+
+// collectValueDecl stores a const or var declaration. Constant groups are
+// kept whole since later specs may depend on iota or repeat an earlier
+// spec's expression implicitly; variable groups are split per spec.
+func (r *RecursiveRewriter) collectValueDecl(pkgInfo *PackageInfo, decl *ast.GenDecl, spec *ast.ValueSpec, file *ast.File) {
+	specs := decl.Specs
+	if decl.Tok == token.VAR && len(decl.Specs) > 1 {
+		decl = &ast.GenDecl{
+			TokPos: spec.Pos(),
+			Tok:    token.VAR,
+			Specs:  []ast.Spec{spec},
+		}
+		specs = decl.Specs
+	}
+	r.substituteTypes(pkgInfo, decl)
+
+	// Dependencies of a spec naming only _ are charged to the group, since
+	// it's copied, or dropped, with the rest of it
+	var group *DeclInfo
+	for _, s := range specs {
+		for _, ident := range s.(*ast.ValueSpec).Names {
+			if ident.Name == "_" {
+				continue
+			}
+			info := r.collectDecl(pkgInfo, ident.Name, decl, file, decl.Doc)
+			if group == nil {
+				group = info
+			}
+		}
+	}
+
+	for _, s := range specs {
+		vs := s.(*ast.ValueSpec)
+		r.walkTypeForDeps(pkgInfo, vs.Type)
+		owner := group
+		if info := pkgInfo.Decls[vs.Names[0].Name]; info != nil && vs.Names[0].Name != "_" {
+			owner = info
+		}
+		for _, value := range vs.Values {
+			r.walkExprForDeps(pkgInfo, owner, value)
+		}
+	}
+}
+
+// declGroup returns the names of the collected declarations that share
+// name's declaration, such as the constants of an iota group, sorted
+func declGroup(pkgInfo *PackageInfo, name string) []string {
+	decl := pkgInfo.Decls[name].Decl
+	var names []string
+	for other, info := range pkgInfo.Decls {
+		if info.Decl == decl {
+			names = append(names, other)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// queueUnderlyingConsts queues the constants of a foreign named type that
+// typeSpec is defined on (e.g., type Phase synccommon.OperationPhase), since
+// the local type's values are those constants converted
+func (r *RecursiveRewriter) queueUnderlyingConsts(pkgInfo *PackageInfo, typeSpec *ast.TypeSpec) {
+	sel, ok := typeSpec.Type.(*ast.SelectorExpr)
+	if typeSpec.Assign.IsValid() || !ok || pkgInfo.Pkg.TypesInfo == nil {
+		return
+	}
+	obj, ok := pkgInfo.Pkg.TypesInfo.Uses[sel.Sel].(*types.TypeName)
+	if !ok {
+		return
+	}
+	// Follow aliases to the package that defines the type and its constants
+	named, ok := types.Unalias(obj.Type()).(*types.Named)
+	if !ok {
+		return
+	}
+	obj = named.Obj()
+	if obj.Pkg() == nil || obj.Pkg() == pkgInfo.Pkg.Types {
+		return
+	}
+	pkgPath := obj.Pkg().Path()
+	if r.isStdlib(pkgPath) || r.external[pkgPath] != nil || r.isVerbatim(pkgPath) {
+		return
+	}
+
+	scope := obj.Pkg().Scope()
+	for _, name := range scope.Names() {
+		if c, ok := scope.Lookup(name).(*types.Const); ok && types.Identical(c.Type(), obj.Type()) {
+			r.queueOptional(TypeRef{PackagePath: pkgPath, TypeName: name})
+		}
+	}
+}
+
+func (r *RecursiveRewriter) collectDecl(pkgInfo *PackageInfo, name string, decl ast.Decl, file *ast.File, comment *ast.CommentGroup) *DeclInfo {
+	if info, exists := pkgInfo.Decls[name]; exists {
+		return info
+	}
+
+	info := &DeclInfo{
+		Name:        name,
+		Decl:        decl,
+		File:        file,
+		Comment:     comment,
+		PackagePath: pkgInfo.Pkg.PkgPath,
+	}
+	pkgInfo.Decls[name] = info
+	return info
+}
+
+// declOrder ranks declarations the way Go source conventionally orders them:
+// constants, variables, types, then functions
+func declOrder(decl ast.Decl) int {
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		switch d.Tok {
+		case token.CONST:
+			return 0
+		case token.VAR:
+			return 1
+		default:
+			return 2
+		}
+	default:
+		return 3
+	}
+}
+
+// sortedDeclNames returns the names of the package's collected declarations,
+// grouped by kind and sorted by name
+func sortedDeclNames(pkgInfo *PackageInfo) []string {
+	var names []string
+	for name := range pkgInfo.Decls {
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		oi, oj := declOrder(pkgInfo.Decls[names[i]].Decl), declOrder(pkgInfo.Decls[names[j]].Decl)
+		if oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// sortedDecls returns the package's collected declarations in the order of
+// sortedDeclNames, emitting declarations shared by several names only once
+func sortedDecls(pkgInfo *PackageInfo) []ast.Decl {
+	var decls []ast.Decl
+	seen := make(map[ast.Decl]bool)
+	for _, name := range sortedDeclNames(pkgInfo) {
+		decl := pkgInfo.Decls[name].Decl
+		if seen[decl] {
+			continue
+		}
+		seen[decl] = true
+		decls = append(decls, decl)
+	}
+	return decls
+}
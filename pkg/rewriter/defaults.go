@@ -0,0 +1,227 @@
+package rewriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/types"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultsFile is written next to types.go in packages with defaulted types
+const defaultsFile = "defaults.go"
+
+// defaultsGen accumulates the Default methods of one package
+type defaultsGen struct {
+	pkgInfo   *PackageInfo
+	marked    map[*types.TypeName]*markedType
+	defaulted map[*types.TypeName]bool // types that get a Default method
+	warned    map[string]bool          // fields with an unusable default
+	body      strings.Builder
+	imports   map[string]bool
+}
+
+// generateDefaults writes Default methods for the package's struct types
+// whose fields carry +kubebuilder:default markers. Like the API server, a
+// field is defaulted before the fields below it, so a defaulted object gets
+// its own fields' defaults too.
+func (r *RecursiveRewriter) generateDefaults(pkgInfo *PackageInfo, outputPath string) error {
+	g := &defaultsGen{pkgInfo: pkgInfo, marked: make(map[*types.TypeName]*markedType), defaulted: make(map[*types.TypeName]bool), warned: make(map[string]bool), imports: make(map[string]bool)}
+	marked := r.markedTypes(pkgInfo)
+	for _, mt := range marked {
+		g.marked[mt.obj] = mt
+	}
+
+	// A type is defaulted if a field has a default or is of a defaulted
+	// type, so iterate until no more types are added
+	for changed := true; changed; {
+		changed = false
+		for _, mt := range marked {
+			if g.defaulted[mt.obj] || len(mt.fields) == 0 || pkgInfo.Decls[mt.obj.Name()+".Default"] != nil {
+				continue
+			}
+			for _, f := range mt.fields {
+				if len(g.fieldDefaults(mt, f)) > 0 {
+					g.defaulted[mt.obj] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	if len(g.defaulted) == 0 {
+		return nil
+	}
+
+	for _, mt := range marked {
+		if !g.defaulted[mt.obj] {
+			continue
+		}
+		fmt.Fprintf(&g.body, "\n// Default sets the unset fields of %s to their kubebuilder defaults\n", mt.name)
+		fmt.Fprintf(&g.body, "func (in *%s) Default() {\n", mt.name)
+		for _, f := range mt.fields {
+			for _, stmt := range g.fieldDefaults(mt, f) {
+				g.body.WriteString(stmt)
+			}
+		}
+		g.body.WriteString("}\n")
+	}
+
+	var buf bytes.Buffer
+	r.writeMarkerFileHeader(&buf, pkgInfo, g.imports)
+	buf.WriteString(g.body.String())
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format defaults for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+	outputFile := filepath.Join(outputPath, defaultsFile)
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "types", len(g.defaulted))
+	return nil
+}
+
+// fieldDefaults returns the statements defaulting a struct field and then
+// the values below it
+func (g *defaultsGen) fieldDefaults(mt *markedType, f markedField) []string {
+	if f.typ == nil {
+		// The field's type was substituted or replaced
+		return nil
+	}
+	expr := "in." + f.goName
+	var stmts []string
+	if stmt := g.defaultValue(mt, f, expr); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+
+	switch t := types.Unalias(f.typ).(type) {
+	case *types.Slice:
+		if nested := g.nestedDefault(t.Elem(), expr+"[i]"); nested != "" {
+			stmts = append(stmts, fmt.Sprintf("\tfor i := range %s {\n%s\t}\n", expr, indent(nested)))
+		}
+	case *types.Map:
+		if nested := g.nestedDefault(t.Elem(), "value"); nested != "" {
+			if _, isPointer := t.Elem().(*types.Pointer); isPointer {
+				stmts = append(stmts, fmt.Sprintf("\tfor _, value := range %s {\n%s\t}\n", expr, indent(nested)))
+			} else {
+				// Map values aren't addressable, so default a copy and store it
+				stmts = append(stmts, fmt.Sprintf("\tfor key, value := range %s {\n%s\t\t%s[key] = value\n\t}\n", expr, indent(nested), expr))
+			}
+		}
+	default:
+		if nested := g.nestedDefault(f.typ, expr); nested != "" {
+			stmts = append(stmts, nested)
+		}
+	}
+	return stmts
+}
+
+// defaultValue returns the statement setting a field to its default when
+// it's unset: nil for pointers, slices, and maps, and the zero value
+// otherwise. Scalars are assigned as constants and anything else is decoded
+// from the marker's JSON.
+func (g *defaultsGen) defaultValue(mt *markedType, f markedField, expr string) string {
+	value, ok := f.markers.Default, f.markers.HasDefault
+	if !ok {
+		// Named types can carry a default for every field of the type
+		if named, isNamed := types.Unalias(f.typ).(*types.Named); isNamed {
+			if fieldType := g.marked[named.Obj()]; fieldType != nil && len(fieldType.fields) == 0 {
+				value, ok = fieldType.markers.Default, fieldType.markers.HasDefault
+			}
+		}
+	}
+	if !ok {
+		return ""
+	}
+
+	if basic, isBasic := f.typ.Underlying().(*types.Basic); isBasic {
+		literal, zero := defaultLiteral(basic, value)
+		if literal == "" {
+			g.warn(mt, f, "Ignoring default that doesn't fit the field's type", value)
+			return ""
+		}
+		if literal == zero {
+			return ""
+		}
+		if zero == "false" {
+			return fmt.Sprintf("\tif !%s {\n\t\t%s = %s\n\t}\n", expr, expr, literal)
+		}
+		return fmt.Sprintf("\tif %s == %s {\n\t\t%s = %s\n\t}\n", expr, zero, expr, literal)
+	}
+
+	switch t := f.typ.Underlying().(type) {
+	case *types.Pointer, *types.Slice, *types.Map:
+		if ptr, isPointer := t.(*types.Pointer); isPointer {
+			if basic, isBasic := ptr.Elem().Underlying().(*types.Basic); isBasic && basic.Info()&types.IsString != 0 && !json.Valid([]byte(value)) {
+				// Strings are usually written unquoted
+				value = strconv.Quote(markerString(value))
+			}
+		}
+		if !json.Valid([]byte(value)) {
+			g.warn(mt, f, "Ignoring default that isn't valid JSON", value)
+			return ""
+		}
+		g.imports["encoding/json"] = true
+		// The value was checked to be valid JSON when this was generated
+		return fmt.Sprintf("\tif %s == nil {\n\t\t_ = json.Unmarshal([]byte(%s), &%s)\n\t}\n", expr, goStringLiteral(value), expr)
+	}
+	g.warn(mt, f, "Ignoring default for a field that can't be unset", value)
+	return ""
+}
+
+// warn logs an unusable default once, although fields are visited on every
+// pass over the package's types
+func (g *defaultsGen) warn(mt *markedType, f markedField, msg, value string) {
+	field := mt.name + "." + f.goName
+	if !g.warned[field] {
+		g.warned[field] = true
+		slog.Warn(msg, "field", field, "value", value)
+	}
+}
+
+// defaultLiteral returns the Go constant for a scalar default and the zero
+// value it replaces, or "" if the value doesn't fit the type
+func defaultLiteral(basic *types.Basic, value string) (string, string) {
+	info := basic.Info()
+	switch {
+	case info&types.IsString != 0:
+		return strconv.Quote(markerString(value)), `""`
+	case info&types.IsBoolean != 0:
+		if value == "true" || value == "false" {
+			return value, "false"
+		}
+	case info&types.IsInteger != 0:
+		if isInteger(value) {
+			return value, "0"
+		}
+	case info&types.IsNumeric != 0:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return value, "0"
+		}
+	}
+	return "", ""
+}
+
+// nestedDefault returns the statement calling the Default method of a value
+// of a defaulted type, or "" if it doesn't have one
+func (g *defaultsGen) nestedDefault(t types.Type, expr string) string {
+	nilCheck := false
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+		nilCheck = true
+	}
+	named, ok := types.Unalias(t).(*types.Named)
+	if !ok || !g.defaulted[named.Obj()] {
+		return ""
+	}
+	if nilCheck {
+		return fmt.Sprintf("\tif %s != nil {\n\t\t%s.Default()\n\t}\n", expr, expr)
+	}
+	return fmt.Sprintf("\t%s.Default()\n", expr)
+}
@@ -0,0 +1,67 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/types"
+	"log/slog"
+	"strings"
+)
+
+// dropDeprecatedFields removes the struct fields documented as deprecated,
+// including those of nested struct types, before the type is walked for
+// dependencies
+func (r *RecursiveRewriter) dropDeprecatedFields(typeRef TypeRef, spec *ast.TypeSpec) {
+	if !r.config.DropDeprecated {
+		return
+	}
+	if st, ok := spec.Type.(*ast.StructType); ok {
+		r.dropDeprecatedStruct(typeRef, st, typeRef.String())
+	}
+}
+
+func (r *RecursiveRewriter) dropDeprecatedStruct(typeRef TypeRef, st *ast.StructType, path string) {
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		names := []string{embeddedFieldName(field.Type)}
+		if len(field.Names) > 0 {
+			names = names[:0]
+			for _, ident := range field.Names {
+				names = append(names, ident.Name)
+			}
+		}
+
+		if !isDeprecated(field.Doc) && !isDeprecated(field.Comment) {
+			ast.Inspect(field.Type, func(n ast.Node) bool {
+				if nested, ok := n.(*ast.StructType); ok {
+					r.dropDeprecatedStruct(typeRef, nested, path+"."+names[0])
+					return false
+				}
+				return true
+			})
+			kept = append(kept, field)
+			continue
+		}
+		for _, name := range names {
+			slog.Info("Dropped deprecated field", "field", path+"."+name)
+			r.recordFieldChange(typeRef, path+"."+name, fieldRemoved, types.ExprString(field.Type), "", "deprecated")
+		}
+	}
+	st.Fields.List = kept
+}
+
+// isDeprecated reports whether a doc comment has a paragraph starting with
+// "Deprecated:", the convention for marking identifiers as deprecated
+func isDeprecated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	paragraphStart := true
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		line = strings.TrimSpace(line)
+		if paragraphStart && strings.HasPrefix(line, "Deprecated:") {
+			return true
+		}
+		paragraphStart = line == ""
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package rewriter
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// Code classifies a failure, stably across releases, so automation can react
+// to specific kinds of failure rather than parse messages
+type Code string
+
+const (
+	CodeTypeNotFound        Code = "type-not-found"       // a declaration to extract isn't in its package
+	CodePackageLoadFailure  Code = "package-load-failure" // a source package couldn't be loaded
+	CodeDanglingImport      Code = "dangling-import"      // generated code would refer to something it can't import
+	CodeCycleDetected       Code = "cycle-detected"       // generated packages would import each other
+	CodeMethodUnextractable Code = "method-unextractable" // a function or method depends on something that can't be extracted
+	CodeSelfExtraction      Code = "self-extraction"      // a generated module is the module whose go.mod or go.work is updated
+	CodeOutsideRecursion    Code = "outside-recursion"    // a type refers to one its entry's recursion leaves out, which nothing else extracts
+)
+
+// Diagnostic is an error of a known class. Errors returned by the rewriter
+// wrap one when the failure has a code; find it with DiagnosticOf.
+type Diagnostic struct {
+	Code    Code
+	Package string // package the failure is in, if known
+	Decl    string // declaration it's about (import/path.Name), if any
+	Err     error
+}
+
+func (d *Diagnostic) Error() string {
+	return d.Err.Error()
+}
+
+func (d *Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// LogValue logs a diagnostic as its code and location, alongside the message
+func (d *Diagnostic) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("code", string(d.Code))}
+	if d.Package != "" {
+		attrs = append(attrs, slog.String("package", d.Package))
+	}
+	if d.Decl != "" {
+		attrs = append(attrs, slog.String("decl", d.Decl))
+	}
+	return slog.GroupValue(append(attrs, slog.String("message", d.Err.Error()))...)
+}
+
+// DiagnosticOf returns the diagnostic err wraps, if any
+func DiagnosticOf(err error) (*Diagnostic, bool) {
+	var d *Diagnostic
+	ok := errors.As(err, &d)
+	return d, ok
+}
@@ -0,0 +1,176 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// SourceChange describes how a type extracted by a batch changed upstream
+// between two versions of its source module
+type SourceChange struct {
+	Type   string `json:"type"`            // import/path.Name
+	Field  string `json:"field,omitempty"` // empty for changes to the type as a whole
+	Change string `json:"change"`          // "added", "removed", "retyped", or "tag"
+	From   string `json:"from,omitempty"`  // type or tag in the first version
+	To     string `json:"to,omitempty"`    // type or tag in the second version
+}
+
+const (
+	sourceAdded   = "added"
+	sourceRemoved = "removed"
+	sourceRetyped = "retyped"
+	sourceTag     = "tag"
+)
+
+// sourceType is the upstream shape of an extracted type: its fields if it's
+// a struct, or else its underlying type
+type sourceType struct {
+	underlying string
+	fields     map[string]sourceField
+	order      []string // field names in declaration order
+}
+
+type sourceField struct {
+	typ string
+	tag string
+}
+
+// DiffSource extracts the closure of a batch at two versions of the module
+// at modulePath, without writing any output, and reports how the types
+// extracted at either version changed: types and struct fields added or
+// removed, fields whose type or tag changed, and other types whose
+// underlying type changed. An empty fromVersion stands for the version the
+// consuming module requires. Changes are sorted by type, then in field
+// order.
+func DiffSource(configs []*Config, modulePath, fromVersion, toVersion string) ([]SourceChange, error) {
+	from, err := extractedSourceTypes(configs, modulePath, fromVersion)
+	if err != nil {
+		return nil, fmt.Errorf("at %s: %w", versionName(modulePath, fromVersion), err)
+	}
+	to, err := extractedSourceTypes(configs, modulePath, toVersion)
+	if err != nil {
+		return nil, fmt.Errorf("at %s: %w", versionName(modulePath, toVersion), err)
+	}
+	return diffSourceTypes(from, to), nil
+}
+
+// versionName describes a version of a module for messages
+func versionName(modulePath, version string) string {
+	if version == "" {
+		return "the required version of " + modulePath
+	}
+	return modulePath + "@" + version
+}
+
+// extractedSourceTypes extracts the closure of a batch with the module at
+// modulePath pinned to version and returns its types' upstream shapes
+func extractedSourceTypes(configs []*Config, modulePath, version string) (map[string]sourceType, error) {
+	r, err := newBatchRewriterAt(configs, modulePath, version)
+	if err != nil {
+		return nil, err
+	}
+	defer r.cleanup()
+	if err := r.processQueue(); err != nil {
+		return nil, err
+	}
+	return r.sourceTypes(), nil
+}
+
+// sourceTypes returns the upstream shape of every extracted type, keyed by
+// its qualified name. Packages copied verbatim contribute all their types.
+func (r *RecursiveRewriter) sourceTypes() map[string]sourceType {
+	shapes := make(map[string]sourceType)
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() || pkgInfo.Pkg.Types == nil {
+			continue
+		}
+		scope := pkgInfo.Pkg.Types.Scope()
+		names := scope.Names()
+		if !pkgInfo.Verbatim {
+			names = names[:0:0]
+			for name := range pkgInfo.Decls {
+				// Methods are keyed by their receiver
+				if !strings.Contains(name, ".") {
+					names = append(names, name)
+				}
+			}
+		}
+		qualifier := types.RelativeTo(pkgInfo.Pkg.Types)
+		for _, name := range names {
+			typeName, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			shape := sourceType{underlying: types.TypeString(typeName.Type().Underlying(), qualifier)}
+			if st, ok := typeName.Type().Underlying().(*types.Struct); ok {
+				shape.underlying = "struct"
+				shape.fields = make(map[string]sourceField)
+				for i := range st.NumFields() {
+					field := st.Field(i)
+					shape.fields[field.Name()] = sourceField{typ: types.TypeString(field.Type(), qualifier), tag: st.Tag(i)}
+					shape.order = append(shape.order, field.Name())
+				}
+			}
+			shapes[pkgPath+"."+name] = shape
+		}
+	}
+	return shapes
+}
+
+// diffSourceTypes compares the types extracted at two versions
+func diffSourceTypes(from, to map[string]sourceType) []SourceChange {
+	keys := make(map[string]bool)
+	for key := range from {
+		keys[key] = true
+	}
+	for key := range to {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []SourceChange
+	for _, key := range sorted {
+		before, inFrom := from[key]
+		after, inTo := to[key]
+		switch {
+		case !inFrom:
+			changes = append(changes, SourceChange{Type: key, Change: sourceAdded, To: after.underlying})
+			continue
+		case !inTo:
+			changes = append(changes, SourceChange{Type: key, Change: sourceRemoved, From: before.underlying})
+			continue
+		case before.fields == nil || after.fields == nil:
+			if before.underlying != after.underlying {
+				changes = append(changes, SourceChange{Type: key, Change: sourceRetyped, From: before.underlying, To: after.underlying})
+			}
+			continue
+		}
+
+		// Fields in the order of the newer version, then removed ones
+		for _, name := range after.order {
+			newField := after.fields[name]
+			oldField, ok := before.fields[name]
+			switch {
+			case !ok:
+				changes = append(changes, SourceChange{Type: key, Field: name, Change: sourceAdded, To: newField.typ})
+			case oldField.typ != newField.typ:
+				changes = append(changes, SourceChange{Type: key, Field: name, Change: sourceRetyped, From: oldField.typ, To: newField.typ})
+			}
+			if ok && oldField.tag != newField.tag {
+				changes = append(changes, SourceChange{Type: key, Field: name, Change: sourceTag, From: oldField.tag, To: newField.tag})
+			}
+		}
+		for _, name := range before.order {
+			if _, ok := after.fields[name]; !ok {
+				changes = append(changes, SourceChange{Type: key, Field: name, Change: sourceRemoved, From: before.fields[name].typ})
+			}
+		}
+	}
+	return changes
+}
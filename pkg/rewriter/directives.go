@@ -0,0 +1,125 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// DirectivePolicy controls what happens when a copied declaration carries a
+// compiler directive that doesn't make sense outside its original package
+type DirectivePolicy string
+
+const (
+	// DirectivesStrip removes the directive and logs a warning (the default)
+	DirectivesStrip DirectivePolicy = "strip"
+	// DirectivesFail stops extraction of the declaration with an error
+	DirectivesFail DirectivePolicy = "fail"
+)
+
+// unsafeDirectives are comment prefixes of directives that would break or
+// change the behavior of generated code: linkname and noescape pragmas refer
+// to symbols and assembly that aren't copied, cgo directives need the cgo
+// preamble, embed needs the embedded files, and generate would run upstream's
+// generators in the consumer's tree
+var unsafeDirectives = []string{
+	"//go:linkname",
+	"//go:noescape",
+	"//go:cgo_",
+	"//go:embed",
+	"//go:generate",
+	"//export ",
+}
+
+// StrippedDirective is a compiler directive removed from a copied
+// declaration
+type StrippedDirective struct {
+	Decl      string // declaration (import/path.Name)
+	Directive string // comment text, e.g. "//go:linkname Now"
+}
+
+func isUnsafeDirective(text string) bool {
+	for _, prefix := range unsafeDirectives {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripDirectives removes unsafe directives from the comments of the
+// declaration collected for typeRef, or fails if the policy says so
+func (r *RecursiveRewriter) stripDirectives(typeRef TypeRef) error {
+	pkgInfo := r.packages[typeRef.PackagePath]
+	if pkgInfo == nil || pkgInfo.Decls[typeRef.TypeName] == nil {
+		return nil
+	}
+	info := pkgInfo.Decls[typeRef.TypeName]
+
+	var groups []**ast.CommentGroup
+	switch d := info.Decl.(type) {
+	case *ast.FuncDecl:
+		groups = append(groups, &d.Doc)
+	case *ast.GenDecl:
+		groups = append(groups, &d.Doc)
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				groups = append(groups, &s.Doc, &s.Comment)
+			case *ast.ValueSpec:
+				groups = append(groups, &s.Doc, &s.Comment)
+			}
+		}
+	}
+
+	for _, group := range groups {
+		if *group == nil {
+			continue
+		}
+
+		var kept []*ast.Comment
+		for _, c := range (*group).List {
+			if !isUnsafeDirective(c.Text) {
+				kept = append(kept, c)
+				continue
+			}
+			if r.config.Directives == DirectivesFail {
+				return fmt.Errorf("%s carries compiler directive %q", typeRef, c.Text)
+			}
+			slog.Warn("Stripped compiler directive from copied declaration",
+				"declaration", typeRef.String(),
+				"directive", c.Text)
+			r.strippedDirectives = append(r.strippedDirectives, StrippedDirective{Decl: typeRef.String(), Directive: c.Text})
+		}
+
+		if len(kept) == len((*group).List) {
+			continue
+		}
+		if len(kept) == 0 {
+			*group = nil
+		} else {
+			*group = &ast.CommentGroup{List: kept}
+		}
+	}
+
+	if fd, ok := info.Decl.(*ast.FuncDecl); ok {
+		info.Comment = fd.Doc
+	}
+	return nil
+}
+
+// extractedDirectives returns the directives stripped from declarations that
+// made it into the output, sorted by declaration
+func (r *RecursiveRewriter) extractedDirectives() []StrippedDirective {
+	var stripped []StrippedDirective
+	for _, directive := range r.strippedDirectives {
+		i := strings.LastIndex(directive.Decl, ".")
+		if pkgInfo := r.packages[directive.Decl[:i]]; pkgInfo != nil && pkgInfo.Decls[directive.Decl[i+1:]] != nil {
+			stripped = append(stripped, directive)
+		}
+	}
+	sort.SliceStable(stripped, func(i, j int) bool { return stripped[i].Decl < stripped[j].Decl })
+	return stripped
+}
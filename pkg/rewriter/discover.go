@@ -0,0 +1,77 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// FindTypePackages returns, for each of typeNames, the packages of the
+// module at modulePath that declare a type by that name, sorted. The module's
+// packages are listed from dir like modulePath/..., so it must be required
+// there, and only parsed, which is much cheaper than loading them. Names
+// declared nowhere are left out.
+func FindTypePackages(dir, modulePath string, typeNames []string) (map[string][]string, error) {
+	pkgs, err := packages.Load(&packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedModule,
+		Dir:  dir,
+	}, modulePath+"/...")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the packages of %s: %w", modulePath, err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range typeNames {
+		wanted[name] = true
+	}
+	found := make(map[string][]string)
+	fset := token.NewFileSet()
+	listed := 0
+	for _, pkg := range pkgs {
+		// The pattern also matches packages of nested modules
+		if pkg.Module == nil || pkg.Module.Path != modulePath {
+			continue
+		}
+		listed++
+		declared := make(map[string]bool)
+		for _, filename := range pkg.GoFiles {
+			file, err := parser.ParseFile(fset, filename, nil, parser.SkipObjectResolution)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+			}
+			for _, decl := range file.Decls {
+				genDecl, ok := decl.(*ast.GenDecl)
+				if !ok || genDecl.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range genDecl.Specs {
+					name := spec.(*ast.TypeSpec).Name.Name
+					if wanted[name] && !declared[name] {
+						declared[name] = true
+						found[name] = append(found[name], pkg.PkgPath)
+					}
+				}
+			}
+		}
+	}
+	if listed == 0 {
+		return nil, fmt.Errorf("no packages found in module %s; is it required by the module in %s?", modulePath, dirName(dir))
+	}
+
+	for _, pkgPaths := range found {
+		sort.Strings(pkgPaths)
+	}
+	return found, nil
+}
+
+// dirName describes dir for messages, which is the current directory if empty
+func dirName(dir string) string {
+	if dir == "" {
+		return "the current directory"
+	}
+	return dir
+}
@@ -0,0 +1,214 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// docsDir holds the Markdown reference, one README.md per package at the
+// package's path in the output
+const docsDir = "docs"
+
+// DocsEmitter writes a Markdown reference of the generated types: each
+// package's types with their doc comments, and the fields of struct types
+// with their JSON names, types, descriptions, and kubebuilder markers. It's
+// read from the generated code rather than the source, so pruned fields and
+// renamed types are documented as consumers see them.
+type DocsEmitter struct{}
+
+// Name returns "docs"
+func (DocsEmitter) Name() string { return "docs" }
+
+// Emit writes docs/README.md, listing the packages, and a README.md for each
+func (DocsEmitter) Emit(out *Output) error {
+	var index strings.Builder
+	index.WriteString("# API Reference\n\n")
+	for _, pkgInfo := range out.Packages {
+		if pkgInfo.Verbatim {
+			continue
+		}
+		types := out.r.markedTypes(pkgInfo)
+		if len(types) == 0 {
+			continue
+		}
+		subdir := filepath.ToSlash(pkgInfo.OutputSubdir)
+		content, err := out.r.packageDocs(pkgInfo, types)
+		if err != nil {
+			return err
+		}
+		if err := out.WriteFile(path.Join(docsDir, subdir, "README.md"), content); err != nil {
+			return err
+		}
+		fmt.Fprintf(&index, "- [%s](%s/README.md)\n", pkgInfo.Pkg.PkgPath, subdir)
+	}
+	return out.WriteFile(path.Join(docsDir, "README.md"), []byte(index.String()))
+}
+
+// packageDocs returns the Markdown reference of a package's types
+func (r *RecursiveRewriter) packageDocs(pkgInfo *PackageInfo, types []*markedType) ([]byte, error) {
+	local := make(map[string]bool)
+	for _, mt := range types {
+		local[mt.name] = true
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n\nSource: `%s`\n\n", pkgInfo.Pkg.Name, pkgInfo.Pkg.PkgPath)
+	for _, mt := range types {
+		fmt.Fprintf(&buf, "- [%s](#%s)\n", mt.name, strings.ToLower(mt.name))
+	}
+	for _, mt := range types {
+		fmt.Fprintf(&buf, "\n## %s\n\n", mt.name)
+		if doc := docText(mt.doc); doc != "" {
+			buf.WriteString(doc + "\n\n")
+		}
+		if _, ok := mt.spec.Type.(*ast.StructType); !ok {
+			underlying, err := r.docsType(mt.spec.Type, local)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "Type: %s\n", underlying)
+			if constraints := markerConstraints(mt.markers); constraints != "" {
+				fmt.Fprintf(&buf, "\n%s\n", constraints)
+			}
+			continue
+		}
+		if constraints := markerConstraints(mt.markers); constraints != "" {
+			buf.WriteString(constraints + "\n\n")
+		}
+		if columns := printColumns(mt.markers); columns != "" {
+			buf.WriteString(columns + "\n\n")
+		}
+		if len(mt.fields) == 0 {
+			buf.WriteString("No fields.\n")
+			continue
+		}
+		buf.WriteString("| Field | JSON | Type | Description |\n| --- | --- | --- | --- |\n")
+		for _, f := range mt.fields {
+			typ, err := r.docsType(f.field.Type, local)
+			if err != nil {
+				return nil, err
+			}
+			jsonName := "`" + f.jsonName + "`"
+			if len(f.field.Names) == 0 && f.jsonName == f.goName {
+				jsonName = "(embedded)"
+			}
+			description := docText(f.field.Doc)
+			if constraints := markerConstraints(f.markers); constraints != "" {
+				description = strings.TrimSpace(description + " " + constraints)
+			}
+			fmt.Fprintf(&buf, "| `%s` | %s | %s | %s |\n", f.goName, jsonName, typ, strings.ReplaceAll(description, "|", `\|`))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// docsType returns a type expression as Markdown, linking to the package's
+// own types
+func (r *RecursiveRewriter) docsType(expr ast.Expr, local map[string]bool) (string, error) {
+	var typ bytes.Buffer
+	if err := format.Node(&typ, r.fset, expr); err != nil {
+		return "", err
+	}
+	text := strings.ReplaceAll(typ.String(), "\n", " ")
+	if name := strings.TrimLeft(text, "*[]"); local[name] {
+		link := fmt.Sprintf("[%s](#%s)", name, strings.ToLower(name))
+		if prefix := strings.TrimSuffix(text, name); prefix != "" {
+			link = "`" + prefix + "`" + link
+		}
+		return link, nil
+	}
+	return "`" + strings.ReplaceAll(text, "|", `\|`) + "`", nil
+}
+
+// docText returns a doc comment as a single line, without its markers
+func docText(doc *ast.CommentGroup) string {
+	var lines []string
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "+") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// markerConstraints describes the markers that constrain a type or field's
+// values, such as "Required. Minimum: 1. Default: `1`."
+func markerConstraints(m Markers) string {
+	var parts []string
+	switch {
+	case m.Required:
+		parts = append(parts, "Required.")
+	case m.Optional:
+		parts = append(parts, "Optional.")
+	}
+	if m.Nullable {
+		parts = append(parts, "Nullable.")
+	}
+	if m.EmbeddedResource {
+		parts = append(parts, "Embedded resource.")
+	}
+	if m.PreserveUnknownFields {
+		parts = append(parts, "Unknown fields are preserved.")
+	}
+	var names []string
+	for name := range m.Validation {
+		// Rules are listed from their arguments below
+		if _, ok := m.Args["validation:"+name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := markerString(m.Validation[name])
+		switch {
+		case value == "":
+			parts = append(parts, name+".")
+		case name == "Enum":
+			parts = append(parts, "One of: `"+strings.Join(strings.Split(value, ";"), "`, `")+"`.")
+		default:
+			parts = append(parts, fmt.Sprintf("%s: `%s`.", name, value))
+		}
+	}
+	if m.ListType != "" {
+		parts = append(parts, fmt.Sprintf("List type: %s.", m.ListType))
+	}
+	if len(m.ListMapKeys) > 0 {
+		parts = append(parts, "Keyed by: `"+strings.Join(m.ListMapKeys, "`, `")+"`.")
+	}
+	if m.MapType != "" {
+		parts = append(parts, fmt.Sprintf("Map type: %s.", m.MapType))
+	}
+	if m.StructType != "" {
+		parts = append(parts, fmt.Sprintf("Struct type: %s.", m.StructType))
+	}
+	for _, rule := range m.Args["validation:XValidation"] {
+		part := fmt.Sprintf("Rule: `%s`", rule["rule"])
+		if message := rule["message"]; message != "" {
+			part += " (" + message + ")"
+		}
+		parts = append(parts, part+".")
+	}
+	if m.HasDefault {
+		parts = append(parts, fmt.Sprintf("Default: `%s`.", m.Default))
+	}
+	return strings.Join(parts, " ")
+}
+
+// printColumns describes the columns kubectl get shows for a resource type,
+// from its +kubebuilder:printcolumn markers
+func printColumns(m Markers) string {
+	var columns []string
+	for _, column := range m.Args["printcolumn"] {
+		columns = append(columns, fmt.Sprintf("`%s` (`%s`)", column["name"], column["JSONPath"]))
+	}
+	if len(columns) == 0 {
+		return ""
+	}
+	return "Printer columns: " + strings.Join(columns, ", ") + "."
+}
@@ -0,0 +1,121 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/token"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Emitter writes the extracted closure in one output format. The closure is
+// computed once per run, and every emitter writes its files from it.
+type Emitter interface {
+	// Name identifies the emitter in a config's emit list
+	Name() string
+	// Emit writes the emitter's files for the generated packages
+	Emit(out *Output) error
+}
+
+// Output is the computed closure handed to emitters
+type Output struct {
+	Dir      string         // output directory files are written under
+	Packages []*PackageInfo // generated packages, sorted by import path, including those copied verbatim
+	Fset     *token.FileSet // positions of the packages' declarations
+
+	r *RecursiveRewriter
+}
+
+// WriteFile writes a file at a slash-separated path relative to Dir,
+// creating its directory, and records its hash in the output manifest like
+// those of the Go files
+func (o *Output) WriteFile(name string, content []byte) error {
+	path := filepath.Join(o.Dir, filepath.FromSlash(name))
+	if err := o.r.mkdirOutput(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := o.r.writeOutputFile(path, content); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", path)
+	return nil
+}
+
+// GoEmitter writes the generated Go packages and their modules, the default
+type GoEmitter struct{}
+
+// Name returns "go"
+func (GoEmitter) Name() string { return "go" }
+
+// Emit writes the generated Go packages
+func (GoEmitter) Emit(out *Output) error { return out.r.emitGo(out) }
+
+// namedEmitters are the emitters configs can list, by name
+var namedEmitters = map[string]func() Emitter{
+	"docs":  func() Emitter { return DocsEmitter{} },
+	"go":    func() Emitter { return GoEmitter{} },
+	"index": func() Emitter { return IndexEmitter{} },
+}
+
+// NewEmitter returns the emitter a config's emit list names
+func NewEmitter(name string) (Emitter, error) {
+	newEmitter, ok := namedEmitters[name]
+	if !ok {
+		var known []string
+		for name := range namedEmitters {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown emitter %q (use: %s)", name, strings.Join(known, ", "))
+	}
+	return newEmitter(), nil
+}
+
+// emitters returns the configured emitters, or the Go emitter alone
+func (r *RecursiveRewriter) emitters() []Emitter {
+	if len(r.config.Emitters) == 0 {
+		return []Emitter{GoEmitter{}}
+	}
+	return r.config.Emitters
+}
+
+// emitsGo reports whether the Go packages are written, which go.mod and
+// go.work directives point at
+func (r *RecursiveRewriter) emitsGo() bool {
+	for _, emitter := range r.emitters() {
+		if _, ok := emitter.(GoEmitter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runEmitters hands the generated packages to each emitter in turn. The Go
+// emitter runs last, since it releases each package's syntax once written.
+func (r *RecursiveRewriter) runEmitters() error {
+	var pkgPaths []string
+	for pkgPath, pkgInfo := range r.packages {
+		if pkgInfo.hasOutput() {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+	out := &Output{Dir: r.config.OutputDir, Fset: r.fset, r: r}
+	for _, pkgPath := range pkgPaths {
+		out.Packages = append(out.Packages, r.packages[pkgPath])
+	}
+
+	ordered := append([]Emitter(nil), r.emitters()...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		_, goI := ordered[i].(GoEmitter)
+		_, goJ := ordered[j].(GoEmitter)
+		return !goI && goJ
+	})
+	for _, emitter := range ordered {
+		if err := emitter.Emit(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
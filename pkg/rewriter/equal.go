@@ -0,0 +1,330 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// equalFile is written next to types.go in packages with compared types
+const equalFile = "equal.go"
+
+// equalGen builds the Equal methods of every generated package at once,
+// since a field of a type from another generated package is compared with
+// that type's Equal
+type equalGen struct {
+	r       *RecursiveRewriter
+	equal   map[string]bool // struct types that get an Equal method, by TypeRef key
+	pkgPath string          // package of the type being compared, whose unexported fields are accessible
+}
+
+// equalMethods returns the Equal methods of each generated package's struct
+// types, by package path. They compare field by field, following pointers
+// and the elements of slices, arrays, and maps, and calling the Equal
+// methods of other types, such as time.Time, where they have one. Like
+// apimachinery's semantic equality, nil and empty slices and maps are equal.
+// Types with a field that can't be compared that way, such as an interface
+// or function, don't get one, nor do the types with a field of theirs. It
+// runs before the packages are written, which releases their syntax.
+func (r *RecursiveRewriter) equalMethods() map[string]string {
+	g := &equalGen{r: r, equal: make(map[string]bool)}
+	marked := make(map[string][]*markedType)
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() || pkgInfo.Verbatim {
+			continue
+		}
+		for _, mt := range r.markedTypes(pkgInfo) {
+			if _, ok := mt.spec.Type.(*ast.StructType); !ok || pkgInfo.Decls[mt.obj.Name()+".Equal"] != nil {
+				continue
+			}
+			if mt.fieldNames()["Equal"] {
+				continue
+			}
+			marked[pkgPath] = append(marked[pkgPath], mt)
+			g.equal[TypeRef{PackagePath: pkgPath, TypeName: mt.obj.Name()}.String()] = true
+		}
+	}
+
+	// Dropping a type can leave a type with a field of it unable to compare
+	// it, so iterate until no more types are dropped
+	for changed := true; changed; {
+		changed = false
+		for pkgPath, pkgTypes := range marked {
+			for _, mt := range pkgTypes {
+				key := TypeRef{PackagePath: pkgPath, TypeName: mt.obj.Name()}.String()
+				if !g.equal[key] {
+					continue
+				}
+				if _, field := g.method(pkgPath, mt); field != "" {
+					slog.Warn("Not generating Equal: a field can't be compared without reflection", "type", key, "field", field)
+					delete(g.equal, key)
+					changed = true
+				}
+			}
+		}
+	}
+
+	methods := make(map[string]string)
+	for pkgPath, pkgTypes := range marked {
+		var body strings.Builder
+		for _, mt := range pkgTypes {
+			if g.equal[TypeRef{PackagePath: pkgPath, TypeName: mt.obj.Name()}.String()] {
+				method, _ := g.method(pkgPath, mt)
+				body.WriteString(method)
+			}
+		}
+		if body.Len() > 0 {
+			methods[pkgPath] = body.String()
+		}
+	}
+	return methods
+}
+
+// fieldNames returns the names of a struct type's fields, in generated code
+func (mt *markedType) fieldNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, field := range mt.spec.Type.(*ast.StructType).Fields.List {
+		for _, ident := range field.Names {
+			names[ident.Name] = true
+		}
+		if len(field.Names) == 0 {
+			names[embeddedFieldName(field.Type)] = true
+		}
+	}
+	return names
+}
+
+// method returns the Equal method of a struct type, or the name of the first
+// field it can't compare
+func (g *equalGen) method(pkgPath string, mt *markedType) (string, string) {
+	g.pkgPath = pkgPath
+	info := g.r.packages[pkgPath].Pkg.TypesInfo
+	var body strings.Builder
+	for _, field := range mt.spec.Type.(*ast.StructType).Fields.List {
+		names := field.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{ast.NewIdent(embeddedFieldName(field.Type))}
+		}
+		for _, ident := range names {
+			if ident.Name == "_" {
+				continue
+			}
+			// Substituted and replaced fields have no type information
+			typ := info.TypeOf(field.Type)
+			if typ == nil {
+				return "", ident.Name
+			}
+			stmts, ok := g.compare(typ, "in."+ident.Name, "other."+ident.Name, 0, make(map[string]bool))
+			if !ok {
+				return "", ident.Name
+			}
+			body.WriteString(stmts)
+		}
+	}
+	return fmt.Sprintf("\n// Equal reports whether in and other hold the same values\nfunc (in %s) Equal(other %s) bool {\n%s\treturn true\n}\n", mt.name, mt.name, body.String()), ""
+}
+
+// compare returns the statements returning false when a and b differ, or
+// false if values of the type can't be compared without reflection. Loop
+// variables are numbered by depth, since loops nest.
+func (g *equalGen) compare(t types.Type, a, b string, depth int, expanding map[string]bool) (string, bool) {
+	t = types.Unalias(t)
+	unequal := "\t\treturn false\n\t}\n"
+	if named, ok := t.(*types.Named); ok {
+		key := namedKey(named)
+		if g.equal[key] {
+			return fmt.Sprintf("\tif !%s.Equal(%s) {\n%s", selectable(a), b, unequal), true
+		}
+		if byPointer, ok := g.equalMethod(named); ok {
+			if byPointer {
+				b = addressOf(b)
+			}
+			return fmt.Sprintf("\tif !%s.Equal(%s) {\n%s", selectable(a), b, unequal), true
+		}
+		if _, isStruct := named.Underlying().(*types.Struct); isStruct && g.generated(named) {
+			// Its fields may have been pruned or substituted, and it has no Equal
+			return "", false
+		}
+	}
+	if g.plainComparable(t) {
+		return fmt.Sprintf("\tif %s != %s {\n%s", a, b, unequal), true
+	}
+
+	suffix := ""
+	if depth > 0 {
+		suffix = strconv.Itoa(depth + 1)
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Pointer:
+		nested, ok := g.compare(u.Elem(), "*"+a, "*"+b, depth, expanding)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("\tif (%s == nil) != (%s == nil) {\n%s\tif %s != nil {\n%s\t}\n", a, b, unequal, a, indent(nested)), true
+	case *types.Slice, *types.Array:
+		elem := u.(interface{ Elem() types.Type }).Elem()
+		i := "i" + suffix
+		nested, ok := g.compare(elem, operand(a)+"["+i+"]", operand(b)+"["+i+"]", depth+1, expanding)
+		if !ok {
+			return "", false
+		}
+		var stmts string
+		if _, isSlice := u.(*types.Slice); isSlice {
+			stmts = fmt.Sprintf("\tif len(%s) != len(%s) {\n%s", a, b, unequal)
+		}
+		return stmts + fmt.Sprintf("\tfor %s := range %s {\n%s\t}\n", i, a, indent(nested)), true
+	case *types.Map:
+		key, value, otherValue := "key"+suffix, "value"+suffix, "otherValue"+suffix
+		nested, ok := g.compare(u.Elem(), value, otherValue, depth+1, expanding)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("\tif len(%s) != len(%s) {\n%s\tfor %s, %s := range %s {\n\t\t%s, ok := %s[%s]\n\t\tif !ok {\n\t\t\treturn false\n\t\t}\n%s\t}\n",
+			a, b, unequal, key, value, a, otherValue, operand(b), key, indent(nested)), true
+	case *types.Struct:
+		if named, ok := t.(*types.Named); ok {
+			// Recursive types would be expanded forever
+			key := namedKey(named)
+			if expanding[key] {
+				return "", false
+			}
+			expanding[key] = true
+			defer delete(expanding, key)
+		}
+		var stmts strings.Builder
+		for i := 0; i < u.NumFields(); i++ {
+			field := u.Field(i)
+			if field.Name() == "_" {
+				continue
+			}
+			if !field.Exported() && (field.Pkg() == nil || field.Pkg().Path() != g.pkgPath) {
+				return "", false
+			}
+			nested, ok := g.compare(field.Type(), selectable(a)+"."+field.Name(), selectable(b)+"."+field.Name(), depth, expanding)
+			if !ok {
+				return "", false
+			}
+			stmts.WriteString(nested)
+		}
+		return stmts.String(), true
+	}
+	return "", false
+}
+
+// equalMethod reports whether a type has an Equal method taking a value of
+// the type, or a pointer to one, and returning a bool. Methods of generated
+// types only count if they were extracted.
+func (g *equalGen) equalMethod(named *types.Named) (byPointer, ok bool) {
+	if g.generated(named) && g.r.packages[named.Obj().Pkg().Path()].Decls[named.Obj().Name()+".Equal"] == nil {
+		return false, false
+	}
+	sel := types.NewMethodSet(types.NewPointer(named)).Lookup(named.Obj().Pkg(), "Equal")
+	if sel == nil {
+		return false, false
+	}
+	sig := sel.Type().(*types.Signature)
+	if sig.Params().Len() != 1 || sig.Results().Len() != 1 || !types.Identical(sig.Results().At(0).Type(), types.Typ[types.Bool]) {
+		return false, false
+	}
+	param := sig.Params().At(0).Type()
+	if types.Identical(param, named) {
+		return false, true
+	}
+	return true, types.Identical(param, types.NewPointer(named))
+}
+
+// generated reports whether a named type is declared by a generated package
+// rather than copied with it
+func (g *equalGen) generated(named *types.Named) bool {
+	if named.Obj().Pkg() == nil {
+		return false
+	}
+	pkgInfo := g.r.packages[named.Obj().Pkg().Path()]
+	return pkgInfo != nil && !pkgInfo.Verbatim && pkgInfo.Decls[named.Obj().Name()] != nil
+}
+
+// plainComparable reports whether == compares values of a type by value:
+// they hold no pointers, interfaces, slices, maps, or generated structs,
+// whose fields may differ from upstream
+func (g *equalGen) plainComparable(t types.Type) bool {
+	if named, ok := types.Unalias(t).(*types.Named); ok {
+		if _, isStruct := named.Underlying().(*types.Struct); isStruct && g.generated(named) {
+			return false
+		}
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		return u.Kind() != types.UnsafePointer && u.Kind() != types.Invalid
+	case *types.Array:
+		return g.plainComparable(u.Elem())
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			if !g.plainComparable(u.Field(i).Type()) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// namedKey returns the TypeRef key of a named type
+func namedKey(named *types.Named) string {
+	ref := TypeRef{TypeName: named.Obj().Name()}
+	if named.Obj().Pkg() != nil {
+		ref.PackagePath = named.Obj().Pkg().Path()
+	}
+	return ref.String()
+}
+
+// operand parenthesizes a dereference, to index it
+func operand(expr string) string {
+	if strings.HasPrefix(expr, "*") {
+		return "(" + expr + ")"
+	}
+	return expr
+}
+
+// selectable returns an expression to select a field or method of, leaving
+// out a single dereference, which selectors do themselves
+func selectable(expr string) string {
+	if strings.HasPrefix(expr, "*") && !strings.HasPrefix(expr, "**") {
+		return expr[1:]
+	}
+	return operand(expr)
+}
+
+// addressOf returns an expression for a pointer to an addressable value
+func addressOf(expr string) string {
+	if strings.HasPrefix(expr, "*") && !strings.HasPrefix(expr, "**") {
+		return expr[1:]
+	}
+	return "&" + expr
+}
+
+// generateEqual writes the package's Equal methods
+func (r *RecursiveRewriter) generateEqual(pkgInfo *PackageInfo, outputPath, methods string) error {
+	if methods == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	r.writeMarkerFileHeader(&buf, pkgInfo, nil)
+	buf.WriteString(methods)
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format Equal methods for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+	outputFile := filepath.Join(outputPath, equalFile)
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "types", strings.Count(methods, ") Equal("))
+	return nil
+}
@@ -0,0 +1,33 @@
+package rewriter
+
+import (
+	"go/types"
+)
+
+// errorMethods are the methods through which fmt and the errors package use
+// a value as an error
+var errorMethods = map[string]bool{"Error": true, "Unwrap": true, "Is": true, "As": true}
+
+// queueErrorMethods queues the error methods of typeName when it implements
+// error, so an extracted error type stays one even without copyMethods. Their
+// bodies bring along the sentinel errors they compare against.
+func (r *RecursiveRewriter) queueErrorMethods(pkgInfo *PackageInfo, typeName string) {
+	obj, ok := pkgInfo.Pkg.Types.Scope().Lookup(typeName).(*types.TypeName)
+	if !ok {
+		return
+	}
+	errorType := types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+	if !types.Implements(obj.Type(), errorType) && !types.Implements(types.NewPointer(obj.Type()), errorType) {
+		return
+	}
+
+	for _, methodName := range pkgInfo.methodNames(typeName) {
+		if !errorMethods[methodName] {
+			continue
+		}
+		r.queueOptional(TypeRef{
+			PackagePath: pkgInfo.Pkg.PkgPath,
+			TypeName:    typeName + "." + methodName,
+		})
+	}
+}
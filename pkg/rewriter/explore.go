@@ -0,0 +1,185 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+)
+
+// DependencyNode is a declaration in the extracted closure
+type DependencyNode struct {
+	Ref      TypeRef
+	Lines    int               // source lines of the declaration itself
+	Children []*DependencyNode // declarations first reached through this one
+	Weight   int               // declarations in this subtree, including this one
+	Size     int               // source lines in this subtree
+}
+
+// BuildDependencyTree extracts the closure of a batch without writing any
+// output, and returns it as a tree: each declaration sits under the one that
+// first referenced it, so a node's weight is roughly what pruning or
+// substituting it would save. Only the packages of the roots are
+// type-checked; the others are parsed, and their dependencies found from
+// syntax alone (see exploreDecl).
+func BuildDependencyTree(configs []*Config) ([]*DependencyNode, error) {
+	r, err := newBatchRewriter(configs)
+	if err != nil {
+		return nil, err
+	}
+	defer r.cleanup()
+	r.exploreRoots = make(map[string]bool)
+	for _, cfg := range configs {
+		r.exploreRoots[cfg.PackagePath] = true
+	}
+	if err := r.processQueue(); err != nil {
+		return nil, err
+	}
+	return r.dependencyTree(), nil
+}
+
+// exploreDecl collects a declaration of a package explore only parsed, and
+// queues what its syntax refers to. Pruning, selecting, and dropping fields
+// apply as in a run, and substituted types end the walk there, but without
+// types, fields whose type is marked +rewriter:skip are kept, and the
+// methods that function bodies call aren't copied (see walkSyntaxForDeps).
+func (r *RecursiveRewriter) exploreDecl(pkgInfo *PackageInfo, typeRef TypeRef) error {
+	if _, ok := r.substitutes[typeRef.String()]; ok {
+		return nil
+	}
+	site, ok := pkgInfo.lookup(typeRef.TypeName)
+	if !ok {
+		// References found in function bodies may not be declarations at all
+		if !r.requiredTypes[typeRef.String()] {
+			return nil
+		}
+		return &Diagnostic{
+			Code:    CodeTypeNotFound,
+			Package: typeRef.PackagePath,
+			Decl:    typeRef.String(),
+			Err:     fmt.Errorf("declaration %s not found in package %s", typeRef.TypeName, typeRef.PackagePath),
+		}
+	}
+
+	switch decl := site.decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Body == nil {
+			return fmt.Errorf("function %s has no Go body (implemented in assembly or linked by name)", typeRef.TypeName)
+		}
+		info := r.collectDecl(pkgInfo, typeRef.TypeName, decl, site.file, decl.Doc)
+		if recvName := receiverTypeName(decl); recvName != "" {
+			r.queueType(pkgInfo.Pkg.PkgPath, recvName)
+		}
+		r.walkFieldListForDeps(pkgInfo, decl.Type.TypeParams)
+		r.walkTypeForDeps(pkgInfo, decl.Type)
+		r.walkExprForDeps(pkgInfo, info, decl.Body)
+
+	case *ast.GenDecl:
+		spec, ok := site.spec.(*ast.TypeSpec)
+		if !ok {
+			if decl.Tok == token.VAR && r.config.Vars == VarsSkip {
+				return fmt.Errorf("package-level variable %s isn't copied (vars: skip)", typeRef.TypeName)
+			}
+			r.collectValueDecl(pkgInfo, decl, site.spec.(*ast.ValueSpec), site.file)
+			return nil
+		}
+		if err := r.pruneFields(typeRef, spec); err != nil {
+			return err
+		}
+		if err := r.selectFields(pkgInfo, typeRef, spec); err != nil {
+			return err
+		}
+		r.dropDeprecatedFields(typeRef, spec)
+		r.dropSkippedFields(pkgInfo, typeRef, spec)
+		r.collectTypeDecl(pkgInfo, spec, decl, site.file)
+		r.walkFieldListForDeps(pkgInfo, spec.TypeParams)
+		r.walkTypeForDeps(pkgInfo, spec.Type)
+		if r.copyMethods(typeRef) {
+			r.queueMethods(pkgInfo, spec.Name.Name)
+		}
+	}
+	return nil
+}
+
+// walkSyntaxForDeps queues what a function body or initializer of an
+// explored package refers to, from its syntax alone: the names the package
+// declares, and the qualified names of the packages it imports. A local
+// variable named like a package-level declaration counts as a reference to
+// it, and method calls aren't resolved, so the closure is an estimate.
+func (r *RecursiveRewriter) walkSyntaxForDeps(pkgInfo *PackageInfo, owner *DeclInfo, node ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if ident, ok := n.X.(*ast.Ident); ok {
+				if _, declared := pkgInfo.lookup(ident.Name); !declared {
+					if pkgPath := importedPath(pkgInfo, ident.Name); pkgPath != "" {
+						if pkgPath != "C" {
+							r.queueDep(owner, TypeRef{PackagePath: pkgPath, TypeName: n.Sel.Name})
+							r.recordImport(pkgInfo, pkgPath, ident.Name)
+						}
+						return false
+					}
+				}
+			}
+			// The selected name is a field or method, not a declaration
+			r.walkSyntaxForDeps(pkgInfo, owner, n.X)
+			return false
+
+		case *ast.Ident:
+			if _, declared := pkgInfo.lookup(n.Name); declared && n.Name != "_" {
+				r.queueDep(owner, TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: n.Name})
+			}
+		}
+		return true
+	})
+}
+
+// dependencyTree arranges the collected declarations by the parent that
+// first queued them
+func (r *RecursiveRewriter) dependencyTree() []*DependencyNode {
+	nodes := make(map[string]*DependencyNode)
+	for pkgPath, pkgInfo := range r.packages {
+		for name, declInfo := range pkgInfo.Decls {
+			ref := TypeRef{PackagePath: pkgPath, TypeName: name}
+			start := r.fset.Position(declInfo.Decl.Pos())
+			end := r.fset.Position(declInfo.Decl.End())
+			nodes[ref.String()] = &DependencyNode{Ref: ref, Lines: end.Line - start.Line + 1}
+		}
+	}
+
+	var roots []*DependencyNode
+	for key, node := range nodes {
+		if parent, ok := nodes[r.parents[key].String()]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	for _, root := range roots {
+		root.weigh()
+	}
+	sortNodes(roots)
+	return roots
+}
+
+// weigh computes the weight and size of the subtree rooted at n and sorts
+// its children, heaviest first
+func (n *DependencyNode) weigh() {
+	n.Weight, n.Size = 1, n.Lines
+	for _, child := range n.Children {
+		child.weigh()
+		n.Weight += child.Weight
+		n.Size += child.Size
+	}
+	sortNodes(n.Children)
+}
+
+func sortNodes(nodes []*DependencyNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Weight != nodes[j].Weight {
+			return nodes[i].Weight > nodes[j].Weight
+		}
+		return nodes[i].Ref.String() < nodes[j].Ref.String()
+	})
+}
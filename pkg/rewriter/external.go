@@ -0,0 +1,105 @@
+package rewriter
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// isKeptExternal reports whether pkgPath matches one of the configured
+// KeepExternal entries, either exactly or as a parent path, or was reached
+// by a local recursion
+func (r *RecursiveRewriter) isKeptExternal(pkgPath string) bool {
+	if r.keptLocal[pkgPath] {
+		return true
+	}
+	for _, entry := range r.config.KeepExternal {
+		if pkgPath == entry || strings.HasPrefix(pkgPath, entry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// keepExternal stops recursion at a package, keeping it as a real
+// dependency that generated modules import and require
+func (r *RecursiveRewriter) keepExternal(typeRef TypeRef, pkgInfo *PackageInfo) error {
+	mod := pkgInfo.Pkg.Module
+	if mod == nil || mod.Version == "" {
+		return fmt.Errorf("package %s is configured to be kept external but its module version is unknown (reached via %s)",
+			typeRef.PackagePath, r.dependencyPath(typeRef))
+	}
+
+	slog.Debug("Keeping package as a real dependency", "package", typeRef.PackagePath, "module", mod.Path+"@"+mod.Version)
+	r.external[typeRef.PackagePath] = mod
+	return nil
+}
+
+// Shim is a published module generated from a source module, such as a
+// shared module of trimmed types. A package of the source module is found at
+// the same path relative to the shim module.
+type Shim struct {
+	Module  string // source module path (e.g., "github.com/argoproj/argo-cd/v3")
+	Path    string // shim module path (e.g., "example.com/platform/argo-types")
+	Version string // shim module version to require (e.g., "v0.3.0")
+}
+
+// inShimModule reports whether pkgPath is within the path of a shimmed
+// module. It may still belong to a nested module that isn't shimmed.
+func (r *RecursiveRewriter) inShimModule(pkgPath string) bool {
+	for _, shim := range r.config.Shims {
+		if pkgPath == shim.Module || strings.HasPrefix(pkgPath, shim.Module+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// shimFor returns the shim configured for a source module, or nil
+func (r *RecursiveRewriter) shimFor(modulePath string) *Shim {
+	for i := range r.config.Shims {
+		if r.config.Shims[i].Module == modulePath {
+			return &r.config.Shims[i]
+		}
+	}
+	return nil
+}
+
+// useShim stops recursion at a package of a shimmed module: generated code
+// imports the shim's copy of the package and requires the shim module
+func (r *RecursiveRewriter) useShim(typeRef TypeRef, pkgInfo *PackageInfo, shim *Shim) error {
+	importPath := shim.Path + strings.TrimPrefix(typeRef.PackagePath, pkgInfo.ModulePath)
+	slog.Debug("Using shim module", "package", typeRef.PackagePath, "shim", importPath+"@"+shim.Version)
+	r.shimmed[typeRef.PackagePath] = importPath
+	r.external[typeRef.PackagePath] = &packages.Module{Path: shim.Path, Version: shim.Version}
+	return nil
+}
+
+// externalRequires returns the modules a generated module needs to require
+// because its packages import packages kept as real dependencies
+func (r *RecursiveRewriter) externalRequires(moduleInfo *ModuleInfo) []*packages.Module {
+	byPath := make(map[string]*packages.Module)
+	for _, pkgPath := range moduleInfo.Packages {
+		pkgInfo, exists := r.packages[pkgPath]
+		if !exists || !pkgInfo.hasOutput() {
+			continue
+		}
+		for importPath := range pkgInfo.Imports {
+			if mod := r.external[importPath]; mod != nil && mod.Path != moduleInfo.Path {
+				byPath[mod.Path] = mod
+			}
+		}
+	}
+
+	var requires []*packages.Module
+	for _, mod := range byPath {
+		requires = append(requires, mod)
+	}
+	sort.Slice(requires, func(i, j int) bool {
+		return requires[i].Path < requires[j].Path
+	})
+	return requires
+}
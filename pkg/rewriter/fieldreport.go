@@ -0,0 +1,165 @@
+package rewriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fieldReportFile is written to the output directory when FieldReport is set
+const fieldReportFile = "field-report.json"
+
+// FieldChange describes a struct field that differs from upstream in
+// generated code, because it was pruned, stripped, replaced, or substituted
+type FieldChange struct {
+	Type   string `json:"type"`         // declaring type (import/path.Name)
+	Field  string `json:"field"`        // path from the type (e.g., Spec.Hooks)
+	Change string `json:"change"`       // "removed" or "retyped"
+	From   string `json:"from"`         // upstream type of the field
+	To     string `json:"to,omitempty"` // type of the field in generated code
+	Reason string `json:"reason"`
+}
+
+const (
+	fieldRemoved = "removed"
+	fieldRetyped = "retyped"
+)
+
+// recordFieldChange notes a change to a field of typeRef. path is the
+// field's path, optionally prefixed with typeRef.
+func (r *RecursiveRewriter) recordFieldChange(typeRef TypeRef, path, change, from, to, reason string) {
+	r.fieldChanges = append(r.fieldChanges, FieldChange{
+		Type:   typeRef.String(),
+		Field:  strings.TrimPrefix(path, typeRef.String()+"."),
+		Change: change,
+		From:   from,
+		To:     to,
+		Reason: reason,
+	})
+}
+
+// fieldTypes returns the type expressions of a struct type's fields, keyed by
+// field name, for comparing before and after a change
+func fieldTypes(spec *ast.TypeSpec) map[string]string {
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return nil
+	}
+	typesByName := make(map[string]string)
+	for _, field := range st.Fields.List {
+		names := []string{embeddedFieldName(field.Type)}
+		if len(field.Names) > 0 {
+			names = names[:0]
+			for _, ident := range field.Names {
+				names = append(names, ident.Name)
+			}
+		}
+		for _, name := range names {
+			typesByName[name] = types.ExprString(field.Type)
+		}
+	}
+	return typesByName
+}
+
+// substituteFieldTypes substitutes types within a type declaration, recording
+// the fields that were retyped
+func (r *RecursiveRewriter) substituteFieldTypes(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) {
+	before := fieldTypes(spec)
+	r.substituteTypes(pkgInfo, spec)
+	after := fieldTypes(spec)
+	for name, from := range before {
+		if to, ok := after[name]; ok && to != from {
+			r.recordFieldChange(typeRef, name, fieldRetyped, from, to, "substituted")
+		}
+	}
+}
+
+// extractedFieldChanges returns the recorded changes to types that made it
+// into the output, sorted by type and field
+func (r *RecursiveRewriter) extractedFieldChanges() []FieldChange {
+	var changes []FieldChange
+	for _, change := range r.fieldChanges {
+		i := strings.LastIndex(change.Type, ".")
+		if pkgInfo := r.packages[change.Type[:i]]; pkgInfo != nil && pkgInfo.Decls[change.Type[i+1:]] != nil {
+			changes = append(changes, change)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Type != changes[j].Type {
+			return changes[i].Type < changes[j].Type
+		}
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// writeFieldReport lists every field that differs from upstream in
+// field-report.json and in the doc comments of the types declaring them
+func (r *RecursiveRewriter) writeFieldReport() error {
+	changes := r.extractedFieldChanges()
+	if changes == nil {
+		changes = []FieldChange{}
+	}
+
+	byType := make(map[string][]FieldChange)
+	for _, change := range changes {
+		byType[change.Type] = append(byType[change.Type], change)
+	}
+	for key, typeChanges := range byType {
+		i := strings.LastIndex(key, ".")
+		r.annotateFieldChanges(r.packages[key[:i]].Decls[key[i+1:]], typeChanges)
+	}
+
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := r.mkdirOutput(r.config.OutputDir); err != nil {
+		return err
+	}
+	path := filepath.Join(r.config.OutputDir, fieldReportFile)
+	if err := r.writeOutputFile(path, append(data, '\n')); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", path, "changes", len(changes))
+	return nil
+}
+
+// annotateFieldChanges appends the changes to a type's fields to its doc
+// comment
+func (r *RecursiveRewriter) annotateFieldChanges(declInfo *DeclInfo, changes []FieldChange) {
+	genDecl, ok := declInfo.Decl.(*ast.GenDecl)
+	if !ok || len(genDecl.Specs) != 1 {
+		return
+	}
+	spec := genDecl.Specs[0].(*ast.TypeSpec)
+	doc := &genDecl.Doc
+	if spec.Doc != nil {
+		doc = &spec.Doc
+	}
+
+	// Place the lines right before the declaration, after any existing doc
+	pos := genDecl.Pos() - 1
+	var list []*ast.Comment
+	if *doc != nil {
+		list = append(list, (*doc).List...)
+		list = append(list, &ast.Comment{Slash: pos, Text: "//"})
+	}
+	lines := []string{"// Fields that differ from upstream:"}
+	for _, change := range changes {
+		line := fmt.Sprintf("//   - %s (%s) removed: %s", change.Field, change.From, change.Reason)
+		if change.Change == fieldRetyped {
+			line = fmt.Sprintf("//   - %s retyped from %s to %s: %s", change.Field, change.From, change.To, change.Reason)
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		list = append(list, &ast.Comment{Slash: pos, Text: line})
+	}
+	*doc = &ast.CommentGroup{List: list}
+}
@@ -0,0 +1,173 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// structRef is a reference to a generated type from a field of a struct
+// type
+type structRef struct {
+	pkgPath string
+	owner   string // type whose declaration contains the reference
+}
+
+// flattenStructs replaces each struct type that's only referenced once, from
+// a field of another struct type in its package, with an anonymous struct in
+// that field, and drops its declaration. Types the configs asked for, and
+// types with methods, options, or type parameters, keep their names. It runs
+// before applyRenames, while references still resolve through the type info.
+func (r *RecursiveRewriter) flattenStructs() {
+	if !r.config.FlattenStructs {
+		return
+	}
+
+	// Count the references to every generated type, noting where those from
+	// struct fields are
+	counts := make(map[string]int)
+	fieldRefs := make(map[string]structRef)
+	verbatimImports := make(map[string]bool)
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() {
+			continue
+		}
+		if pkgInfo.Verbatim {
+			// Whatever a verbatim package refers to keeps its name
+			for importPath := range pkgInfo.Pkg.Imports {
+				verbatimImports[importPath] = true
+			}
+			continue
+		}
+		info := pkgInfo.Pkg.TypesInfo
+		if info == nil {
+			continue
+		}
+		for name, declInfo := range pkgInfo.Decls {
+			fields := make(map[*ast.Ident]bool)
+			if spec := structSpec(declInfo.Decl); spec != nil {
+				for _, field := range spec.Type.(*ast.StructType).Fields.List {
+					if len(field.Names) == 0 {
+						continue // Embedded fields are named after their type
+					}
+					ast.Inspect(field.Type, func(n ast.Node) bool {
+						if ident, ok := n.(*ast.Ident); ok {
+							fields[ident] = true
+						}
+						return true
+					})
+				}
+			}
+			ast.Inspect(declInfo.Decl, func(n ast.Node) bool {
+				ident, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				obj, ok := info.Uses[ident].(*types.TypeName)
+				if !ok || obj.Pkg() == nil {
+					return true
+				}
+				key := TypeRef{PackagePath: obj.Pkg().Path(), TypeName: obj.Name()}.String()
+				counts[key]++
+				if fields[ident] && obj.Pkg().Path() == pkgPath {
+					fieldRefs[key] = structRef{pkgPath: pkgPath, owner: name}
+				}
+				return true
+			})
+		}
+	}
+
+	var candidates []string
+	for key, ref := range fieldRefs {
+		if counts[key] == 1 && !verbatimImports[ref.pkgPath] && r.flattenable(ref.pkgPath, strings.TrimPrefix(key, ref.pkgPath+".")) {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Strings(candidates)
+
+	// Types flattened into others, to the type whose declaration they're in
+	into := make(map[string]string)
+	ownerOf := func(key string) string {
+		owner := fieldRefs[key].owner
+		for into[owner] != "" {
+			owner = into[owner]
+		}
+		return owner
+	}
+	for _, key := range candidates {
+		ref := fieldRefs[key]
+		pkgInfo := r.packages[ref.pkgPath]
+		name := strings.TrimPrefix(key, ref.pkgPath+".")
+		owner := ownerOf(key)
+		if owner == name {
+			continue // It would end up inside itself
+		}
+		body := structSpec(pkgInfo.Decls[name].Decl).Type
+
+		info := pkgInfo.Pkg.TypesInfo
+		astutil.Apply(pkgInfo.Decls[owner].Decl, func(c *astutil.Cursor) bool {
+			ident, ok := c.Node().(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if obj, ok := info.Uses[ident].(*types.TypeName); ok && obj.Pkg() != nil && obj.Pkg().Path() == ref.pkgPath && obj.Name() == name {
+				c.Replace(body)
+			}
+			return true
+		}, nil)
+		delete(pkgInfo.Decls, name)
+		into[name] = owner
+		slog.Info("Flattened struct", "type", key, "into", TypeRef{PackagePath: ref.pkgPath, TypeName: owner}.String())
+	}
+}
+
+// flattenable reports whether a struct type may lose its name: nobody asked
+// for it, no methods were extracted with it, it has no options, and it isn't
+// generic
+func (r *RecursiveRewriter) flattenable(pkgPath, name string) bool {
+	pkgInfo := r.packages[pkgPath]
+	declInfo, exists := pkgInfo.Decls[name]
+	if !exists {
+		return false
+	}
+	spec := structSpec(declInfo.Decl)
+	key := TypeRef{PackagePath: pkgPath, TypeName: name}.String()
+	if spec == nil || spec.TypeParams != nil || spec.Assign.IsValid() {
+		return false
+	}
+	if _, queued := r.parents[key]; !queued && r.requiredTypes[key] {
+		return false
+	}
+	if _, hasOptions := r.typeOptions[key]; hasOptions {
+		return false
+	}
+	return !hasMethodDecls(pkgInfo, name)
+}
+
+// hasMethodDecls reports whether methods of typeName were extracted
+func hasMethodDecls(pkgInfo *PackageInfo, typeName string) bool {
+	for name := range pkgInfo.Decls {
+		if recv, _, ok := strings.Cut(name, "."); ok && recv == typeName {
+			return true
+		}
+	}
+	return false
+}
+
+// structSpec returns the spec of a declaration of a single struct type
+func structSpec(decl ast.Decl) *ast.TypeSpec {
+	genDecl, ok := decl.(*ast.GenDecl)
+	if !ok || genDecl.Tok != token.TYPE || len(genDecl.Specs) != 1 {
+		return nil
+	}
+	spec := genDecl.Specs[0].(*ast.TypeSpec)
+	if _, ok := spec.Type.(*ast.StructType); !ok {
+		return nil
+	}
+	return spec
+}
@@ -0,0 +1,103 @@
+package rewriter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// managedMarker starts and ends the lines package-rewriter maintains in a
+// file it shares with the user
+const managedMarker = "package-rewriter"
+
+// writeGitMetadata marks the output as generated for code hosts: a
+// .gitattributes in the output directory flags everything in it as
+// linguist-generated, and a CODEOWNERS entry assigns it owners
+func (r *RecursiveRewriter) writeGitMetadata() error {
+	if r.config.GitAttributes {
+		path := filepath.Join(r.config.OutputDir, ".gitattributes")
+		if err := updateManagedBlock(path, "", []string{"* linguist-generated=true"}); err != nil {
+			return err
+		}
+		slog.Info("Updated", "file", path)
+	}
+
+	if len(r.config.CodeOwners) == 0 {
+		return nil
+	}
+	outputDir, err := filepath.Abs(r.config.OutputDir)
+	if err != nil {
+		return err
+	}
+	// Resolve symlinks, since git reports the real path
+	if resolved, err := filepath.EvalSymlinks(outputDir); err == nil {
+		outputDir = resolved
+	}
+	root, err := gitTopLevel(outputDir)
+	if err != nil {
+		return fmt.Errorf("CODEOWNERS needs the output inside a git repository: %w", err)
+	}
+	rel, err := filepath.Rel(root, outputDir)
+	if err != nil {
+		return err
+	}
+
+	// Use the repository's CODEOWNERS wherever the code host looks for it
+	path := filepath.Join(root, ".github", "CODEOWNERS")
+	for _, candidate := range []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"} {
+		if _, err := os.Stat(filepath.Join(root, candidate)); err == nil {
+			path = filepath.Join(root, candidate)
+			break
+		}
+	}
+	pattern := "/" + filepath.ToSlash(rel) + "/"
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := updateManagedBlock(path, pattern, []string{pattern + " " + strings.Join(r.config.CodeOwners, " ")}); err != nil {
+		return err
+	}
+	slog.Info("Updated", "file", path, "pattern", pattern)
+	return nil
+}
+
+// updateManagedBlock replaces the block of lines package-rewriter maintains
+// in a file, identified by id, leaving the rest of the file alone. A new
+// block is appended, since later lines take precedence in both
+// .gitattributes and CODEOWNERS.
+func updateManagedBlock(path, id string, lines []string) error {
+	begin := strings.TrimSpace("# BEGIN " + managedMarker + " " + id)
+	end := strings.TrimSpace("# END " + managedMarker + " " + id)
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	block := begin + "\n" + strings.Join(lines, "\n") + "\n" + end + "\n"
+	existing := string(content)
+	if start := strings.Index(existing, begin+"\n"); start >= 0 {
+		if stop := strings.Index(existing[start:], end+"\n"); stop >= 0 {
+			existing = existing[:start] + block + existing[start+stop+len(end)+1:]
+			return os.WriteFile(path, []byte(existing), 0o644)
+		}
+	}
+	if existing != "" && !strings.HasSuffix(existing, "\n") {
+		existing += "\n"
+	}
+	return os.WriteFile(path, []byte(existing+block), 0o644)
+}
+
+// gitTopLevel returns the root of the git repository containing dir
+func gitTopLevel(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
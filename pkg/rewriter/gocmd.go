@@ -0,0 +1,135 @@
+package rewriter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultGoTimeout bounds a go command when Config.GoTimeout isn't set. It's
+// long enough for go mod tidy or go get to download a large module graph.
+const DefaultGoTimeout = 10 * time.Minute
+
+// goSlots limits how many go commands run at once in the process. Server
+// requests and parallel jobs each run their own, and a single go command
+// already keeps every CPU busy.
+var goSlots = make(chan struct{}, max(2, runtime.GOMAXPROCS(0)/2))
+
+// goCommand is a run of the go command
+type goCommand struct {
+	dir     string
+	args    []string
+	env     []string      // added to the process environment, overriding it (KEY=value)
+	timeout time.Duration // defaults to DefaultGoTimeout
+}
+
+// GoError is a go command that failed, with what it wrote to standard error
+type GoError struct {
+	Args     []string // arguments after "go"
+	Dir      string
+	Stderr   string
+	TimedOut bool
+	Err      error
+}
+
+func (e *GoError) Error() string {
+	cause := e.Err.Error()
+	if e.TimedOut {
+		cause = "timed out"
+	}
+	msg := fmt.Sprintf("go %s failed: %s", strings.Join(e.Args, " "), cause)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += "\nOutput: " + stderr
+	}
+	return msg
+}
+
+func (e *GoError) Unwrap() error { return e.Err }
+
+// run runs the command, waiting for a free slot first, and returns its
+// standard output. Standard error is logged at debug level as it's written,
+// and kept for the error.
+func (c goCommand) run(ctx context.Context) ([]byte, error) {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = DefaultGoTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case goSlots <- struct{}{}:
+		defer func() { <-goSlots }()
+	case <-ctx.Done():
+		return nil, &GoError{Args: c.args, Dir: c.dir, TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded), Err: ctx.Err()}
+	}
+
+	cmd := exec.CommandContext(ctx, "go", c.args...)
+	cmd.Dir = c.dir
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	// Don't wait forever on processes the go command left holding the pipes
+	cmd.WaitDelay = 10 * time.Second
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &lineLogger{buf: &stderr, args: c.args}
+
+	start := time.Now()
+	err := cmd.Run()
+	slog.Debug("Ran go command", "args", c.args, "dir", c.dir, "duration", time.Since(start))
+	if err != nil {
+		return stdout.Bytes(), &GoError{
+			Args:     c.args,
+			Dir:      c.dir,
+			Stderr:   stderr.String(),
+			TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+			Err:      err,
+		}
+	}
+	return stdout.Bytes(), nil
+}
+
+// lineLogger keeps what a go command writes, logging each complete line
+type lineLogger struct {
+	buf     *bytes.Buffer
+	args    []string
+	partial []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf.Write(p)
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		slog.Debug("go "+l.args[0], "output", string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// goCommand returns a go command run in dir with the configured environment
+// and timeout
+func (r *RecursiveRewriter) goCommand(dir string, args ...string) goCommand {
+	return goCommand{dir: dir, args: args, env: r.config.GoEnv, timeout: r.config.GoTimeout}
+}
+
+// goEnviron returns the environment packages are loaded with: the process
+// environment with the configured overrides, or nil for the process
+// environment alone
+func (r *RecursiveRewriter) goEnviron() []string {
+	if len(r.config.GoEnv) == 0 {
+		return nil
+	}
+	return append(os.Environ(), r.config.GoEnv...)
+}
@@ -1,16 +1,25 @@
 package rewriter
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 )
 
-// GoModManager handles reading and writing go.mod files
+// GoModManager edits a go.mod file: its require, exclude, and replace
+// directives. Edits are made to the parsed file, so comments and the layout
+// of what isn't edited are kept, and nothing is written until Save; Diff
+// shows what Save would change. It can be used outside the rewriter, by
+// other tools that update go.mod files.
 type GoModManager struct {
 	path    string
 	file    *modfile.File
@@ -19,21 +28,28 @@ type GoModManager struct {
 
 // NewGoModManager creates a new go.mod manager
 func NewGoModManager(path string) (*GoModManager, error) {
-	content, err := os.ReadFile(path)
+	m := &GoModManager{path: path}
+	if err := m.read(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// read reads and parses go.mod, dropping edits that weren't saved
+func (m *GoModManager) read() error {
+	content, err := os.ReadFile(m.path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read go.mod: %w", err)
+		return fmt.Errorf("failed to read go.mod: %w", err)
 	}
 
-	file, err := modfile.Parse(path, content, nil)
+	file, err := modfile.Parse(m.path, content, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse go.mod: %w", err)
+		return fmt.Errorf("failed to parse go.mod: %w", err)
 	}
 
-	return &GoModManager{
-		path:    path,
-		file:    file,
-		content: content,
-	}, nil
+	m.file = file
+	m.content = content
+	return nil
 }
 
 // HasReplace checks if a replace directive exists for the given module path
@@ -48,28 +64,343 @@ func (m *GoModManager) HasReplace(modulePath string) bool {
 
 // RemoveReplace removes a replace directive for the given module path
 func (m *GoModManager) RemoveReplace(modulePath string) error {
-	return m.file.DropReplace(modulePath, "")
+	if err := m.file.DropReplace(modulePath, ""); err != nil {
+		return err
+	}
+	m.file.Cleanup()
+	return nil
 }
 
 // AddReplace adds a replace directive
 func (m *GoModManager) AddReplace(modulePath, localPath string) error {
-	return m.file.AddReplace(modulePath, "", localPath, "")
+	return m.addReplace(modulePath, module.Version{Path: localPath})
+}
+
+// Replaces reports whether go.mod replaces every version of a module with
+// exactly the given target
+func (m *GoModManager) Replaces(modulePath, newPath, newVersion string) bool {
+	for _, replace := range m.file.Replace {
+		if replace.Old.Path == modulePath && replace.Old.Version == "" {
+			return replace.New.Path == newPath && replace.New.Version == newVersion
+		}
+	}
+	return false
+}
+
+// AddReplaceVersion adds a replace directive pointing at a module version
+// rather than a directory
+func (m *GoModManager) AddReplaceVersion(modulePath string, target module.Version) error {
+	return m.addReplace(modulePath, target)
+}
+
+// addReplace replaces every version of a module with target, updating an
+// existing directive in place or adding one to the last replace block
+func (m *GoModManager) addReplace(modulePath string, target module.Version) error {
+	existing := slices.ContainsFunc(m.file.Replace, func(replace *modfile.Replace) bool {
+		return replace.Old.Path == modulePath && replace.Old.Version == ""
+	})
+	if err := m.file.AddReplace(modulePath, "", target.Path, target.Version); err != nil || existing {
+		return err
+	}
+	for _, replace := range m.file.Replace {
+		if replace.Old.Path == modulePath && replace.Old.Version == "" {
+			m.moveToBlock(replace.Syntax, "replace", func(*modfile.Line) bool { return true })
+		}
+	}
+	return nil
+}
+
+// moveToBlock moves a directive's line to the end of the last block of verb
+// directives whose lines all fit, unless it's in that block already
+func (m *GoModManager) moveToBlock(line *modfile.Line, verb string, fits func(*modfile.Line) bool) {
+	var target *modfile.LineBlock
+	for _, stmt := range m.file.Syntax.Stmt {
+		block, ok := stmt.(*modfile.LineBlock)
+		if ok && len(block.Token) == 1 && block.Token[0] == verb && !slices.ContainsFunc(block.Line, func(l *modfile.Line) bool { return !fits(l) }) {
+			target = block
+		}
+	}
+	if target == nil || slices.Contains(target.Line, line) {
+		return
+	}
+
+	stmts := m.file.Syntax.Stmt[:0]
+	for _, stmt := range m.file.Syntax.Stmt {
+		switch stmt := stmt.(type) {
+		case *modfile.Line:
+			if stmt == line {
+				continue
+			}
+		case *modfile.LineBlock:
+			stmt.Line = slices.DeleteFunc(stmt.Line, func(l *modfile.Line) bool { return l == line })
+		}
+		stmts = append(stmts, stmt)
+	}
+	m.file.Syntax.Stmt = stmts
+	if !line.InBlock {
+		line.Token = line.Token[1:] // the verb is the block's
+		line.InBlock = true
+	}
+	target.Line = append(target.Line, line)
+	// Drops the block the line leaves if it's empty now
+	m.file.Cleanup()
+}
+
+// Requirement is a require directive
+type Requirement struct {
+	Mod      module.Version
+	Indirect bool // marked // indirect
+}
+
+// Replacement is a replace directive. Old.Version is empty when every
+// version is replaced, and New.Version when the replacement is a directory.
+type Replacement struct {
+	Old, New module.Version
+}
+
+// Path returns the path of the go.mod file
+func (m *GoModManager) Path() string {
+	return m.path
+}
+
+// ListRequires returns the require directives, in file order
+func (m *GoModManager) ListRequires() []Requirement {
+	var requires []Requirement
+	for _, require := range m.file.Require {
+		requires = append(requires, Requirement{Mod: require.Mod, Indirect: require.Indirect})
+	}
+	return requires
+}
+
+// AddRequire requires a module version, updating the version and indirect
+// comment of an existing requirement in place
+func (m *GoModManager) AddRequire(modulePath, version string, indirect bool) error {
+	if err := module.Check(modulePath, version); err != nil {
+		return err
+	}
+	// SetRequire edits existing lines in place, keeping their comments
+	var requires []*modfile.Require
+	found := false
+	for _, require := range m.file.Require {
+		updated := &modfile.Require{Mod: require.Mod, Indirect: require.Indirect}
+		if require.Mod.Path == modulePath {
+			updated.Mod.Version, updated.Indirect = version, indirect
+			found = true
+		}
+		requires = append(requires, updated)
+	}
+	if !found {
+		requires = append(requires, &modfile.Require{Mod: module.Version{Path: modulePath, Version: version}, Indirect: indirect})
+	}
+	m.file.SetRequire(requires)
+	if found {
+		return nil
+	}
+
+	// A new requirement goes to the last block of requirements that are
+	// all direct, or all indirect, like it
+	lines := make(map[*modfile.Line]bool) // indirect, by line
+	var line *modfile.Line
+	for _, require := range m.file.Require {
+		lines[require.Syntax] = require.Indirect
+		if require.Mod.Path == modulePath {
+			line = require.Syntax
+		}
+	}
+	m.moveToBlock(line, "require", func(l *modfile.Line) bool { return lines[l] == indirect })
+	return nil
+}
+
+// RemoveRequire removes the require directive of a module
+func (m *GoModManager) RemoveRequire(modulePath string) error {
+	if err := m.file.DropRequire(modulePath); err != nil {
+		return err
+	}
+	m.file.Cleanup()
+	return nil
+}
+
+// ListExcludes returns the excluded module versions, in file order
+func (m *GoModManager) ListExcludes() []module.Version {
+	var excludes []module.Version
+	for _, exclude := range m.file.Exclude {
+		excludes = append(excludes, exclude.Mod)
+	}
+	return excludes
+}
+
+// AddExclude excludes a module version, unless it's excluded already
+func (m *GoModManager) AddExclude(modulePath, version string) error {
+	if err := module.Check(modulePath, version); err != nil {
+		return err
+	}
+	return m.file.AddExclude(modulePath, version)
+}
+
+// RemoveExclude removes the exclude directive of a module version
+func (m *GoModManager) RemoveExclude(modulePath, version string) error {
+	if err := m.file.DropExclude(modulePath, version); err != nil {
+		return err
+	}
+	m.file.Cleanup()
+	return nil
+}
+
+// ListReplaces returns the replace directives, in file order
+func (m *GoModManager) ListReplaces() []Replacement {
+	var replaces []Replacement
+	for _, replace := range m.file.Replace {
+		replaces = append(replaces, Replacement{Old: replace.Old, New: replace.New})
+	}
+	return replaces
+}
+
+// checkReplaceWith validates the module@version targets generated modules
+// are replaced with
+func checkReplaceWith(replaceWith map[string]string) error {
+	for modulePath, target := range replaceWith {
+		if _, err := parseReplaceTarget(target); err != nil {
+			return fmt.Errorf("invalid replacement for %s: %w", modulePath, err)
+		}
+	}
+	return nil
+}
+
+// parseReplaceTarget splits a module@version replacement
+func parseReplaceTarget(target string) (module.Version, error) {
+	path, version, ok := strings.Cut(target, "@")
+	if !ok {
+		return module.Version{}, fmt.Errorf("%q has no version (use: module/path@version)", target)
+	}
+	if err := module.Check(path, version); err != nil {
+		return module.Version{}, err
+	}
+	return module.Version{Path: path, Version: version}, nil
+}
+
+// generatedReplaces returns the modules go.mod replaces with generated
+// code: with a directory inside the output directory, or with the version
+// configured by ReplaceWith
+func (r *RecursiveRewriter) generatedReplaces(goMod *GoModManager) []string {
+	outputDir, err := filepath.Abs(r.config.OutputDir)
+	if err != nil {
+		return nil
+	}
+	var modulePaths []string
+	for _, replace := range goMod.file.Replace {
+		if _, ok := r.config.ReplaceWith[replace.Old.Path]; ok {
+			modulePaths = append(modulePaths, replace.Old.Path)
+			continue
+		}
+		if replace.New.Version != "" {
+			continue
+		}
+		dir := replace.New.Path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(goMod.path), dir)
+		}
+		if rel, err := filepath.Rel(outputDir, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			modulePaths = append(modulePaths, replace.Old.Path)
+		}
+	}
+	return modulePaths
 }
 
-// Save writes the modified go.mod back to disk
+// loadWithoutGeneratedReplaces has packages loaded from the real modules
+// rather than the generated code go.mod replaces them with, without
+// touching go.mod: they're loaded through a temporary copy of it without
+// those replace directives, tidied so that its go.sum has the checksums of
+// the real modules
+func (r *RecursiveRewriter) loadWithoutGeneratedReplaces(goMod *GoModManager) error {
+	replaced := r.generatedReplaces(goMod)
+	if len(replaced) == 0 {
+		return nil
+	}
+	path, err := r.tempModFile("go.mod replaces modules with generated code")
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := modfile.Parse(path, content, nil)
+	if err != nil {
+		return fmt.Errorf("failed to parse go.mod: %w", err)
+	}
+	for _, modulePath := range replaced {
+		if err := file.DropReplace(modulePath, ""); err != nil {
+			return err
+		}
+	}
+	if content, err = file.Format(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("Loading packages without the replace directives of generated modules", "modules", replaced)
+	if _, err := r.goCommand(r.modDir, "mod", "tidy", "-modfile="+path).run(context.Background()); err != nil {
+		slog.Warn("Failed to tidy the temporary go.mod", "error", err)
+	}
+	return nil
+}
+
+// replaceTarget returns the module version configured to replace a
+// generated module, if any
+func (r *RecursiveRewriter) replaceTarget(modulePath string) (module.Version, bool) {
+	target, ok := r.config.ReplaceWith[modulePath]
+	if !ok {
+		return module.Version{}, false
+	}
+	// checkReplaceWith has validated it
+	version, _ := parseReplaceTarget(target)
+	return version, true
+}
+
+// Changed reports whether go.mod differs from what was read, or last saved
+func (m *GoModManager) Changed() bool {
+	formatted, err := m.file.Format()
+	return err != nil || !bytes.Equal(formatted, m.content)
+}
+
+// Diff returns the changes Save would write as a unified diff, or "" if
+// go.mod is unchanged
+func (m *GoModManager) Diff() (string, error) {
+	formatted, err := m.file.Format()
+	if err != nil {
+		return "", fmt.Errorf("failed to format go.mod: %w", err)
+	}
+	return unifiedDiff(m.path, m.content, formatted), nil
+}
+
+// Save writes the modified go.mod back to disk, unless it's unchanged
 func (m *GoModManager) Save() error {
 	formatted, err := m.file.Format()
 	if err != nil {
 		return fmt.Errorf("failed to format go.mod: %w", err)
 	}
+	if bytes.Equal(formatted, m.content) {
+		return nil
+	}
 
 	if err := os.WriteFile(m.path, formatted, 0644); err != nil {
 		return fmt.Errorf("failed to write go.mod: %w", err)
 	}
+	m.content = formatted
 
 	return nil
 }
 
+// ModulePath returns the path of the module go.mod declares
+func (m *GoModManager) ModulePath() string {
+	if m.file.Module == nil {
+		return ""
+	}
+	return m.file.Module.Mod.Path
+}
+
 // GetReplaces returns all replace directives as a map
 func (m *GoModManager) GetReplaces() map[string]string {
 	replaces := make(map[string]string)
@@ -79,17 +410,27 @@ func (m *GoModManager) GetReplaces() map[string]string {
 	return replaces
 }
 
-// Tidy runs 'go mod tidy' in the directory containing the go.mod file
+// Tidy runs 'go mod tidy' in the directory containing the go.mod file, in
+// the process environment. See TidyContext.
 func (m *GoModManager) Tidy() error {
-	dir := filepath.Dir(m.path)
-	cmd := exec.Command("go", "mod", "tidy")
-	cmd.Dir = dir
+	return m.TidyContext(context.Background(), nil, 0)
+}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("go mod tidy failed: %w\nOutput: %s", err, string(output))
+// TidyContext runs 'go mod tidy' in the directory containing the go.mod
+// file, with env added to the process environment (KEY=value), and stops it
+// after timeout, or DefaultGoTimeout when it's zero. Pending edits are saved
+// first, and go.mod is read again after go mod tidy rewrites it, so later
+// edits and Save start from the tidied file. A failure of the go command is
+// a *GoError.
+func (m *GoModManager) TidyContext(ctx context.Context, env []string, timeout time.Duration) error {
+	if err := m.Save(); err != nil {
+		return err
 	}
-
-	return nil
+	cmd := goCommand{dir: filepath.Dir(m.path), args: []string{"mod", "tidy"}, env: env, timeout: timeout}
+	if _, err := cmd.run(ctx); err != nil {
+		return err
+	}
+	return m.read()
 }
 
 // FindGoMod finds the go.mod file starting from the current directory
@@ -0,0 +1,308 @@
+package rewriter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// copyGoMod copies a go.mod from testdata/gomod into a temporary directory
+func copyGoMod(t *testing.T, name string) *GoModManager {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", "gomod", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "go.mod")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goMod, err := NewGoModManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goMod
+}
+
+// withBlankContext adds the space starting the blank context lines of a
+// unified diff, which are left empty in the test cases
+func withBlankContext(diff string) string {
+	lines := strings.SplitAfter(diff, "\n")
+	for i, line := range lines {
+		if line == "\n" {
+			lines[i] = " \n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestGoModManagerList(t *testing.T) {
+	goMod := copyGoMod(t, "staging.mod")
+	if got := goMod.ModulePath(); got != "k8s.io/kubernetes" {
+		t.Errorf("ModulePath() = %q", got)
+	}
+
+	requires := goMod.ListRequires()
+	if len(requires) != 7 {
+		t.Fatalf("ListRequires() = %v, want 7", requires)
+	}
+	if got, want := requires[5], (Requirement{Mod: module.Version{Path: "github.com/docker/docker", Version: "v26.1.4+incompatible"}, Indirect: true}); got != want {
+		t.Errorf("ListRequires()[5] = %v, want %v", got, want)
+	}
+	if requires[1].Indirect {
+		t.Errorf("a comment other than // indirect marks %v indirect", requires[1])
+	}
+
+	wantExcludes := []module.Version{{Path: "github.com/docker/docker", Version: "v26.0.0+incompatible"}}
+	if got := goMod.ListExcludes(); !reflect.DeepEqual(got, wantExcludes) {
+		t.Errorf("ListExcludes() = %v, want %v", got, wantExcludes)
+	}
+
+	wantReplaces := []Replacement{
+		{Old: module.Version{Path: "k8s.io/api"}, New: module.Version{Path: "./staging/src/k8s.io/api"}},
+		{Old: module.Version{Path: "k8s.io/apimachinery"}, New: module.Version{Path: "./staging/src/k8s.io/apimachinery"}},
+		{Old: module.Version{Path: "k8s.io/klog/v2", Version: "v2.130.0"}, New: module.Version{Path: "k8s.io/klog/v2", Version: "v2.130.1"}},
+	}
+	if got := goMod.ListReplaces(); !reflect.DeepEqual(got, wantReplaces) {
+		t.Errorf("ListReplaces() = %v, want %v", got, wantReplaces)
+	}
+}
+
+func TestGoModManagerEdit(t *testing.T) {
+	goMod := copyGoMod(t, "staging.mod")
+	before, err := os.ReadFile(goMod.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing lines are edited in place, keeping their comments, and new
+	// requirements go to the block matching their indirect comment
+	for _, err := range []error{
+		goMod.AddRequire("go.etcd.io/etcd/client/v3", "v3.5.22", false),
+		goMod.AddRequire("github.com/beorn7/perks", "v1.0.1", false),
+		goMod.AddRequire("github.com/google/go-cmp", "v0.7.0", true),
+		goMod.AddRequire("sigs.k8s.io/yaml", "v1.4.0", false),
+		goMod.RemoveRequire("gopkg.in/yaml.v3"),
+		goMod.AddExclude("github.com/docker/docker", "v26.0.0+incompatible"),
+		goMod.AddExclude("github.com/docker/docker", "v26.0.1+incompatible"),
+		goMod.RemoveReplace("k8s.io/api"),
+		goMod.AddReplace("k8s.io/client-go", "./staging/src/k8s.io/client-go"),
+		goMod.AddReplace("k8s.io/apimachinery", "./staging/src/k8s.io/apimachinery"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is written until Save
+	if content, err := os.ReadFile(goMod.Path()); err != nil || string(content) != string(before) {
+		t.Fatalf("go.mod written before Save (%v)", err)
+	}
+	diff, err := goMod.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := goMod.Path()
+	wantDiff := "--- " + path + "\n+++ " + path + "\n" + withBlankContext(`@@ -10,24 +10,28 @@
+
+ require (
+ 	github.com/spf13/cobra v1.9.1
+-	go.etcd.io/etcd/client/v3 v3.5.21 // pinned for the 1.33 release
++	go.etcd.io/etcd/client/v3 v3.5.22 // pinned for the 1.33 release
+ 	k8s.io/api v0.0.0
+ 	k8s.io/apimachinery v0.0.0
++	sigs.k8s.io/yaml v1.4.0
+ )
+
+ require (
+-	github.com/beorn7/perks v1.0.1 // indirect
++	github.com/beorn7/perks v1.0.1
+ 	github.com/docker/docker v26.1.4+incompatible // indirect
+-	gopkg.in/yaml.v3 v3.0.1 // indirect
++	github.com/google/go-cmp v0.7.0 // indirect
+ )
+
+-exclude github.com/docker/docker v26.0.0+incompatible
++exclude (
++	github.com/docker/docker v26.0.0+incompatible
++	github.com/docker/docker v26.0.1+incompatible
++)
+
+ replace (
+-	k8s.io/api => ./staging/src/k8s.io/api
+ 	// apimachinery is developed in staging
+ 	k8s.io/apimachinery => ./staging/src/k8s.io/apimachinery
+ 	k8s.io/klog/v2 v2.130.0 => k8s.io/klog/v2 v2.130.1
++	k8s.io/client-go => ./staging/src/k8s.io/client-go
+ )
+
+ tool golang.org/x/tools/cmd/stringer
+`)
+	if diff != wantDiff {
+		t.Errorf("Diff():\n%s\nwant:\n%s", diff, wantDiff)
+	}
+
+	if err := goMod.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(goMod.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"// This is a generated file. Do not edit directly.\n", "godebug default=go1.24\n", "\t// apimachinery is developed in staging\n"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("saved go.mod lost %q:\n%s", want, content)
+		}
+	}
+	if diff, err := goMod.Diff(); err != nil || diff != "" || goMod.Changed() {
+		t.Errorf("go.mod changed after Save: %q (%v)", diff, err)
+	}
+}
+
+func TestGoModManagerLegacy(t *testing.T) {
+	// A go 1.16 file has a single require block, and no newline at its end
+	goMod := copyGoMod(t, "legacy.mod")
+	if err := goMod.AddRequire("golang.org/x/net", "v0.0.0-20210226172049-e18ecbb05110", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.AddRequire("golang.org/x/text", "v0.3.5", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.RemoveReplace("github.com/pkg/errors"); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := goMod.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := goMod.Path()
+	wantDiff := "--- " + path + "\n+++ " + path + "\n" + withBlankContext(`@@ -4,9 +4,8 @@
+
+ require (
+ 	github.com/pkg/errors v0.9.1
+-	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
++	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
++	golang.org/x/text v0.3.5 // indirect
+ )
+
+ retract v1.0.0 // published by mistake
+-
+-replace github.com/pkg/errors => ../errors
+\ No newline at end of file
+`)
+	if diff != wantDiff {
+		t.Errorf("Diff():\n%s\nwant:\n%s", diff, wantDiff)
+	}
+
+	for _, err := range []error{
+		goMod.AddRequire("github.com/pkg/errors", "latest", false),
+		goMod.AddRequire("github.com/pkg/errors/v2", "v1.0.0", false),
+		goMod.AddExclude("github.com/pkg/errors", "v0.9"),
+	} {
+		if err == nil {
+			t.Errorf("Expected an invalid version to be rejected")
+		}
+	}
+}
+
+func TestGoModManagerTidy(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "go.mod")
+	if err := os.WriteFile(path, []byte("module example.com/tidy\n\ngo 1.22\n\nrequire golang.org/x/mod v0.29.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goMod, err := NewGoModManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An edit made before tidying is saved, and the unused requirement go
+	// mod tidy drops stays dropped when the manager saves again
+	if err := goMod.AddReplace("example.com/local", "../local"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.TidyContext(context.Background(), []string{"GOFLAGS=-mod=mod", "GOPROXY=off"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if requires := goMod.ListRequires(); len(requires) != 0 {
+		t.Errorf("ListRequires() after Tidy = %v, want none", requires)
+	}
+	if goMod.Changed() {
+		t.Error("go.mod changed after Tidy")
+	}
+	if err := goMod.AddExclude("golang.org/x/mod", "v0.28.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "module example.com/tidy\n\ngo 1.22\n\nreplace example.com/local => ../local\n\nexclude golang.org/x/mod v0.28.0\n"
+	if string(content) != want {
+		t.Errorf("saved go.mod:\n%s\nwant:\n%s", content, want)
+	}
+
+	var goErr *GoError
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"example.com/missing\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := goMod.TidyContext(context.Background(), []string{"GOFLAGS=-mod=mod", "GOPROXY=off"}, time.Minute); !errors.As(err, &goErr) {
+		t.Errorf("Expected a *GoError for an import that doesn't resolve, got %v", err)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var old, new strings.Builder
+	for i := 1; i <= 20; i++ {
+		line := strings.Repeat("x", i) + "\n"
+		old.WriteString(line)
+		switch i {
+		case 2:
+			new.WriteString("changed\n")
+		case 18:
+		default:
+			new.WriteString(line)
+		}
+	}
+	// The changes are far enough apart for a hunk each
+	want := `--- a
++++ a
+@@ -1,5 +1,5 @@
+ x
+-xx
++changed
+ xxx
+ xxxx
+ xxxxx
+@@ -15,6 +15,5 @@
+ xxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxx
+-xxxxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxxxxx
+`
+	if got := unifiedDiff("a", []byte(old.String()), []byte(new.String())); got != want {
+		t.Errorf("unifiedDiff:\n%s\nwant:\n%s", got, want)
+	}
+	if got := unifiedDiff("a", []byte("same\n"), []byte("same\n")); got != "" {
+		t.Errorf("unifiedDiff of equal files = %q", got)
+	}
+	if got := unifiedDiff("a", nil, []byte("new\n")); got != "--- a\n+++ a\n@@ -0,0 +1 @@\n+new\n" {
+		t.Errorf("unifiedDiff from nothing = %q", got)
+	}
+}
@@ -0,0 +1,164 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/format"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gvkFile is written next to types.go in packages with Kubernetes kinds
+const gvkFile = "gvk.go"
+
+// generateGVK writes Group and Version constants, a Kind constant for each of
+// the package's kinds (the struct types embedding TypeMeta or ObjectMeta),
+// and a GroupVersionKind method returning them. The group and version come
+// from the source package's registration.
+func (r *RecursiveRewriter) generateGVK(pkgInfo *PackageInfo, outputPath string) error {
+	var kinds []*markedType
+	for _, mt := range r.markedTypes(pkgInfo) {
+		if isKind(mt) && pkgInfo.Decls[mt.obj.Name()+".GroupVersionKind"] == nil {
+			kinds = append(kinds, mt)
+		}
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	group, version, ok := groupVersion(pkgInfo)
+	if !ok {
+		slog.Warn("Skipping GroupVersionKind helpers for a package without a registered group", "package", pkgInfo.Pkg.PkgPath)
+		return nil
+	}
+
+	// Constants the package already declares are reused when they agree
+	var consts []string
+	declare := func(name, value, doc string) error {
+		if pkgInfo.Decls[name] != nil {
+			if c, ok := pkgInfo.Pkg.Types.Scope().Lookup(name).(*types.Const); ok && c.Val().Kind() == constant.String && constant.StringVal(c.Val()) == value {
+				return nil
+			}
+			return fmt.Errorf("can't declare %s = %q in %s, which already declares %s", name, value, pkgInfo.Pkg.PkgPath, name)
+		}
+		consts = append(consts, fmt.Sprintf("\t// %s\n\t%s = %q\n", doc, name, value))
+		return nil
+	}
+	if err := declare("Group", group, "Group is the API group of the package's kinds"); err != nil {
+		return err
+	}
+	if err := declare("Version", version, "Version is the API version of the package's kinds"); err != nil {
+		return err
+	}
+	for _, mt := range kinds {
+		if err := declare(mt.name+"Kind", mt.obj.Name(), mt.name+"Kind is the kind of "+mt.name); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	r.writeMarkerFileHeader(&buf, pkgInfo, nil)
+	if len(consts) > 0 {
+		fmt.Fprintf(&buf, "\nconst (\n%s)\n", strings.Join(consts, ""))
+	}
+	for _, mt := range kinds {
+		fmt.Fprintf(&buf, "\n// GroupVersionKind returns the group, version, and kind of %s\n", mt.name)
+		fmt.Fprintf(&buf, "func (*%s) GroupVersionKind() (group, version, kind string) {\n\treturn Group, Version, %sKind\n}\n", mt.name, mt.name)
+	}
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format GroupVersionKind helpers for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+	outputFile := filepath.Join(outputPath, gvkFile)
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "group", group, "version", version, "kinds", len(kinds))
+	return nil
+}
+
+// isKind reports whether a type is a Kubernetes kind, which embeds TypeMeta
+// or ObjectMeta
+func isKind(mt *markedType) bool {
+	for _, f := range mt.fields {
+		if len(f.field.Names) == 0 && (f.goName == "TypeMeta" || f.goName == "ObjectMeta") {
+			return true
+		}
+	}
+	return false
+}
+
+// groupVersion finds the group and version a package registers its kinds
+// under: the GroupVersion it declares in register.go (or
+// groupversion_info.go, for kubebuilder projects), or else its +groupName
+// marker and the last element of its path
+func groupVersion(pkgInfo *PackageInfo) (string, string, bool) {
+	info := pkgInfo.Pkg.TypesInfo
+	var markerGroup string
+	for _, f := range pkgInfo.Pkg.Syntax {
+		for _, group := range f.Comments {
+			for _, c := range group.List {
+				text := strings.TrimSpace(strings.TrimPrefix(c.Text, "//"))
+				if value, ok := strings.CutPrefix(text, "+groupName="); ok && markerGroup == "" {
+					markerGroup = strings.TrimSpace(value)
+				}
+			}
+		}
+		if info == nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range genDecl.Specs {
+				for _, value := range spec.(*ast.ValueSpec).Values {
+					if group, version, ok := groupVersionLiteral(info, value); ok {
+						return group, version, true
+					}
+				}
+			}
+		}
+	}
+	if markerGroup == "" {
+		return "", "", false
+	}
+	return markerGroup, path.Base(pkgInfo.Pkg.PkgPath), true
+}
+
+// groupVersionLiteral evaluates a GroupVersion{Group: ..., Version: ...}
+// composite literal whose fields are constants
+func groupVersionLiteral(info *types.Info, expr ast.Expr) (string, string, bool) {
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		return "", "", false
+	}
+	named, ok := types.Unalias(info.TypeOf(lit)).(*types.Named)
+	if !ok || named.Obj().Name() != "GroupVersion" {
+		return "", "", false
+	}
+	fields := make(map[string]string)
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if tv, ok := info.Types[kv.Value]; ok && tv.Value != nil && tv.Value.Kind() == constant.String {
+			fields[key.Name] = constant.StringVal(tv.Value)
+		}
+	}
+	group, hasGroup := fields["Group"]
+	version := fields["Version"]
+	return group, version, hasGroup && version != ""
+}
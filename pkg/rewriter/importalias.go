@@ -0,0 +1,238 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// assignImportAliases gives each package imported by the generated code of
+// pkgInfo a single alias, whichever source files its declarations came from,
+// and rewrites the references in the collected declarations to use it. The
+// alias is the explicit one the source files use most (the shortest on a
+// tie), or else the package's name. Aliases taken by another import, by the
+// name of another imported package, or by an identifier declared in the
+// copied code are skipped, and a numbered package name is the last resort.
+func (r *RecursiveRewriter) assignImportAliases(pkgInfo *PackageInfo) {
+	info := pkgInfo.Pkg.TypesInfo
+	if pkgInfo.Verbatim || len(pkgInfo.Imports) == 0 || info == nil {
+		return
+	}
+
+	counts := make(map[string]map[string]int)
+	for _, f := range pkgInfo.Pkg.Syntax {
+		for _, imp := range f.Imports {
+			if imp.Name == nil || imp.Name.Name == "_" || imp.Name.Name == "." {
+				continue
+			}
+			importPath := imp.Path.Value[1 : len(imp.Path.Value)-1]
+			if isMangledAlias(importPath, imp.Name.Name) {
+				continue
+			}
+			if counts[importPath] == nil {
+				counts[importPath] = make(map[string]int)
+			}
+			counts[importPath][imp.Name.Name]++
+		}
+	}
+
+	var paths []string
+	names := make(map[string]string)        // import path -> package name
+	packageNames := make(map[string]string) // package name -> an import path with it
+	for importPath, used := range pkgInfo.Imports {
+		if len(used) == 1 && used["_"] {
+			continue // Imported for its side effects alone
+		}
+		paths = append(paths, importPath)
+		names[importPath] = r.importedPackageName(pkgInfo, importPath)
+	}
+	sort.Strings(paths)
+	for _, importPath := range paths {
+		if _, exists := packageNames[names[importPath]]; !exists {
+			packageNames[names[importPath]] = importPath
+		}
+	}
+
+	taken := make(map[string]bool)
+	for name := range pkgInfo.Decls {
+		taken[name] = true
+	}
+	for _, declInfo := range pkgInfo.Decls {
+		ast.Inspect(declInfo.Decl, func(n ast.Node) bool {
+			// Locals could shadow the alias; fields and methods can't
+			if ident, ok := n.(*ast.Ident); ok && info.Defs[ident] != nil && info.Defs[ident].Parent() != nil {
+				taken[ident.Name] = true
+			}
+			return true
+		})
+	}
+
+	aliases := make(map[string]string)
+	for _, importPath := range paths {
+		var candidates []string
+		for alias := range counts[importPath] {
+			if other, exists := packageNames[alias]; !exists || other == importPath {
+				candidates = append(candidates, alias)
+			}
+		}
+		explicit := counts[importPath]
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if explicit[a] != explicit[b] {
+				return explicit[a] > explicit[b]
+			}
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return a < b
+		})
+		candidates = append(candidates, names[importPath])
+
+		alias := ""
+		for _, candidate := range candidates {
+			if !taken[candidate] {
+				alias = candidate
+				break
+			}
+		}
+		for n := 2; alias == ""; n++ {
+			if candidate := fmt.Sprintf("%s%d", names[importPath], n); !taken[candidate] {
+				alias = candidate
+			}
+		}
+		taken[alias] = true
+		aliases[importPath] = alias
+	}
+
+	for _, declInfo := range pkgInfo.Decls {
+		ast.Inspect(declInfo.Decl, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if alias, ok := aliases[selectorImportPath(pkgInfo, sel)]; ok {
+				sel.X.(*ast.Ident).Name = alias
+			}
+			return true
+		})
+	}
+	for importPath, alias := range aliases {
+		pkgInfo.Imports[importPath] = map[string]bool{alias: true}
+	}
+}
+
+// importedPackageName returns the name declared by an imported package
+func (r *RecursiveRewriter) importedPackageName(pkgInfo *PackageInfo, importPath string) string {
+	if imported := pkgInfo.Pkg.Imports[importPath]; imported != nil && imported.Name != "" {
+		return imported.Name
+	}
+	if loaded := r.packages[importPath]; loaded != nil && loaded.Pkg.Name != "" {
+		return loaded.Pkg.Name
+	}
+	return path.Base(importPath)
+}
+
+// selectorImportPath returns the import path of the package a selector
+// qualifies, like k8s.io/api/core/v1 for corev1.Pod, or "" if it selects a
+// field or method instead
+func selectorImportPath(pkgInfo *PackageInfo, sel *ast.SelectorExpr) string {
+	ident, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	info := pkgInfo.Pkg.TypesInfo
+	if pkgName, ok := info.Uses[ident].(*types.PkgName); ok {
+		return pkgName.Imported().Path()
+	}
+	if info.Uses[ident] == nil && info.Defs[ident] == nil {
+		// Qualifiers added by substitution aren't in the type info
+		return pathForAlias(pkgInfo, ident.Name)
+	}
+	return ""
+}
+
+// pathForAlias returns the only import path recorded under alias, or ""
+func pathForAlias(pkgInfo *PackageInfo, alias string) string {
+	found := ""
+	for importPath, aliases := range pkgInfo.Imports {
+		if aliases[alias] {
+			if found != "" {
+				return ""
+			}
+			found = importPath
+		}
+	}
+	return found
+}
+
+// importDecl returns the import declaration of a generated package's
+// types.go, grouped the way goimports does: the standard library, then
+// packages kept as real dependencies, then generated packages, each group
+// sorted by path and separated by a blank line
+func (r *RecursiveRewriter) importDecl(pkgInfo *PackageInfo) string {
+	type importSpec struct{ path, alias string }
+	groups := make([][]importSpec, 3)
+	for pkgPath, aliases := range pkgInfo.Imports {
+		group := 2
+		switch {
+		case r.isStdlib(r.importPath(pkgPath)):
+			group = 0
+		case r.external[pkgPath] != nil:
+			group = 1
+		case r.packages[pkgPath] == nil || !r.packages[pkgPath].hasOutput():
+			continue // Unused, or checkDanglingImports would have failed
+		}
+		for alias := range aliases {
+			spec := importSpec{path: r.importPath(pkgPath)}
+			// Compared with the path imported, which differs for substitutes
+			if alias != path.Base(spec.path) {
+				spec.alias = alias
+			}
+			groups[group] = append(groups[group], spec)
+		}
+	}
+
+	var lines []string
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].path != group[j].path {
+				return group[i].path < group[j].path
+			}
+			return group[i].alias < group[j].alias
+		})
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		for _, spec := range group {
+			line := strconv.Quote(spec.path)
+			if spec.alias != "" {
+				line = spec.alias + " " + line
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	switch len(lines) {
+	case 0:
+		return ""
+	case 1:
+		return "import " + lines[0] + "\n"
+	}
+	var b strings.Builder
+	b.WriteString("import (\n")
+	for _, line := range lines {
+		if line != "" {
+			b.WriteString("\t" + line)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(")\n")
+	return b.String()
+}
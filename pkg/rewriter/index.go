@@ -0,0 +1,84 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// declSite locates a top-level declaration in a package's syntax
+type declSite struct {
+	decl ast.Decl
+	spec ast.Spec // the TypeSpec or ValueSpec declaring the name; nil for functions and methods
+	file *ast.File
+}
+
+// declIndex indexes the top-level declarations of a package loaded for
+// extraction by name, and its methods by receiver type and name (e.g.,
+// "List.Len"), so a package listing many roots, or reached through many
+// references, is only scanned once. Where several declarations share a name,
+// like init functions, the first one is indexed.
+type declIndex struct {
+	sites   map[string]declSite
+	methods map[string][]string // method names of each receiver type, in source order
+}
+
+// index returns the package's declaration index, building it on first use
+func (p *PackageInfo) index() *declIndex {
+	if p.declIndex != nil {
+		return p.declIndex
+	}
+	idx := &declIndex{
+		sites:   make(map[string]declSite),
+		methods: make(map[string][]string),
+	}
+	add := func(name string, site declSite) {
+		if _, exists := idx.sites[name]; !exists {
+			idx.sites[name] = site
+		}
+	}
+	for _, f := range p.Pkg.Syntax {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					add(d.Name.Name, declSite{decl: d, file: f})
+					continue
+				}
+				recvName := receiverTypeName(d)
+				key := recvName + "." + d.Name.Name
+				if _, exists := idx.sites[key]; !exists {
+					idx.methods[recvName] = append(idx.methods[recvName], d.Name.Name)
+				}
+				add(key, declSite{decl: d, file: f})
+
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						add(s.Name.Name, declSite{decl: d, spec: s, file: f})
+					case *ast.ValueSpec:
+						if d.Tok != token.CONST && d.Tok != token.VAR {
+							continue
+						}
+						for _, ident := range s.Names {
+							add(ident.Name, declSite{decl: d, spec: s, file: f})
+						}
+					}
+				}
+			}
+		}
+	}
+	p.declIndex = idx
+	return idx
+}
+
+// lookup returns where name is declared, if it is
+func (p *PackageInfo) lookup(name string) (declSite, bool) {
+	site, ok := p.index().sites[name]
+	return site, ok
+}
+
+// methodNames returns the names of the methods declared on typeName
+func (p *PackageInfo) methodNames(typeName string) []string {
+	return p.index().methods[typeName]
+}
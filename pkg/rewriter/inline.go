@@ -0,0 +1,188 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"reflect"
+	"slices"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// inlineTypes replaces references within node to types configured to be
+// inlined with a copy of the type declared in the referencing package, so
+// the type's own package isn't extracted for it. It runs before node is
+// walked for dependencies, like substituteTypes.
+func (r *RecursiveRewriter) inlineTypes(pkgInfo *PackageInfo, node ast.Node) error {
+	info := pkgInfo.Pkg.TypesInfo
+	if len(r.config.Inline) == 0 || info == nil {
+		return nil
+	}
+
+	var err error
+	astutil.Apply(node, func(c *astutil.Cursor) bool {
+		sel, ok := c.Node().(*ast.SelectorExpr)
+		if !ok || err != nil {
+			return err == nil
+		}
+		obj, ok := info.Uses[sel.Sel].(*types.TypeName)
+		if !ok || obj.Pkg() == nil || obj.Pkg().Path() == pkgInfo.Pkg.PkgPath {
+			return true
+		}
+		typeRef := TypeRef{PackagePath: obj.Pkg().Path(), TypeName: obj.Name()}
+		if !slices.Contains(r.config.Inline, typeRef.String()) {
+			return true
+		}
+		var name string
+		if name, err = r.inlineCopy(pkgInfo, typeRef); err != nil {
+			return false
+		}
+		c.Replace(&ast.Ident{NamePos: sel.Pos(), Name: name})
+		return false
+	}, nil)
+	return err
+}
+
+// inlineCopy declares a copy of an inlined type in pkgInfo's package, once,
+// and returns its name there: the type's own name, unless the package
+// declares something by that name, in which case it's suffixed with the last
+// element of the type's package path
+func (r *RecursiveRewriter) inlineCopy(pkgInfo *PackageInfo, typeRef TypeRef) (string, error) {
+	if name, ok := pkgInfo.Inlined[typeRef.String()]; ok {
+		return name, nil
+	}
+
+	source, err := r.loadPackageInfo(typeRef.PackagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load %s to inline it: %w", typeRef, err)
+	}
+	site, _ := source.lookup(typeRef.TypeName)
+	spec, ok := site.spec.(*ast.TypeSpec)
+	if !ok {
+		return "", fmt.Errorf("can't inline %s: not a type", typeRef)
+	}
+	if spec.TypeParams != nil {
+		return "", fmt.Errorf("can't inline %s: generic types can't be inlined", typeRef)
+	}
+
+	imports, dep := r.inlineImports(source, spec)
+	if dep != nil {
+		return "", fmt.Errorf("can't inline %s: it refers to %s, and only predeclared and standard library types can be inlined", typeRef, dep.Name())
+	}
+
+	name := typeRef.TypeName
+	if r.declaredIn(pkgInfo, name) {
+		name += pathSuffix(typeRef.PackagePath, 1)
+		for i := 2; r.declaredIn(pkgInfo, name); i++ {
+			name = typeRef.TypeName + pathSuffix(typeRef.PackagePath, 1) + fmt.Sprint(i)
+		}
+	}
+
+	inlined := cloneNode(spec)
+	inlined.Name = &ast.Ident{NamePos: spec.Name.Pos(), Name: name}
+	decl := &ast.GenDecl{TokPos: spec.Pos(), Tok: token.TYPE, Specs: []ast.Spec{inlined}}
+	comment := spec.Doc
+	if genDecl := site.decl.(*ast.GenDecl); len(genDecl.Specs) == 1 {
+		comment = genDecl.Doc
+	}
+	info := r.collectDecl(pkgInfo, name, decl, site.file, comment)
+	info.PackagePath = typeRef.PackagePath
+	for alias, importPath := range imports {
+		r.recordImport(pkgInfo, importPath, alias)
+	}
+
+	if pkgInfo.Inlined == nil {
+		pkgInfo.Inlined = make(map[string]string)
+	}
+	pkgInfo.Inlined[typeRef.String()] = name
+	slog.Info("Inlined type", "type", typeRef.String(), "package", pkgInfo.Pkg.PkgPath, "name", name)
+	return name, nil
+}
+
+// inlineImports returns the standard library packages a type declaration
+// refers to, by name, or else the first thing it refers to that keeps it
+// from being inlined: the copy can only refer to what's the same from any
+// package
+func (r *RecursiveRewriter) inlineImports(source *PackageInfo, spec *ast.TypeSpec) (map[string]string, types.Object) {
+	imports := make(map[string]string)
+	var dep types.Object
+	ast.Inspect(spec.Type, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok || dep != nil {
+			return dep == nil
+		}
+		switch obj := source.Pkg.TypesInfo.Uses[ident].(type) {
+		case nil:
+		case *types.PkgName:
+			if r.isStdlib(obj.Imported().Path()) {
+				imports[ident.Name] = obj.Imported().Path()
+			} else {
+				dep = obj
+			}
+		default:
+			if obj.Pkg() != nil && obj.Pkg().Path() == source.Pkg.PkgPath {
+				dep = obj
+			}
+		}
+		return true
+	})
+	return imports, dep
+}
+
+// declaredIn reports whether name is declared in a package, in its source or
+// by inlining
+func (r *RecursiveRewriter) declaredIn(pkgInfo *PackageInfo, name string) bool {
+	if _, ok := pkgInfo.Decls[name]; ok {
+		return true
+	}
+	return pkgInfo.Pkg.Types.Scope().Lookup(name) != nil
+}
+
+// cloneNode deep-copies a syntax tree, so it can be changed independently
+// of the original. Objects and scopes from the parser are shared.
+func cloneNode[T ast.Node](node T) T {
+	return cloneValue(reflect.ValueOf(node)).Interface().(T)
+}
+
+var (
+	objectType = reflect.TypeOf((*ast.Object)(nil))
+	scopeType  = reflect.TypeOf((*ast.Scope)(nil))
+)
+
+func cloneValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() || v.Type() == objectType || v.Type() == scopeType {
+			return v
+		}
+		clone := reflect.New(v.Type().Elem())
+		clone.Elem().Set(cloneValue(v.Elem()))
+		return clone
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		clone := reflect.New(v.Type()).Elem()
+		clone.Set(cloneValue(v.Elem()))
+		return clone
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		clone := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			clone.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return clone
+	case reflect.Struct:
+		clone := reflect.New(v.Type()).Elem()
+		for i := range v.NumField() {
+			clone.Field(i).Set(cloneValue(v.Field(i)))
+		}
+		return clone
+	}
+	return v
+}
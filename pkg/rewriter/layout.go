@@ -0,0 +1,300 @@
+package rewriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/version"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// importPath returns the import path generated code uses for pkgPath.
+// Packages we generate move under the import prefix, if one is configured,
+// and packages provided by a shim module are imported from it; stdlib and
+// packages kept as real dependencies keep their path.
+func (r *RecursiveRewriter) importPath(pkgPath string) string {
+	if shimPath, ok := r.shimmed[pkgPath]; ok {
+		return shimPath
+	}
+	if r.config.ImportPrefix == "" {
+		return pkgPath
+	}
+	if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() {
+		return path.Join(r.config.ImportPrefix, pkgInfo.OutputSubdir)
+	}
+	return pkgPath
+}
+
+// rewriteFileImports rewrites the imports of a copied source file to the
+// import paths of generated packages. Files are returned unchanged when no
+// import needs rewriting.
+func (r *RecursiveRewriter) rewriteFileImports(filename string, content []byte) ([]byte, error) {
+	if r.config.ImportPrefix == "" && len(r.shimmed) == 0 {
+		return content, nil
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, content, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	rewritten := false
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		if newPath := r.importPath(path); newPath != path {
+			rewritten = astutil.RewriteImport(fset, file, path, newPath) || rewritten
+		}
+	}
+	if !rewritten {
+		return content, nil
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return nil, fmt.Errorf("failed to format %s: %w", filename, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// checkOutputPaths fails if two generated packages would be written to the
+// same directory, or to directories differing only in case, which share a
+// directory on case-insensitive file systems. One package's files would
+// silently replace the other's.
+func (r *RecursiveRewriter) checkOutputPaths() error {
+	var pkgPaths []string
+	for pkgPath, pkgInfo := range r.packages {
+		if pkgInfo.hasOutput() {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+
+	dirs := make(map[string]string) // lowercased output subdirectory to the package written there
+	for _, pkgPath := range pkgPaths {
+		dir := r.packages[pkgPath].OutputSubdir
+		key := strings.ToLower(dir)
+		other, exists := dirs[key]
+		if !exists {
+			dirs[key] = pkgPath
+			continue
+		}
+		otherDir := r.packages[other].OutputSubdir
+		where := "both be written to " + path.Join(filepath.ToSlash(r.config.OutputDir), dir)
+		if otherDir != dir {
+			where = fmt.Sprintf("be written to %s and %s, which differ only in case", otherDir, dir)
+		}
+		return fmt.Errorf("packages %s (%s) and %s (%s) would %s",
+			other, r.packageOrigin(other), pkgPath, r.packageOrigin(pkgPath), where)
+	}
+	return nil
+}
+
+// packageOrigin describes the config entry a generated package comes from
+func (r *RecursiveRewriter) packageOrigin(pkgPath string) string {
+	pkgInfo := r.packages[pkgPath]
+	if pkgInfo.Verbatim {
+		return "copied verbatim"
+	}
+	names := sortedDeclNames(pkgInfo)
+	return "reached via " + r.dependencyPath(TypeRef{PackagePath: pkgPath, TypeName: names[0]})
+}
+
+// Layout controls where generated modules are placed in the output
+// directory
+type Layout string
+
+const (
+	// LayoutModulePath places each module at its module path (the default)
+	LayoutModulePath Layout = "module-path"
+	// LayoutThirdParty places each module at third_party/generated/<module
+	// path>, the way monorepos keep vendored code apart, and records where
+	// each one went in module-map.json
+	LayoutThirdParty Layout = "third-party"
+	// LayoutUmbrella places every generated package in one module at the
+	// root of the output directory, imported from under the module's path,
+	// so consumers need a single replace directive
+	LayoutUmbrella Layout = "umbrella"
+	// LayoutInternal places every generated package inside the consuming
+	// module, under a directory named internal, so the copies can't be
+	// imported from outside it and leak into its public API
+	LayoutInternal Layout = "internal"
+)
+
+const (
+	thirdPartyDir = "third_party/generated"
+	moduleMapFile = "module-map.json"
+)
+
+// writeModuleMap writes module-map.json to the output directory, mapping the
+// path of every generated module to its directory relative to the output
+// directory. Configs sharing the output directory share the file: entries
+// for modules whose go.mod another config generated are kept.
+func (r *RecursiveRewriter) writeModuleMap(modulePaths []string) error {
+	mapPath := filepath.Join(r.config.OutputDir, moduleMapFile)
+	moduleMap := make(map[string]string)
+	if content, err := os.ReadFile(mapPath); err == nil {
+		var existing map[string]string
+		if err := json.Unmarshal(content, &existing); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", mapPath, err)
+		}
+		for modulePath, dir := range existing {
+			if _, owned := r.otherOwners[dir+"/go.mod"]; owned {
+				moduleMap[modulePath] = dir
+			}
+		}
+	}
+	for _, modulePath := range modulePaths {
+		moduleMap[modulePath] = r.moduleDir(modulePath)
+	}
+
+	// Maps are marshaled with sorted keys
+	data, err := json.MarshalIndent(moduleMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if existing, err := os.ReadFile(mapPath); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	if err := r.writeFile(mapPath, data); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", mapPath, "modules", len(modulePaths))
+	return nil
+}
+
+// checkUmbrella validates the umbrella layout settings of a batch
+func checkUmbrella(config *Config) error {
+	if config.ImportPrefix != "" || config.Publish != nil {
+		return fmt.Errorf("the %s layout generates its own module, so it can't be combined with an import prefix or publishing", config.Layout)
+	}
+	if err := module.CheckPath(config.UmbrellaModule); err != nil {
+		return fmt.Errorf("the %s layout requires a valid module path: %w", config.Layout, err)
+	}
+	return nil
+}
+
+// checkInternal validates the internal layout settings of a batch and sets
+// its import prefix, as checkInModule does
+func checkInternal(config *Config) error {
+	if err := checkInModule(config); err != nil {
+		return err
+	}
+	if !slices.Contains(strings.Split(config.ImportPrefix, "/"), "internal") {
+		return fmt.Errorf("the %s layout requires the generated packages to be under an internal directory, but %s isn't (e.g., output: ./internal/generated)", config.Layout, config.ImportPrefix)
+	}
+	return nil
+}
+
+// checkInModule validates the settings of a batch generating plain packages
+// inside the consuming module and sets its import prefix: given, or derived
+// from where the output directory sits in the module
+func checkInModule(config *Config) error {
+	if config.Publish != nil {
+		return fmt.Errorf("generating packages inside the consuming module can't be combined with publishing")
+	}
+	switch config.Layout {
+	case LayoutThirdParty, LayoutUmbrella:
+		return fmt.Errorf("the %s layout generates modules, so it can't be combined with generating packages inside the consuming module", config.Layout)
+	}
+	if config.ImportPrefix != "" {
+		return nil
+	}
+	goMod, err := goEnv(config.Dir, "GOMOD")
+	if err != nil {
+		return err
+	}
+	if goMod == "" || goMod == os.DevNull {
+		return fmt.Errorf("generating packages inside the consuming module requires one, but there's no go.mod")
+	}
+	content, err := os.ReadFile(goMod)
+	if err != nil {
+		return err
+	}
+	outputDir, err := filepath.Abs(config.OutputDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.Dir(goMod), outputDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("generating packages inside the consuming module requires the output directory to be in it, but %s is outside %s", config.OutputDir, filepath.Dir(goMod))
+	}
+	config.ImportPrefix = path.Join(modfile.ModulePath(content), filepath.ToSlash(rel))
+	return nil
+}
+
+// generatesModules reports whether consumers resolve the generated code
+// through replace or use directives, rather than finding it inside their
+// own module under an import prefix, or it isn't written as Go at all
+func (r *RecursiveRewriter) generatesModules() bool {
+	return r.emitsGo() && (r.config.ImportPrefix == "" || r.config.Layout == LayoutUmbrella)
+}
+
+// generatedModules returns the paths of the generated modules consumers
+// need replace or use directives for, sorted: the umbrella module, or each
+// module with generated packages
+func (r *RecursiveRewriter) generatedModules() []string {
+	if r.config.Layout == LayoutUmbrella {
+		return []string{r.config.UmbrellaModule}
+	}
+	var modulePaths []string
+	for modulePath, moduleInfo := range r.modules {
+		if r.isStdlib(modulePath) {
+			continue
+		}
+		for _, pkgPath := range moduleInfo.Packages {
+			if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() {
+				modulePaths = append(modulePaths, modulePath)
+				break
+			}
+		}
+	}
+	sort.Strings(modulePaths)
+	return modulePaths
+}
+
+// generateUmbrellaModule writes the go.mod of the umbrella module to the
+// root of the output directory. It targets the newest Go version of the
+// source modules, so every package builds.
+func (r *RecursiveRewriter) generateUmbrellaModule() error {
+	umbrella := &ModuleInfo{Path: r.config.UmbrellaModule}
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() {
+			continue
+		}
+		umbrella.Packages = append(umbrella.Packages, pkgPath)
+		source := r.modules[pkgInfo.ModulePath]
+		if source != nil && source.GoVersion != "" && (umbrella.GoVersion == "" || version.Compare("go"+source.GoVersion, "go"+umbrella.GoVersion) > 0) {
+			umbrella.GoVersion, umbrella.Toolchain = source.GoVersion, source.Toolchain
+		}
+	}
+	sort.Strings(umbrella.Packages)
+
+	if err := r.mkdirOutput(r.config.OutputDir); err != nil {
+		return err
+	}
+	goModPath := filepath.Join(r.config.OutputDir, "go.mod")
+	if err := r.writeOutputFile(goModPath, []byte(r.goModContent(umbrella))); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", goModPath, "packages", len(umbrella.Packages))
+	return nil
+}
@@ -0,0 +1,230 @@
+package rewriter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestFile is written to the output directory, listing the SHA-256 of
+// every file generated there in the format of sha256sum, so it can be
+// checked with sha256sum -c. When several configs share the output
+// directory, each one's files follow an "# owner: <owner>" comment line,
+// which sha256sum ignores. A "# version: <version>" line first records the
+// rewriter version of the last run.
+const manifestFile = "package-rewriter.sum"
+
+const (
+	manifestOwnerPrefix   = "# owner: "
+	manifestVersionPrefix = "# version: "
+)
+
+// manifestEntry is a file recorded in the manifest
+type manifestEntry struct {
+	hash  string
+	owner string // Config.Owner of the run that generated it
+}
+
+// parseManifest reads the manifest in dir, keyed by path relative to dir,
+// and the rewriter version that wrote it, if recorded
+func parseManifest(dir string) (map[string]manifestEntry, string) {
+	entries := make(map[string]manifestEntry)
+	content, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return entries, ""
+	}
+	owner, version := "", ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, manifestOwnerPrefix); ok {
+			owner = name
+			continue
+		}
+		if v, ok := strings.CutPrefix(line, manifestVersionPrefix); ok {
+			version = v
+			continue
+		}
+		if hash, rel, ok := strings.Cut(line, "  "); ok {
+			entries[rel] = manifestEntry{hash: hash, owner: owner}
+		}
+	}
+	return entries, version
+}
+
+// readManifest loads the hashes recorded by the previous run into the same
+// output directory, if any, and the files other configs generated there. It
+// warns when that run used another rewriter version, whose output may differ
+// for reasons unrelated to the config.
+func (r *RecursiveRewriter) readManifest() {
+	r.previousHashes = make(map[string]string)
+	r.outputHashes = make(map[string]string)
+	r.otherOwners = make(map[string]string)
+	entries, version := parseManifest(r.config.OutputDir)
+	if version != "" && version != Version() {
+		slog.Warn("Output was generated by another package-rewriter version; changes may come from the version rather than the config",
+			"dir", r.config.OutputDir, "previous", version, "current", Version())
+	}
+	for rel, entry := range entries {
+		if entry.owner == r.config.Owner {
+			r.previousHashes[rel] = entry.hash
+		} else {
+			r.otherOwners[rel] = entry.owner
+		}
+	}
+}
+
+// checkOwnership fails, before anything is written, if this run would write
+// to a directory holding files another config generated, so configs sharing
+// an output directory can't replace each other's packages or go.mod files
+func (r *RecursiveRewriter) checkOwnership() error {
+	if len(r.otherOwners) == 0 {
+		return nil
+	}
+	rels := make([]string, 0, len(r.otherOwners))
+	for rel := range r.otherOwners {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	if r.config.Publish != nil {
+		return fmt.Errorf("can't publish to %s, which holds files generated by %s", r.config.OutputDir, ownerName(r.otherOwners[rels[0]]))
+	}
+
+	owners := make(map[string]string) // directory to the owner of a file in it
+	for _, rel := range rels {
+		if dir := path.Dir(rel); dir != "." {
+			if _, ok := owners[dir]; !ok {
+				owners[dir] = r.otherOwners[rel]
+			}
+		}
+	}
+	claim := func(dir, what string) error {
+		if owner, ok := owners[filepath.ToSlash(dir)]; ok {
+			return fmt.Errorf("%s would be written to %s in %s, which holds files generated by %s; extract it in one config only, or use separate output directories",
+				what, dir, r.config.OutputDir, ownerName(owner))
+		}
+		return nil
+	}
+
+	var pkgPaths []string
+	for pkgPath, pkgInfo := range r.packages {
+		if pkgInfo.hasOutput() {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+	modules := make(map[string]bool)
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+		if err := claim(pkgInfo.OutputSubdir, "package "+pkgPath); err != nil {
+			return err
+		}
+		modules[pkgInfo.ModulePath] = true
+	}
+	if r.config.ImportPrefix == "" {
+		var modulePaths []string
+		for modulePath := range modules {
+			modulePaths = append(modulePaths, modulePath)
+		}
+		sort.Strings(modulePaths)
+		for _, modulePath := range modulePaths {
+			if err := claim(r.moduleDir(modulePath), "go.mod of module "+modulePath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ownerName describes the owner of files in the manifest for messages
+func ownerName(owner string) string {
+	if owner == "" {
+		return "a run without a config file"
+	}
+	return owner
+}
+
+// writeOutputFile writes a file under the output directory, unless the
+// previous run wrote the same content and the file still holds it, so its
+// modification time only changes with its content
+func (r *RecursiveRewriter) writeOutputFile(path string, content []byte) error {
+	rel, err := filepath.Rel(r.config.OutputDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") || r.outputHashes == nil {
+		return r.writeFile(path, content)
+	}
+	rel = filepath.ToSlash(rel)
+	if owner, ok := r.otherOwners[rel]; ok {
+		return fmt.Errorf("%s was generated by %s; extract it in one config only, or use separate output directories", path, ownerName(owner))
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	r.outputHashes[rel] = hash
+	if r.previousHashes[rel] == hash {
+		if existing, err := os.ReadFile(path); err == nil && sha256.Sum256(existing) == sum {
+			slog.Debug("Unchanged", "file", path)
+			return r.chmodFile(path)
+		}
+	}
+	return r.writeFile(path, content)
+}
+
+// writeManifest records the hashes of the files written by this run, along
+// with those other configs generated in the output directory. The manifest
+// is read again first, to keep what runs that finished in the meantime
+// recorded.
+func (r *RecursiveRewriter) writeManifest() error {
+	entries := make(map[string]manifestEntry)
+	previous, _ := parseManifest(r.config.OutputDir)
+	for rel, entry := range previous {
+		if entry.owner == r.config.Owner {
+			continue
+		}
+		if _, written := r.outputHashes[rel]; written {
+			return fmt.Errorf("%s was also generated by %s while this run was in progress", filepath.Join(r.config.OutputDir, rel), ownerName(entry.owner))
+		}
+		entries[rel] = entry
+	}
+	for rel, hash := range r.outputHashes {
+		entries[rel] = manifestEntry{hash: hash, owner: r.config.Owner}
+	}
+
+	rels := make([]string, 0, len(entries))
+	for rel := range entries {
+		rels = append(rels, rel)
+	}
+	sort.Slice(rels, func(i, j int) bool {
+		if a, b := entries[rels[i]].owner, entries[rels[j]].owner; a != b {
+			return a < b
+		}
+		return rels[i] < rels[j]
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString(manifestVersionPrefix + Version() + "\n")
+	owner := ""
+	for _, rel := range rels {
+		entry := entries[rel]
+		if entry.owner != owner {
+			owner = entry.owner
+			buf.WriteString(manifestOwnerPrefix + owner + "\n")
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", entry.hash, rel)
+	}
+	path := filepath.Join(r.config.OutputDir, manifestFile)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, buf.Bytes()) {
+		return r.chmodFile(path)
+	}
+	if err := r.mkdirOutput(r.config.OutputDir); err != nil {
+		return err
+	}
+	return r.writeFile(path, buf.Bytes())
+}
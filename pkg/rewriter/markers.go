@@ -0,0 +1,298 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Markers are the markers in the doc comments of a type or field that shape
+// its CRD schema: kubebuilder's, and the Kubernetes API markers with the same
+// meaning, like +listType and +optional. The docs, validation, and defaults
+// emitters read the parsed values rather than matching comment text.
+type Markers struct {
+	// Validation holds the +kubebuilder:validation markers not parsed into
+	// the fields below, keyed by what follows the prefix (e.g., "Enum" for
+	// +kubebuilder:validation:Enum=A;B). Markers without a value map to "".
+	Validation map[string]string
+
+	Default    string // +kubebuilder:default or +default, as written
+	HasDefault bool
+
+	Optional bool // +optional or +kubebuilder:validation:Optional
+	Required bool // +required or +kubebuilder:validation:Required
+	Nullable bool // +nullable
+
+	// PreserveUnknownFields stops the API server from pruning fields the
+	// schema doesn't declare (+kubebuilder:pruning:PreserveUnknownFields or
+	// +kubebuilder:validation:XPreserveUnknownFields)
+	PreserveUnknownFields bool
+	// EmbeddedResource marks an embedded object with its own apiVersion,
+	// kind, and metadata (+kubebuilder:validation:EmbeddedResource)
+	EmbeddedResource bool
+
+	ListType    string   // +listType: "atomic", "set", or "map"
+	ListMapKeys []string // +listMapKey, in order, for lists of type map
+	MapType     string   // +mapType: "atomic" or "granular"
+	StructType  string   // +structType: "atomic" or "granular"
+
+	// Other holds the remaining +kubebuilder markers, keyed by what follows
+	// "+kubebuilder:" (e.g., "printcolumn")
+	Other map[string]string
+
+	// Args holds the arguments of the markers that take named arguments,
+	// like +kubebuilder:printcolumn:name="Age",type=date, keyed like Other
+	// or Validation with the prefix ("validation:XValidation"), one entry per
+	// marker given. Their text is in Other or Validation too.
+	Args map[string][]MarkerArgs
+}
+
+// MarkerArgs are the named arguments of a marker, unquoted. An argument
+// given without a value maps to "".
+type MarkerArgs map[string]string
+
+// argMarkers are the markers whose name is followed by named arguments
+// (+name:key=value,key=value) rather than a value (+name=value)
+var argMarkers = []string{
+	"kubebuilder:printcolumn",
+	"kubebuilder:resource",
+	"kubebuilder:selectablefield",
+	"kubebuilder:subresource:scale",
+	"kubebuilder:metadata",
+	"kubebuilder:validation:XValidation",
+	"kubebuilder:validation:items:XValidation",
+}
+
+// ParseMarkers parses the markers in comment groups. Where a marker is given
+// more than once, the last one wins, except for +listMapKey, which adds a
+// key each time.
+func ParseMarkers(groups ...*ast.CommentGroup) Markers {
+	m := Markers{Validation: make(map[string]string), Other: make(map[string]string)}
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		for _, c := range group.List {
+			text, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(c.Text, "//")), "+")
+			if !ok {
+				continue
+			}
+			name, value, args := splitMarker(text)
+			if args != nil {
+				key := strings.TrimPrefix(name, "kubebuilder:")
+				if m.Args == nil {
+					m.Args = make(map[string][]MarkerArgs)
+				}
+				m.Args[key] = append(m.Args[key], args)
+			}
+			switch name {
+			case "kubebuilder:default", "default":
+				m.Default, m.HasDefault = value, true
+			case "optional", "kubebuilder:validation:Optional":
+				m.Optional = true
+			case "required", "kubebuilder:validation:Required":
+				m.Required = true
+			case "nullable":
+				m.Nullable = true
+			case "kubebuilder:pruning:PreserveUnknownFields", "kubebuilder:validation:XPreserveUnknownFields":
+				m.PreserveUnknownFields = true
+			case "kubebuilder:validation:EmbeddedResource":
+				m.EmbeddedResource = true
+			case "listType":
+				m.ListType = value
+			case "listMapKey":
+				m.ListMapKeys = append(m.ListMapKeys, value)
+			case "mapType":
+				m.MapType = value
+			case "structType":
+				m.StructType = value
+			default:
+				if rest, ok := strings.CutPrefix(name, "kubebuilder:validation:"); ok {
+					m.Validation[rest] = value
+				} else if rest, ok := strings.CutPrefix(name, "kubebuilder:"); ok {
+					m.Other[rest] = value
+				}
+			}
+		}
+	}
+	return m
+}
+
+// splitMarker splits a marker, without its "+", into its name and what
+// follows it: the value of +name=value, or the text and parsed arguments of
+// +name:key=value,...
+func splitMarker(text string) (string, string, MarkerArgs) {
+	for _, name := range argMarkers {
+		if rest, ok := strings.CutPrefix(text, name+":"); ok {
+			return name, strings.TrimSpace(rest), parseMarkerArgs(rest)
+		}
+	}
+	name, value, _ := strings.Cut(text, "=")
+	return strings.TrimSpace(name), strings.TrimSpace(value), nil
+}
+
+// parseMarkerArgs parses comma-separated key=value arguments. Commas inside
+// quotes, backticks, or braces (shortName={a,b}) don't separate arguments.
+func parseMarkerArgs(text string) MarkerArgs {
+	args := make(MarkerArgs)
+	add := func(arg string) {
+		if arg = strings.TrimSpace(arg); arg == "" {
+			return
+		}
+		key, value, _ := strings.Cut(arg, "=")
+		args[strings.TrimSpace(key)] = markerString(strings.TrimSpace(value))
+	}
+	var quote rune
+	depth, start := 0, 0
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote && (quote == '`' || i == 0 || text[i-1] != '\\') {
+				quote = 0
+			}
+		case c == '"' || c == '`':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			add(text[start:i])
+			start = i + 1
+		}
+	}
+	add(text[start:])
+	return args
+}
+
+// markerString returns a marker's value as a string, removing the quotes or
+// backticks it may be written with
+func markerString(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	return value
+}
+
+// jsonField returns the name a struct field is marshaled under, and whether
+// it's left out when empty
+func jsonField(field *ast.Field, name string) (string, bool) {
+	if field.Tag == nil {
+		return name, false
+	}
+	tag, err := strconv.Unquote(field.Tag.Value)
+	if err != nil {
+		return name, false
+	}
+	jsonName, options, _ := strings.Cut(reflect.StructTag(tag).Get("json"), ",")
+	omitEmpty := strings.Contains(","+options+",", ",omitempty,")
+	if jsonName == "" || jsonName == "-" {
+		return name, omitEmpty
+	}
+	return jsonName, omitEmpty
+}
+
+// markedType is a collected type declaration that marker-driven code is
+// generated for
+type markedType struct {
+	name    string // in generated code, after renames
+	spec    *ast.TypeSpec
+	doc     *ast.CommentGroup
+	obj     *types.TypeName
+	markers Markers
+	fields  []markedField // of struct types
+}
+
+type markedField struct {
+	field     *ast.Field
+	goName    string
+	jsonName  string
+	omitEmpty bool // a zero value means the field is absent
+	typ       types.Type
+	markers   Markers
+}
+
+// markedTypes returns the package's collected, non-generic type
+// definitions, sorted by name, with the marker-relevant details of their
+// fields
+func (r *RecursiveRewriter) markedTypes(pkgInfo *PackageInfo) []*markedType {
+	info := pkgInfo.Pkg.TypesInfo
+	if info == nil {
+		return nil
+	}
+	var marked []*markedType
+	for _, name := range sortedDeclNames(pkgInfo) {
+		genDecl, ok := pkgInfo.Decls[name].Decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			ts := spec.(*ast.TypeSpec)
+			obj, ok := info.Defs[ts.Name].(*types.TypeName)
+			if !ok || obj.Name() != name || ts.Assign.IsValid() || ts.TypeParams != nil {
+				continue
+			}
+			doc := ts.Doc
+			if doc == nil && len(genDecl.Specs) == 1 {
+				doc = genDecl.Doc
+			}
+			mt := &markedType{name: ts.Name.Name, spec: ts, doc: doc, obj: obj, markers: ParseMarkers(doc)}
+			if st, ok := ts.Type.(*ast.StructType); ok {
+				for _, field := range st.Fields.List {
+					names := field.Names
+					if len(names) == 0 {
+						if goName := embeddedFieldName(field.Type); goName != "" {
+							names = []*ast.Ident{ast.NewIdent(goName)}
+						}
+					}
+					for _, ident := range names {
+						if len(field.Names) > 0 && !ident.IsExported() {
+							continue
+						}
+						jsonName, omitEmpty := jsonField(field, ident.Name)
+						mt.fields = append(mt.fields, markedField{
+							field:     field,
+							goName:    ident.Name,
+							jsonName:  jsonName,
+							omitEmpty: omitEmpty,
+							typ:       info.TypeOf(field.Type),
+							markers:   ParseMarkers(field.Doc),
+						})
+					}
+				}
+			}
+			marked = append(marked, mt)
+		}
+	}
+	sort.SliceStable(marked, func(i, j int) bool { return marked[i].name < marked[j].name })
+	return marked
+}
+
+// writeMarkerFileHeader starts a file generated from markers, which sits next
+// to types.go and shares its build constraint
+func (r *RecursiveRewriter) writeMarkerFileHeader(buf *bytes.Buffer, pkgInfo *PackageInfo, imports map[string]bool) {
+	if r.config.AliasTag != "" {
+		fmt.Fprintf(buf, "//go:build !%s\n\n", r.config.AliasTag)
+	}
+	buf.WriteString(generatedHeader(pkgInfo.Pkg.PkgPath))
+	fmt.Fprintf(buf, "package %s\n", pkgInfo.Pkg.Name)
+	if len(imports) == 0 {
+		return
+	}
+	var paths []string
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	buf.WriteString("\nimport (\n")
+	for _, path := range paths {
+		fmt.Fprintf(buf, "\t%q\n", path)
+	}
+	buf.WriteString(")\n")
+}
@@ -0,0 +1,208 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/types"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// marshalMethods are the methods encoding/json uses instead of a type's
+// structure, on the type or a pointer to it
+var marshalMethods = []string{"MarshalJSON", "UnmarshalJSON", "MarshalText", "UnmarshalText"}
+
+// marshalDifference is a field of a generated type that may marshal
+// differently from upstream
+type marshalDifference struct {
+	Field  string // import/path.Type.Field, followed by the fields of an anonymous struct down to the one that differs
+	Reason string
+}
+
+// marshalDifferences audits the fields of the generated struct types for
+// JSON encodings that differ from upstream: a type whose marshaling methods
+// weren't extracted with it, a substitute that marshals itself differently
+// from the type it replaces, and omitempty or omitzero fields whose zero
+// value is no longer omitted the same way. Pruned and stripped fields are
+// left to the field report.
+func (r *RecursiveRewriter) marshalDifferences() []marshalDifference {
+	var diffs []marshalDifference
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() || pkgInfo.Verbatim {
+			continue
+		}
+		for _, mt := range r.markedTypes(pkgInfo) {
+			st, ok := mt.obj.Type().Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+			upstream := make(map[string]*types.Var)
+			for i := 0; i < st.NumFields(); i++ {
+				upstream[st.Field(i).Name()] = st.Field(i)
+			}
+			typeName := TypeRef{PackagePath: pkgPath, TypeName: mt.obj.Name()}.String()
+			for _, f := range mt.fields {
+				typ := pkgInfo.Pkg.TypesInfo.TypeOf(f.field.Type)
+				if v := upstream[f.goName]; v != nil {
+					typ = v.Type()
+				}
+				if typ == nil {
+					continue // An embedded field retyped along with its name
+				}
+				tag := ""
+				if f.field.Tag != nil {
+					tag = strings.Trim(f.field.Tag.Value, "`")
+				}
+				r.auditField(typ, tag, typeName+"."+f.goName, &diffs)
+			}
+		}
+	}
+	sort.SliceStable(diffs, func(i, j int) bool { return diffs[i].Field < diffs[j].Field })
+	return diffs
+}
+
+// auditField records how a field of an upstream type, with a struct tag,
+// marshals differently in generated code. Named types are checked as a
+// whole, since the fields of generated ones are audited with them; the
+// elements and fields of other types are checked one by one.
+func (r *RecursiveRewriter) auditField(typ types.Type, tag, path string, diffs *[]marshalDifference) {
+	jsonTag := reflect.StructTag(tag).Get("json")
+	if jsonTag == "-" {
+		return
+	}
+	_, opts, _ := strings.Cut(jsonTag, ",")
+	omitEmpty := strings.Contains(","+opts+",", ",omitempty,")
+	omitZero := strings.Contains(","+opts+",", ",omitzero,")
+	differs := func(format string, args ...any) {
+		*diffs = append(*diffs, marshalDifference{Field: path, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	var visit func(t types.Type, top bool)
+	visit = func(t types.Type, top bool) {
+		t = types.Unalias(t)
+		named, ok := t.(*types.Named)
+		if !ok {
+			switch u := t.(type) {
+			case *types.Pointer:
+				visit(u.Elem(), false)
+			case *types.Slice:
+				visit(u.Elem(), false)
+			case *types.Array:
+				visit(u.Elem(), false)
+			case *types.Map:
+				visit(u.Key(), false)
+				visit(u.Elem(), false)
+			case *types.Struct:
+				for i := 0; i < u.NumFields(); i++ {
+					if u.Field(i).Exported() {
+						r.auditField(u.Field(i).Type(), u.Tag(i), path+"."+u.Field(i).Name(), diffs)
+					}
+				}
+			}
+			return
+		}
+		if _, isInterface := named.Underlying().(*types.Interface); isInterface || named.Obj().Pkg() == nil {
+			return
+		}
+		name := namedKey(named)
+
+		if replacement := r.replacementType(named); replacement != nil {
+			// The replacement is used as it is, with its own methods
+			substitute := types.TypeString(replacement, nil)
+			for _, method := range marshalMethods {
+				had, has := hasMethod(named, method), hasMethod(replacement, method)
+				switch {
+				case had && !has:
+					differs("%s has a %s method, which its substitute %s lacks", name, method, substitute)
+				case !had && has:
+					differs("substitute %s has a %s method, which %s lacks", substitute, method, name)
+				}
+			}
+			if top && omitEmpty && emptiable(named) != emptiable(replacement) {
+				differs("omitempty omits the zero value of only one of %s and its substitute %s", name, substitute)
+			}
+			if top && omitZero && hasMethod(named, "IsZero") != hasMethod(replacement, "IsZero") {
+				differs("omitzero uses the IsZero method of only one of %s and its substitute %s", name, substitute)
+			}
+			return
+		}
+
+		pkgInfo := r.packages[named.Obj().Pkg().Path()]
+		if pkgInfo == nil || pkgInfo.Verbatim || pkgInfo.Decls[named.Obj().Name()] == nil {
+			return // Imported as it is
+		}
+		// Methods promoted from embedded fields come along with the fields
+		for _, method := range marshalMethods {
+			if declaresMethod(named, method) && pkgInfo.Decls[named.Obj().Name()+"."+method] == nil {
+				differs("the %s method of %s wasn't extracted with it (see copyMethods)", method, name)
+			}
+		}
+		if top && omitZero && declaresMethod(named, "IsZero") && pkgInfo.Decls[named.Obj().Name()+".IsZero"] == nil {
+			differs("omitzero uses the IsZero method of %s, which wasn't extracted with it (see copyMethods)", name)
+		}
+	}
+	visit(typ, true)
+}
+
+// replacementType returns the type generated code uses instead of a named
+// type, when it's substituted or its package is, or nil
+func (r *RecursiveRewriter) replacementType(named *types.Named) types.Type {
+	ref := TypeRef{PackagePath: named.Obj().Pkg().Path(), TypeName: named.Obj().Name()}
+	if substitute, ok := r.substitutes[ref.String()]; ok {
+		ref = substitute
+	} else if importPath := r.shimmed[ref.PackagePath]; importPath != "" {
+		ref.PackagePath = importPath
+	} else {
+		return nil
+	}
+	pkgInfo := r.packages[ref.PackagePath]
+	if pkgInfo == nil || pkgInfo.Pkg.Types == nil {
+		return nil
+	}
+	obj, ok := pkgInfo.Pkg.Types.Scope().Lookup(ref.TypeName).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+	return obj.Type()
+}
+
+// declaresMethod reports whether a named type declares a method itself
+func declaresMethod(named *types.Named, name string) bool {
+	for i := 0; i < named.NumMethods(); i++ {
+		if named.Method(i).Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMethod reports whether a type or a pointer to it has a method
+func hasMethod(t types.Type, name string) bool {
+	if _, isPointer := t.Underlying().(*types.Pointer); !isPointer {
+		t = types.NewPointer(t)
+	}
+	obj, _, _ := types.LookupFieldOrMethod(t, true, nil, name)
+	_, ok := obj.(*types.Func)
+	return ok
+}
+
+// emptiable reports whether omitempty omits the zero value of a type
+func emptiable(t types.Type) bool {
+	switch u := t.Underlying().(type) {
+	case *types.Basic, *types.Pointer, *types.Slice, *types.Map, *types.Interface:
+		return true
+	case *types.Array:
+		return u.Len() == 0
+	}
+	return false
+}
+
+// warnMarshalDifferences logs the fields that may marshal differently from
+// upstream, so wire incompatibilities show up when generating rather than
+// in production
+func (r *RecursiveRewriter) warnMarshalDifferences() {
+	for _, diff := range r.marshalDifferences() {
+		slog.Warn("Field may marshal differently from upstream", "field", diff.Field, "reason", diff.Reason)
+	}
+}
@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// minifySource strips the comments and blank lines from a generated Go file.
+// The header above the package clause (the generated-code notice and build
+// constraints) and compiler directives are kept, and so are struct tags.
+func minifySource(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []*ast.CommentGroup
+	for _, group := range file.Comments {
+		if group.End() < file.Package {
+			kept = append(kept, group)
+			continue
+		}
+		var directives []*ast.Comment
+		for _, c := range group.List {
+			if strings.HasPrefix(c.Text, "//go:") || strings.HasPrefix(c.Text, "//line ") || strings.HasPrefix(c.Text, "//export ") {
+				directives = append(directives, c)
+			}
+		}
+		if len(directives) > 0 {
+			kept = append(kept, &ast.CommentGroup{List: directives})
+		}
+	}
+	file.Comments = kept
+	file.Doc = nil
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return nil, err
+	}
+	return format.Source(dropBlankLines(buf.Bytes(), fset.Position(file.Package).Line))
+}
+
+// dropBlankLines removes the blank lines of src after line from, leaving
+// those within raw string literals alone
+func dropBlankLines(src []byte, from int) []byte {
+	// Find the lines inside multi-line raw strings
+	inString := make(map[int]bool)
+	fset := token.NewFileSet()
+	tokFile := fset.AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(tokFile, src, nil, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.STRING && strings.HasPrefix(lit, "`") {
+			start := fset.Position(pos).Line
+			for line := start + 1; line <= start+strings.Count(lit, "\n"); line++ {
+				inString[line] = true
+			}
+		}
+	}
+
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	var out bytes.Buffer
+	for i, line := range lines {
+		if i+1 > from && !inString[i+1] && len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
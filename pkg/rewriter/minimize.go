@@ -0,0 +1,101 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// ModuleSuggestion is a config change that would avoid generating a module,
+// and so a replace directive in every consumer
+type ModuleSuggestion struct {
+	Module string // generated module that could be avoided
+	Types  int    // types generated in it
+	Change string // config change avoiding it
+	Reason string // why the change applies
+}
+
+// suggestFewerModules finds the generated modules that could be merged into
+// their importer with collapseModules, or whose types could be inlined
+// instead, sorted by module. It runs once modules have been collapsed, so
+// it only suggests what's left.
+func (r *RecursiveRewriter) suggestFewerModules() []ModuleSuggestion {
+	if r.config.ImportPrefix != "" {
+		return nil
+	}
+
+	var suggestions []ModuleSuggestion
+	for modulePath, moduleInfo := range r.modules {
+		if pkgPath, importer, ok := r.collapsible(moduleInfo); ok {
+			types := countTypes(r.packages[pkgPath])
+			suggestions = append(suggestions, ModuleSuggestion{
+				Module: modulePath,
+				Types:  types,
+				Change: fmt.Sprintf("collapseModules: %d", types+1),
+				Reason: "only " + importer + " imports it",
+			})
+		} else if refs := r.inlinable(moduleInfo); len(refs) > 0 {
+			suggestions = append(suggestions, ModuleSuggestion{
+				Module: modulePath,
+				Types:  len(refs),
+				Change: "inline: [" + strings.Join(refs, ", ") + "]",
+				Reason: "its types only refer to predeclared and standard library types",
+			})
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool { return suggestions[i].Module < suggestions[j].Module })
+	return suggestions
+}
+
+// inlinable returns the types of a module's single generated package if
+// they could all be inlined into the packages referring to them: the
+// package declares nothing else, and they refer to nothing else of it
+func (r *RecursiveRewriter) inlinable(moduleInfo *ModuleInfo) []string {
+	pkgInfo := r.modulePackage(moduleInfo)
+	if pkgInfo == nil || r.hasRoots(pkgInfo) {
+		return nil
+	}
+	var refs []string
+	for name, declInfo := range pkgInfo.Decls {
+		genDecl, ok := declInfo.Decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			return nil
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if typeSpec.TypeParams != nil {
+				return nil
+			}
+			if _, dep := r.inlineImports(pkgInfo, typeSpec); dep != nil {
+				return nil
+			}
+		}
+		refs = append(refs, TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: name}.String())
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// logModuleSuggestions reports how many modules consumers have to replace,
+// and how the config could make them fewer
+func (r *RecursiveRewriter) logModuleSuggestions() {
+	if len(r.suggestions) == 0 {
+		return
+	}
+	modules := 0
+	for _, moduleInfo := range r.modules {
+		for _, pkgPath := range moduleInfo.Packages {
+			if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() {
+				modules++
+				break
+			}
+		}
+	}
+	slog.Info("Generated modules could be fewer", "modules", modules, "avoidable", len(r.suggestions))
+	for _, suggestion := range r.suggestions {
+		slog.Info("Avoidable module", "module", suggestion.Module, "types", suggestion.Types, "change", suggestion.Change, "reason", suggestion.Reason)
+	}
+}
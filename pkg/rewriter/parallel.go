@@ -0,0 +1,101 @@
+package rewriter
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// RunJobs runs independent batches of configs, such as the shim modules of a
+// CI pipeline, up to parallel at a time (all at once if parallel < 1), and
+// returns the error of each, nil if it succeeded. The jobs share cache, if
+// given, so packages they all consult are loaded once. Like Extract, it
+// leaves go.mod alone.
+//
+// Each job loads and rewrites its own packages, so only writing output is
+// serialized: jobs writing to the same output directory take turns, and
+// CODEOWNERS, which jobs in one repository share, is updated by one job at
+// a time.
+func RunJobs(jobs [][]*Config, cache *PackageCache, parallel int) []error {
+	if parallel < 1 || parallel > len(jobs) {
+		parallel = len(jobs)
+	}
+
+	var (
+		mu        sync.Mutex // guards outputMus
+		outputMus = make(map[string]*sync.Mutex)
+		gitMu     sync.Mutex
+	)
+	outputLock := func(outputDir string) *sync.Mutex {
+		if abs, err := filepath.Abs(outputDir); err == nil {
+			outputDir = abs
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if outputMus[outputDir] == nil {
+			outputMus[outputDir] = &sync.Mutex{}
+		}
+		return outputMus[outputDir]
+	}
+
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for i, configs := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := runJob(configs, cache, outputLock, &gitMu); err != nil {
+				errs[i] = fmt.Errorf("job %d: %w", i+1, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// runJob runs one batch of RunJobs, holding the lock of its output directory
+// while it writes its files and gitMu while it updates git metadata
+func runJob(configs []*Config, cache *PackageCache, outputLock func(string) *sync.Mutex, gitMu *sync.Mutex) error {
+	if cache != nil {
+		shared := make([]*Config, len(configs))
+		for i, cfg := range configs {
+			c := *cfg
+			c.Cache = cache
+			shared[i] = &c
+		}
+		configs = shared
+	}
+
+	r, err := newBatchRewriter(configs)
+	if err != nil {
+		return err
+	}
+	defer r.cleanup()
+
+	if err := r.processQueue(); err != nil {
+		return err
+	}
+
+	outputMu := outputLock(r.config.OutputDir)
+	outputMu.Lock()
+	err = r.generateOutput()
+	outputMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	gitMu.Lock()
+	err = r.writeGitMetadata()
+	gitMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	r.logSummary()
+	r.logReferencedPackages()
+	r.logModuleSuggestions()
+	return nil
+}
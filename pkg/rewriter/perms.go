@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultFileMode os.FileMode = 0o644
+	defaultDirMode  os.FileMode = 0o755
+)
+
+// fileMode returns the permissions generated files get
+func (r *RecursiveRewriter) fileMode() os.FileMode {
+	mode := defaultFileMode
+	if r.config.FileMode != 0 {
+		mode = r.config.FileMode
+	}
+	if r.config.ReadOnly {
+		mode &^= 0o222
+	}
+	return mode
+}
+
+// setsPerms reports whether permissions were configured, in which case
+// they're applied exactly instead of being left to the umask
+func (r *RecursiveRewriter) setsPerms() bool {
+	return r.config.FileMode != 0 || r.config.ReadOnly
+}
+
+// writeFile writes a generated file with the configured permissions,
+// replacing a read-only file left by an earlier run
+func (r *RecursiveRewriter) writeFile(path string, content []byte) error {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o200 == 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0o200); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, content, r.fileMode()); err != nil {
+		return err
+	}
+	return r.chmodFile(path)
+}
+
+// chmodFile applies the configured permissions to a generated file, if any
+func (r *RecursiveRewriter) chmodFile(path string) error {
+	if !r.setsPerms() {
+		return nil
+	}
+	return os.Chmod(path, r.fileMode())
+}
+
+// mkdirOutput creates a directory under the output directory, along with
+// its parents, giving the configured permissions to each of them from the
+// output directory down
+func (r *RecursiveRewriter) mkdirOutput(dir string) error {
+	mode := defaultDirMode
+	if r.config.DirMode != 0 {
+		mode = r.config.DirMode
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	if r.config.DirMode == 0 {
+		return nil
+	}
+
+	outputDir := filepath.Clean(r.config.OutputDir)
+	for {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,71 @@
+package rewriter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Preset names a curated set of per-type options
+type Preset string
+
+const (
+	// PresetKubernetes wraps the apimachinery types with custom JSON
+	// marshaling, keeping their wire format without their dependencies
+	PresetKubernetes Preset = "kubernetes"
+
+	// PresetAWS wraps the epoch time types of the Lambda event structs
+	PresetAWS Preset = "aws"
+
+	// PresetGCP substitutes and wraps the googleapi types the generated
+	// Google API structs use for their JSON encoding
+	PresetGCP Preset = "gcp"
+)
+
+// presets are the per-type options of each preset, by TypeRef key
+var presets = map[Preset]map[string]TypeOptions{
+	PresetKubernetes: {
+		"k8s.io/apimachinery/pkg/apis/meta/v1.Time":       {Substitute: "time.Time", Wrap: true},
+		"k8s.io/apimachinery/pkg/apis/meta/v1.MicroTime":  {Substitute: "time.Time", Wrap: true},
+		"k8s.io/apimachinery/pkg/apis/meta/v1.Duration":   {Substitute: "time.Duration", Wrap: true},
+		"k8s.io/apimachinery/pkg/util/intstr.IntOrString": {Wrap: true},
+		"k8s.io/apimachinery/pkg/api/resource.Quantity":   {Wrap: true},
+		"k8s.io/apimachinery/pkg/runtime.RawExtension":    {Wrap: true},
+	},
+	PresetAWS: {
+		"github.com/aws/aws-lambda-go/events.SecondsEpochTime":      {Substitute: "time.Time", Wrap: true},
+		"github.com/aws/aws-lambda-go/events.MilliSecondsEpochTime": {Substitute: "time.Time", Wrap: true},
+	},
+	PresetGCP: {
+		"google.golang.org/api/googleapi.RawMessage": {Substitute: "encoding/json.RawMessage"},
+		"google.golang.org/api/googleapi.Int64s":     {Wrap: true},
+		"google.golang.org/api/googleapi.Int32s":     {Wrap: true},
+		"google.golang.org/api/googleapi.Uint64s":    {Wrap: true},
+		"google.golang.org/api/googleapi.Uint32s":    {Wrap: true},
+		"google.golang.org/api/googleapi.Float64s":   {Wrap: true},
+	},
+}
+
+// applyPreset sets the options of a preset's types. It runs before the
+// configs' own options are set, which replace the preset's for a type.
+func (r *RecursiveRewriter) applyPreset(preset Preset) error {
+	if preset == "" {
+		return nil
+	}
+	options, ok := presets[preset]
+	if !ok {
+		var known []string
+		for name := range presets {
+			known = append(known, string(name))
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown preset %q (use: %s)", preset, strings.Join(known, ", "))
+	}
+	for key, opts := range options {
+		i := strings.LastIndex(key, ".")
+		if err := r.setTypeOptions(TypeRef{PackagePath: key[:i], TypeName: key[i+1:]}, opts); err != nil {
+			return fmt.Errorf("preset %s: %w", preset, err)
+		}
+	}
+	return nil
+}
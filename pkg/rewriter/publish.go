@@ -0,0 +1,168 @@
+package rewriter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Publish describes a single module generated for publishing, such as a
+// shim module maintained for many consumers. Packages of the source module
+// are placed at the same path relative to the published module, so it can
+// be used as a Shim; packages from other modules go under their full path.
+type Publish struct {
+	Module  string // module path of the published module (e.g., "example.com/platform/argo-types")
+	Source  string // source module it's generated from (e.g., "github.com/argoproj/argo-cd/v3")
+	Version string // version stamped into the module (e.g., "v0.3.0")
+	License string // license file to copy (defaults to the source module's)
+}
+
+// versionFile records the published version, and marks the output directory
+// as one package-rewriter may clean
+const versionFile = "VERSION"
+
+// checkPublish validates the publish settings of a batch
+func checkPublish(config *Config) error {
+	p := config.Publish
+	if p.Module == "" || p.Source == "" {
+		return fmt.Errorf("publishing requires the module path and the source module")
+	}
+	if config.ImportPrefix != "" || config.StripVersionSuffix || config.Layout == LayoutThirdParty {
+		return fmt.Errorf("publishing lays out its own module, so it can't be combined with an import prefix, stripping version suffixes, or another layout")
+	}
+	if !semver.IsValid(p.Version) {
+		return fmt.Errorf("invalid publish version %q (e.g., v0.3.0)", p.Version)
+	}
+	if _, pathMajor, ok := module.SplitPathVersion(p.Module); !ok {
+		return fmt.Errorf("invalid publish module path %q", p.Module)
+	} else if err := module.CheckPathMajor(p.Version, pathMajor); err != nil {
+		return fmt.Errorf("publish version doesn't match module path %s: %w", p.Module, err)
+	}
+	return nil
+}
+
+// publishSubdir returns the directory, relative to the published module, of
+// a package
+func (r *RecursiveRewriter) publishSubdir(pkgPath, modulePath string) string {
+	if modulePath == r.config.Publish.Source {
+		return strings.TrimPrefix(strings.TrimPrefix(pkgPath, modulePath), "/")
+	}
+	return pkgPath
+}
+
+// generatePublishModule empties the output directory and writes the files
+// that make it a publishable module: go.mod, the license, and the version
+func (r *RecursiveRewriter) generatePublishModule() error {
+	p := r.config.Publish
+	dir := r.config.OutputDir
+	if err := cleanPublishDir(dir, p.Module); err != nil {
+		return err
+	}
+	if err := r.mkdirOutput(dir); err != nil {
+		return err
+	}
+
+	// One module holds every generated package
+	published := &ModuleInfo{Path: p.Module}
+	if source := r.modules[p.Source]; source != nil {
+		published.GoVersion, published.Toolchain = source.GoVersion, source.Toolchain
+	}
+	for pkgPath := range r.packages {
+		published.Packages = append(published.Packages, pkgPath)
+	}
+	sort.Strings(published.Packages)
+
+	if err := r.writeOutputFile(filepath.Join(dir, "go.mod"), []byte(r.goModContent(published))); err != nil {
+		return err
+	}
+
+	if err := r.copyLicense(dir); err != nil {
+		return err
+	}
+	if err := r.writeOutputFile(filepath.Join(dir, versionFile), []byte(p.Version+"\n")); err != nil {
+		return err
+	}
+
+	slog.Info("Generated publishable module", "module", p.Module, "version", p.Version, "dir", dir, "suggestedTag", publishTag(dir, p.Version))
+	return nil
+}
+
+// cleanPublishDir removes a previously published module from dir, so files
+// of packages that are no longer generated don't linger. Directories that
+// don't hold the same published module are left alone.
+func cleanPublishDir(dir, modulePath string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err == nil {
+		_, err = os.Stat(filepath.Join(dir, versionFile))
+	}
+	if err != nil || modfile.ModulePath(content) != modulePath {
+		return fmt.Errorf("refusing to clean %s: it doesn't hold a previously published %s", dir, modulePath)
+	}
+	return os.RemoveAll(dir)
+}
+
+// copyLicense copies the configured license file, or the source module's,
+// to the published module
+func (r *RecursiveRewriter) copyLicense(dir string) error {
+	license := r.config.Publish.License
+	if license == "" {
+		for _, pkgInfo := range r.packages {
+			if pkgInfo.ModulePath != r.config.Publish.Source || pkgInfo.Pkg.Module == nil {
+				continue
+			}
+			matches, _ := filepath.Glob(filepath.Join(pkgInfo.Pkg.Module.Dir, "LICENSE*"))
+			if len(matches) > 0 {
+				license = matches[0]
+			}
+			break
+		}
+	}
+	if license == "" {
+		slog.Warn("No license found to copy to the published module", "source", r.config.Publish.Source)
+		return nil
+	}
+
+	content, err := os.ReadFile(license)
+	if err != nil {
+		return fmt.Errorf("failed to read license: %w", err)
+	}
+	return r.writeOutputFile(filepath.Join(dir, filepath.Base(license)), content)
+}
+
+// publishTag returns the git tag that publishes version of the module in
+// dir: modules below the repository root are tagged with their directory
+func publishTag(dir, version string) string {
+	root, err := gitTopLevel(dir)
+	if err != nil {
+		return version
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return version
+	}
+	// Resolve symlinks on both sides, since git reports the real path
+	if resolved, err := filepath.EvalSymlinks(absDir); err == nil {
+		absDir = resolved
+	}
+	rel, err := filepath.Rel(root, absDir)
+	if err != nil || rel == "." {
+		return version
+	}
+	return path.Join(filepath.ToSlash(rel), version)
+}
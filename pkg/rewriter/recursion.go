@@ -0,0 +1,188 @@
+package rewriter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Recursion controls how far extraction follows the dependencies of a root
+// declaration
+type Recursion string
+
+const (
+	// RecursionAll follows dependencies across packages, extracting the
+	// full closure (the default)
+	RecursionAll Recursion = "all"
+	// RecursionPackage follows dependencies within the root's package only
+	RecursionPackage Recursion = "package"
+	// RecursionLocal follows dependencies within the root's package, and
+	// keeps the packages of the others as real dependencies, unless they're
+	// generated anyway
+	RecursionLocal Recursion = "local"
+	// RecursionType extracts the root alone, with its methods
+	RecursionType Recursion = "type"
+)
+
+// narrowedRoot is a root declaration whose recursion is narrowed
+type narrowedRoot struct {
+	ref       TypeRef
+	recursion Recursion
+}
+
+// breadth orders recursions from the narrowest; the default is the widest
+func (m Recursion) breadth() int {
+	switch m {
+	case RecursionType:
+		return 0
+	case RecursionLocal:
+		return 1
+	case RecursionPackage:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// checkRecursion validates a config's recursion
+func checkRecursion(cfg *Config) error {
+	switch cfg.Recursion {
+	case "", RecursionAll:
+	case RecursionPackage, RecursionLocal, RecursionType:
+		if cfg.CopyAll {
+			return fmt.Errorf("recursion %s for %s can't be combined with copying the package", cfg.Recursion, cfg.PackagePath)
+		}
+	default:
+		return fmt.Errorf("unknown recursion %q for %s (use: all, local, package, type)", cfg.Recursion, cfg.PackagePath)
+	}
+	return nil
+}
+
+// queueNarrowedRoot queues the next root whose recursion is narrowed,
+// reporting whether there was one. They're extracted after the full
+// closures, widest first, so a declaration any root reaches in full has its
+// dependencies followed in full.
+func (r *RecursiveRewriter) queueNarrowedRoot() bool {
+	if len(r.narrowedRoots) == 0 {
+		return false
+	}
+	root := r.narrowedRoots[0]
+	r.narrowedRoots = r.narrowedRoots[1:]
+	r.widenRecursion(root.ref, root.recursion)
+	r.queueType(root.ref.PackagePath, root.ref.TypeName)
+	return true
+}
+
+// sortNarrowedRoots orders the roots whose recursion is narrowed widest first
+func (r *RecursiveRewriter) sortNarrowedRoots() {
+	sort.SliceStable(r.narrowedRoots, func(i, j int) bool {
+		return r.narrowedRoots[i].recursion.breadth() > r.narrowedRoots[j].recursion.breadth()
+	})
+}
+
+// widenRecursion records that a declaration's dependencies are followed at
+// least as far as recursion allows
+func (r *RecursiveRewriter) widenRecursion(typeRef TypeRef, recursion Recursion) {
+	if current, ok := r.recursion[typeRef.String()]; !ok || recursion.breadth() > current.breadth() {
+		r.recursion[typeRef.String()] = recursion
+	}
+}
+
+// outsideRecursion reports whether the declaration being extracted may not
+// queue typeRef, recording it to be checked once extraction is done. A
+// narrowed declaration passes its recursion on to the dependencies it may
+// queue.
+func (r *RecursiveRewriter) outsideRecursion(typeRef TypeRef) bool {
+	if r.current == (TypeRef{}) {
+		return false
+	}
+	recursion, narrowed := r.recursion[r.current.String()]
+	if !narrowed || recursion == RecursionAll {
+		return false
+	}
+
+	// Packages nothing is extracted from are imported as usual
+	pkgPath := typeRef.PackagePath
+	if r.isStdlib(pkgPath) || r.external[pkgPath] != nil || r.isVerbatim(pkgPath) || r.isKeptExternal(pkgPath) || r.inShimModule(pkgPath) {
+		return false
+	}
+	if _, ok := r.packageSubstitute(pkgPath); ok {
+		return false
+	}
+
+	inside := pkgPath == r.current.PackagePath
+	if !inside && recursion == RecursionLocal {
+		// Types of packages generated for other roots are extracted there
+		if pkgInfo, exists := r.packages[pkgPath]; !exists || !pkgInfo.hasOutput() {
+			r.keptLocal[pkgPath] = true
+		}
+		inside = true
+	}
+	if inside && recursion == RecursionType {
+		recv, _, _ := strings.Cut(r.current.TypeName, ".")
+		inside = typeRef.TypeName == recv || strings.HasPrefix(typeRef.TypeName, recv+".")
+	}
+	if !inside {
+		if _, seen := r.outside[typeRef.String()]; !seen {
+			r.outside[typeRef.String()] = r.current
+		}
+		return true
+	}
+	r.widenRecursion(typeRef, recursion)
+	return false
+}
+
+// checkOutsideRecursion fails if a type left out by a narrowed recursion
+// wasn't extracted for another root. Functions and methods left out are
+// treated like those that can't be extracted.
+func (r *RecursiveRewriter) checkOutsideRecursion() error {
+	var keys []string
+	for key := range r.outside {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if r.processedTypes[key] {
+			continue
+		}
+		from := r.outside[key]
+		reason := fmt.Sprintf("it's outside the recursion of %s (recursion: %s)", from, r.recursion[from.String()])
+		if !r.requiredTypes[key] {
+			r.unextractable[key] = reason
+			continue
+		}
+		return &Diagnostic{
+			Code:    CodeOutsideRecursion,
+			Package: from.PackagePath,
+			Decl:    from.String(),
+			Err: fmt.Errorf("%s refers to %s, but %s; extract it with another entry, keep its package external, or widen the recursion (reached via %s)",
+				from, key, reason, r.dependencyPath(from)),
+		}
+	}
+	return nil
+}
+
+// checkKeptLocal fails if a package kept as a real dependency by a local
+// recursion is in a generated module: the replace directive pointing the
+// module at the generated code would leave the package out
+func (r *RecursiveRewriter) checkKeptLocal() error {
+	if r.config.ImportPrefix != "" || len(r.keptLocal) == 0 {
+		return nil
+	}
+	generated := make(map[string]bool)
+	for _, modulePath := range r.generatedModules() {
+		generated[modulePath] = true
+	}
+	var pkgPaths []string
+	for pkgPath := range r.keptLocal {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+	for _, pkgPath := range pkgPaths {
+		if mod := r.external[pkgPath]; mod != nil && generated[mod.Path] {
+			return fmt.Errorf("package %s is kept as a real dependency (recursion: %s), but its module %s is generated, replacing it; generate inside your module with importPrefix or standalone: false, or use recursion: package",
+				pkgPath, RecursionLocal, mod.Path)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package rewriter
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"go/ast"
 	"go/format"
@@ -11,54 +13,270 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
+	"golang.org/x/mod/module"
 	"golang.org/x/tools/go/packages"
 )
 
 // Config holds the configuration for the package rewriter
 type Config struct {
-	PackagePath string
-	TypeName    string
-	OutputDir   string
+	PackagePath  string
+	TypeName     string
+	FunctionName string // extract a function instead of a type
+	OutputDir    string
+	Dir          string // directory packages are loaded from (defaults to the current directory)
+
+	// Run-wide options, taken from the first config of a batch
+	CopyMethods     bool                // copy methods of extracted types along with their dependencies
+	OnUnextractable UnextractablePolicy // what to do with functions and methods whose dependencies can't be extracted
+	Directives      DirectivePolicy     // what to do with compiler directives on copied declarations
+	Cgo             CgoPolicy           // what to do when the closure reaches a package that requires cgo
+	Vars            VarPolicy           // whether package-level variables referenced by copied code are copied
+	SuspectFields   SuspectFieldPolicy  // what to do with struct fields holding pointers, reflection state, or locks
+	GoVersion       string              // target Go version for generated code and go.mod files (e.g., "1.17"), instead of the source module's
+	Toolchain       string              // toolchain directive for generated go.mod files (e.g., "go1.22.5"), instead of the source module's
+	WholePackage    int                 // percentage of a package's types above which all of its types are copied (0 disables)
+	KeepExternal    []string            // packages (or parent paths) kept as real dependencies instead of being extracted
+	Stdlib          []string            // packages (or parent paths) treated like the standard library: imported as they are, never loaded, extracted, or required
+	Shims           []Shim              // published modules used in place of the source modules they were generated from
+
+	// Inline lists types ("import/path.Name") copied into each generated
+	// package referring to them, instead of being extracted into their own
+	Inline []string
+	// Preset adds a curated set of per-type options, such as wrappers for
+	// the Kubernetes, AWS, or Google API types with custom marshaling
+	Preset Preset
+
+	// SubstitutePackages maps packages (or parent paths) to the import path
+	// generated code uses instead; they're never extracted
+	SubstitutePackages map[string]string
+
+	// CollapseModules merges each generated module with fewer types than
+	// this into the package importing it, when only one does (0 disables).
+	// Types whose names collide are renamed by CollisionPolicy.
+	CollapseModules int
+	CollisionPolicy CollisionPolicy
+	// MinimizeModules collapses every module that can be, whatever its size
+	MinimizeModules bool
+
+	// FlattenStructs turns struct types referenced once, from a field of
+	// another struct type in their package, into anonymous structs in that
+	// field
+	FlattenStructs bool
+
+	// SuspectFieldReplacement is the type given to suspect fields with
+	// SuspectFieldsReplace (defaults to struct{})
+	SuspectFieldReplacement string
+
+	// NonSerializableFields is what to do with struct fields holding
+	// channels, functions, or contexts
+	NonSerializableFields NonSerializablePolicy
+
+	// DropDeprecated leaves out the struct fields whose doc comments mark
+	// them as deprecated
+	DropDeprecated bool
+
+	// Unexported is what to do when an exported type exposes unexported
+	// fields or types
+	Unexported UnexportedPolicy
+
+	// SideEffectImports is what to do with the blank imports of the source
+	// files declarations are copied from
+	SideEffectImports SideEffectImportPolicy
+	// SideEffectImportMap maps blank imports to the package generated code
+	// imports instead, or to "" to drop them, overriding SideEffectImports
+	SideEffectImportMap map[string]string
+
+	// ImportPrefix places generated packages at <ImportPrefix>/<package path>
+	// inside the consuming module, rewriting imports between them, instead of
+	// generating modules that replace the originals
+	ImportPrefix string
+	// AliasTag generates an alias flavor of each package, selected with this
+	// build tag, whose types are aliases of the originals. Requires ImportPrefix.
+	AliasTag string
+	// StripVersionSuffix writes modules with a major version suffix (e.g.,
+	// github.com/argoproj/argo-cd/v3) to a directory without it. Their go.mod
+	// and replace directives keep the full module path.
+	StripVersionSuffix bool
+	// Layout places generated modules in the output directory: at their
+	// module path (the default), under third_party/generated with a
+	// module-map.json from module path to directory, as packages of one
+	// umbrella module at its root, whose path is UmbrellaModule, or as
+	// packages of the consuming module under an internal directory
+	Layout         Layout
+	UmbrellaModule string
+	// InModule generates plain packages inside the consuming module, with
+	// no go.mod files or replace directives, under ImportPrefix or, if it's
+	// empty, the import path of the output directory in the module
+	InModule bool
+	// ReplaceWith maps generated modules to the module@version consumers
+	// replace them with, such as the generated code published from another
+	// repository, instead of its directory in the output
+	ReplaceWith map[string]string
+	// Publish generates a single module ready to be published, in place of
+	// one module per source module. It lays the packages out under the
+	// published module's path the way ImportPrefix does.
+	Publish *Publish
+	// Bazel writes a Gazelle-compatible BUILD.bazel file next to each
+	// generated package
+	Bazel bool
+	// Emitters write the closure in their output formats, each from the
+	// same computed packages; none writes the Go packages alone
+	Emitters []Emitter
+	// Validation generates Validate methods from the kubebuilder validation
+	// markers of extracted types
+	Validation bool
+	// Defaults generates Default methods from the kubebuilder default
+	// markers of extracted types
+	Defaults bool
+	// GVK generates Group, Version, and Kind constants and GroupVersionKind
+	// methods for Kubernetes kinds
+	GVK bool
+	// Builders generates a New constructor and chainable With methods for
+	// each struct type the configs asked for
+	Builders bool
+	// Equal generates Equal methods comparing struct types field by field,
+	// without reflection
+	Equal bool
+	// FieldReport lists the fields that differ from upstream, because they
+	// were pruned, stripped, replaced, or substituted, in field-report.json
+	// and in the doc comments of their types
+	FieldReport bool
+	// Minify strips comments and blank lines from the generated files
+	Minify bool
+	// PreserveSource copies declarations from their source files, keeping
+	// their comments and formatting, unless they were changed by more than
+	// renames
+	PreserveSource bool
+	// GitAttributes writes a .gitattributes to the output directory marking
+	// the generated files as linguist-generated
+	GitAttributes bool
+	// CodeOwners are assigned the output directory in the repository's
+	// CODEOWNERS file
+	CodeOwners []string
+	// FileMode and DirMode are the permissions of generated files and of the
+	// directories created for them, applied regardless of the umask; the
+	// defaults are 0644 and 0755, less the umask
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// ReadOnly clears the write bits of generated files, to discourage
+	// editing them by hand
+	ReadOnly bool
+
+	// Owner identifies the config in the output directory's manifest, so
+	// several configs can generate into one directory without replacing
+	// each other's packages
+	Owner string
+
+	// Cache keeps loaded packages across runs
+	Cache *PackageCache
+	// AutoRequire gets source packages that the consuming module doesn't
+	// require, at Version, into a temporary copy of its go.mod, leaving the
+	// real one untouched
+	AutoRequire bool
+	Version     string    // version of PackagePath to get with AutoRequire (defaults to latest)
+	Recursion   Recursion // how far the dependencies of TypeName or FunctionName are followed (defaults to RecursionAll)
+
+	// Tidy runs go mod tidy on the consuming module after its replace
+	// directives are updated, and fails naming the generated modules that
+	// don't resolve
+	Tidy bool
+
+	// GoEnv is added to the environment of the go commands the rewriter runs
+	// and loads packages with (KEY=value, e.g., GOPROXY=off or
+	// GOFLAGS=-mod=mod), and GoTimeout bounds each go command it runs
+	// (defaults to DefaultGoTimeout)
+	GoEnv     []string
+	GoTimeout time.Duration
+
+	// CopyAll copies the files of PackagePath essentially unmodified instead
+	// of extracting TypeName, leaving out files matching ExcludeFiles
+	CopyAll      bool
+	ExcludeFiles []string
+
+	// Options adjust how TypeName is extracted. A substituted type is only
+	// registered, not extracted.
+	Options TypeOptions
 }
 
-// DeclInfo holds information about a type declaration
+// DeclInfo holds information about a top-level declaration
 type DeclInfo struct {
 	Name        string
 	Decl        ast.Decl
 	File        *ast.File
 	Comment     *ast.CommentGroup
-	PackagePath string // The package this declaration came from
+	PackagePath string    // The package this declaration came from
+	Deps        []TypeRef // declarations referenced from a function body or value initializer
 }
 
 // RecursiveRewriter handles recursive extraction of types across packages
 type RecursiveRewriter struct {
-	config         *Config
-	fset           *token.FileSet
-	packages       map[string]*PackageInfo // key: package path
-	pendingTypes   []TypeRef               // types we need to extract
-	processedTypes map[string]bool         // types we've already extracted
-	modules        map[string]*ModuleInfo  // key: module path
+	config             *Config
+	fset               *token.FileSet
+	packages           map[string]*PackageInfo     // key: package path
+	pendingTypes       []TypeRef                   // types we need to extract
+	queued             map[string]bool             // keys of pendingTypes
+	processedTypes     map[string]bool             // types we've already extracted
+	requiredTypes      map[string]bool             // roots and type dependencies, which must always be extracted
+	unextractable      map[string]string           // optional dependencies that couldn't be extracted, with the reason
+	parents            map[string]TypeRef          // the declaration that first queued each type, for reporting dependency paths
+	current            TypeRef                     // the declaration being extracted
+	external           map[string]*packages.Module // packages referenced as real dependencies instead of being extracted, with their module
+	recursion          map[string]Recursion        // how far the dependencies of declarations reached from narrowed roots are followed, keyed by TypeRef.String()
+	narrowedRoots      []narrowedRoot              // roots with a narrowed recursion, queued once the full closures are extracted
+	outside            map[string]TypeRef          // dependencies a narrowed recursion left out, with the declaration referring to them
+	keptLocal          map[string]bool             // packages a local recursion keeps as real dependencies
+	shimmed            map[string]string           // packages provided by a shim module, with their import path in it
+	typeOptions        map[string]TypeOptions      // per-type options, keyed by TypeRef.String()
+	substitutes        map[string]TypeRef          // substituted types and their replacements, keyed by TypeRef.String()
+	modules            map[string]*ModuleInfo      // key: module path
+	loadMode           packages.LoadMode           // mode used when loading packages declarations are extracted from; their dependencies' types come from export data
+	typesMode          packages.LoadMode           // mode used when loading packages only consulted for their types, such as substitutes
+	exploreRoots       map[string]bool             // when exploring, the packages of the roots; every other package is only parsed
+	generatedLines     int                         // lines of Go code written so far
+	previousHashes     map[string]string           // manifest of the previous run, by path relative to the output directory
+	outputHashes       map[string]string           // hashes of the files written so far, likewise
+	otherOwners        map[string]string           // files generated in the output directory by other configs, with their owner
+	fieldChanges       []FieldChange               // fields that differ from upstream
+	strippedDirectives []StrippedDirective         // compiler directives removed from copied declarations
+	suggestions        []ModuleSuggestion          // ways the config could generate fewer modules
+	buildFlags         []string                    // flags passed to the go command when loading packages
+	modDir             string                      // directory of the consuming module's go.mod, once a temporary copy is used
+	tmpDirs            []string                    // temporary directories removed by cleanup
 }
 
 // ModuleInfo holds information about a Go module
 type ModuleInfo struct {
-	Path     string   // module path (e.g., "github.com/argoproj/argo-cd/v3")
-	Packages []string // package paths in this module
+	Path      string   // module path (e.g., "github.com/argoproj/argo-cd/v3")
+	Packages  []string // package paths in this module
+	GoVersion string   // go directive of the source module's go.mod
+	Toolchain string   // toolchain directive of the source module's go.mod
 }
 
 // PackageInfo holds information about a package being processed
 type PackageInfo struct {
 	Pkg           *packages.Package
-	Decls         map[string]*DeclInfo       // key: type name
+	Decls         map[string]*DeclInfo       // key: declaration name (type, function, constant, or variable)
 	Imports       map[string]map[string]bool // key: package path, value: set of aliases actually used in generated code
 	SourceImports map[string][]string        // key: package path, value: all package names/aliases used across source files
 	NameToPath    map[string]string          // key: package name/alias, value: package path (reverse lookup)
 	OutputSubdir  string                     // subdirectory in output (e.g., "k8s.io/apimachinery/pkg/apis/meta/v1")
 	ModulePath    string                     // module this package belongs to
+	UsesCgo       bool                       // whether any of the package's files import "C"
+	WholePackage  bool                       // whether all of the package's types are copied
+	Verbatim      bool                       // whether the package's files are copied unmodified instead of extracting declarations
+	ExcludeFiles  []string                   // file name patterns left out of a verbatim copy
+	Consulted     bool                       // whether the package was loaded without syntax, since nothing is extracted from it
+	Unchecked     bool                       // whether the package was only parsed, without type checking it, since nothing is extracted from it yet
+	Inlined       map[string]string          // key: TypeRef.String() of a type of another package copied into this one, value: its name here
+
+	declIndex *declIndex // built on first lookup
 }
 
-// TypeRef represents a reference to a type we need to extract
+// TypeRef represents a reference to a type we need to extract. Functions,
+// constants, and variables referenced by extracted functions are queued the
+// same way, with TypeName holding their name.
 type TypeRef struct {
 	PackagePath string
 	TypeName    string
@@ -76,184 +294,568 @@ func RewriteRecursive(config *Config) error {
 // This is more efficient than calling RewriteRecursive multiple times
 // as it reuses the same rewriter state and only updates go.mod once
 func RewriteRecursiveBatch(configs []*Config) error {
-	if len(configs) == 0 {
-		return fmt.Errorf("no configs provided")
+	r, err := newBatchRewriter(configs)
+	if err != nil {
+		return err
 	}
+	defer r.cleanup()
 
-	// Use the output directory from the first config
-	outputDir := configs[0].OutputDir
+	// In a workspace, generated modules are added to go.work instead
+	var goWork *GoWorkManager
+	if r.generatesModules() {
+		goWorkPath, err := FindGoWork(r.config.Dir)
+		if err != nil {
+			slog.Warn("Failed to detect a go.work workspace", "error", err)
+		} else if goWorkPath != "" {
+			slog.Info("Using workspace", "go.work", goWorkPath)
+			if goWork, err = NewGoWorkManager(goWorkPath); err != nil {
+				return err
+			}
+			if err := r.removeGeneratedUses(goWork); err != nil {
+				return err
+			}
+		}
+	}
 
-	r := &RecursiveRewriter{
-		config: &Config{
-			OutputDir: outputDir,
-		},
-		fset:           token.NewFileSet(),
-		packages:       make(map[string]*PackageInfo),
-		processedTypes: make(map[string]bool),
-		modules:        make(map[string]*ModuleInfo),
+	// Find and load go.mod, unless the workspace is used instead
+	var goMod *GoModManager
+	if goWork == nil {
+		goModPath, err := FindGoMod()
+		if err != nil {
+			slog.Warn("go.mod not found, replace directives will not be managed automatically", "error", err)
+		} else {
+			goMod, err = NewGoModManager(goModPath)
+			if err != nil {
+				slog.Warn("Failed to parse go.mod, replace directives will not be managed automatically", "error", err)
+				goMod = nil
+			} else if err := r.loadWithoutGeneratedReplaces(goMod); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Queue all target types from all configs
-	for _, cfg := range configs {
-		r.pendingTypes = append(r.pendingTypes, TypeRef{
-			PackagePath: cfg.PackagePath,
-			TypeName:    cfg.TypeName,
-		})
+	// Process types recursively
+	if err := r.processQueue(); err != nil {
+		return err
 	}
 
-	// Find and load go.mod
-	goModPath, err := FindGoMod()
-	var goMod *GoModManager
+	// The directives for generated modules can't point at a module being
+	// updated
+	if goWork != nil {
+		if err := r.checkSelfExtraction(goWork.ModulePaths()); err != nil {
+			return err
+		}
+	} else if goMod != nil && r.generatesModules() {
+		if err := r.checkSelfExtraction([]string{goMod.ModulePath()}); err != nil {
+			return err
+		}
+	}
+
+	// Generate output for all packages
+	if err := r.generateOutput(); err != nil {
+		return err
+	}
+
+	if err := r.writeGitMetadata(); err != nil {
+		return err
+	}
+
+	// Add use or replace directives for generated modules
+	if goWork != nil {
+		if err := r.updateGoWorkUses(goWork); err != nil {
+			return err
+		}
+		if r.config.Tidy {
+			slog.Info("Not running go mod tidy, which ignores the workspace", "go.work", goWork.path)
+		}
+	} else if goMod != nil && r.generatesModules() {
+		if err := r.updateGoModReplaces(goMod); err != nil {
+			return err
+		}
+	}
+
+	r.logSummary()
+	r.logReferencedPackages()
+	r.logModuleSuggestions()
+	return nil
+}
+
+// checkSelfExtraction fails when a module the run would generate is one of
+// the consuming modules: the replace or use directive for the generated copy
+// would point the module at a trimmed copy of itself. Code is copied within
+// a module with ImportPrefix instead, which doesn't generate modules.
+func (r *RecursiveRewriter) checkSelfExtraction(consuming []string) error {
+	generated := make(map[string]bool)
+	for _, modulePath := range r.generatedModules() {
+		generated[modulePath] = true
+	}
+	for _, modulePath := range consuming {
+		if !generated[modulePath] {
+			continue
+		}
+		if r.config.Layout == LayoutUmbrella {
+			return &Diagnostic{Code: CodeSelfExtraction, Err: fmt.Errorf("umbrellaModule %s is the module being updated; use another module path, or importPrefix to generate packages inside it", modulePath)}
+		}
+		err := fmt.Errorf("can't generate module %s, which is the module being updated: its replace directive would point it at a trimmed copy of itself. Extract from other modules, keep its packages external (keepExternal), or copy them into it with importPrefix", modulePath)
+		pkgPaths := append([]string(nil), r.modules[modulePath].Packages...)
+		sort.Strings(pkgPaths)
+		for _, pkgPath := range pkgPaths {
+			if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() && !pkgInfo.Verbatim {
+				typeRef := TypeRef{PackagePath: pkgPath, TypeName: sortedDeclNames(pkgInfo)[0]}
+				return &Diagnostic{Code: CodeSelfExtraction, Package: pkgPath, Decl: typeRef.String(), Err: fmt.Errorf("%w (reached via %s)", err, r.dependencyPath(typeRef))}
+			}
+		}
+		return &Diagnostic{Code: CodeSelfExtraction, Err: err}
+	}
+	return nil
+}
+
+// Extract runs a batch like RewriteRecursiveBatch, but leaves go.mod alone
+// and returns the generated files, keyed by their path relative to the
+// output directory
+func Extract(configs []*Config) (map[string][]byte, error) {
+	r, err := newBatchRewriter(configs)
 	if err != nil {
-		slog.Warn("go.mod not found, replace directives will not be managed automatically", "error", err)
-	} else {
-		goMod, err = NewGoModManager(goModPath)
+		return nil, err
+	}
+	defer r.cleanup()
+
+	if err := r.processQueue(); err != nil {
+		return nil, err
+	}
+	if err := r.generateOutput(); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	err = filepath.WalkDir(r.config.OutputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
 		if err != nil {
-			slog.Warn("Failed to parse go.mod, replace directives will not be managed automatically", "error", err)
-			goMod = nil
-		} else {
-			// Remove existing replace directives for all modules (we'll add back only what we generate)
-			replaces := goMod.GetReplaces()
-			if len(replaces) > 0 {
-				slog.Info("Removing existing replace directives from go.mod", "count", len(replaces))
-				for modulePath := range replaces {
-					if err := goMod.RemoveReplace(modulePath); err != nil {
-						slog.Warn("Failed to remove replace directive", "module", modulePath, "error", err)
-					}
-				}
-				if err := goMod.Save(); err != nil {
-					slog.Warn("Failed to save go.mod after removing replace directives", "error", err)
-				} else {
-					// Run go mod tidy after removing replace directives
-					if err := goMod.Tidy(); err != nil {
-						slog.Warn("Failed to run go mod tidy after removing replace directives", "error", err)
-					}
-				}
+			return err
+		}
+		rel, err := filepath.Rel(r.config.OutputDir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	return files, err
+}
+
+// newBatchRewriter creates a rewriter for a batch of configs, with the
+// run-wide options of the first one, and queues their targets
+func newBatchRewriter(configs []*Config) (*RecursiveRewriter, error) {
+	return newBatchRewriterAt(configs, "", "")
+}
+
+// newBatchRewriterAt is newBatchRewriter loading the packages of modulePath
+// at version, if given, instead of the version the consuming module requires
+func newBatchRewriterAt(configs []*Config, modulePath, version string) (_ *RecursiveRewriter, err error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no configs provided")
+	}
+
+	// Use the output directory and run-wide options from the first config
+	global := *configs[0]
+	global.PackagePath, global.TypeName, global.FunctionName = "", "", ""
+	global.CopyAll, global.ExcludeFiles = false, nil
+	global.Options, global.Version, global.Recursion = TypeOptions{}, "", ""
+
+	if global.Layout == LayoutUmbrella {
+		if err := checkUmbrella(&global); err != nil {
+			return nil, err
+		}
+		global.ImportPrefix = global.UmbrellaModule
+	}
+	if global.Layout == LayoutInternal {
+		if err := checkInternal(&global); err != nil {
+			return nil, err
+		}
+	} else if global.InModule {
+		if err := checkInModule(&global); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkReplaceWith(global.ReplaceWith); err != nil {
+		return nil, err
+	}
+	if global.Publish != nil {
+		if err := checkPublish(&global); err != nil {
+			return nil, err
+		}
+		global.ImportPrefix = global.Publish.Module
+	}
+	if global.AliasTag != "" && global.ImportPrefix == "" {
+		return nil, fmt.Errorf("an alias tag requires an import prefix, since aliases can't refer to the package they replace")
+	}
+	if global.StripVersionSuffix && global.ImportPrefix != "" {
+		return nil, fmt.Errorf("stripping version suffixes requires generated modules, so it can't be combined with an import prefix")
+	}
+	if global.FlattenStructs && (global.Validation || global.Defaults) {
+		return nil, fmt.Errorf("flattening structs can't be combined with validation or defaults, which generate methods on the nested types")
+	}
+	if (global.CollapseModules > 0 || global.MinimizeModules) && global.ImportPrefix != "" {
+		return nil, fmt.Errorf("collapsing modules requires generated modules, so it can't be combined with an import prefix")
+	}
+	switch global.Layout {
+	case "", LayoutModulePath, LayoutUmbrella, LayoutInternal:
+	case LayoutThirdParty:
+		if global.ImportPrefix != "" {
+			return nil, fmt.Errorf("the %s layout places generated modules, so it can't be combined with an import prefix", global.Layout)
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout %q", global.Layout)
+	}
+
+	r := newRecursiveRewriter(&global)
+	defer func() {
+		if err != nil {
+			r.cleanup()
+		}
+	}()
+
+	// Make source packages loadable before anything is loaded
+	if global.AutoRequire {
+		versions := make(map[string]string)
+		for _, cfg := range configs {
+			if versions[cfg.PackagePath] == "" {
+				versions[cfg.PackagePath] = cfg.Version
+			}
+			if i := strings.LastIndex(cfg.Options.Substitute, "."); i > 0 {
+				versions[cfg.Options.Substitute[:i]] = ""
+			}
+		}
+		if err := r.requireMissing(versions); err != nil {
+			return nil, err
+		}
+	}
+	if version != "" {
+		if err := r.pinModule(modulePath, version); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.applyPreset(global.Preset); err != nil {
+		return nil, err
+	}
+
+	// Queue all target types from all configs
+	for _, cfg := range configs {
+		if err := checkRecursion(cfg); err != nil {
+			return nil, err
+		}
+		if cfg.CopyAll {
+			if err := r.queuePackageCopy(cfg.PackagePath, cfg.ExcludeFiles); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if cfg.TypeName != "" {
+			ref := TypeRef{PackagePath: cfg.PackagePath, TypeName: cfg.TypeName}
+			if err := r.setTypeOptions(ref, cfg.Options); err != nil {
+				return nil, err
+			}
+			if cfg.Options.Substitute != "" || cfg.Options.Wrap {
+				continue
 			}
 		}
+		name := cfg.TypeName
+		if cfg.FunctionName != "" {
+			name = cfg.FunctionName
+		}
+		if cfg.Recursion != "" && cfg.Recursion != RecursionAll {
+			r.narrowedRoots = append(r.narrowedRoots, narrowedRoot{TypeRef{PackagePath: cfg.PackagePath, TypeName: name}, cfg.Recursion})
+			continue
+		}
+		r.queueType(cfg.PackagePath, name)
 	}
+	r.sortNarrowedRoots()
+
+	return r, nil
+}
+
+func newRecursiveRewriter(config *Config) *RecursiveRewriter {
+	// Positions of cached packages are recorded in the cache's file set
+	fset := token.NewFileSet()
+	if config.Cache != nil {
+		fset = config.Cache.fset
+	}
+	return &RecursiveRewriter{
+		config:         config,
+		fset:           fset,
+		packages:       make(map[string]*PackageInfo),
+		queued:         make(map[string]bool),
+		processedTypes: make(map[string]bool),
+		requiredTypes:  make(map[string]bool),
+		unextractable:  make(map[string]string),
+		parents:        make(map[string]TypeRef),
+		external:       make(map[string]*packages.Module),
+		recursion:      make(map[string]Recursion),
+		outside:        make(map[string]TypeRef),
+		keptLocal:      make(map[string]bool),
+		shimmed:        make(map[string]string),
+		typeOptions:    make(map[string]TypeOptions),
+		substitutes:    make(map[string]TypeRef),
+		modules:        make(map[string]*ModuleInfo),
+		loadMode: packages.NeedName |
+			packages.NeedFiles |
+			packages.NeedCompiledGoFiles |
+			packages.NeedImports |
+			packages.NeedTypes |
+			packages.NeedSyntax |
+			packages.NeedTypesInfo |
+			packages.NeedModule,
+		// Without syntax, go/packages reads types from export data instead of
+		// type-checking the package from source
+		typesMode: consultMode | packages.NeedImports | packages.NeedTypes,
+	}
+}
+
+// consultMode is how packages nothing is extracted from, such as those kept
+// as real dependencies, are loaded: without parsing or type checking them,
+// which dominates load time on large trees, and without preprocessing cgo
+// files
+const consultMode = packages.NeedName | packages.NeedFiles | packages.NeedModule
+
+// parseMode loads packages nothing is extracted from yet, but whose syntax is
+// read: those whose annotations are checked, and those explore only counts
+// the dependencies of. They're parsed but not type-checked.
+const parseMode = consultMode | packages.NeedImports | packages.NeedSyntax
+
+// processQueue extracts pending types until the queue is empty
+func (r *RecursiveRewriter) processQueue() error {
+	for {
+		if err := r.drainQueue(); err != nil {
+			return err
+		}
+		if r.queueNarrowedRoot() {
+			continue
+		}
+		// Copying whole packages may queue more types, possibly in new packages
+		if !r.expandWholePackages() {
+			break
+		}
+	}
+	if err := r.checkOutsideRecursion(); err != nil {
+		return err
+	}
+	if err := r.checkKeptLocal(); err != nil {
+		return err
+	}
+
+	// Drop functions and methods that ended up depending on something we couldn't extract
+	return r.dropUnextractable()
+}
+
+// drainQueue extracts pending types and their dependencies until none are left
+func (r *RecursiveRewriter) drainQueue() error {
+	defer func() { r.current = TypeRef{} }()
 
-	// Process types recursively
 	for len(r.pendingTypes) > 0 {
 		// Pop next type to process
 		typeRef := r.pendingTypes[0]
 		r.pendingTypes = r.pendingTypes[1:]
+		delete(r.queued, typeRef.String())
 
 		// Skip if already processed
 		if r.processedTypes[typeRef.String()] {
 			continue
 		}
 
-		// Skip stdlib types
-		if r.isStdlib(typeRef.PackagePath) {
+		// Skip stdlib types, packages kept as real dependencies, and packages copied verbatim
+		if r.isStdlib(typeRef.PackagePath) || r.external[typeRef.PackagePath] != nil || r.isVerbatim(typeRef.PackagePath) {
 			r.processedTypes[typeRef.String()] = true
 			continue
 		}
 
-		fmt.Printf("Processing: %s\n", typeRef.String())
+		slog.Info("Processing", "decl", typeRef.String())
 
 		// Extract this type and queue its dependencies
-		if err := r.extractType(typeRef); err != nil {
-			return fmt.Errorf("failed to extract %s: %w", typeRef.String(), err)
+		r.current = typeRef
+		err := r.extractDecl(typeRef)
+		if err == nil {
+			err = r.stripDirectives(typeRef)
+		}
+		if err != nil {
+			if r.requiredTypes[typeRef.String()] || r.config.OnUnextractable != UnextractableDrop {
+				return fmt.Errorf("failed to extract %s: %w", typeRef.String(), err)
+			}
+			r.unextractable[typeRef.String()] = err.Error()
 		}
 
 		r.processedTypes[typeRef.String()] = true
 	}
 
-	// Generate output for all packages
-	if err := r.generateOutput(); err != nil {
+	return nil
+}
+
+func (r *RecursiveRewriter) extractDecl(typeRef TypeRef) error {
+	// Packages substituted as a whole aren't even loaded
+	if importPath, ok := r.packageSubstitute(typeRef.PackagePath); ok {
+		return r.substitutePackage(typeRef, importPath)
+	}
+
+	// Load package if not already loaded. Packages configured to stay real
+	// dependencies are only consulted for their module, and explore only
+	// parses packages other than the roots'.
+	var pkgInfo *PackageInfo
+	var err error
+	exploring := r.exploring(typeRef.PackagePath)
+	switch {
+	case r.isKeptExternal(typeRef.PackagePath) || r.inShimModule(typeRef.PackagePath):
+		pkgInfo, err = r.consultPackageInfo(typeRef.PackagePath, consultMode)
+	case exploring:
+		pkgInfo, err = r.parsePackageInfo(typeRef.PackagePath)
+	default:
+		pkgInfo, err = r.loadPackageInfo(typeRef.PackagePath)
+	}
+	if err != nil {
 		return err
 	}
 
-	// Add replace directives for generated modules
-	if goMod != nil {
-		return r.updateGoModReplaces(goMod)
+	// Packages configured to stay real dependencies aren't extracted
+	if r.isKeptExternal(typeRef.PackagePath) {
+		return r.keepExternal(typeRef, pkgInfo)
+	}
+	if shim := r.shimFor(pkgInfo.ModulePath); shim != nil {
+		return r.useShim(typeRef, pkgInfo, shim)
+	}
+	if pkgInfo.Consulted {
+		// A nested module of a shimmed module's path, which isn't shimmed
+		if exploring {
+			pkgInfo, err = r.parsePackageInfo(typeRef.PackagePath)
+		} else {
+			pkgInfo, err = r.loadPackageInfo(typeRef.PackagePath)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
-}
+	// Packages requiring cgo can't be copied into pure Go modules
+	if pkgInfo.UsesCgo {
+		return r.handleCgoPackage(typeRef, pkgInfo)
+	}
+	if exploring {
+		return r.exploreDecl(pkgInfo, typeRef)
+	}
 
-func (r *RecursiveRewriter) extractType(typeRef TypeRef) error {
-	// Load package if not already loaded
-	pkgInfo, err := r.loadPackageInfo(typeRef.PackagePath)
-	if err != nil {
-		return err
+	// Wrapped types are declared by their wrapper, methods included
+	if recv, _, _ := strings.Cut(typeRef.TypeName, "."); r.typeOptions[TypeRef{PackagePath: typeRef.PackagePath, TypeName: recv}.String()].Wrap {
+		return r.extractWrapper(pkgInfo, typeRef)
 	}
 
 	// Find the type declaration in the package
-	found := false
-	var typeSpec *ast.TypeSpec
-	var genDecl *ast.GenDecl
-	var file *ast.File
-
-	for _, f := range pkgInfo.Pkg.Syntax {
-		for _, decl := range f.Decls {
-			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.TYPE {
-				for _, spec := range gd.Specs {
-					if ts, ok := spec.(*ast.TypeSpec); ok {
-						if ts.Name.Name == typeRef.TypeName {
-							// Found it!
-							typeSpec = ts
-							genDecl = gd
-							file = f
-							found = true
-							break
-						}
-					}
-				}
-				if found {
-					break
-				}
-			}
+	site, _ := pkgInfo.lookup(typeRef.TypeName)
+	if typeSpec, ok := site.spec.(*ast.TypeSpec); ok {
+		genDecl, file := site.decl.(*ast.GenDecl), site.file
+		if err := r.checkAnnotations(pkgInfo, typeRef); err != nil {
+			return err
 		}
-		if found {
-			break
+		// Apply the type's options before its dependencies are known
+		if err := r.pruneFields(typeRef, typeSpec); err != nil {
+			return err
+		}
+		if err := r.selectFields(pkgInfo, typeRef, typeSpec); err != nil {
+			return err
+		}
+		r.dropDeprecatedFields(typeRef, typeSpec)
+		r.dropSkippedFields(pkgInfo, typeRef, typeSpec)
+		if err := r.checkUnexported(pkgInfo, typeRef, typeSpec); err != nil {
+			return err
+		}
+		if err := r.checkSuspectFields(pkgInfo, typeRef, typeSpec); err != nil {
+			return err
+		}
+		if err := r.checkNonSerializableFields(pkgInfo, typeRef, typeSpec); err != nil {
+			return err
+		}
+		if err := r.substituteAnnotated(pkgInfo, typeSpec); err != nil {
+			return err
+		}
+		r.substituteFieldTypes(pkgInfo, typeRef, typeSpec)
+		if err := r.inlineTypes(pkgInfo, typeSpec); err != nil {
+			return err
 		}
-	}
 
-	if found {
 		// Store the declaration
-		r.collectTypeDecl(pkgInfo, typeSpec.Name.Name, genDecl, file)
+		r.collectTypeDecl(pkgInfo, typeSpec, genDecl, file)
 
-		// Walk the type to find dependencies
+		// Walk the type parameters and the type to find dependencies
+		r.walkFieldListForDeps(pkgInfo, typeSpec.TypeParams)
 		r.walkTypeForDeps(pkgInfo, typeSpec.Type)
+		r.queueUnderlyingConsts(pkgInfo, typeSpec)
+
+		if r.copyMethods(typeRef) {
+			r.queueMethods(pkgInfo, typeSpec.Name.Name)
+		} else if r.typeOptions[typeRef.String()].CopyMethods == nil {
+			r.queueErrorMethods(pkgInfo, typeSpec.Name.Name)
+		}
+		return nil
 	}
 
-	if !found {
-		return fmt.Errorf("type %s not found in package %s", typeRef.TypeName, typeRef.PackagePath)
+	// Not a type: it may be a method, function, constant, or variable
+	if recvName, methodName, ok := strings.Cut(typeRef.TypeName, "."); ok {
+		return r.extractMethod(pkgInfo, recvName, methodName)
+	}
+	if found, err := r.extractValueDecl(pkgInfo, typeRef.TypeName); found || err != nil {
+		return err
 	}
 
-	return nil
+	return &Diagnostic{
+		Code:    CodeTypeNotFound,
+		Package: typeRef.PackagePath,
+		Decl:    typeRef.String(),
+		Err:     fmt.Errorf("declaration %s not found in package %s", typeRef.TypeName, typeRef.PackagePath),
+	}
 }
 
+// loadPackageInfo loads a package with its syntax and type information, for
+// extracting declarations from it. A package that was only consulted or
+// explored so far is loaded again.
 func (r *RecursiveRewriter) loadPackageInfo(pkgPath string) (*PackageInfo, error) {
-	if pkgInfo, exists := r.packages[pkgPath]; exists {
+	if pkgInfo, exists := r.packages[pkgPath]; exists && !pkgInfo.Consulted && !pkgInfo.Unchecked {
 		return pkgInfo, nil
 	}
+	return r.loadPackageInfoMode(pkgPath, r.loadMode)
+}
 
-	// Load the package
-	cfg := &packages.Config{
-		Mode: packages.NeedName |
-			packages.NeedFiles |
-			packages.NeedCompiledGoFiles |
-			packages.NeedImports |
-			packages.NeedTypes |
-			packages.NeedSyntax |
-			packages.NeedTypesInfo |
-			packages.NeedModule,
-		Fset: r.fset,
-	}
+// exploring reports whether explore only parses the package, which it does
+// for every package but the roots'
+func (r *RecursiveRewriter) exploring(pkgPath string) bool {
+	return r.exploreRoots != nil && !r.exploreRoots[pkgPath]
+}
 
-	pkgs, err := packages.Load(cfg, pkgPath)
-	if err != nil {
-		return nil, err
+// parsePackageInfo loads a package in parseMode. A package already loaded
+// with its syntax is reused; loadPackageInfo type-checks it if something is
+// extracted from it later.
+func (r *RecursiveRewriter) parsePackageInfo(pkgPath string) (*PackageInfo, error) {
+	if pkgInfo, exists := r.packages[pkgPath]; exists && !pkgInfo.Consulted {
+		return pkgInfo, nil
 	}
+	return r.loadPackageInfoMode(pkgPath, parseMode)
+}
 
-	if len(pkgs) == 0 {
-		return nil, fmt.Errorf("package not found: %s", pkgPath)
+// consultPackageInfo loads a package nothing is extracted from, such as one
+// kept as a real dependency, in consultMode, or typesMode if its types are
+// needed. A package already loaded with what's needed is reused.
+func (r *RecursiveRewriter) consultPackageInfo(pkgPath string, mode packages.LoadMode) (*PackageInfo, error) {
+	if pkgInfo, exists := r.packages[pkgPath]; exists && (mode&packages.NeedTypes == 0 || pkgInfo.Pkg.Types != nil) {
+		return pkgInfo, nil
 	}
+	return r.loadPackageInfoMode(pkgPath, mode)
+}
 
-	pkg := pkgs[0]
+func (r *RecursiveRewriter) loadPackageInfoMode(pkgPath string, mode packages.LoadMode) (*PackageInfo, error) {
+	// Load the package
+	pkg, err := r.loadPackage(pkgPath, mode)
+	if err != nil {
+		return nil, &Diagnostic{Code: CodePackageLoadFailure, Package: pkgPath, Err: err}
+	}
 
 	if len(pkg.Errors) > 0 {
 		for _, err := range pkg.Errors {
@@ -262,16 +864,24 @@ func (r *RecursiveRewriter) loadPackageInfo(pkgPath string) (*PackageInfo, error
 	}
 
 	// Get the module path for this package
-	modulePath := getModulePath(pkg)
+	modulePath, err := r.getModulePath(pkg)
+	if err != nil {
+		return nil, &Diagnostic{Code: CodePackageLoadFailure, Package: pkgPath, Err: err}
+	}
 
 	// Track the module
 	if _, exists := r.modules[modulePath]; !exists {
+		goVersion, toolchain := sourceGoDirectives(pkg.Module)
 		r.modules[modulePath] = &ModuleInfo{
-			Path:     modulePath,
-			Packages: []string{},
+			Path:      modulePath,
+			Packages:  []string{},
+			GoVersion: goVersion,
+			Toolchain: toolchain,
 		}
 	}
-	r.modules[modulePath].Packages = append(r.modules[modulePath].Packages, pkgPath)
+	if _, reloaded := r.packages[pkgPath]; !reloaded {
+		r.modules[modulePath].Packages = append(r.modules[modulePath].Packages, pkgPath)
+	}
 
 	// Create package info
 	pkgInfo := &PackageInfo{
@@ -280,8 +890,15 @@ func (r *RecursiveRewriter) loadPackageInfo(pkgPath string) (*PackageInfo, error
 		Imports:       make(map[string]map[string]bool),
 		SourceImports: make(map[string][]string),
 		NameToPath:    make(map[string]string),
-		OutputSubdir:  pkgPath,
+		OutputSubdir:  r.outputSubdir(pkgPath, modulePath),
 		ModulePath:    modulePath,
+		Consulted:     mode&packages.NeedSyntax == 0,
+		Unchecked:     mode&packages.NeedSyntax != 0 && mode&packages.NeedTypes == 0,
+	}
+	// Declarations explored so far stay collected when a package is loaded
+	// again to be type-checked
+	if previous, exists := r.packages[pkgPath]; exists && previous.Unchecked {
+		pkgInfo.Decls, pkgInfo.Imports = previous.Decls, previous.Imports
 	}
 
 	// Collect all imports from source files for name resolution
@@ -299,10 +916,29 @@ func (r *RecursiveRewriter) loadPackageInfo(pkgPath string) (*PackageInfo, error
 		"path", pkgPath,
 		"importCount", len(pkgInfo.SourceImports))
 
+	pkgInfo.UsesCgo = usesCgo(pkg)
+
 	r.packages[pkgPath] = pkgInfo
 	return pkgInfo, nil
 }
 
+// isMangledAlias detects auto-generated mangled names by checking if the
+// alias contains multiple consecutive package path components separated by
+// underscores. For example: "github_com_argoproj_gitops_engine_pkg_sync_common".
+// Real user aliases like "synccommon", "metav1", "v1alpha1" don't match this
+// pattern.
+func isMangledAlias(path, alias string) bool {
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathParts) < 3 {
+		return false
+	}
+	// Check if the alias contains at least 3 path components joined by underscores
+	mangledPattern := strings.Join(pathParts, "_")
+	mangledPattern = strings.ReplaceAll(mangledPattern, ".", "_")
+	mangledPattern = strings.ReplaceAll(mangledPattern, "-", "_")
+	return strings.Contains(alias, mangledPattern) || strings.Count(alias, "_") >= 2
+}
+
 func (r *RecursiveRewriter) collectSourceImports(pkgInfo *PackageInfo, file *ast.File) {
 	// Scan the file's imports and add them to SourceImports for lookup
 	for _, imp := range file.Imports {
@@ -319,22 +955,7 @@ func (r *RecursiveRewriter) collectSourceImports(pkgInfo *PackageInfo, file *ast
 		if imp.Name != nil {
 			pkgName = imp.Name.Name
 			hasExplicitAlias = true
-
-			// Detect auto-generated mangled names by checking if the alias contains
-			// multiple consecutive package path components separated by underscores.
-			// For example: "github_com_argoproj_gitops_engine_pkg_sync_common"
-			// Real user aliases like "synccommon", "metav1", "v1alpha1" don't match this pattern.
-			pathParts := strings.Split(strings.Trim(path, "/"), "/")
-			if len(pathParts) >= 3 {
-				// Check if the alias contains at least 3 path components joined by underscores
-				mangledPattern := strings.Join(pathParts, "_")
-				mangledPattern = strings.ReplaceAll(mangledPattern, ".", "_")
-				mangledPattern = strings.ReplaceAll(mangledPattern, "-", "_")
-				if strings.Contains(pkgName, mangledPattern) ||
-					(len(pathParts) >= 3 && strings.Count(pkgName, "_") >= 2) {
-					isMangled = true
-				}
-			}
+			isMangled = isMangledAlias(path, pkgName)
 		} else {
 			pkgName = filepath.Base(path)
 		}
@@ -378,7 +999,8 @@ func (r *RecursiveRewriter) collectSourceImports(pkgInfo *PackageInfo, file *ast
 	}
 }
 
-func (r *RecursiveRewriter) collectTypeDecl(pkgInfo *PackageInfo, name string, decl *ast.GenDecl, file *ast.File) {
+func (r *RecursiveRewriter) collectTypeDecl(pkgInfo *PackageInfo, spec *ast.TypeSpec, decl *ast.GenDecl, file *ast.File) {
+	name := spec.Name.Name
 	if _, exists := pkgInfo.Decls[name]; exists {
 		return
 	}
@@ -388,6 +1010,16 @@ func (r *RecursiveRewriter) collectTypeDecl(pkgInfo *PackageInfo, name string, d
 		comment = decl.Doc
 	}
 
+	// Split grouped declarations so sibling types we don't need aren't emitted
+	if len(decl.Specs) > 1 {
+		comment = spec.Doc
+		decl = &ast.GenDecl{
+			TokPos: spec.Pos(),
+			Tok:    token.TYPE,
+			Specs:  []ast.Spec{spec},
+		}
+	}
+
 	pkgInfo.Decls[name] = &DeclInfo{
 		Name:        name,
 		Decl:        decl,
@@ -404,6 +1036,15 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 
 	switch t := expr.(type) {
 	case *ast.Ident:
+		if pkgInfo.Pkg.Types == nil {
+			// Packages explore only parsed have no types
+			if site, ok := pkgInfo.lookup(t.Name); ok {
+				if _, ok := site.spec.(*ast.TypeSpec); ok {
+					r.queueType(pkgInfo.Pkg.PkgPath, t.Name)
+				}
+			}
+			return
+		}
 		// Check if this is a type from the same package
 		if obj := pkgInfo.Pkg.Types.Scope().Lookup(t.Name); obj != nil {
 			// Check if this is a type name (includes both named types and type aliases)
@@ -417,6 +1058,8 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 		r.walkTypeForDeps(pkgInfo, t.X)
 
 	case *ast.ArrayType:
+		// The length of an array type may be a constant expression (e.g., [Size]byte)
+		r.walkExprForDeps(pkgInfo, nil, t.Len)
 		r.walkTypeForDeps(pkgInfo, t.Elt)
 
 	case *ast.MapType:
@@ -424,11 +1067,7 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 		r.walkTypeForDeps(pkgInfo, t.Value)
 
 	case *ast.StructType:
-		if t.Fields != nil {
-			for _, field := range t.Fields.List {
-				r.walkTypeForDeps(pkgInfo, field.Type)
-			}
-		}
+		r.walkFieldListForDeps(pkgInfo, t.Fields)
 
 	case *ast.SelectorExpr:
 		// This is a type from another package (e.g., metav1.Time, synccommon.OperationPhase)
@@ -451,36 +1090,9 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 				}
 			}
 
-			// If not found via TypesInfo, check all imported packages from the loader
-			if externalPkgPath == "" {
-				for path, imp := range pkgInfo.Pkg.Imports {
-					if imp.Name == pkgName {
-						externalPkgPath = path
-						break
-					}
-				}
-			}
-
-			// If still not found, use NameToPath as a fallback
+			// If not found via TypesInfo, resolve the name from the imports
 			if externalPkgPath == "" {
-				if path, exists := pkgInfo.NameToPath[pkgName]; exists {
-					externalPkgPath = path
-				}
-			}
-
-			// If still not found, check our Imports map (already used imports)
-			if externalPkgPath == "" {
-				for path, aliases := range pkgInfo.Imports {
-					for alias := range aliases {
-						if alias == pkgName {
-							externalPkgPath = path
-							break
-						}
-					}
-					if externalPkgPath != "" {
-						break
-					}
-				}
+				externalPkgPath = importedPath(pkgInfo, pkgName)
 			}
 
 			if externalPkgPath != "" {
@@ -489,32 +1101,20 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 				r.queueType(externalPkgPath, typeName)
 
 				// Record the import for this package with the correct alias
-				if pkgInfo.Imports[externalPkgPath] == nil {
-					pkgInfo.Imports[externalPkgPath] = make(map[string]bool)
-				}
-				pkgInfo.Imports[externalPkgPath][pkgName] = true
+				r.recordImport(pkgInfo, externalPkgPath, pkgName)
 			}
 		}
 
 	case *ast.InterfaceType:
-		// Interface - might have embedded interfaces
-		if t.Methods != nil {
-			for _, field := range t.Methods.List {
-				r.walkTypeForDeps(pkgInfo, field.Type)
-			}
-		}
+		// Interface methods are FuncTypes whose parameter and result types
+		// must be extracted too; embedded interfaces and type-set elements
+		// (e.g. ~int | Foo) are walked like any other type expression
+		r.walkFieldListForDeps(pkgInfo, t.Methods)
 
 	case *ast.FuncType:
-		if t.Params != nil {
-			for _, field := range t.Params.List {
-				r.walkTypeForDeps(pkgInfo, field.Type)
-			}
-		}
-		if t.Results != nil {
-			for _, field := range t.Results.List {
-				r.walkTypeForDeps(pkgInfo, field.Type)
-			}
-		}
+		r.walkFieldListForDeps(pkgInfo, t.TypeParams)
+		r.walkFieldListForDeps(pkgInfo, t.Params)
+		r.walkFieldListForDeps(pkgInfo, t.Results)
 
 	case *ast.ChanType:
 		r.walkTypeForDeps(pkgInfo, t.Value)
@@ -522,7 +1122,67 @@ func (r *RecursiveRewriter) walkTypeForDeps(pkgInfo *PackageInfo, expr ast.Expr)
 	case *ast.Ellipsis:
 		r.walkTypeForDeps(pkgInfo, t.Elt)
 
+	case *ast.ParenExpr:
+		r.walkTypeForDeps(pkgInfo, t.X)
+
+	case *ast.IndexExpr:
+		// Generic instantiation with one type argument (e.g., List[Item])
+		r.walkTypeForDeps(pkgInfo, t.X)
+		r.walkTypeForDeps(pkgInfo, t.Index)
+
+	case *ast.IndexListExpr:
+		r.walkTypeForDeps(pkgInfo, t.X)
+		for _, index := range t.Indices {
+			r.walkTypeForDeps(pkgInfo, index)
+		}
+
+	case *ast.UnaryExpr:
+		// Approximation element in a constraint (e.g., ~string)
+		r.walkTypeForDeps(pkgInfo, t.X)
+
+	case *ast.BinaryExpr:
+		// Union element in a constraint (e.g., int | Foo)
+		r.walkTypeForDeps(pkgInfo, t.X)
+		r.walkTypeForDeps(pkgInfo, t.Y)
+
+	}
+}
+
+// importedPath returns the path of the package the files of pkgInfo import
+// as name, or "" if there's none: by the names of the imported packages, then
+// by the aliases of the source files, then by the aliases used so far
+func importedPath(pkgInfo *PackageInfo, name string) string {
+	for path, imp := range pkgInfo.Pkg.Imports {
+		if imp.Name == name {
+			return path
+		}
+	}
+	if path, exists := pkgInfo.NameToPath[name]; exists {
+		return path
 	}
+	for path, aliases := range pkgInfo.Imports {
+		if aliases[name] {
+			return path
+		}
+	}
+	return ""
+}
+
+func (r *RecursiveRewriter) walkFieldListForDeps(pkgInfo *PackageInfo, fields *ast.FieldList) {
+	if fields == nil {
+		return
+	}
+	for _, field := range fields.List {
+		r.walkTypeForDeps(pkgInfo, field.Type)
+	}
+}
+
+// recordImport notes that generated code for pkgInfo refers to pkgPath by alias
+func (r *RecursiveRewriter) recordImport(pkgInfo *PackageInfo, pkgPath, alias string) {
+	if pkgInfo.Imports[pkgPath] == nil {
+		pkgInfo.Imports[pkgPath] = make(map[string]bool)
+	}
+	pkgInfo.Imports[pkgPath][alias] = true
 }
 
 func (r *RecursiveRewriter) queueType(pkgPath, typeName string) {
@@ -530,46 +1190,140 @@ func (r *RecursiveRewriter) queueType(pkgPath, typeName string) {
 		PackagePath: pkgPath,
 		TypeName:    typeName,
 	}
+	r.requiredTypes[typeRef.String()] = true
+	r.queueOptional(typeRef)
+}
 
-	// Skip if already processed or queued
-	if r.processedTypes[typeRef.String()] {
+// queueOptional queues a dependency that may be dropped, along with whatever
+// refers to it, if it can't be extracted
+func (r *RecursiveRewriter) queueOptional(typeRef TypeRef) {
+	// Skip if already processed, being processed, or queued
+	if r.processedTypes[typeRef.String()] || typeRef == r.current {
 		return
 	}
 
 	// Check if already in queue
-	for _, pending := range r.pendingTypes {
-		if pending.String() == typeRef.String() {
-			return
-		}
+	if r.queued[typeRef.String()] {
+		return
+	}
+	if r.outsideRecursion(typeRef) {
+		return
 	}
 
+	// Remember who needed this type first so we can explain how it was
+	// reached. Only the first time counts: a type referring back to one queued
+	// before it (such as a root, in a cycle) must not become its parent, so
+	// parents always form a tree.
+	if r.current != (TypeRef{}) {
+		r.parents[typeRef.String()] = r.current
+	}
 	r.pendingTypes = append(r.pendingTypes, typeRef)
+	r.queued[typeRef.String()] = true
 }
 
 func (r *RecursiveRewriter) generateOutput() error {
-	fmt.Printf("\nGenerating output for %d packages...\n", len(r.packages))
+	slog.Info("Generating output", "packages", len(r.packages))
+	r.readManifest()
 
-	// First, create go.mod files for each module
-	if err := r.generateModuleFiles(); err != nil {
+	r.flattenStructs()
+	collapsed := r.prepareCollapse()
+	if err := r.applyRenames(); err != nil {
 		return err
 	}
+	r.collapseModules(collapsed)
+	r.suggestions = r.suggestFewerModules()
 
-	// Sort package paths for deterministic output
-	var pkgPaths []string
-	for pkgPath := range r.packages {
-		pkgPaths = append(pkgPaths, pkgPath)
+	// Make the output compatible with the target Go version, if any
+	if err := r.applyGoVersion(); err != nil {
+		return err
 	}
-	sort.Strings(pkgPaths)
 
-	for _, pkgPath := range pkgPaths {
-		pkgInfo := r.packages[pkgPath]
-		if len(pkgInfo.Decls) == 0 {
-			continue
+	if err := r.checkOutputPaths(); err != nil {
+		return err
+	}
+	if err := r.checkOwnership(); err != nil {
+		return err
+	}
+	if err := r.checkImportCycles(); err != nil {
+		return err
+	}
+	r.warnMarshalDifferences()
+
+	if r.config.FieldReport {
+		if err := r.writeFieldReport(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.collectSideEffectImports(); err != nil {
+		return err
+	}
+
+	if err := r.runEmitters(); err != nil {
+		return err
+	}
+	return r.writeManifest()
+}
+
+// emitGo writes the generated Go packages: a go.mod for each generated
+// module, types.go and the files of the enabled generators in each package,
+// and BUILD.bazel files. Each package's syntax is released once its files
+// are written.
+func (r *RecursiveRewriter) emitGo(out *Output) error {
+	// First, create go.mod files for each module, unless the output lives
+	// inside the consuming module under an import prefix or is a single
+	// published or umbrella module
+	if r.config.ImportPrefix == "" {
+		if err := r.generateModuleFiles(); err != nil {
+			return err
+		}
+	} else if r.config.Publish != nil {
+		if err := r.generatePublishModule(); err != nil {
+			return err
+		}
+	} else if r.config.Layout == LayoutUmbrella {
+		if err := r.generateUmbrellaModule(); err != nil {
+			return err
 		}
+	}
+
+	var pkgPaths []string
+	for _, pkgInfo := range out.Packages {
+		pkgPaths = append(pkgPaths, pkgInfo.Pkg.PkgPath)
+	}
+
+	// Equal methods depend on those of other packages, so they're built
+	// before any package's syntax is released
+	var equalMethods map[string]string
+	if r.config.Equal {
+		equalMethods = r.equalMethods()
+	}
+
+	for _, pkgInfo := range out.Packages {
+		pkgPath := pkgInfo.Pkg.PkgPath
 
 		// Create output directory
 		outputPath := filepath.Join(r.config.OutputDir, pkgInfo.OutputSubdir)
-		if err := os.MkdirAll(outputPath, 0o755); err != nil {
+		if err := r.mkdirOutput(outputPath); err != nil {
+			return err
+		}
+
+		// Packages copied verbatim keep their original files
+		if pkgInfo.Verbatim {
+			if err := r.copyVerbatimFiles(pkgInfo, outputPath); err != nil {
+				return err
+			}
+			if r.config.AliasTag != "" {
+				if err := r.generateAliasFile(pkgInfo, outputPath, pkgInfo.Pkg.Types.Scope().Names()); err != nil {
+					return err
+				}
+			}
+			r.releaseSyntax(pkgInfo)
+			continue
+		}
+
+		r.assignImportAliases(pkgInfo)
+		if err := r.checkDanglingImports(pkgInfo); err != nil {
 			return err
 		}
 
@@ -581,108 +1335,122 @@ func (r *RecursiveRewriter) generateOutput() error {
 			Name: ast.NewIdent(pkgInfo.Pkg.Name),
 		}
 
-		// Add package comment
-		packageComment := fmt.Sprintf("// Code generated by package-rewriter. DO NOT EDIT.\n// Source: %s\n", pkgPath)
-
-		// Add imports (only used imports from this package's perspective)
-		// pkgInfo.Imports now maps path -> set of aliases used
-		if len(pkgInfo.Imports) > 0 {
-			importDecl := &ast.GenDecl{
-				Tok: token.IMPORT,
-			}
+		// Add package comment, behind a build constraint if an alias flavor is generated
+		packageComment := generatedHeader(pkgPath)
+		if r.config.AliasTag != "" {
+			packageComment = fmt.Sprintf("//go:build !%s\n\n", r.config.AliasTag) + packageComment
+		}
 
-			// Check for alias conflicts (same alias pointing to different packages)
-			aliasToPackages := make(map[string][]string) // alias -> list of package paths
-			for path, aliases := range pkgInfo.Imports {
-				for alias := range aliases {
+		// Warn about alias conflicts (same alias pointing to different packages)
+		aliasToPackages := make(map[string][]string) // alias -> list of package paths
+		for path, aliases := range pkgInfo.Imports {
+			for alias := range aliases {
+				if alias != "_" {
 					aliasToPackages[alias] = append(aliasToPackages[alias], path)
 				}
 			}
-
-			// Warn about conflicts
-			for alias, packages := range aliasToPackages {
-				if len(packages) > 1 {
-					slog.Warn("Import alias conflict detected in generated code",
-						"package", pkgPath,
-						"alias", alias,
-						"conflictingPackages", packages,
-						"resolution", "The generated code will import all packages with their respective aliases, but only one can use this specific alias. Consider using different aliases in your types.")
-				}
+		}
+		for alias, packages := range aliasToPackages {
+			if len(packages) > 1 {
+				slog.Warn("Import alias conflict detected in generated code",
+					"package", pkgPath,
+					"alias", alias,
+					"conflictingPackages", packages,
+					"resolution", "The generated code will import all packages with their respective aliases, but only one can use this specific alias. Consider using different aliases in your types.")
 			}
+		}
 
-			// Sort import paths for deterministic output
-			var importPaths []string
-			for path := range pkgInfo.Imports {
-				importPaths = append(importPaths, path)
+		// Add declarations in sorted order for deterministic output
+		newFile.Decls = append(newFile.Decls, sortedDecls(pkgInfo)...)
+
+		// Write the file, with the imports after the package clause
+		var body bytes.Buffer
+		if err := format.Node(&body, r.fset, newFile); err != nil {
+			return err
+		}
+		packageClause, decls, _ := strings.Cut(body.String(), "\n")
+		if r.config.PreserveSource {
+			var err error
+			if decls, err = r.sourceDecls(newFile.Decls); err != nil {
+				return err
 			}
-			sort.Strings(importPaths)
+		}
+		var buf bytes.Buffer
+		buf.WriteString(packageComment)
+		buf.WriteString(packageClause + "\n")
+		if imports := r.importDecl(pkgInfo); imports != "" {
+			buf.WriteString("\n" + imports)
+		}
+		buf.WriteString(decls)
+		if err := r.writeGenerated(outputFile, buf.Bytes()); err != nil {
+			return err
+		}
 
-			for _, path := range importPaths {
-				aliases := pkgInfo.Imports[path]
-				// Only add import if we actually generated that package
-				if _, exists := r.packages[path]; !exists && !r.isStdlib(path) {
-					continue // Skip imports to packages we didn't extract
-				}
+		slog.Info("Generated", "file", outputFile, "decls", len(pkgInfo.Decls))
 
-				// Sort aliases for deterministic output
-				var sortedAliases []string
-				for alias := range aliases {
-					sortedAliases = append(sortedAliases, alias)
-				}
-				sort.Strings(sortedAliases)
-
-				// Add an import for each unique alias for this path
-				for _, alias := range sortedAliases {
-					importSpec := &ast.ImportSpec{
-						Path: &ast.BasicLit{
-							Kind:  token.STRING,
-							Value: fmt.Sprintf(`"%s"`, path),
-						},
-					}
-					if alias != filepath.Base(path) && !strings.HasSuffix(path, "/"+alias) {
-						importSpec.Name = ast.NewIdent(alias)
-					}
-					importDecl.Specs = append(importDecl.Specs, importSpec)
-				}
-			}
-			if len(importDecl.Specs) > 0 {
-				newFile.Decls = append(newFile.Decls, importDecl)
+		if r.config.AliasTag != "" {
+			if err := r.generateAliasFile(pkgInfo, outputPath, sortedDeclNames(pkgInfo)); err != nil {
+				return err
 			}
 		}
 
-		// Add type declarations in sorted order for deterministic output
-		var typeNames []string
-		for typeName := range pkgInfo.Decls {
-			typeNames = append(typeNames, typeName)
+		if r.config.Validation {
+			if err := r.generateValidation(pkgInfo, outputPath); err != nil {
+				return err
+			}
 		}
-		sort.Strings(typeNames)
 
-		for _, typeName := range typeNames {
-			info := pkgInfo.Decls[typeName]
-			newFile.Decls = append(newFile.Decls, info.Decl)
+		if r.config.Defaults {
+			if err := r.generateDefaults(pkgInfo, outputPath); err != nil {
+				return err
+			}
 		}
 
-		// Write the file
-		f, err := os.Create(outputFile)
-		if err != nil {
-			return err
+		if r.config.GVK {
+			if err := r.generateGVK(pkgInfo, outputPath); err != nil {
+				return err
+			}
 		}
-		defer f.Close()
 
-		if _, err := f.WriteString(packageComment); err != nil {
-			return err
+		if r.config.Builders {
+			if err := r.generateBuilders(pkgInfo, outputPath); err != nil {
+				return err
+			}
 		}
 
-		if err := format.Node(f, r.fset, newFile); err != nil {
-			return err
+		if r.config.Equal {
+			if err := r.generateEqual(pkgInfo, outputPath, equalMethods[pkgPath]); err != nil {
+				return err
+			}
 		}
 
-		fmt.Printf("Generated: %s (%d types)\n", outputFile, len(pkgInfo.Decls))
+		r.releaseSyntax(pkgInfo)
 	}
 
+	if r.config.Bazel {
+		if err := r.generateBuildFiles(pkgPaths); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// releaseSyntax drops a generated package's syntax trees and type
+// information once its files are written, so the garbage collector can
+// reclaim them instead of a large batch holding every package's until the
+// run ends. Its declarations keep their names, and the package its name,
+// types, and imports, which is all that's consulted afterwards.
+func (r *RecursiveRewriter) releaseSyntax(pkgInfo *PackageInfo) {
+	pkgInfo.Pkg.Syntax = nil
+	pkgInfo.Pkg.TypesInfo = nil
+	pkgInfo.declIndex = nil
+	for _, declInfo := range pkgInfo.Decls {
+		declInfo.Decl = nil
+		declInfo.File = nil
+		declInfo.Comment = nil
+	}
+}
+
 func (r *RecursiveRewriter) generateModuleFiles() error {
 	// Sort module paths for deterministic output
 	var modulePaths []string
@@ -691,6 +1459,7 @@ func (r *RecursiveRewriter) generateModuleFiles() error {
 	}
 	sort.Strings(modulePaths)
 
+	dirs := make(map[string]string) // module directory to the module written there
 	for _, modulePath := range modulePaths {
 		moduleInfo := r.modules[modulePath]
 		// Skip stdlib modules
@@ -701,7 +1470,7 @@ func (r *RecursiveRewriter) generateModuleFiles() error {
 		// Check if any packages in this module have declarations
 		hasDecls := false
 		for _, pkgPath := range moduleInfo.Packages {
-			if pkgInfo, exists := r.packages[pkgPath]; exists && len(pkgInfo.Decls) > 0 {
+			if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.hasOutput() {
 				hasDecls = true
 				break
 			}
@@ -710,90 +1479,223 @@ func (r *RecursiveRewriter) generateModuleFiles() error {
 			continue
 		}
 
-		// Create module directory
-		moduleDir := filepath.Join(r.config.OutputDir, modulePath)
-		if err := os.MkdirAll(moduleDir, 0o755); err != nil {
+		// Create module directory. Without version suffixes, two major
+		// versions of a module would share one.
+		dir := r.moduleDir(modulePath)
+		if other, exists := dirs[dir]; exists {
+			return fmt.Errorf("modules %s and %s would both be written to %s; disable stripVersionSuffix to keep them apart", other, modulePath, dir)
+		}
+		dirs[dir] = modulePath
+		moduleDir := filepath.Join(r.config.OutputDir, dir)
+		if err := r.mkdirOutput(moduleDir); err != nil {
 			return err
 		}
 
-		// Generate go.mod file
+		// Generate go.mod file, requiring any modules kept as real dependencies
 		goModPath := filepath.Join(moduleDir, "go.mod")
-		goModContent := fmt.Sprintf("module %s\n\ngo 1.21\n", modulePath)
-
-		if err := os.WriteFile(goModPath, []byte(goModContent), 0o644); err != nil {
+		if err := r.writeOutputFile(goModPath, []byte(r.goModContent(moduleInfo))); err != nil {
 			return err
 		}
 
-		fmt.Printf("Generated: %s\n", goModPath)
+		slog.Info("Generated", "file", goModPath)
+	}
+
+	if r.config.Layout == LayoutThirdParty {
+		var generated []string
+		for _, modulePath := range dirs {
+			generated = append(generated, modulePath)
+		}
+		sort.Strings(generated)
+		return r.writeModuleMap(generated)
 	}
 	return nil
 }
 
+// updateGoModReplaces points the replace directives of go.mod at the
+// generated modules, and drops those of modules no longer generated.
+// Directives that are already right are left alone, so they keep their
+// place and comments, and go.mod is only written, and tidied, if it changed.
 func (r *RecursiveRewriter) updateGoModReplaces(goMod *GoModManager) error {
-	// Get list of modules with generated code
-	var modulePaths []string
-	for modulePath := range r.modules {
-		if r.isStdlib(modulePath) {
+	modulePaths := r.generatedModules()
+	generated := make(map[string]bool)
+	for _, modulePath := range modulePaths {
+		generated[modulePath] = true
+	}
+	for _, modulePath := range r.generatedReplaces(goMod) {
+		if generated[modulePath] {
 			continue
 		}
-		// Check if module has any declarations
-		hasDecls := false
-		for _, pkgPath := range r.modules[modulePath].Packages {
-			if pkgInfo, exists := r.packages[pkgPath]; exists && len(pkgInfo.Decls) > 0 {
-				hasDecls = true
-				break
-			}
-		}
-		if hasDecls {
-			modulePaths = append(modulePaths, modulePath)
+		if err := goMod.RemoveReplace(modulePath); err != nil {
+			return fmt.Errorf("failed to remove replace directive for %s: %w", modulePath, err)
 		}
+		slog.Info("Removed replace directive", "module", modulePath)
 	}
 
-	// Sort module paths for deterministic replace directive order
-	sort.Strings(modulePaths)
-
 	// Add replace directives
 	for _, modulePath := range modulePaths {
-		relPath := filepath.Join(r.config.OutputDir, modulePath)
+		if target, ok := r.replaceTarget(modulePath); ok {
+			if goMod.Replaces(modulePath, target.Path, target.Version) {
+				continue
+			}
+			if err := goMod.AddReplaceVersion(modulePath, target); err != nil {
+				return fmt.Errorf("failed to add replace directive for %s: %w", modulePath, err)
+			}
+			slog.Info("Added replace directive", "module", modulePath, "target", target.String())
+			continue
+		}
+		relPath := filepath.Join(r.config.OutputDir, r.moduleDir(modulePath))
+		// Replace paths are relative to go.mod, which may be above the
+		// current directory (e.g., when run by go generate in a package)
+		if !filepath.IsAbs(relPath) {
+			if abs, err := filepath.Abs(relPath); err == nil {
+				if rel, err := filepath.Rel(filepath.Dir(goMod.path), abs); err == nil {
+					relPath = rel
+				}
+			}
+		}
 		// Ensure path starts with ./ for go.mod replace directive
 		if !filepath.IsAbs(relPath) && !strings.HasPrefix(relPath, ".") {
 			relPath = "./" + relPath
 		}
+		if goMod.Replaces(modulePath, relPath, "") {
+			continue
+		}
 		if err := goMod.AddReplace(modulePath, relPath); err != nil {
 			return fmt.Errorf("failed to add replace directive for %s: %w", modulePath, err)
 		}
 		slog.Info("Added replace directive", "module", modulePath, "path", relPath)
 	}
 
-	// Save go.mod
-	if err := goMod.Save(); err != nil {
-		return fmt.Errorf("failed to save go.mod: %w", err)
+	if !goMod.Changed() {
+		slog.Info("go.mod is up to date", "replaces", len(modulePaths))
+	} else {
+		if err := goMod.Save(); err != nil {
+			return fmt.Errorf("failed to save go.mod: %w", err)
+		}
+		slog.Info("Updated go.mod", "replaces", len(modulePaths))
 	}
 
-	fmt.Printf("\nUpdated go.mod with %d replace directive(s)\n", len(modulePaths))
+	if r.config.Tidy {
+		return r.tidy(goMod)
+	}
+	return nil
+}
 
-	// Run go mod tidy to clean up dependencies
-	if err := goMod.Tidy(); err != nil {
-		slog.Warn("Failed to run go mod tidy", "error", err)
-	} else {
+// tidy runs go mod tidy on the consuming module, which fails unless every
+// generated module it requires resolves through its replace directive. The
+// error names the generated modules the output of go mod tidy mentions.
+func (r *RecursiveRewriter) tidy(goMod *GoModManager) error {
+	err := goMod.TidyContext(context.Background(), r.config.GoEnv, r.config.GoTimeout)
+	if err == nil {
 		slog.Info("Ran go mod tidy successfully")
+		return nil
+	}
+	var failed []string
+	for _, modulePath := range r.tidyFailures(err.Error()) {
+		target := filepath.Join(r.config.OutputDir, r.moduleDir(modulePath))
+		if replace, ok := r.replaceTarget(modulePath); ok {
+			target = replace.String()
+		}
+		failed = append(failed, modulePath+" (replaced by "+target+")")
+	}
+	if len(failed) == 0 {
+		return fmt.Errorf("failed to tidy %s after updating replace directives: %w", goMod.path, err)
 	}
+	return fmt.Errorf("failed to tidy %s: generated module %s doesn't resolve: %w", goMod.path, strings.Join(failed, ", "), err)
+}
 
-	return nil
+// tidyFailures returns the generated modules that packages or modules named
+// in the output of go mod tidy belong to, sorted
+func (r *RecursiveRewriter) tidyFailures(output string) []string {
+	modulePaths := r.generatedModules()
+	found := make(map[string]bool)
+	for _, field := range strings.Fields(output) {
+		path, _, _ := strings.Cut(strings.Trim(field, "\"':;,()"), "@")
+		// The longest module path owning the path is the one it's in
+		owner := ""
+		for _, modulePath := range modulePaths {
+			if (path == modulePath || strings.HasPrefix(path, modulePath+"/")) && len(modulePath) > len(owner) {
+				owner = modulePath
+			}
+		}
+		if owner != "" {
+			found[owner] = true
+		}
+	}
+	var failures []string
+	for modulePath := range found {
+		failures = append(failures, modulePath)
+	}
+	sort.Strings(failures)
+	return failures
 }
 
-func (r *RecursiveRewriter) isStdlib(pkgPath string) bool {
-	// Simple heuristic: stdlib packages don't have a domain in the path
-	return !strings.Contains(pkgPath, ".")
+// goModContent returns the go.mod of a generated module, requiring any
+// modules its packages keep as real dependencies
+func (r *RecursiveRewriter) goModContent(moduleInfo *ModuleInfo) string {
+	goVersion, toolchain := r.goDirectives(moduleInfo)
+	content := fmt.Sprintf("module %s\n\ngo %s\n", moduleInfo.Path, goVersion)
+	if toolchain != "" {
+		content += fmt.Sprintf("\ntoolchain %s\n", toolchain)
+	}
+	if requires := r.externalRequires(moduleInfo); len(requires) > 0 {
+		content += "\nrequire (\n"
+		for _, mod := range requires {
+			content += fmt.Sprintf("\t%s %s\n", mod.Path, mod.Version)
+		}
+		content += ")\n"
+	}
+	return content
 }
 
-// getModulePath extracts the module path from a package path
-// For example: "github.com/argoproj/argo-cd/v3/pkg/apis/application/v1alpha1" -> "github.com/argoproj/argo-cd/v3"
-func getModulePath(pkg *packages.Package) string {
+// moduleDir returns the directory, relative to the output directory, that a
+// generated module is written to: its module path, less any major version
+// suffix when StripVersionSuffix is set. gopkg.in's .vN suffixes are part of
+// the last path element and are kept.
+func (r *RecursiveRewriter) moduleDir(modulePath string) string {
+	if r.config.Layout == LayoutUmbrella && modulePath == r.config.UmbrellaModule {
+		return "."
+	}
+	dir := modulePath
+	if r.config.StripVersionSuffix {
+		if prefix, pathMajor, ok := module.SplitPathVersion(modulePath); ok && strings.HasPrefix(pathMajor, "/") {
+			dir = prefix
+		}
+	}
+	if r.config.Layout == LayoutThirdParty {
+		dir = thirdPartyDir + "/" + dir
+	}
+	return dir
+}
+
+// outputSubdir returns the directory, relative to the output directory, that
+// a generated package is written to, inside its module's directory
+func (r *RecursiveRewriter) outputSubdir(pkgPath, modulePath string) string {
+	if r.config.Publish != nil {
+		return r.publishSubdir(pkgPath, modulePath)
+	}
+	rest, ok := strings.CutPrefix(pkgPath, modulePath)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return pkgPath
+	}
+	return r.moduleDir(modulePath) + rest
+}
+
+// getModulePath returns the path of the module a package belongs to, as
+// reported by the go command. Module paths can't be inferred from package
+// paths (e.g., k8s.io/apimachinery is hosted at github.com/kubernetes/apimachinery,
+// and a module may sit anywhere above its packages), so there's no fallback
+// for packages outside a module. Stdlib packages use their own path.
+func (r *RecursiveRewriter) getModulePath(pkg *packages.Package) (string, error) {
 	if pkg.Module != nil {
-		return pkg.Module.Path
+		return pkg.Module.Path, nil
+	}
+	if r.isStdlib(pkg.PkgPath) {
+		return pkg.PkgPath, nil
+	}
+	msg := fmt.Sprintf("can't determine the module of package %s", pkg.PkgPath)
+	if len(pkg.Errors) > 0 {
+		msg += fmt.Sprintf(" (%v)", pkg.Errors[0])
 	}
-	// Fallback: try to infer from package path
-	// This is a heuristic and may not work for all cases
-	return pkg.PkgPath
+	return "", fmt.Errorf("%s: run package-rewriter from a module that requires it (go get %s)", msg, pkg.PkgPath)
 }
@@ -1,10 +1,29 @@
 package rewriter
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -188,7 +207,9 @@ type Foo struct {
 			r := &RecursiveRewriter{
 				fset:           fset,
 				pendingTypes:   []TypeRef{},
+				queued:         make(map[string]bool),
 				processedTypes: make(map[string]bool),
+				requiredTypes:  make(map[string]bool),
 			}
 
 			// Create a mock package
@@ -198,7 +219,7 @@ type Foo struct {
 					Imports: make(map[string]*packages.Package),
 					Types:   nil, // We won't check same-package types in this test
 				},
-				Imports:       make(map[string]string),
+				Imports:       make(map[string]map[string]bool),
 				SourceImports: make(map[string][]string),
 				NameToPath:    tt.nameToPath,
 			}
@@ -231,12 +252,3261 @@ type Foo struct {
 
 			// Check imports were recorded
 			for path, expectedName := range tt.expectedImports {
-				if gotName, ok := pkgInfo.Imports[path]; !ok {
+				if gotNames, ok := pkgInfo.Imports[path]; !ok {
 					t.Errorf("Expected import %s not recorded in Imports", path)
-				} else if gotName != expectedName {
-					t.Errorf("For import %s: expected name %s, got %s", path, expectedName, gotName)
+				} else if !gotNames[expectedName] {
+					t.Errorf("For import %s: expected name %s, got %v", path, expectedName, gotNames)
 				}
 			}
 		})
 	}
 }
+
+// newFixtureRewriter returns a rewriter that loads packages from testdata/fixture
+// and writes output to a temporary directory
+func newFixtureRewriter(t *testing.T) *RecursiveRewriter {
+	t.Helper()
+	dir, err := filepath.Abs(filepath.Join("testdata", "fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRecursiveRewriter(&Config{
+		OutputDir: t.TempDir(),
+		Dir:       dir,
+	})
+	// Type-check fixture dependencies and substitutes from source so the
+	// tests don't rely on export data being readable by this version of
+	// x/tools
+	r.loadMode |= packages.NeedDeps
+	r.typesMode = r.loadMode
+	return r
+}
+
+// extractFixture queues the given fixture types and processes them
+func extractFixture(t *testing.T, r *RecursiveRewriter, roots ...TypeRef) {
+	t.Helper()
+	for _, root := range roots {
+		r.queueType(root.PackagePath, root.TypeName)
+	}
+	if err := r.processQueue(); err != nil {
+		t.Fatalf("processQueue failed: %v", err)
+	}
+}
+
+// extractedTypes returns the sorted qualified names of all collected declarations
+func extractedTypes(r *RecursiveRewriter) []string {
+	var names []string
+	for pkgPath, pkgInfo := range r.packages {
+		for name := range pkgInfo.Decls {
+			names = append(names, pkgPath+"."+name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestExtractType_InterfaceClosure(t *testing.T) {
+	tests := []struct {
+		name     string
+		root     string
+		expected []string
+	}{
+		{
+			name: "interface method signatures and embedded interfaces",
+			root: "Holder",
+			expected: []string{
+				"example.com/fixture/ifaces.Handler",
+				"example.com/fixture/ifaces.Holder",
+				"example.com/fixture/ifaces.Item",
+				"example.com/fixture/ifaces.List",
+				"example.com/fixture/ifaces.Result",
+				"example.com/fixture/other.Closer",
+				"example.com/fixture/other.Request",
+				"example.com/fixture/other.Response",
+			},
+		},
+		{
+			name: "type parameter constraints with type-set unions",
+			root: "Sum",
+			expected: []string{
+				"example.com/fixture/ifaces.Number",
+				"example.com/fixture/ifaces.Sum",
+				"example.com/fixture/ifaces.Unit",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/ifaces", TypeName: tt.root})
+
+			if got := extractedTypes(r); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Extracted types:\n got: %v\nwant: %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExtractDecl_Functions(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/funcs", TypeName: "ParseName"})
+
+	expected := []string{
+		"example.com/fixture/funcs.Config",
+		"example.com/fixture/funcs.High",
+		"example.com/fixture/funcs.Level",
+		"example.com/fixture/funcs.Low",
+		"example.com/fixture/funcs.ParseName",
+		"example.com/fixture/funcs.Prefix",
+		"example.com/fixture/funcs.defaultName",
+		"example.com/fixture/funcs.normalize",
+		"example.com/fixture/other.Suffix",
+		"example.com/fixture/other.suffix",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/funcs", "types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(data)
+
+	for _, want := range []string{`"strings"`, `"example.com/fixture/other"`, "func normalize(s string) string", "High\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Generated output missing %q:\n%s", want, output)
+		}
+	}
+	// Unused shares a type group with Config but must not be emitted
+	if strings.Contains(output, "Unused") {
+		t.Errorf("Generated output contains unrequested grouped type:\n%s", output)
+	}
+}
+
+func TestStripDirectives(t *testing.T) {
+	t.Run("strip", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/directives", TypeName: "Now"})
+
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/directives", "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := string(data)
+
+		if strings.Contains(output, "go:linkname") {
+			t.Errorf("Generated output still contains linkname directive:\n%s", output)
+		}
+		for _, want := range []string{"// Now returns the current time.", "//go:nosplit"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("Generated output missing %q:\n%s", want, output)
+			}
+		}
+
+		// The run summary lists what was stripped
+		summary, err := r.summarize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []StrippedDirective{{Decl: "example.com/fixture/directives.Now", Directive: "//go:linkname Now"}}
+		if !reflect.DeepEqual(summary.StrippedDirectives, want) {
+			t.Errorf("Stripped directives = %v, want %v", summary.StrippedDirectives, want)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.Directives = DirectivesFail
+		r.queueType("example.com/fixture/directives", "Now")
+
+		err := r.processQueue()
+		if err == nil || !strings.Contains(err.Error(), "go:linkname") {
+			t.Errorf("Expected an error naming the linkname directive, got: %v", err)
+		}
+	})
+}
+
+func TestExpandWholePackages(t *testing.T) {
+	tests := []struct {
+		name       string
+		threshold  int
+		wantUnused bool
+	}{
+		{name: "disabled", threshold: 0, wantUnused: false},
+		{name: "below threshold", threshold: 80, wantUnused: false},
+		{name: "at threshold", threshold: 75, wantUnused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			r.config.WholePackage = tt.threshold
+			// Holder needs three of the four types in package other
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/ifaces", TypeName: "Holder"})
+
+			_, gotUnused := r.packages["example.com/fixture/other"].Decls["Unused"]
+			if gotUnused != tt.wantUnused {
+				t.Errorf("Expected other.Unused extracted=%v, got %v", tt.wantUnused, gotUnused)
+			}
+			// The root package is below any threshold and stays cherry-picked
+			if r.packages["example.com/fixture/ifaces"].WholePackage {
+				t.Error("Expected package ifaces not to be copied whole")
+			}
+		})
+	}
+}
+
+func TestQueuePackageCopy(t *testing.T) {
+	r := newFixtureRewriter(t)
+	if err := r.queuePackageCopy("example.com/fixture/leaf", []string{"zz_*.go"}); err != nil {
+		t.Fatalf("queuePackageCopy failed: %v", err)
+	}
+	extractFixture(t, r)
+
+	// Dependencies of the copied files are extracted as usual, including
+	// those of files for other platforms
+	expected := []string{"example.com/fixture/other.Request", "example.com/fixture/other.Response"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	outputDir := filepath.Join(r.config.OutputDir, "example.com/fixture/leaf")
+	data, err := os.ReadFile(filepath.Join(outputDir, "leaf.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.ReadFile(filepath.Join("testdata", "fixture", "leaf", "leaf.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), string(source)) {
+		t.Errorf("Expected leaf.go to be copied verbatim, got:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "zz_generated.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected zz_generated.go to be excluded, got err=%v", err)
+	}
+	for _, name := range []string{"leaf_linux.go", "leaf_windows.go"} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Errorf("Expected %s to be copied: %v", name, err)
+		}
+	}
+}
+
+func TestKeepExternal(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.KeepExternal = []string{"example.com/cgomod"}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/cgouser", TypeName: "Wrapper"})
+
+	if _, ok := r.external["example.com/cgomod"]; !ok {
+		t.Fatal("Expected example.com/cgomod to be kept external")
+	}
+	// Packages kept external are never parsed or type-checked
+	if pkgInfo := r.packages["example.com/cgomod"]; !pkgInfo.Consulted || pkgInfo.Pkg.Syntax != nil || pkgInfo.Pkg.Types != nil {
+		t.Errorf("Expected example.com/cgomod to be loaded without syntax or types")
+	}
+	expected := []string{"example.com/fixture/cgouser.Wrapper"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+func TestShims(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Shims = []Shim{{Module: "example.com/shimmed", Path: "example.com/platform/shimmed-types", Version: "v0.3.0"}}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/shimuser", TypeName: "Deployment"})
+	if pkgInfo := r.packages["example.com/shimmed/api"]; !pkgInfo.Consulted || pkgInfo.Pkg.Syntax != nil {
+		t.Errorf("Expected the shimmed package to be loaded without syntax")
+	}
+
+	expected := []string{"example.com/fixture/shimuser.Deployment"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	types, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/shimuser", "types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(types), `"example.com/platform/shimmed-types/api"`) {
+		t.Errorf("Expected the shim's package to be imported:\n%s", types)
+	}
+	goMod, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(goMod), "example.com/platform/shimmed-types v0.3.0") {
+		t.Errorf("Expected the shim module to be required:\n%s", goMod)
+	}
+}
+
+func TestTypeOptions(t *testing.T) {
+	r := newFixtureRewriter(t)
+	copyMethods := true
+	options := map[string]TypeOptions{
+		"Stamp": {Substitute: "time.Time"},
+		"Event": {Prune: []string{"Response", "Trace"}, Rename: "Record", CopyMethods: &copyMethods},
+	}
+	for name, opts := range options {
+		if err := r.setTypeOptions(TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: name}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"})
+
+	expected := []string{
+		"example.com/fixture/other.Request",
+		"example.com/fixture/typeopts.Event",
+		"example.com/fixture/typeopts.Event.Label",
+		"example.com/fixture/typeopts.Sink",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/typeopts/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compare without alignment
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{
+		`"time"`,
+		"type Record struct",
+		"At time.Time",
+		"Debug bool",
+		"func (e Record) Label() string",
+		"Events []Record",
+		"Last *time.Time",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{"Response", "Trace", "Stamp"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("Expected generated code not to contain %q:\n%s", unwanted, data)
+		}
+	}
+}
+
+func TestSourceAnnotations(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/annotated", TypeName: "Job"})
+
+	expected := []string{"example.com/fixture/annotated.Job"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/annotated/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{`"time"`, "Started time.Time", "Limit int"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{"Internal", "Owner", "Token", "vault", "Request", "Response", "State", "+rewriter"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("Expected generated code not to contain %q:\n%s", unwanted, data)
+		}
+	}
+
+	var changes []string
+	for _, change := range r.extractedFieldChanges() {
+		changes = append(changes, change.Field+": "+change.Reason)
+	}
+	expectedChanges := []string{
+		"Owner: Internal is marked +rewriter:skip",
+		"Request: +rewriter:skip",
+		"Response: +rewriter:skip",
+		"Retry.State: Internal is marked +rewriter:skip",
+		"Started: substituted",
+		"Token: Token is marked +rewriter:skip",
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("Field changes:\n got: %v\nwant: %v", changes, expectedChanges)
+	}
+
+	// A package only read for its annotations is parsed, not type-checked,
+	// and not generated
+	vault := r.packages["example.com/fixture/annotated/vault"]
+	if vault == nil || !vault.Unchecked || vault.Pkg.TypesInfo != nil {
+		t.Errorf("Expected the vault package to be parsed without type checking it, got %+v", vault)
+	}
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/fixture/annotated/vault")); !os.IsNotExist(err) {
+		t.Errorf("Expected the vault package not to be generated, got: %v", err)
+	}
+
+	// A skipped type can't be extracted as a root
+	r = newFixtureRewriter(t)
+	r.queueType("example.com/fixture/annotated", "Internal")
+	if err := r.processQueue(); err == nil || !strings.Contains(err.Error(), "is marked +rewriter:skip") {
+		t.Errorf("Expected extracting a skipped type to fail, got: %v", err)
+	}
+}
+
+func TestStdlib(t *testing.T) {
+	r := newFixtureRewriter(t)
+	for pkgPath, want := range map[string]bool{
+		"fmt":                          true,
+		"net/http":                     true,
+		"C":                            true,
+		"example.com/fixture/other":    false,
+		"corp/internal/api":            false, // module paths need no dot
+		"golang.org/x/exp/constraints": false,
+	} {
+		if got := r.isStdlib(pkgPath); got != want {
+			t.Errorf("isStdlib(%q) = %v, want %v", pkgPath, got, want)
+		}
+	}
+
+	// Configured packages are never extracted
+	r.config.Stdlib = []string{"example.com/fixture/other", "golang.org/x/exp"}
+	if !r.isStdlib("golang.org/x/exp/constraints") || r.isStdlib("golang.org/x/expression") {
+		t.Error("Expected Stdlib entries to match their packages and those beneath them")
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Event"})
+	expected := []string{"example.com/fixture/typeopts.Event", "example.com/fixture/typeopts.Stamp"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+func TestSubstitutePackages(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.SubstitutePackages = map[string]string{"example.com/fixture/slimtime": "time"}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/pkgsubst", TypeName: "Schedule"})
+
+	expected := []string{"example.com/fixture/pkgsubst.Schedule"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/pkgsubst/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{`import slimtime "time"`, "Every slimtime.Duration", "In []slimtime.Month"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+
+	// The replacement must declare everything used from the package
+	r = newFixtureRewriter(t)
+	r.config.SubstitutePackages = map[string]string{"example.com/fixture/slimtime": "time"}
+	r.queueType("example.com/fixture/pkgsubst", "Zoned")
+	if err := r.processQueue(); err == nil || !strings.Contains(err.Error(), "substitute package time doesn't declare Zone") {
+		t.Errorf("Expected a missing declaration in the substitute package to fail, got: %v", err)
+	}
+}
+
+func TestInline(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Inline = []string{"example.com/fixture/helpers.Pair", "example.com/fixture/helpers.Wide"}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/inliner", TypeName: "Config"})
+
+	// The helpers package isn't extracted
+	expected := []string{"example.com/fixture/inliner.Config", "example.com/fixture/inliner.Pair", "example.com/fixture/inliner.PairHelpers"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/inliner/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{
+		`import "time"`,
+		"type PairHelpers struct { Key string `json:\"key\"` Value time.Duration `json:\"value\"` }",
+		"Limit PairHelpers",
+		"Extra []*PairHelpers",
+		"Tagged Pair",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/fixture/helpers")); !os.IsNotExist(err) {
+		t.Errorf("Expected the helpers package not to be generated, got: %v", err)
+	}
+
+	// Types referring to others of their package stay where they are
+	r = newFixtureRewriter(t)
+	r.config.Inline = []string{"example.com/fixture/helpers.Wide"}
+	r.queueType("example.com/fixture/inliner", "Broad")
+	if err := r.processQueue(); err == nil || !strings.Contains(err.Error(), "can't inline example.com/fixture/helpers.Wide: it refers to Pair") {
+		t.Errorf("Expected inlining a type with dependencies to fail, got: %v", err)
+	}
+}
+
+func TestCollapseModules(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.CollapseModules = 3
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/collapser/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{
+		"type Label string",
+		"type Pair string",
+		"type PairTiny struct { Key Label Value string }",
+		"Tag Label",
+		"Entry PairTiny",
+		"Own Pair",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(content, "example.com/tiny") {
+		t.Errorf("Expected the collapsed module not to be imported:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/tiny")); !os.IsNotExist(err) {
+		t.Errorf("Expected the collapsed module not to be generated, got: %v", err)
+	}
+
+	// Modules with as many types as the limit stay
+	r = newFixtureRewriter(t)
+	r.config.CollapseModules = 2
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/tiny/go.mod")); err != nil {
+		t.Errorf("Expected the module to be generated: %v", err)
+	}
+}
+
+func TestModuleSuggestions(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	expected := []ModuleSuggestion{{
+		Module: "example.com/tiny",
+		Types:  2,
+		Change: "collapseModules: 3",
+		Reason: "only example.com/fixture/collapser imports it",
+	}}
+	if !reflect.DeepEqual(r.suggestions, expected) {
+		t.Errorf("Suggestions:\n got: %+v\nwant: %+v", r.suggestions, expected)
+	}
+
+	// Minimizing applies them
+	r = newFixtureRewriter(t)
+	r.config.MinimizeModules = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	if len(r.suggestions) != 0 {
+		t.Errorf("Expected no suggestions once modules are minimized, got: %+v", r.suggestions)
+	}
+	if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com/tiny")); !os.IsNotExist(err) {
+		t.Errorf("Expected the module to be collapsed, got: %v", err)
+	}
+}
+
+func TestDependencyTree(t *testing.T) {
+	expected := []string{
+		"example.com/fixture/typeopts.Sink 5",
+		"  example.com/fixture/typeopts.Event 3",
+		"    example.com/fixture/other.Request 1",
+		"    example.com/fixture/other.Response 1",
+		"  example.com/fixture/typeopts.Stamp 1",
+	}
+	for _, exploring := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exploring=%v", exploring), func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			if exploring {
+				r.exploreRoots = map[string]bool{"example.com/fixture/typeopts": true}
+			}
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"})
+
+			var lines []string
+			var walk func(nodes []*DependencyNode, indent string)
+			walk = func(nodes []*DependencyNode, indent string) {
+				for _, node := range nodes {
+					lines = append(lines, fmt.Sprintf("%s%s %d", indent, node.Ref, node.Weight))
+					walk(node.Children, indent+"  ")
+				}
+			}
+			walk(r.dependencyTree(), "")
+			if !reflect.DeepEqual(lines, expected) {
+				t.Errorf("Dependency tree:\n got: %v\nwant: %v", lines, expected)
+			}
+
+			// Only the root's package is type-checked while exploring
+			other := r.packages["example.com/fixture/other"]
+			if other.Unchecked != exploring || (other.Pkg.TypesInfo == nil) != exploring {
+				t.Errorf("Expected other to be explored: %v, got Unchecked %v with types %v",
+					exploring, other.Unchecked, other.Pkg.TypesInfo != nil)
+			}
+			if root := r.packages["example.com/fixture/typeopts"]; root.Unchecked || root.Pkg.TypesInfo == nil {
+				t.Errorf("Expected the root's package to be type-checked")
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.KeepExternal = []string{"example.com/cgomod"}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Event"},
+		TypeRef{PackagePath: "example.com/fixture/cgouser", TypeName: "Wrapper"},
+	)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	summary, err := r.summarize()
+	if err != nil {
+		t.Fatalf("summarize failed: %v", err)
+	}
+	expected := Summary{
+		Decls:    5, // Event, Stamp, Request, Response, Wrapper
+		Packages: 3,
+		Modules:  1,
+		Lines:    r.generatedLines,
+		Requires: 1,
+		// typeopts, other, cgouser, and cgomod, in two modules
+		UpstreamPackages: 4,
+		UpstreamModules:  2,
+		UpstreamLines:    summary.UpstreamLines,
+	}
+	if !reflect.DeepEqual(*summary, expected) {
+		t.Errorf("Summary:\n got: %+v\nwant: %+v", *summary, expected)
+	}
+	if summary.Lines == 0 || summary.UpstreamLines == 0 {
+		t.Errorf("Expected lines to be counted, got %+v", *summary)
+	}
+}
+
+func TestStripVersionSuffix(t *testing.T) {
+	tests := []struct {
+		pkgPath, modulePath string
+		strip               bool
+		want                string
+	}{
+		{"github.com/argoproj/argo-cd/v3/pkg/apis", "github.com/argoproj/argo-cd/v3", false, "github.com/argoproj/argo-cd/v3/pkg/apis"},
+		{"github.com/argoproj/argo-cd/v3/pkg/apis", "github.com/argoproj/argo-cd/v3", true, "github.com/argoproj/argo-cd/pkg/apis"},
+		{"github.com/argoproj/argo-cd/v3", "github.com/argoproj/argo-cd/v3", true, "github.com/argoproj/argo-cd"},
+		{"gopkg.in/yaml.v3", "gopkg.in/yaml.v3", true, "gopkg.in/yaml.v3"},
+		{"k8s.io/api/core/v1", "k8s.io/api", true, "k8s.io/api/core/v1"},
+	}
+
+	for _, tt := range tests {
+		r := newRecursiveRewriter(&Config{StripVersionSuffix: tt.strip})
+		if got := r.outputSubdir(tt.pkgPath, tt.modulePath); got != tt.want {
+			t.Errorf("outputSubdir(%s, %s) with strip=%v: expected %s, got %s", tt.pkgPath, tt.modulePath, tt.strip, tt.want, got)
+		}
+	}
+
+	// Two major versions of a module can't share a directory
+	r := newRecursiveRewriter(&Config{OutputDir: t.TempDir(), StripVersionSuffix: true})
+	for _, modulePath := range []string{"example.com/lib/v2", "example.com/lib/v3"} {
+		pkgPath := modulePath + "/api"
+		r.modules[modulePath] = &ModuleInfo{Path: modulePath, Packages: []string{pkgPath}}
+		r.packages[pkgPath] = &PackageInfo{Decls: map[string]*DeclInfo{"T": {Name: "T"}}}
+	}
+	if err := r.generateModuleFiles(); err == nil || !strings.Contains(err.Error(), "would both be written to example.com/lib") {
+		t.Errorf("Expected a directory collision error, got: %v", err)
+	}
+}
+
+func TestGetModulePath(t *testing.T) {
+	r := newRecursiveRewriter(&Config{})
+	tests := []struct {
+		pkg     *packages.Package
+		want    string
+		wantErr string
+	}{
+		{
+			pkg:  &packages.Package{PkgPath: "k8s.io/apimachinery/pkg/apis/meta/v1", Module: &packages.Module{Path: "k8s.io/apimachinery"}},
+			want: "k8s.io/apimachinery",
+		},
+		{
+			pkg:  &packages.Package{PkgPath: "time"},
+			want: "time",
+		},
+		{
+			pkg:     &packages.Package{PkgPath: "example.com/vanity/pkg/api"},
+			wantErr: "can't determine the module of package example.com/vanity/pkg/api",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := r.getModulePath(tt.pkg)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: expected error containing %q, got: %v", tt.pkg.PkgPath, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %s, got %q (error: %v)", tt.pkg.PkgPath, tt.want, got, err)
+		}
+	}
+}
+
+func TestMissingPackages(t *testing.T) {
+	r := newFixtureRewriter(t)
+	missing, err := r.missingPackages(map[string]string{
+		"example.com/fixture/leaf":   "",
+		"example.com/unrequired/api": "v1.2.0",
+		"time":                       "",
+	})
+	if err != nil {
+		t.Fatalf("missingPackages failed: %v", err)
+	}
+	if want := []string{"example.com/unrequired/api"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("Expected %v, got %v", want, missing)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Publish = &Publish{Module: "example.com/platform/fixture-types", Source: "example.com/fixture", Version: "v0.3.0"}
+	r.config.ImportPrefix = r.config.Publish.Module
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/shimuser", TypeName: "Deployment"})
+
+	// A stale file from an earlier run is cleaned up
+	stale := filepath.Join(r.config.OutputDir, "removed", "types.go")
+	for name, content := range map[string]string{
+		"go.mod":    "module example.com/platform/fixture-types\n",
+		versionFile: "v0.2.0\n",
+		stale:       "package removed\n",
+	} {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(r.config.OutputDir, name)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	read := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(r.config.OutputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if got := read("shimuser/types.go"); !strings.Contains(got, `"example.com/platform/fixture-types/example.com/shimmed/api"`) {
+		t.Errorf("Expected imports of other modules' packages under the published module:\n%s", got)
+	}
+	if got, want := read("go.mod"), "module example.com/platform/fixture-types\n\ngo 1.22\n\ntoolchain go1.22.5\n"; got != want {
+		t.Errorf("go.mod: expected:\n%s\ngot:\n%s", want, got)
+	}
+	if got := read(versionFile); got != "v0.3.0\n" {
+		t.Errorf("VERSION: expected v0.3.0, got %q", got)
+	}
+	if got := read("LICENSE"); got != "Fixture license text.\n" {
+		t.Errorf("LICENSE: expected the source module's license, got %q", got)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be cleaned up, got: %v", stale, err)
+	}
+
+	// Anything else in the output directory is left alone
+	if err := cleanPublishDir(filepath.Join("testdata", "fixture"), r.config.Publish.Module); err == nil || !strings.Contains(err.Error(), "refusing to clean") {
+		t.Errorf("Expected a foreign directory not to be cleaned, got: %v", err)
+	}
+}
+
+func TestBazelBuildFiles(t *testing.T) {
+	r := newFixtureRewriter(t)
+	workspace := r.config.OutputDir
+	if err := os.WriteFile(filepath.Join(workspace, "MODULE.bazel"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r.config.OutputDir = filepath.Join(workspace, "generated")
+	r.config.Bazel = true
+	r.config.Shims = []Shim{{Module: "example.com/shimmed", Path: "github.com/Platform/shimmed-types", Version: "v0.3.0"}}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/shimuser", TypeName: "Deployment"},
+		TypeRef{PackagePath: "example.com/fixture/ifaces", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	build, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/shimuser", "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "shimuser",
+    srcs = ["types.go"],
+    importpath = "example.com/fixture/shimuser",
+    visibility = ["//visibility:public"],
+    deps = ["@com_github_platform_shimmed_types//api"],
+)
+`
+	if !strings.HasSuffix(string(build), want) {
+		t.Errorf("Expected BUILD.bazel to end with:\n%s\ngot:\n%s", want, build)
+	}
+
+	build, err = os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/ifaces", "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `deps = ["//generated/example.com/fixture/other"]`; !strings.Contains(string(build), want) {
+		t.Errorf("Expected generated dependencies to be referenced in the workspace (%s):\n%s", want, build)
+	}
+}
+
+func TestGitMetadata(t *testing.T) {
+	repo := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+		t.Skipf("git init failed: %v\n%s", err, output)
+	}
+	outputDir := filepath.Join(repo, "internal", "generated")
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, ".gitattributes"), []byte("*.pb.go binary"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "CODEOWNERS"), []byte("* @org/everyone\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &RecursiveRewriter{config: &Config{
+		OutputDir:     outputDir,
+		GitAttributes: true,
+		CodeOwners:    []string{"@org/platform", "ops@example.com"},
+	}}
+	// Running twice must leave a single block behind
+	for range 2 {
+		if err := r.writeGitMetadata(); err != nil {
+			t.Fatalf("writeGitMetadata failed: %v", err)
+		}
+	}
+
+	attributes, err := os.ReadFile(filepath.Join(outputDir, ".gitattributes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*.pb.go binary\n# BEGIN package-rewriter\n* linguist-generated=true\n# END package-rewriter\n"
+	if string(attributes) != want {
+		t.Errorf("Expected .gitattributes:\n%s\ngot:\n%s", want, attributes)
+	}
+
+	if _, err := os.Stat(filepath.Join(repo, ".github", "CODEOWNERS")); err == nil {
+		t.Error("Expected the existing CODEOWNERS to be used instead of creating .github/CODEOWNERS")
+	}
+	owners, err := os.ReadFile(filepath.Join(repo, "CODEOWNERS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "* @org/everyone\n" +
+		"# BEGIN package-rewriter /internal/generated/\n" +
+		"/internal/generated/ @org/platform ops@example.com\n" +
+		"# END package-rewriter /internal/generated/\n"
+	if string(owners) != want {
+		t.Errorf("Expected CODEOWNERS:\n%s\ngot:\n%s", want, owners)
+	}
+}
+
+func TestIotaGroups(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/consts", TypeName: "Describe"},
+		TypeRef{PackagePath: "example.com/fixture/consts", TypeName: "Size"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// Every constant must keep the value it has in the source package, which
+	// only holds if the groups were copied with all of their specs
+	filename := filepath.Join(r.config.OutputDir, "example.com/fixture/consts", "types.go")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := (&types.Config{}).Check("consts", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatalf("Generated package doesn't type-check: %v", err)
+	}
+
+	source := r.packages["example.com/fixture/consts"].Pkg.Types.Scope()
+	for _, name := range []string{"Debug", "Info", "Warn", "MaxLevel", "Limit", "KB", "MB", "GB", "ModeA", "ModeB", "ModeCount"} {
+		want, ok := source.Lookup(name).(*types.Const)
+		if !ok {
+			t.Fatalf("%s isn't a constant in the source package", name)
+		}
+		got, ok := generated.Scope().Lookup(name).(*types.Const)
+		if !ok {
+			t.Errorf("%s missing from the generated package", name)
+			continue
+		}
+		if got.Val().ExactString() != want.Val().ExactString() {
+			t.Errorf("%s = %s, want %s", name, got.Val().ExactString(), want.Val().ExactString())
+		}
+		if got.Type().String() != strings.ReplaceAll(want.Type().String(), "example.com/fixture/", "") {
+			t.Errorf("%s has type %s, want %s", name, got.Type(), want.Type())
+		}
+	}
+}
+
+func TestIotaGroups_DroppedWhole(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.CopyMethods = true
+	r.config.OnUnextractable = UnextractableDrop
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/consts", TypeName: "Buffer"})
+
+	// Dropping MB alone would turn GB into 1 << 20
+	pkgInfo := r.packages["example.com/fixture/consts"]
+	bad := TypeRef{PackagePath: "example.com/fixture/consts", TypeName: "missing"}
+	r.unextractable[bad.String()] = "test"
+	pkgInfo.Decls["MB"].Deps = append(pkgInfo.Decls["MB"].Deps, bad)
+	if err := r.dropUnextractable(); err != nil {
+		t.Fatalf("dropUnextractable failed: %v", err)
+	}
+
+	for _, name := range []string{"KB", "MB", "GB", "Buffer.Cap"} {
+		if pkgInfo.Decls[name] != nil {
+			t.Errorf("Expected %s to be dropped with its constant group", name)
+		}
+	}
+	if pkgInfo.Decls["Buffer"] == nil {
+		t.Error("Expected Buffer to be kept")
+	}
+}
+
+func TestVarPolicy(t *testing.T) {
+	t.Run("copy", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.CopyMethods = true
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/funcs", TypeName: "Config"})
+
+		pkgInfo := r.packages["example.com/fixture/funcs"]
+		if pkgInfo.Decls["ErrNoName"] == nil {
+			t.Fatalf("Expected ErrNoName to be copied, got %v", extractedTypes(r))
+		}
+		if _, ok := pkgInfo.Imports["errors"]; !ok {
+			t.Errorf("Expected the initializer's errors import to be recorded, got %v", pkgInfo.Imports)
+		}
+	})
+
+	t.Run("skip and drop", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.CopyMethods = true
+		r.config.Vars = VarsSkip
+		r.config.OnUnextractable = UnextractableDrop
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/funcs", TypeName: "Config"})
+
+		pkgInfo := r.packages["example.com/fixture/funcs"]
+		for _, name := range []string{"ErrNoName", "Config.Validate"} {
+			if pkgInfo.Decls[name] != nil {
+				t.Errorf("Expected %s to be left out", name)
+			}
+		}
+	})
+
+	t.Run("skip and fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.CopyMethods = true
+		r.config.Vars = VarsSkip
+		r.queueType("example.com/fixture/funcs", "Config")
+
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the skipped variable, got nil")
+		}
+		if want := "example.com/fixture/funcs.ErrNoName: package-level variable ErrNoName isn't copied"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestErrorTypes(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/errs", TypeName: "Result"})
+
+	expected := []string{
+		"example.com/fixture/errs.ErrNotFound",
+		"example.com/fixture/errs.LookupError",
+		"example.com/fixture/errs.LookupError.Error",
+		"example.com/fixture/errs.LookupError.Is",
+		"example.com/fixture/errs.LookupError.Unwrap",
+		"example.com/fixture/errs.Result",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+	}
+
+	// An explicit copyMethods: false leaves the error methods out too
+	r = newFixtureRewriter(t)
+	noMethods := false
+	r.typeOptions["example.com/fixture/errs.LookupError"] = TypeOptions{CopyMethods: &noMethods}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/errs", TypeName: "Result"})
+	if got := extractedTypes(r); len(got) != 2 {
+		t.Errorf("Expected only Result and LookupError, got %v", got)
+	}
+}
+
+func TestRecursiveTypes(t *testing.T) {
+	// Go forbids import cycles, so types can only refer to each other within
+	// a package; whichever side is reached first, the output is the same
+	var outputs []string
+	for _, root := range []string{"Node", "Edge"} {
+		r := newFixtureRewriter(t)
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/cycle", TypeName: root})
+
+		expected := []string{
+			"example.com/fixture/cycle.Edge",
+			"example.com/fixture/cycle.Node",
+			"example.com/fixture/other.Request",
+		}
+		if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Extracted declarations from %s:\n got: %v\nwant: %v", root, got, expected)
+		}
+
+		// The root must stay the root of the tree, not a child of what it reaches
+		tree := r.dependencyTree()
+		if len(tree) != 1 || tree[0].Ref.TypeName != root || tree[0].Weight != 3 {
+			t.Errorf("Expected a single tree rooted at %s, got %+v", root, tree)
+		}
+
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/cycle", "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(data))
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("Output depends on the root:\n%s\nvs\n%s", outputs[0], outputs[1])
+	}
+}
+
+func TestForeignUnderlyingType(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/phases", TypeName: "Status"})
+
+	// Phase's values are kinds.Kind's constants, but not untyped ones
+	expected := []string{
+		"example.com/fixture/kinds.Kind",
+		"example.com/fixture/kinds.KindDone",
+		"example.com/fixture/kinds.KindPending",
+		"example.com/fixture/phases.Phase",
+		"example.com/fixture/phases.Status",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+	}
+}
+
+func TestAliasChains(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.typeOptions["example.com/fixture/chain/c.C"] = TypeOptions{Rename: "Record"}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/chain/a", TypeName: "Pair"})
+
+	// a.A = b.B = c.C is reached three ways but resolved to one definition,
+	// and Severity's constants are found behind b.Level
+	expected := []string{
+		"example.com/fixture/chain/a.A",
+		"example.com/fixture/chain/a.Pair",
+		"example.com/fixture/chain/a.Severity",
+		"example.com/fixture/chain/b.B",
+		"example.com/fixture/chain/b.Level",
+		"example.com/fixture/chain/c.C",
+		"example.com/fixture/chain/c.Level",
+		"example.com/fixture/chain/c.LevelHigh",
+		"example.com/fixture/chain/c.LevelLow",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted declarations:\n got: %v\nwant: %v", got, expected)
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	for pkg, want := range map[string][]string{
+		"a": {"type A = b.B\n", "Third  []c.Record\n"},
+		"b": {"type B = c.Record\n", "type Level = c.Level\n"},
+		"c": {"type Record struct", "type Level int\n"},
+	} {
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/chain", pkg, "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range want {
+			if n := strings.Count(string(data), w); n != 1 {
+				t.Errorf("Expected %q once in package %s, found it %d times:\n%s", w, pkg, n, data)
+			}
+		}
+	}
+}
+
+func TestSuspectFields(t *testing.T) {
+	cache := TypeRef{PackagePath: "example.com/fixture/suspect", TypeName: "Cache"}
+	generate := func(t *testing.T, r *RecursiveRewriter) string {
+		t.Helper()
+		extractFixture(t, r, cache)
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/suspect", "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		output := generate(t, newFixtureRewriter(t))
+		for _, want := range []string{"\tsync.Mutex\n", "ptr unsafe.Pointer", "map[string]*reflect.Value"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("Expected %q in output:\n%s", want, output)
+			}
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.SuspectFields = SuspectFieldsReplace
+		output := generate(t, r)
+		for _, want := range []string{"\t_ struct{}\n", "ptr struct{}", "map[string]*struct{}"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("Expected %q in output:\n%s", want, output)
+			}
+		}
+		for _, unwanted := range []string{`"sync"`, `"unsafe"`, `"reflect"`} {
+			if strings.Contains(output, unwanted) {
+				t.Errorf("Expected %s not to be imported:\n%s", unwanted, output)
+			}
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.SuspectFields = SuspectFieldsFail
+		r.queueType(cache.PackagePath, cache.TypeName)
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the suspect fields, got nil")
+		}
+		if want := "field example.com/fixture/suspect.Cache.Mutex has type sync.Mutex"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestNonSerializableFields(t *testing.T) {
+	job := TypeRef{PackagePath: "example.com/fixture/wire", TypeName: "Job"}
+
+	t.Run("strip", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.NonSerializableFields = NonSerializableStrip
+		extractFixture(t, r, job)
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/wire", "types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := string(data)
+
+		for _, want := range []string{"Name ", "Key ", "Runner interface{ Run() error }"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("Expected %q to be kept:\n%s", want, output)
+			}
+		}
+		for _, unwanted := range []string{"Done", "ctx", "Hooks", "Cancel", `"context"`} {
+			if strings.Contains(output, unwanted) {
+				t.Errorf("Expected %q to be stripped:\n%s", unwanted, output)
+			}
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.NonSerializableFields = NonSerializableFail
+		r.queueType(job.PackagePath, job.TypeName)
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the channel field, got nil")
+		}
+		if want := "field example.com/fixture/wire.Job.Done holds a channel"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestGenerateGVK(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.GVK = true
+	copyMethods := true
+	r.typeOptions["example.com/fixture/k8s/apps/v1.Deployment"] = TypeOptions{CopyMethods: &copyMethods}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/k8s/apps/v1", TypeName: "DeploymentList"},
+		TypeRef{PackagePath: "example.com/fixture/k8s/batch/v2", TypeName: "Job"},
+	)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	read := func(pkgPath string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, pkgPath, gvkFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	apps := read("example.com/fixture/k8s/apps/v1")
+	for _, want := range []string{
+		`Group = "apps.example.com"`,
+		`Version = "v1"`,
+		`DeploymentListKind = "DeploymentList"`,
+		"func (*Deployment) GroupVersionKind() (group, version, kind string)",
+		"func (*DeploymentList) GroupVersionKind() (group, version, kind string)",
+	} {
+		if !strings.Contains(apps, want) {
+			t.Errorf("Expected %q in apps/v1:\n%s", want, apps)
+		}
+	}
+	// DeploymentKind was copied along with Describe, so it isn't redeclared
+	if strings.Contains(apps, "DeploymentKind =") {
+		t.Errorf("Expected the copied DeploymentKind to be reused:\n%s", apps)
+	}
+	if strings.Contains(apps, "DeploymentSpec) GroupVersionKind") {
+		t.Errorf("Expected no GroupVersionKind for DeploymentSpec, which isn't a kind:\n%s", apps)
+	}
+
+	// The group comes from the +groupName marker and the version from the path
+	batch := read("example.com/fixture/k8s/batch/v2")
+	for _, want := range []string{`Group = "batch.example.com"`, `Version = "v2"`, `JobKind = "Job"`} {
+		if !strings.Contains(batch, want) {
+			t.Errorf("Expected %q in batch/v2:\n%s", want, batch)
+		}
+	}
+
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated code failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	r := newFixtureRewriter(t)
+	widget := TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"}
+	if err := r.setTypeOptions(widget, TypeOptions{Fields: []string{"spec.replicas", "Spec.Ports.number"}}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r, widget)
+
+	// Only the selected fields are left, and the types only the others used
+	// aren't extracted
+	expected := []string{
+		"example.com/fixture/crd.Port",
+		"example.com/fixture/crd.Spec",
+		"example.com/fixture/crd.Widget",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted:\n got: %v\nwant: %v", got, expected)
+	}
+	fields := map[string][]string{"Widget": {"Spec"}, "Spec": {"Replicas", "Ports"}, "Port": {"Number"}}
+	for name, want := range fields {
+		spec := r.packages["example.com/fixture/crd"].Decls[name].Decl.(*ast.GenDecl).Specs[0].(*ast.TypeSpec)
+		var got []string
+		for _, field := range spec.Type.(*ast.StructType).Fields.List {
+			got = append(got, field.Names[0].Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Fields of %s: got %v, want %v", name, got, want)
+		}
+	}
+
+	r = newFixtureRewriter(t)
+	if err := r.setTypeOptions(widget, TypeOptions{Fields: []string{"spec", "metadata"}}); err != nil {
+		t.Fatal(err)
+	}
+	r.queueType(widget.PackagePath, widget.TypeName)
+	if err := r.processQueue(); err == nil || !strings.Contains(err.Error(), "can't select field metadata of example.com/fixture/crd.Widget: no such field") {
+		t.Errorf("Expected an error for an unknown field, got: %v", err)
+	}
+}
+
+func TestDropStatus(t *testing.T) {
+	r := newFixtureRewriter(t)
+	widget := TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"}
+	if err := r.setTypeOptions(widget, TypeOptions{DropStatus: true}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r, widget)
+	if got := extractedTypes(r); slices.Contains(got, "example.com/fixture/crd.Status") || !slices.Contains(got, "example.com/fixture/crd.Spec") {
+		t.Errorf("Expected Spec but not Status to be extracted, got %v", got)
+	}
+
+	// A type without a status can't drop it
+	r = newFixtureRewriter(t)
+	spec := TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Spec"}
+	if err := r.setTypeOptions(spec, TypeOptions{DropStatus: true}); err != nil {
+		t.Fatal(err)
+	}
+	r.queueType(spec.PackagePath, spec.TypeName)
+	if err := r.processQueue(); err == nil || !strings.Contains(err.Error(), "can't drop the status of example.com/fixture/crd.Spec: it has no Status field") {
+		t.Errorf("Expected an error for a type without a status, got: %v", err)
+	}
+}
+
+func TestFlattenStructs(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.FlattenStructs = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// Spec and Status are only used by Widget, but Port is used twice
+	expected := []string{
+		"example.com/fixture/crd.Phase",
+		"example.com/fixture/crd.Port",
+		"example.com/fixture/crd.Widget",
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted:\n got: %v\nwant: %v", got, expected)
+	}
+	content, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/crd/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\tSpec struct {\n", "\t\tPorts []Port ", "\tStatus *struct {\n"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Expected %q in types.go:\n%s", want, content)
+		}
+	}
+
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated code failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Builders = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/crd/builders.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"func NewWidget() *Widget {",
+		"func (in *Widget) WithSpec(value Spec) *Widget {",
+		"func (in *Widget) WithStatus(value *Status) *Widget {",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Expected %q in builders.go:\n%s", want, content)
+		}
+	}
+	// Spec is only extracted as a dependency
+	if strings.Contains(string(content), "NewSpec") {
+		t.Errorf("Expected no builder for Spec:\n%s", content)
+	}
+
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated code failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Equal = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	dir := filepath.Join(r.config.OutputDir, "example.com/fixture/crd")
+	content, err := os.ReadFile(filepath.Join(dir, "equal.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"func (in Widget) Equal(other Widget) bool {",
+		"func (in Spec) Equal(other Spec) bool {",
+		"\tif !in.Status.Equal(*other.Status) {",
+		"\tif !in.Ports[i].Equal(other.Ports[i]) {",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Expected %q in equal.go:\n%s", want, content)
+		}
+	}
+	if strings.Contains(string(content), "reflect") {
+		t.Errorf("Expected no reflection in equal.go:\n%s", content)
+	}
+
+	// Run the methods against the values they compare
+	check := `package crd
+
+import "testing"
+
+func TestEqual(t *testing.T) {
+	policy, other := "Always", "Always"
+	a := Widget{Spec: Spec{Policy: &policy, Ports: []Port{{Number: 80}}, Named: map[string]Port{"http": {Number: 80}}}, Status: &Status{}}
+	b := Widget{Spec: Spec{Policy: &other, Ports: []Port{{Number: 80}}, Named: map[string]Port{"http": {Number: 80}}, Hosts: []string{}}, Status: &Status{}}
+	if !a.Equal(b) {
+		t.Error("expected equal widgets")
+	}
+	b.Spec.Named["http"] = Port{Number: 81}
+	if a.Equal(b) {
+		t.Error("expected a different map value to differ")
+	}
+	b.Spec.Named["http"] = Port{Number: 80}
+	b.Status = nil
+	if a.Equal(b) {
+		t.Error("expected a nil pointer to differ")
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "equal_test.go"), []byte(check), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", "./crd")
+	cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated Equal methods failed: %v\n%s", err, output)
+	}
+}
+
+func TestMarshalDifferences(t *testing.T) {
+	r := newFixtureRewriter(t)
+	label := TypeRef{PackagePath: "example.com/fixture/marshal", TypeName: "Label"}
+	if err := r.setTypeOptions(label, TypeOptions{Substitute: "time.Time"}); err != nil {
+		t.Fatal(err)
+	}
+	settings := TypeRef{PackagePath: "example.com/fixture/marshal", TypeName: "Settings"}
+	extractFixture(t, r, settings)
+
+	got := make(map[string][]string)
+	for _, diff := range r.marshalDifferences() {
+		field := strings.TrimPrefix(diff.Field, settings.String()+".")
+		got[field] = append(got[field], diff.Reason)
+	}
+	dropped := "the MarshalJSON method of example.com/fixture/marshal.Level wasn't extracted with it (see copyMethods)"
+	expected := map[string][]string{
+		"Level":          {dropped},
+		"Levels":         {dropped},
+		"Extra.Fallback": {dropped},
+		"Label": {
+			"substitute time.Time has a MarshalJSON method, which example.com/fixture/marshal.Label lacks",
+			"substitute time.Time has a UnmarshalJSON method, which example.com/fixture/marshal.Label lacks",
+			"substitute time.Time has a MarshalText method, which example.com/fixture/marshal.Label lacks",
+			"substitute time.Time has a UnmarshalText method, which example.com/fixture/marshal.Label lacks",
+			"omitempty omits the zero value of only one of example.com/fixture/marshal.Label and its substitute time.Time",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Differences:\n got: %v\nwant: %v", got, expected)
+	}
+
+	// Copying Level's methods keeps its encoding
+	r = newFixtureRewriter(t)
+	r.config.CopyMethods = true
+	extractFixture(t, r, settings)
+	if diffs := r.marshalDifferences(); len(diffs) != 0 {
+		t.Errorf("Expected no differences with copied methods, got %v", diffs)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	// The fixture's Time stands in for metav1.Time
+	wireWrappers["example.com/fixture/marshal.Time"] = wireWrappers["k8s.io/apimachinery/pkg/apis/meta/v1.Time"]
+	t.Cleanup(func() { delete(wireWrappers, "example.com/fixture/marshal.Time") })
+
+	r := newFixtureRewriter(t)
+	stamp := TypeRef{PackagePath: "example.com/fixture/marshal", TypeName: "Time"}
+	if err := r.setTypeOptions(stamp, TypeOptions{Substitute: "time.Duration", Wrap: true}); err == nil || !strings.Contains(err.Error(), "its wrapper holds time.Time") {
+		t.Errorf("Expected an error for the wrong substitute, got: %v", err)
+	}
+	if err := r.setTypeOptions(TypeRef{PackagePath: "example.com/fixture/marshal", TypeName: "Level"}, TypeOptions{Wrap: true}); err == nil || !strings.Contains(err.Error(), "no wrapper reproduces its wire format") {
+		t.Errorf("Expected an error for a type without a wrapper, got: %v", err)
+	}
+	if err := r.setTypeOptions(stamp, TypeOptions{Substitute: "time.Time", Wrap: true}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/marshal", TypeName: "Event"})
+	if diffs := r.marshalDifferences(); len(diffs) != 0 {
+		t.Errorf("Expected the wrapper to keep the wire format, got %v", diffs)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	dir := filepath.Join(r.config.OutputDir, "example.com/fixture/marshal")
+	check := `package marshal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWireFormat(t *testing.T) {
+	for _, tc := range []struct {
+		event Event
+		want  string
+	}{
+		{Event{}, ` + "`" + `{"at":null}` + "`" + `},
+		{Event{At: Time{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}}, ` + "`" + `{"at":"2024-01-02T03:04:05Z"}` + "`" + `},
+	} {
+		data, err := json.Marshal(tc.event)
+		if err != nil || string(data) != tc.want {
+			t.Errorf("got %s, %v; want %s", data, err, tc.want)
+		}
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil || !event.At.Equal(&tc.event.At) {
+			t.Errorf("round trip of %s: got %v, %v", data, event, err)
+		}
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "wrap_test.go"), []byte(check), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", "./marshal")
+	cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Wrapped type failed: %v\n%s", err, output)
+	}
+
+	// Every wrapper builds on its own
+	module := t.TempDir()
+	if err := os.WriteFile(filepath.Join(module, "go.mod"), []byte("module example.com/wrappers\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for key, wrapper := range wireWrappers {
+		pkgPath := key[:strings.LastIndex(key, ".")]
+		pkgDir := filepath.Join(module, strings.ReplaceAll(key, "/", "_"))
+		if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		source := "package " + path.Base(pkgPath) + "\n" + wrapper.source
+		if err := os.WriteFile(filepath.Join(pkgDir, "wrapper.go"), []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd = exec.Command("go", "vet", "./...")
+	cmd.Dir = module
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Wrappers failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	for preset, options := range presets {
+		r := newFixtureRewriter(t)
+		if err := r.applyPreset(preset); err != nil {
+			t.Fatal(err)
+		}
+		for key, opts := range options {
+			_, substituted := r.substitutes[key]
+			if opts.Wrap && (!r.typeOptions[key].Wrap || substituted) {
+				t.Errorf("%s: expected %s to be wrapped, keeping its references", preset, key)
+			}
+			if !opts.Wrap && !substituted {
+				t.Errorf("%s: expected %s to be substituted", preset, key)
+			}
+		}
+	}
+
+	// The kubernetes preset only wraps, so references keep their types
+	r := newFixtureRewriter(t)
+	if err := r.applyPreset(PresetKubernetes); err != nil {
+		t.Fatal(err)
+	}
+	for key := range presets[PresetKubernetes] {
+		if !r.typeOptions[key].Wrap {
+			t.Errorf("Expected %s to be wrapped", key)
+		}
+	}
+	if len(r.substitutes) != 0 {
+		t.Errorf("Expected no substitutes, got %v", r.substitutes)
+	}
+
+	r = newFixtureRewriter(t)
+	if err := r.applyPreset("k8s"); err == nil || !strings.Contains(err.Error(), `unknown preset "k8s" (use: aws, gcp, kubernetes)`) {
+		t.Errorf("Expected an error for an unknown preset, got: %v", err)
+	}
+}
+
+func TestPresetWrappers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the wrappers")
+	}
+
+	// The aws and gcp wrappers read and write what upstream does
+	module := t.TempDir()
+	if err := os.WriteFile(filepath.Join(module, "go.mod"), []byte("module example.com/wrappers\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, preset := range []Preset{PresetAWS, PresetGCP} {
+		for key := range presets[preset] {
+			wrapper, ok := wireWrappers[key]
+			if !ok {
+				continue
+			}
+			pkgPath, name := key[:strings.LastIndex(key, ".")], key[strings.LastIndex(key, ".")+1:]
+			pkgDir := filepath.Join(module, path.Base(pkgPath))
+			if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			source := "package " + path.Base(pkgPath) + "\n" + wrapper.source
+			if err := os.WriteFile(filepath.Join(pkgDir, strings.ToLower(name)+".go"), []byte(source), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checks := map[string]string{
+		"events": `package events
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEpochTimes(t *testing.T) {
+	var seconds SecondsEpochTime
+	if err := json.Unmarshal([]byte("1.5"), &seconds); err != nil || !seconds.Equal(time.Unix(1, 5e8)) {
+		t.Errorf("1.5 decoded as %v, %v; want 1.5s after the epoch", seconds.Time, err)
+	}
+	if data, err := json.Marshal(seconds); err != nil || string(data) != "1.5" {
+		t.Errorf("got %s, %v; want 1.5", data, err)
+	}
+
+	var millis MilliSecondsEpochTime
+	if err := json.Unmarshal([]byte("1700000000123"), &millis); err != nil || !millis.Equal(time.Unix(1700000000, 123e6)) {
+		t.Errorf("1700000000123 decoded as %v, %v", millis.Time, err)
+	}
+	if data, err := json.Marshal(millis); err != nil || string(data) != "1700000000123" {
+		t.Errorf("got %s, %v; want 1700000000123", data, err)
+	}
+}
+`,
+		"googleapi": `package googleapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestQuotedLists(t *testing.T) {
+	var ints Int64s
+	if err := json.Unmarshal([]byte(` + "`" + `["123","-4"]` + "`" + `), &ints); err != nil || !reflect.DeepEqual(ints, Int64s{123, -4}) {
+		t.Errorf("decoded %v, %v; want [123 -4]", ints, err)
+	}
+	if data, err := json.Marshal(ints); err != nil || string(data) != ` + "`" + `["123","-4"]` + "`" + ` {
+		t.Errorf("got %s, %v", data, err)
+	}
+	if data, err := json.Marshal(Float64s{1.5, 2}); err != nil || string(data) != ` + "`" + `["1.5","2"]` + "`" + ` {
+		t.Errorf("got %s, %v", data, err)
+	}
+	var small Uint32s
+	if err := json.Unmarshal([]byte(` + "`" + `["4294967296"]` + "`" + `), &small); err == nil {
+		t.Errorf("Expected an out-of-range value to fail, got %v", small)
+	}
+	if data, err := json.Marshal(Int32s(nil)); err != nil || string(data) != "[]" {
+		t.Errorf("got %s, %v", data, err)
+	}
+}
+`,
+	}
+	for dir, check := range checks {
+		if err := os.WriteFile(filepath.Join(module, dir, "wire_test.go"), []byte(check), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "test", "./...")
+	cmd.Dir = module
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Preset wrappers failed: %v\n%s", err, output)
+	}
+}
+
+// listEmitter writes the declarations of each package it's handed
+type listEmitter struct {
+	withSyntax bool // whether the declarations still had their syntax
+}
+
+func (e *listEmitter) Name() string { return "list" }
+
+func (e *listEmitter) Emit(out *Output) error {
+	var lines []string
+	for _, pkgInfo := range out.Packages {
+		for _, name := range sortedDeclNames(pkgInfo) {
+			lines = append(lines, pkgInfo.Pkg.PkgPath+"."+name)
+			e.withSyntax = pkgInfo.Decls[name].Decl != nil
+		}
+	}
+	return out.WriteFile("lists/decls.txt", []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func TestEmitters(t *testing.T) {
+	for _, withGo := range []bool{true, false} {
+		r := newFixtureRewriter(t)
+		list := &listEmitter{}
+		// The Go emitter runs last, whatever its place in the list
+		r.config.Emitters = []Emitter{list}
+		if withGo {
+			r.config.Emitters = []Emitter{GoEmitter{}, list}
+		}
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+
+		content, err := os.ReadFile(filepath.Join(r.config.OutputDir, "lists/decls.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), "example.com/fixture/crd.Widget\n") || !list.withSyntax {
+			t.Errorf("Expected the emitter to get Widget with its syntax, got:\n%s", content)
+		}
+		manifest, err := os.ReadFile(filepath.Join(r.config.OutputDir, manifestFile))
+		if err != nil || !strings.Contains(string(manifest), "lists/decls.txt") {
+			t.Errorf("Expected the emitted file in the manifest, got: %s, %v", manifest, err)
+		}
+		_, err = os.Stat(filepath.Join(r.config.OutputDir, "example.com/fixture/crd/types.go"))
+		if withGo != (err == nil) || withGo != r.generatesModules() {
+			t.Errorf("Expected types.go and module directives only with the Go emitter (withGo=%v): %v", withGo, err)
+		}
+	}
+
+	if _, err := NewEmitter("proto"); err == nil || !strings.Contains(err.Error(), `unknown emitter "proto" (use: docs, go, index)`) {
+		t.Errorf("Expected an error for an unknown emitter, got: %v", err)
+	}
+}
+
+func TestDocsEmitter(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Emitters = []Emitter{DocsEmitter{}}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(r.config.OutputDir, "docs/example.com/fixture/crd/README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"## Widget\n\nWidget is a resource with a desired and an observed state\n\n" +
+			"Rule: `self.spec.replicas <= 5 || has(self.spec.name)` (large widgets need a name).\n\n" +
+			"Printer columns: `Replicas` (`.spec.replicas`).\n",
+		"| `Spec` | `spec` | [Spec](#spec) |  |",
+		"| `Status` | `status` | `*`[Status](#status) | Nullable. Unknown fields are preserved. |",
+		"## Status\n\nStruct type: atomic.\n",
+		"| `Labels` | `labels` | `map[string]string` | Map type: granular. Default: `{\"app\":\"web\"}`. |",
+		"| `Replicas` | `replicas` | `int32` | Replicas is the number of copies to run ExclusiveMaximum: `true`. Maximum: `10`. Minimum: `1`. Default: `1`. |",
+		"| `Name` | `name` | `string` | MaxLength: `8`. Pattern: `^[a-z][a-z0-9-]*$`. |",
+		"| `Ports` | `ports` | `[]`[Port](#port) | MinItems: `1`. List type: map. Keyed by: `number`. |",
+		"## Phase\n\nType: `string`\n\nOne of: `Pending`, `Running`, `Failed`. Default: `Pending`.\n",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("Expected %q in the package's docs:\n%s", want, content)
+		}
+	}
+	index, err := os.ReadFile(filepath.Join(r.config.OutputDir, "docs/README.md"))
+	if err != nil || !strings.Contains(string(index), "- [example.com/fixture/crd](example.com/fixture/crd/README.md)") {
+		t.Errorf("Expected the package in the index, got: %s, %v", index, err)
+	}
+}
+
+func TestIndexEmitter(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Emitters = []Emitter{GoEmitter{}, IndexEmitter{}}
+	if err := r.setTypeOptions(TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Status"}, TypeOptions{Rename: "WidgetStatus"}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, typeIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []IndexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, fmt.Sprintf("%s %s.%s %s", entry.Source, entry.ImportPath, entry.Name, entry.File))
+	}
+	expected := []string{
+		"example.com/fixture/crd.Phase example.com/fixture/crd.Phase example.com/fixture/crd/types.go",
+		"example.com/fixture/crd.Port example.com/fixture/crd.Port example.com/fixture/crd/types.go",
+		"example.com/fixture/crd.Spec example.com/fixture/crd.Spec example.com/fixture/crd/types.go",
+		"example.com/fixture/crd.Status example.com/fixture/crd.WidgetStatus example.com/fixture/crd/types.go",
+		"example.com/fixture/crd.Widget example.com/fixture/crd.Widget example.com/fixture/crd/types.go",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected index:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestSelfExtraction(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.checkSelfExtraction([]string{"example.com/consumer"}); err != nil {
+		t.Errorf("Expected no error for another module, got: %v", err)
+	}
+
+	err := r.checkSelfExtraction([]string{"example.com/consumer", "example.com/fixture"})
+	d, ok := DiagnosticOf(err)
+	if !ok || d.Code != CodeSelfExtraction || d.Package != "example.com/fixture/crd" {
+		t.Fatalf("Expected a self-extraction diagnostic, got: %v", err)
+	}
+	for _, want := range []string{"can't generate module example.com/fixture, which is the module being updated", "reached via example.com/fixture/crd.Widget -> "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in: %v", want, err)
+		}
+	}
+}
+
+func TestInternalLayout(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The import prefix follows the output directory's place in the module
+	config := &Config{Dir: dir, OutputDir: filepath.Join(dir, "internal", "generated"), Layout: LayoutInternal}
+	if err := checkInternal(config); err != nil {
+		t.Fatalf("checkInternal failed: %v", err)
+	}
+	if want := "example.com/app/internal/generated"; config.ImportPrefix != want {
+		t.Errorf("Import prefix: got %s, want %s", config.ImportPrefix, want)
+	}
+
+	for _, outputDir := range []string{filepath.Join(dir, "generated"), t.TempDir()} {
+		config := &Config{Dir: dir, OutputDir: outputDir, Layout: LayoutInternal}
+		if err := checkInternal(config); err == nil {
+			t.Errorf("Expected an error for output %s, got import prefix %s", outputDir, config.ImportPrefix)
+		}
+	}
+}
+
+func TestInModule(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n\ngo 1.22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Dir: dir, OutputDir: filepath.Join(dir, "pkg", "generated"), InModule: true}
+	if err := checkInModule(config); err != nil {
+		t.Fatalf("checkInModule failed: %v", err)
+	}
+	if want := "example.com/app/pkg/generated"; config.ImportPrefix != want {
+		t.Errorf("Import prefix: got %s, want %s", config.ImportPrefix, want)
+	}
+
+	// A given import prefix is kept
+	config = &Config{Dir: dir, OutputDir: t.TempDir(), InModule: true, ImportPrefix: "example.com/app/types"}
+	if err := checkInModule(config); err != nil || config.ImportPrefix != "example.com/app/types" {
+		t.Errorf("Expected the import prefix to be kept, got %s, %v", config.ImportPrefix, err)
+	}
+
+	config = &Config{Dir: dir, OutputDir: filepath.Join(dir, "generated"), InModule: true, Layout: LayoutUmbrella, UmbrellaModule: "example.com/generated"}
+	if err := checkInModule(config); err == nil {
+		t.Errorf("Expected an error combined with the umbrella layout")
+	}
+}
+
+func TestRecursion(t *testing.T) {
+	holder := TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"}
+
+	// Same-package dependencies are followed, others must be extracted by
+	// another root
+	r := newFixtureRewriter(t)
+	r.narrowedRoots = []narrowedRoot{{holder, RecursionPackage}}
+	err := r.processQueue()
+	if d, ok := DiagnosticOf(err); !ok || d.Code != CodeOutsideRecursion || !strings.Contains(err.Error(), "example.com/tiny.Label") {
+		t.Fatalf("Expected an outside-recursion error for tiny.Label, got %v", err)
+	}
+
+	r = newFixtureRewriter(t)
+	r.narrowedRoots = []narrowedRoot{{holder, RecursionPackage}}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/tiny", TypeName: "Label"},
+		TypeRef{PackagePath: "example.com/tiny", TypeName: "Pair"})
+	want := []string{"example.com/fixture/collapser.Holder", "example.com/fixture/collapser.Pair", "example.com/tiny.Label", "example.com/tiny.Pair"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, want)
+	}
+
+	// The type alone leaves out the rest of its package too
+	r = newFixtureRewriter(t)
+	r.narrowedRoots = []narrowedRoot{{holder, RecursionType}}
+	r.queueType("example.com/tiny", "Label")
+	r.queueType("example.com/tiny", "Pair")
+	err = r.processQueue()
+	if d, ok := DiagnosticOf(err); !ok || d.Code != CodeOutsideRecursion || !strings.Contains(err.Error(), "collapser.Pair") {
+		t.Fatalf("Expected an outside-recursion error for collapser.Pair, got %v", err)
+	}
+}
+
+func TestLocalRecursion(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.narrowedRoots = []narrowedRoot{{TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"}, RecursionLocal}}
+	if err := r.processQueue(); err != nil {
+		t.Fatalf("processQueue failed: %v", err)
+	}
+	want := []string{"example.com/fixture/collapser.Holder", "example.com/fixture/collapser.Pair"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, want)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// Other packages are imported as they are, and their modules required
+	files := readTree(t, r.config.OutputDir)
+	if types := files[filepath.FromSlash("example.com/fixture/collapser/types.go")]; !strings.Contains(types, `"example.com/tiny"`) {
+		t.Errorf("Expected example.com/tiny to be imported:\n%s", types)
+	}
+	if goMod := files[filepath.FromSlash("example.com/fixture/go.mod")]; !strings.Contains(goMod, "example.com/tiny v0.0.0") {
+		t.Errorf("Expected example.com/tiny to be required:\n%s", goMod)
+	}
+	if _, ok := files[filepath.FromSlash("example.com/tiny/types.go")]; ok {
+		t.Errorf("Expected example.com/tiny not to be generated")
+	}
+}
+
+func TestConstraintRequires(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.KeepExternal = []string{"example.com/tiny"}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/bounded", TypeName: "Clamp"},
+		TypeRef{PackagePath: "example.com/fixture/bounded", TypeName: "Mid"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// Constraints of type parameters, including those of types declared in
+	// function bodies, are imported and required like any other dependency
+	files := readTree(t, r.config.OutputDir)
+	types := files[filepath.FromSlash("example.com/fixture/bounded/types.go")]
+	for _, want := range []string{`"example.com/tiny"`, "type Range[T tiny.Ordered]", "type pair[T tiny.Ordered]"} {
+		if !strings.Contains(types, want) {
+			t.Errorf("Expected %s in types.go:\n%s", want, types)
+		}
+	}
+	if goMod := files[filepath.FromSlash("example.com/fixture/go.mod")]; !strings.Contains(goMod, "example.com/tiny v0.0.0") {
+		t.Errorf("Expected example.com/tiny to be required:\n%s", goMod)
+	}
+}
+
+func TestVersionProvenance(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/tiny", TypeName: "Pair"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	files := readTree(t, r.config.OutputDir)
+	header := "// Code generated by package-rewriter " + Version() + ". DO NOT EDIT.\n"
+	if types := files[filepath.FromSlash("example.com/tiny/types.go")]; !strings.HasPrefix(types, header) {
+		t.Errorf("Expected types.go to start with %q:\n%s", header, types)
+	}
+	if _, version := parseManifest(r.config.OutputDir); version != Version() {
+		t.Errorf("Expected the manifest to record version %s, got %q", Version(), version)
+	}
+}
+
+func TestGoCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	output, err := goCommand{dir: dir, args: []string{"env", "GOPROXY"}, env: []string{"GOPROXY=off"}}.run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(output)); got != "off" {
+		t.Errorf("GOPROXY = %q, want the configured off", got)
+	}
+
+	// Failures keep standard error apart from standard output
+	_, err = goCommand{dir: dir, args: []string{"mod", "tidy"}, env: []string{"GOWORK=off", "GOFLAGS="}}.run(context.Background())
+	var goErr *GoError
+	if !errors.As(err, &goErr) {
+		t.Fatalf("tidy without a go.mod: got %v, want a *GoError", err)
+	}
+	if goErr.TimedOut || !strings.Contains(goErr.Stderr, "go.mod") || !strings.Contains(err.Error(), "go mod tidy failed") {
+		t.Errorf("unexpected error %#v: %v", goErr, err)
+	}
+
+	_, err = goCommand{dir: dir, args: []string{"env", "GOPROXY"}, timeout: time.Nanosecond}.run(context.Background())
+	if !errors.As(err, &goErr) || !goErr.TimedOut || !strings.Contains(err.Error(), "go env GOPROXY failed: timed out") {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestFieldReport(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.FieldReport = true
+	r.config.SuspectFields = SuspectFieldsReplace
+	r.config.NonSerializableFields = NonSerializableStrip
+	options := map[string]TypeOptions{
+		"Stamp": {Substitute: "time.Time"},
+		"Event": {Prune: []string{"Response", "Trace"}},
+	}
+	for name, opts := range options {
+		if err := r.setTypeOptions(TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: name}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"},
+		TypeRef{PackagePath: "example.com/fixture/suspect", TypeName: "Cache"},
+		TypeRef{PackagePath: "example.com/fixture/wire", TypeName: "Job"},
+	)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, fieldReportFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []FieldChange
+	if err := json.Unmarshal(data, &changes); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s.%s %s %s->%s", change.Type, change.Field, change.Change, change.From, change.To))
+	}
+	expected := []string{
+		"example.com/fixture/suspect.Cache.Handlers retyped map[string]*reflect.Value->map[string]*struct{}",
+		"example.com/fixture/suspect.Cache.Mutex retyped sync.Mutex->struct{}",
+		"example.com/fixture/suspect.Cache.state.ptr retyped unsafe.Pointer->struct{}",
+		"example.com/fixture/typeopts.Event.At retyped Stamp->time.Time",
+		"example.com/fixture/typeopts.Event.Response removed other.Response->",
+		"example.com/fixture/typeopts.Event.Trace removed bool->",
+		"example.com/fixture/typeopts.Sink.Last retyped *Stamp->*time.Time",
+		"example.com/fixture/wire.Job.Done removed chan struct{}->",
+		"example.com/fixture/wire.Job.Hooks removed []func()->",
+		"example.com/fixture/wire.Job.Meta.Cancel removed func()->",
+		"example.com/fixture/wire.Job.OnDone removed func(error)->",
+		"example.com/fixture/wire.Job.ctx removed context.Context->",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Field report:\n got: %v\nwant: %v", got, expected)
+	}
+
+	output, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/wire/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"// Fields that differ from upstream:\n",
+		"//   - Done (chan struct{}) removed: holds a channel, which can't be serialized\n",
+		"//   - ctx (context.Context) removed: holds a context.Context, which can't be serialized\ntype Job struct",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected %q in the doc comment of Job:\n%s", want, output)
+		}
+	}
+
+	// Existing doc comments are kept
+	output, err = os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/typeopts/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "// Event is renamed to Record\n//\n// Fields that differ from upstream:\n"; !strings.Contains(string(output), want) {
+		t.Errorf("Expected %q in the doc comment of Event:\n%s", want, output)
+	}
+}
+
+func TestDropDeprecated(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.DropDeprecated = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/legacy", TypeName: "Options"})
+
+	// other.Request isn't extracted, since only the dropped field needed it
+	expected := []string{"example.com/fixture/legacy.Options"}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+	}
+
+	var dropped []string
+	for _, change := range r.fieldChanges {
+		dropped = append(dropped, change.Field)
+	}
+	if want := []string{"Timeout", "Request", "Retry.Backoff"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("Dropped fields:\n got: %v\nwant: %v", dropped, want)
+	}
+
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/legacy/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{"Name string", "Deadline int64", "Attempts int", "Notes string"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected %q to be kept:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{"Timeout", "Backoff", "Request"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("Expected %q to be dropped:\n%s", unwanted, data)
+		}
+	}
+}
+
+func TestUnexportedPolicy(t *testing.T) {
+	public := TypeRef{PackagePath: "example.com/fixture/leaky", TypeName: "Public"}
+
+	t.Run("prune", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.Unexported = UnexportedPrune
+		extractFixture(t, r, public)
+
+		expected := []string{"example.com/fixture/leaky.Public", "example.com/fixture/leaky.Shared"}
+		if got := extractedTypes(r); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Extracted types:\n got: %v\nwant: %v", got, expected)
+		}
+		var pruned []string
+		for _, change := range r.fieldChanges {
+			pruned = append(pruned, change.Type+"."+change.Field)
+		}
+		want := []string{
+			"example.com/fixture/leaky.Public.count",
+			"example.com/fixture/leaky.Public.Detail",
+			"example.com/fixture/leaky.Public.Items",
+			"example.com/fixture/leaky.Shared.secret",
+		}
+		if !reflect.DeepEqual(pruned, want) {
+			t.Errorf("Pruned fields:\n got: %v\nwant: %v", pruned, want)
+		}
+	})
+
+	t.Run("prune non-struct", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.Unexported = UnexportedPrune
+		r.queueType("example.com/fixture/leaky", "List")
+		err := r.processQueue()
+		if err == nil || !strings.Contains(err.Error(), "leaky.List refers to unexported type item") {
+			t.Errorf("Expected an error for List, got: %v", err)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		r := newFixtureRewriter(t)
+		r.config.Unexported = UnexportedFail
+		r.queueType(public.PackagePath, public.TypeName)
+		err := r.processQueue()
+		if err == nil {
+			t.Fatal("Expected an error for the unexported field, got nil")
+		}
+		if want := "field example.com/fixture/leaky.Public.count exposes package internals: unexported field"; !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got: %v", want, err)
+		}
+	})
+}
+
+func TestImportAliases(t *testing.T) {
+	generate := func(t *testing.T, names ...string) string {
+		t.Helper()
+		r := newFixtureRewriter(t)
+		var roots []TypeRef
+		for _, name := range names {
+			roots = append(roots, TypeRef{PackagePath: "example.com/fixture/aliases", TypeName: name})
+		}
+		extractFixture(t, r, roots...)
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/aliases/types.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("go", "vet", "./aliases")
+		cmd.Dir = filepath.Join(r.config.OutputDir, "example.com/fixture")
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("Generated code failed to build: %v\n%s\n%s", err, output, data)
+		}
+		return strings.Join(strings.Fields(string(data)), " ")
+	}
+
+	t.Run("most common alias", func(t *testing.T) {
+		content := generate(t, "A", "B", "C", "D", "E")
+		for _, want := range []string{
+			`m "example.com/fixture/k8s/meta"`,
+			"Object m.ObjectMeta",
+			"m.TypeMeta",
+			"List m.ListMeta",
+			// other is the name of another import, so chain/c gets its own
+			`"example.com/fixture/chain/c"`,
+			"Record c.C",
+			"Request other.Request",
+		} {
+			if !strings.Contains(content, want) {
+				t.Errorf("Expected %q in:\n%s", want, content)
+			}
+		}
+		if strings.Contains(content, `meta "example.com/fixture/k8s/meta"`) {
+			t.Errorf("Expected meta to be imported once:\n%s", content)
+		}
+	})
+
+	t.Run("alias shadowed by a local", func(t *testing.T) {
+		content := generate(t, "A", "B", "Describe")
+		for _, want := range []string{`"example.com/fixture/k8s/meta"`, "Object meta.ObjectMeta", "meta.TypeMeta"} {
+			if !strings.Contains(content, want) {
+				t.Errorf("Expected %q in:\n%s", want, content)
+			}
+		}
+	})
+}
+
+func TestImportGroups(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Shims = []Shim{{Module: "example.com/shimmed", Path: "example.com/platform/shimmed-types", Version: "v0.3.0"}}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/grouped", TypeName: "Mixed"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/grouped/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `package grouped
+
+import (
+	"time"
+
+	"example.com/platform/shimmed-types/api"
+
+	"example.com/fixture/chain/c"
+	"example.com/fixture/other"
+)
+`
+	if !strings.Contains(string(data), want) {
+		t.Errorf("Expected grouped imports:\n%s\ngot:\n%s", want, data)
+	}
+	if formatted, err := format.Source(data); err != nil || !bytes.Equal(formatted, data) {
+		t.Errorf("Expected gofmt'd output (err: %v):\n%s", err, data)
+	}
+}
+
+func TestMinify(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Minify = true
+	r.config.Validation = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	crdDir := filepath.Join(r.config.OutputDir, "example.com/fixture/crd")
+	for _, name := range []string{"types.go", validationFile} {
+		data, err := os.ReadFile(filepath.Join(crdDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, body, ok := strings.Cut(string(data), "\npackage crd\n")
+		if !ok || !strings.HasPrefix(header, "// Code generated by package-rewriter") {
+			t.Errorf("Expected %s to keep its header:\n%s", name, data)
+		}
+		// gofmt keeps a blank line between declarations of different kinds
+		if strings.Contains(body, "//") || strings.Contains(body, "\n\n\t") || strings.Contains(body, "}\n\nfunc") {
+			t.Errorf("Expected no comments or blank lines in %s:\n%s", name, data)
+		}
+		if formatted, err := format.Source(data); err != nil || !bytes.Equal(formatted, data) {
+			t.Errorf("Expected gofmt'd output in %s (err: %v):\n%s", name, err, data)
+		}
+	}
+
+	types, err := os.ReadFile(filepath.Join(crdDir, "types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(types), "`json:\"replicas\"`") {
+		t.Errorf("Expected struct tags to be kept:\n%s", types)
+	}
+
+	cmd := exec.Command("go", "vet", "./crd")
+	cmd.Dir = filepath.Dir(crdDir)
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Minified code failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestPreserveSource(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.PreserveSource = true
+	r.typeOptions["example.com/fixture/commented.Schedule"] = TypeOptions{Rename: "Timing"}
+	r.typeOptions["example.com/fixture/commented.Job"] = TypeOptions{Prune: []string{"Trace"}}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/commented", TypeName: "Job"},
+		TypeRef{PackagePath: "example.com/fixture/commented", TypeName: "Next"},
+	)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	pkgDir := filepath.Join(r.config.OutputDir, "example.com/fixture/commented")
+	data, err := os.ReadFile(filepath.Join(pkgDir, "types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(data)
+
+	// Renamed declarations are copied with the new name patched in, keeping
+	// comments that aren't part of the syntax tree
+	for _, want := range []string{
+		"// Schedule says when a job runs.\ntype Timing struct {\n",
+		"\n\t// This comment isn't attached to a field, so it's lost when the\n",
+		"\tJitter int `json:\"jitter\"` // added to Every\n",
+		"func Next(s Timing, now int) int {\n\t// Jitter delays every run, including the first\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected types.go to contain %q:\n%s", want, output)
+		}
+	}
+	// Pruned declarations are printed from their syntax tree
+	if strings.Contains(output, "Trace") || !strings.Contains(output, "Schedule Timing `json:\"schedule\"`") {
+		t.Errorf("Expected Job to be printed without Trace:\n%s", output)
+	}
+
+	cmd := exec.Command("go", "vet", "./commented")
+	cmd.Dir = filepath.Dir(pkgDir)
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Copied code failed to build: %v\n%s", err, output)
+	}
+}
+
+func TestReferencedPackages(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.KeepExternal = []string{"example.com/cgomod"}
+	r.config.Shims = []Shim{{Module: "example.com/shimmed", Path: "github.com/Platform/shimmed-types", Version: "v0.3.0"}}
+	if err := r.setTypeOptions(TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Stamp"}, TypeOptions{Substitute: "time.Time"}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Event"},
+		TypeRef{PackagePath: "example.com/fixture/cgouser", TypeName: "Wrapper"},
+		TypeRef{PackagePath: "example.com/fixture/shimuser", TypeName: "Deployment"},
+	)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	expected := []ReferencedPackage{
+		{Path: "example.com/cgomod", Resolution: ResolvedExternal, Module: "example.com/cgomod@v0.0.0"},
+		{Path: "example.com/fixture/cgouser", Resolution: ResolvedExtracted},
+		{Path: "example.com/fixture/other", Resolution: ResolvedExtracted},
+		{Path: "example.com/fixture/shimuser", Resolution: ResolvedExtracted},
+		{Path: "example.com/fixture/typeopts", Resolution: ResolvedExtracted},
+		{Path: "example.com/shimmed/api", ImportPath: "github.com/Platform/shimmed-types/api", Resolution: ResolvedExternal, Module: "github.com/Platform/shimmed-types@v0.3.0"},
+		// Stamp's substitute
+		{Path: "time", Resolution: ResolvedSubstituted},
+	}
+	if got := r.referencedPackages(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Referenced packages:\n got: %+v\nwant: %+v", got, expected)
+	}
+}
+
+func TestDanglingImports(t *testing.T) {
+	tests := []struct {
+		name    string
+		drop    []string // declarations of other to lose after extraction
+		wantErr string
+	}{
+		{
+			name:    "name not extracted",
+			drop:    []string{"Request"},
+			wantErr: "example.com/fixture/typeopts.Event.Request refers to example.com/fixture/other.Request, but it wasn't extracted (reached via example.com/fixture/typeopts.Event)",
+		},
+		{
+			name:    "package not extracted",
+			drop:    []string{"Request", "Response"},
+			wantErr: "example.com/fixture/typeopts.Event.Request refers to example.com/fixture/other.Request, but example.com/fixture/other was neither extracted nor kept external",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Event"})
+			for _, name := range tt.drop {
+				delete(r.packages["example.com/fixture/other"].Decls, name)
+			}
+			err := r.generateOutput()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got: %v", tt.wantErr, err)
+			}
+			if d, ok := DiagnosticOf(err); !ok || d.Code != CodeDanglingImport || d.Decl != "example.com/fixture/typeopts.Event" {
+				t.Errorf("Expected a %s diagnostic for example.com/fixture/typeopts.Event, got %+v", CodeDanglingImport, d)
+			}
+		})
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	// A missing root is wrapped, but keeps its code
+	r := newFixtureRewriter(t)
+	r.queueType("example.com/fixture/other", "Missing")
+	err := r.processQueue()
+	if d, ok := DiagnosticOf(err); !ok || d.Code != CodeTypeNotFound || d.Decl != "example.com/fixture/other.Missing" {
+		t.Errorf("Expected a %s diagnostic, got %+v from %v", CodeTypeNotFound, d, err)
+	}
+
+	r = newFixtureRewriter(t)
+	r.queueType("example.com/fixture/nonexistent", "Missing")
+	err = r.processQueue()
+	if d, ok := DiagnosticOf(err); !ok || d.Code != CodePackageLoadFailure || d.Package != "example.com/fixture/nonexistent" {
+		t.Errorf("Expected a %s diagnostic, got %+v from %v", CodePackageLoadFailure, d, err)
+	}
+
+	// Generated packages importing each other fail before anything is written
+	r = newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Event"})
+	r.recordImport(r.packages["example.com/fixture/other"], "example.com/fixture/typeopts", "typeopts")
+	err = r.generateOutput()
+	want := "generated packages would import each other: example.com/fixture/other -> example.com/fixture/typeopts -> example.com/fixture/other"
+	if d, ok := DiagnosticOf(err); !ok || d.Code != CodeCycleDetected || err.Error() != want {
+		t.Errorf("Expected a %s diagnostic %q, got %+v from %v", CodeCycleDetected, want, d, err)
+	}
+}
+
+func TestSideEffectImports(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  SideEffectImportPolicy
+		mapping map[string]string
+		want    []string // blank imports in types.go
+		wantErr string
+	}{
+		{name: "warn by default"},
+		{name: "drop", policy: SideEffectImportsDrop},
+		{
+			name:    "keep",
+			policy:  SideEffectImportsKeep,
+			wantErr: "can't keep side-effect import example.com/fixture/sideeffect/register of example.com/fixture/sideeffect (digest.go)",
+		},
+		{
+			name:    "keep with a mapped drop",
+			policy:  SideEffectImportsKeep,
+			mapping: map[string]string{"example.com/fixture/sideeffect/register": ""},
+			want:    []string{`_ "crypto/sha256"`},
+		},
+		{
+			name:    "mapped",
+			mapping: map[string]string{"example.com/fixture/sideeffect/register": "crypto/sha512"},
+			want:    []string{`_ "crypto/sha512"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			r.config.SideEffectImports = tt.policy
+			r.config.SideEffectImportMap = tt.mapping
+			extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/sideeffect", TypeName: "Digest"})
+			err := r.generateOutput()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateOutput failed: %v", err)
+			}
+
+			pkgDir := filepath.Join(r.config.OutputDir, "example.com/fixture/sideeffect")
+			data, err := os.ReadFile(filepath.Join(pkgDir, "types.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(data), `_ "`); got != len(tt.want) {
+				t.Errorf("Expected %d blank imports, got %d:\n%s", len(tt.want), got, data)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("Expected types.go to contain %s:\n%s", want, data)
+				}
+			}
+
+			cmd := exec.Command("go", "vet", "./sideeffect")
+			cmd.Dir = filepath.Dir(pkgDir)
+			cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("Generated code failed to build: %v\n%s", err, output)
+			}
+		})
+	}
+}
+
+func TestLoadModes(t *testing.T) {
+	r := newRecursiveRewriter(&Config{})
+	// Only packages declarations are extracted from are parsed and
+	// type-checked; everything else comes from export data, or isn't
+	// type-checked at all
+	if r.loadMode&packages.NeedDeps != 0 {
+		t.Errorf("Expected dependencies of extracted packages to be read from export data")
+	}
+	if r.typesMode&(packages.NeedSyntax|packages.NeedTypesInfo|packages.NeedDeps) != 0 || r.typesMode&packages.NeedTypes == 0 {
+		t.Errorf("Expected substitutes to be loaded with types from export data, got mode %v", r.typesMode)
+	}
+	if consultMode&(packages.NeedSyntax|packages.NeedTypes|packages.NeedCompiledGoFiles) != 0 {
+		t.Errorf("Expected consulted packages to be loaded without syntax, types, or cgo preprocessing, got mode %v", consultMode)
+	}
+}
+
+func TestSubstituteFromExportData(t *testing.T) {
+	r := newFixtureRewriter(t)
+	// Load substitutes as a run does, rather than from source
+	r.typesMode = newRecursiveRewriter(&Config{}).typesMode
+	stamp := TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Stamp"}
+	if err := r.setTypeOptions(stamp, TypeOptions{Substitute: "time.Time"}); err != nil {
+		t.Fatal(err)
+	}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"})
+
+	timePkg := r.packages["time"]
+	if timePkg == nil || timePkg.Pkg.Types == nil || timePkg.Pkg.Syntax != nil || timePkg.Pkg.TypesInfo != nil {
+		t.Fatalf("Expected time to be loaded from export data, without syntax, got %+v", timePkg)
+	}
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(r.config.OutputDir, "example.com/fixture/typeopts/types.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(strings.Fields(string(data)), " ")
+	for _, want := range []string{`"time"`, "At time.Time", "Last *time.Time"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Expected generated code to contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestReleaseSyntax(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"})
+	before := extractedTypes(r)
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// Generated packages drop their syntax trees once written, but keep
+	// what the summary needs
+	for pkgPath, pkgInfo := range r.packages {
+		if pkgInfo.hasOutput() && (pkgInfo.Pkg.Syntax != nil || pkgInfo.Pkg.TypesInfo != nil) {
+			t.Errorf("Expected the syntax of %s to be released", pkgPath)
+		}
+	}
+	if got := extractedTypes(r); !reflect.DeepEqual(got, before) {
+		t.Errorf("Declarations after generating:\n got: %v\nwant: %v", got, before)
+	}
+	if _, err := r.summarize(); err != nil {
+		t.Errorf("summarize failed: %v", err)
+	}
+}
+
+func TestPackageCacheEnv(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewPackageCache()
+	load := func(goEnv ...string) *packages.Package {
+		t.Helper()
+		r := newRecursiveRewriter(&Config{Dir: dir, OutputDir: t.TempDir(), Cache: cache, GoEnv: goEnv})
+		pkg, err := r.loadPackage("example.com/fixture/other", consultMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkg
+	}
+
+	// Runs with the same environment share loads, and others don't
+	if first, second := load(), load(); first != second {
+		t.Error("Expected the second load to come from the cache")
+	}
+	if load() == load("GOFLAGS=-tags=other") {
+		t.Error("Expected a load with other environment not to come from the cache")
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := []TypeRef{
+		{PackagePath: "example.com/fixture/other", TypeName: "Request"},
+		{PackagePath: "example.com/fixture/commented", TypeName: "Job"},
+		{PackagePath: "example.com/fixture/crd", TypeName: "Widget"},
+	}
+	job := func(root TypeRef, outputDir string) []*Config {
+		return []*Config{{PackagePath: root.PackagePath, TypeName: root.TypeName, OutputDir: outputDir, Dir: dir}}
+	}
+
+	// Each job alone, one at a time
+	var want []map[string]string
+	for _, root := range roots {
+		outputDir := t.TempDir()
+		if errs := RunJobs([][]*Config{job(root, outputDir)}, nil, 1); errs[0] != nil {
+			t.Fatalf("RunJobs failed for %s: %v", root, errs[0])
+		}
+		want = append(want, readTree(t, outputDir))
+	}
+
+	// All of them at once, sharing a cache, plus a job writing to the same
+	// directory as another and one that fails
+	var jobs [][]*Config
+	var outputDirs []string
+	for _, root := range roots {
+		outputDirs = append(outputDirs, t.TempDir())
+		jobs = append(jobs, job(root, outputDirs[len(outputDirs)-1]))
+	}
+	jobs = append(jobs, job(roots[0], outputDirs[0]))
+	jobs = append(jobs, job(TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Missing"}, t.TempDir()))
+	errs := RunJobs(jobs, NewPackageCache(), 0)
+
+	for i := range roots {
+		if errs[i] != nil {
+			t.Errorf("Job %d failed: %v", i+1, errs[i])
+			continue
+		}
+		if got := readTree(t, outputDirs[i]); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("Concurrent job %d wrote different files than running it alone:\n got: %v\nwant: %v", i+1, got, want[i])
+		}
+	}
+	if errs[len(roots)] != nil {
+		t.Errorf("Job sharing an output directory failed: %v", errs[len(roots)])
+	}
+	if last := errs[len(errs)-1]; last == nil || !strings.Contains(last.Error(), "Missing") {
+		t.Errorf("Expected the job extracting a missing type to fail on its own, got %v", last)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	outputDir := t.TempDir()
+	generate := func() {
+		t.Helper()
+		r := newFixtureRewriter(t)
+		r.config.OutputDir = outputDir
+		r.config.FieldReport = true
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"})
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+	}
+	generate()
+	first := readTree(t, outputDir)
+
+	// Every generated file is listed with its hash
+	manifest := first[manifestFile]
+	for rel, content := range first {
+		if rel == manifestFile {
+			continue
+		}
+		sum := sha256.Sum256([]byte(content))
+		if line := hex.EncodeToString(sum[:]) + "  " + filepath.ToSlash(rel) + "\n"; !strings.Contains(manifest, line) {
+			t.Errorf("Expected the manifest to list %q, got:\n%s", line, manifest)
+		}
+	}
+
+	// Backdate everything and edit one file by hand
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	edited := filepath.Join("example.com", "fixture", "typeopts", "types.go")
+	if err := os.WriteFile(filepath.Join(outputDir, edited), []byte("package typeopts\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for rel := range first {
+		if err := os.Chtimes(filepath.Join(outputDir, rel), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generate()
+	if got := readTree(t, outputDir); !reflect.DeepEqual(got, first) {
+		t.Errorf("Expected regenerating to write the same files:\n got: %v\nwant: %v", got, first)
+	}
+	for rel := range first {
+		info, err := os.Stat(filepath.Join(outputDir, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten := !info.ModTime().Equal(old); rewritten != (rel == edited) {
+			t.Errorf("%s: expected rewritten = %v", rel, rel == edited)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "generated")
+	generate := func() {
+		t.Helper()
+		r := newFixtureRewriter(t)
+		r.config.OutputDir = outputDir
+		r.config.FileMode = 0o640
+		r.config.DirMode = 0o750
+		r.config.ReadOnly = true
+		extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+		if err := r.generateOutput(); err != nil {
+			t.Fatalf("generateOutput failed: %v", err)
+		}
+	}
+	generate()
+	// Without the manifest, every read-only file is written again
+	if err := os.Remove(filepath.Join(outputDir, manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+	generate()
+
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		want := os.FileMode(0o440)
+		if d.IsDir() {
+			want = 0o750
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s: expected permissions %v, got %v", path, want, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutputPathCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		subdir  string
+		wantErr string
+	}{
+		{
+			name:    "same directory",
+			subdir:  "example.com/fixture/other",
+			wantErr: "packages example.com/fixture/commented (reached via example.com/fixture/commented.Job) and example.com/fixture/other (reached via example.com/fixture/other.Request) would both be written to ",
+		},
+		{
+			name:    "directories differing in case",
+			subdir:  "example.com/fixture/Other",
+			wantErr: "would be written to example.com/fixture/Other and example.com/fixture/other, which differ only in case",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFixtureRewriter(t)
+			extractFixture(t, r,
+				TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"},
+				TypeRef{PackagePath: "example.com/fixture/commented", TypeName: "Job"},
+			)
+			// As a stripped version suffix or a published module's layout
+			// could place it
+			r.packages["example.com/fixture/commented"].OutputSubdir = tt.subdir
+
+			err := r.generateOutput()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			if _, err := os.Stat(filepath.Join(r.config.OutputDir, "example.com")); !os.IsNotExist(err) {
+				t.Errorf("Expected nothing to be written, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeclIndex(t *testing.T) {
+	r := newFixtureRewriter(t)
+	// Several roots in one package are found through one index
+	extractFixture(t, r,
+		TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"},
+		TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Response"},
+		TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Suffix"},
+		TypeRef{PackagePath: "example.com/fixture/methods", TypeName: "Describe"},
+	)
+	got := extractedTypes(r)
+	for _, want := range []string{
+		"example.com/fixture/other.Request",
+		"example.com/fixture/other.Response",
+		"example.com/fixture/other.Suffix",
+		"example.com/fixture/other.suffix",
+		"example.com/fixture/methods.Describe",
+		"example.com/fixture/methods.Store",
+		"example.com/fixture/methods.Store.Count",
+	} {
+		if !slices.Contains(got, want) {
+			t.Errorf("Expected %s to be extracted, got %v", want, got)
+		}
+	}
+
+	pkgInfo := r.packages["example.com/fixture/methods"]
+	if pkgInfo.declIndex == nil {
+		t.Fatal("Expected the package's declarations to be indexed")
+	}
+	if got, want := pkgInfo.methodNames("Store"), []string{"Add", "touch", "Count", "Fast", "Total"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Methods of Store:\n got: %v\nwant: %v", got, want)
+	}
+	if site, ok := pkgInfo.lookup("Store.touch"); !ok || site.decl.(*ast.FuncDecl).Name.Name != "touch" {
+		t.Errorf("Expected to find Store.touch, got %v", site)
+	}
+	if _, ok := pkgInfo.lookup("touch"); ok {
+		t.Errorf("Expected methods not to be indexed by their bare name")
+	}
+}
+
+func TestSharedOutputDirectory(t *testing.T) {
+	outputDir := t.TempDir()
+	generate := func(owner, importPrefix string, root TypeRef) error {
+		t.Helper()
+		r := newFixtureRewriter(t)
+		r.config.OutputDir = outputDir
+		r.config.Owner = owner
+		r.config.ImportPrefix = importPrefix
+		extractFixture(t, r, root)
+		return r.generateOutput()
+	}
+	const prefix = "example.com/consumer/generated"
+	request := TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"}
+	job := TypeRef{PackagePath: "example.com/fixture/commented", TypeName: "Job"}
+
+	// Configs generating different packages share the directory, and
+	// regenerating one keeps the other's entries
+	for _, run := range []struct {
+		owner string
+		root  TypeRef
+	}{{"team-a.yaml", request}, {"team-b.yaml", job}, {"team-a.yaml", request}} {
+		if err := generate(run.owner, prefix, run.root); err != nil {
+			t.Fatalf("Generating %s for %s failed: %v", run.root, run.owner, err)
+		}
+	}
+	manifest, err := os.ReadFile(filepath.Join(outputDir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# owner: team-a.yaml\n",
+		"  example.com/fixture/other/types.go\n# owner: team-b.yaml\n",
+		"  example.com/fixture/commented/types.go\n",
+	} {
+		if !strings.Contains(string(manifest), want) {
+			t.Errorf("Expected the manifest to contain %q, got:\n%s", want, manifest)
+		}
+	}
+
+	// A third config can't take over a package, and nothing is written
+	before := readTree(t, outputDir)
+	err = generate("team-c.yaml", prefix, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Response"})
+	if want := "package example.com/fixture/other would be written to example.com/fixture/other in " + outputDir + ", which holds files generated by team-a.yaml"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected an error containing %q, got %v", want, err)
+	}
+	if after := readTree(t, outputDir); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected the rejected run not to change the output")
+	}
+
+	// Nor another config's module, whose go.mod it would replace
+	outputDir = t.TempDir()
+	if err := generate("team-a.yaml", "", request); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	err = generate("team-b.yaml", "", TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if want := "go.mod of module example.com/fixture would be written"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected an error containing %q, got %v", want, err)
+	}
+}
+
+func TestThirdPartyLayout(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Layout = LayoutThirdParty
+	r.config.StripVersionSuffix = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	files := readTree(t, r.config.OutputDir)
+	for _, want := range []string{
+		"third_party/generated/example.com/fixture/go.mod",
+		"third_party/generated/example.com/fixture/other/types.go",
+	} {
+		if _, ok := files[filepath.FromSlash(want)]; !ok {
+			t.Errorf("Expected %s to be generated, got %v", want, files)
+		}
+	}
+	want := "{\n  \"example.com/fixture\": \"third_party/generated/example.com/fixture\"\n}\n"
+	if got := files[moduleMapFile]; got != want {
+		t.Errorf("module-map.json:\n got: %s\nwant: %s", got, want)
+	}
+
+	// Replace directives point into it, and version suffixes can still be
+	// stripped
+	if got := r.moduleDir("example.com/lib/v2"); got != "third_party/generated/example.com/lib" {
+		t.Errorf("Expected modules under third_party/generated, got %s", got)
+	}
+}
+
+func TestUmbrellaLayout(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Layout = LayoutUmbrella
+	r.config.UmbrellaModule = "example.com/generated"
+	r.config.ImportPrefix = r.config.UmbrellaModule
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/collapser", TypeName: "Holder"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	// One go.mod at the root, with the newest Go version of the sources
+	files := readTree(t, r.config.OutputDir)
+	if want := "module example.com/generated\n\ngo 1.22\n\ntoolchain go1.22.5\n"; files["go.mod"] != want {
+		t.Errorf("go.mod:\n got: %s\nwant: %s", files["go.mod"], want)
+	}
+	for name := range files {
+		if strings.HasSuffix(name, "go.mod") && name != "go.mod" {
+			t.Errorf("Expected no other go.mod, got %s", name)
+		}
+	}
+	types := files[filepath.FromSlash("example.com/fixture/collapser/types.go")]
+	if !strings.Contains(types, `"example.com/generated/example.com/tiny"`) {
+		t.Errorf("Expected packages to be imported from the umbrella module:\n%s", types)
+	}
+	if _, ok := files[filepath.FromSlash("example.com/tiny/types.go")]; !ok {
+		t.Errorf("Expected example.com/tiny to be generated, got %v", files)
+	}
+
+	// Consumers replace the umbrella module alone, with the output directory
+	if got := r.generatedModules(); !reflect.DeepEqual(got, []string{"example.com/generated"}) {
+		t.Errorf("Generated modules: %v", got)
+	}
+	if got := r.moduleDir("example.com/generated"); got != "." {
+		t.Errorf("Expected the umbrella module at the output root, got %s", got)
+	}
+}
+
+func TestGoWorkUses(t *testing.T) {
+	r := newFixtureRewriter(t)
+	root := t.TempDir()
+	r.config.OutputDir = filepath.Join(root, "generated")
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+
+	goWorkPath := filepath.Join(root, "go.work")
+	if err := os.WriteFile(goWorkPath, []byte("go 1.22\n\nuse (\n\t./app\n\t./generated/example.com/stale\n)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goWork, err := NewGoWorkManager(goWorkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uses of modules generated by earlier runs are dropped before loading,
+	// and the workspace's own modules are kept
+	if err := r.removeGeneratedUses(goWork); err != nil {
+		t.Fatalf("removeGeneratedUses failed: %v", err)
+	}
+	if err := r.updateGoWorkUses(goWork); err != nil {
+		t.Fatalf("updateGoWorkUses failed: %v", err)
+	}
+	content, err := os.ReadFile(goWorkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "go 1.22\n\nuse (\n\t./app\n\t./generated/example.com/fixture\n)\n"
+	if string(content) != want {
+		t.Errorf("go.work:\n got: %s\nwant: %s", content, want)
+	}
+
+	// Running again doesn't add the use twice
+	if err := r.updateGoWorkUses(goWork); err != nil {
+		t.Fatalf("updateGoWorkUses failed: %v", err)
+	}
+	if again, _ := os.ReadFile(goWorkPath); string(again) != want {
+		t.Errorf("go.work changed on the second run:\n%s", again)
+	}
+}
+
+func TestGoModReplaces(t *testing.T) {
+	r := newFixtureRewriter(t)
+	root := t.TempDir()
+	r.config.OutputDir = filepath.Join(root, "generated")
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+
+	goModPath := filepath.Join(root, "go.mod")
+	fixtureDir := filepath.Join(r.config.OutputDir, "example.com/fixture")
+	before := "module example.com/app\n\ngo 1.22\n\nreplace (\n\texample.com/fixture => " + fixtureDir + "\n\t// Keep using the fork\n\texample.com/forked => ../forked\n\texample.com/stale => ./generated/example.com/stale\n)\n"
+	if err := os.WriteFile(goModPath, []byte(before), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goMod, err := NewGoModManager(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.generatedReplaces(goMod); !reflect.DeepEqual(got, []string{"example.com/fixture", "example.com/stale"}) {
+		t.Errorf("Generated replaces: %v", got)
+	}
+
+	// The directive of a module no longer generated is dropped, and the
+	// others are left where they are
+	if err := r.updateGoModReplaces(goMod); err != nil {
+		t.Fatalf("updateGoModReplaces failed: %v", err)
+	}
+	content, err := os.ReadFile(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "module example.com/app\n\ngo 1.22\n\nreplace (\n\texample.com/fixture => " + fixtureDir + "\n\t// Keep using the fork\n\texample.com/forked => ../forked\n)\n"
+	if string(content) != want {
+		t.Errorf("go.mod:\n got: %s\nwant: %s", content, want)
+	}
+
+	// Running again leaves go.mod alone
+	goMod, err = NewGoModManager(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.updateGoModReplaces(goMod); err != nil {
+		t.Fatalf("updateGoModReplaces failed: %v", err)
+	}
+	if goMod.Changed() {
+		t.Errorf("Expected go.mod to be unchanged on the second run")
+	}
+}
+
+func TestTidy(t *testing.T) {
+	r := newFixtureRewriter(t)
+	root := t.TempDir()
+	r.config.OutputDir = filepath.Join(root, "generated")
+	r.config.Tidy = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	goModPath := filepath.Join(root, "go.mod")
+	if err := os.WriteFile(goModPath, []byte("module example.com/app\n\ngo 1.22\n\nrequire example.com/fixture v0.0.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	main := "package main\n\nimport \"example.com/fixture/other\"\n\nvar _ other.Request\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(root, "main.go"), []byte(main), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goMod, err := NewGoModManager(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.updateGoModReplaces(goMod); err != nil {
+		t.Fatalf("updateGoModReplaces failed: %v", err)
+	}
+
+	// A generated module that doesn't resolve fails the run, naming it
+	if err := os.Remove(filepath.Join(r.config.OutputDir, "example.com/fixture", "go.mod")); err != nil {
+		t.Fatal(err)
+	}
+	goMod, err = NewGoModManager(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.updateGoModReplaces(goMod)
+	if err == nil || !strings.Contains(err.Error(), "generated module example.com/fixture (replaced by ") {
+		t.Errorf("Expected the error to name the generated module, got: %v", err)
+	}
+}
+
+func TestReplaceWith(t *testing.T) {
+	r := newFixtureRewriter(t)
+	root := t.TempDir()
+	r.config.OutputDir = filepath.Join(root, "generated")
+	r.config.ReplaceWith = map[string]string{"example.com/fixture": "github.com/mycorp/shims/fixture@v1.2.3"}
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/other", TypeName: "Request"})
+
+	goWorkPath := filepath.Join(root, "go.work")
+	if err := os.WriteFile(goWorkPath, []byte("go 1.22\n\nuse ./app\n\nreplace example.com/fixture => github.com/mycorp/shims/fixture v1.2.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goWork, err := NewGoWorkManager(goWorkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement from an earlier run is dropped before loading, and
+	// the module is replaced with the published version instead of used
+	if err := r.removeGeneratedUses(goWork); err != nil {
+		t.Fatalf("removeGeneratedUses failed: %v", err)
+	}
+	if got := goWork.ReplacedModules(); len(got) != 0 {
+		t.Errorf("Expected the replacement to be dropped before loading, got %v", got)
+	}
+	if err := r.updateGoWorkUses(goWork); err != nil {
+		t.Fatalf("updateGoWorkUses failed: %v", err)
+	}
+	content, err := os.ReadFile(goWorkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "go 1.22\n\nuse ./app\n\nreplace example.com/fixture => github.com/mycorp/shims/fixture v1.2.3\n"
+	if string(content) != want {
+		t.Errorf("go.work:\n got: %s\nwant: %s", content, want)
+	}
+
+	if err := checkReplaceWith(map[string]string{"example.com/fixture": "github.com/mycorp/shims/fixture"}); err == nil || !strings.Contains(err.Error(), "has no version") {
+		t.Errorf("Expected a replacement without a version to be rejected, got: %v", err)
+	}
+}
+
+func TestFindTypePackages(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "fixture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := FindTypePackages(dir, "example.com/fixture", []string{"Request", "Level", "Missing"})
+	if err != nil {
+		t.Fatalf("FindTypePackages failed: %v", err)
+	}
+	if got := found["Request"]; !slices.Equal(got, []string{"example.com/fixture/other"}) {
+		t.Errorf("Expected Request in example.com/fixture/other, got %v", got)
+	}
+	if got := found["Level"]; len(got) < 2 || !slices.IsSorted(got) {
+		t.Errorf("Expected Level in several packages, sorted, got %v", got)
+	}
+	if got, ok := found["Missing"]; ok {
+		t.Errorf("Expected no package for Missing, got %v", got)
+	}
+
+	if _, err := FindTypePackages(dir, "example.com/unknown", []string{"Request"}); err == nil || !strings.Contains(err.Error(), "no packages found in module example.com/unknown") {
+		t.Errorf("Expected an error for a module that isn't required, got: %v", err)
+	}
+}
+
+func TestDiffSourceTypes(t *testing.T) {
+	r := newFixtureRewriter(t)
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Spec"})
+	from := r.sourceTypes()
+
+	spec, ok := from["example.com/fixture/crd.Spec"]
+	if !ok || spec.fields["Ports"] != (sourceField{typ: "[]Port", tag: `json:"ports"`}) {
+		t.Fatalf("Expected Spec.Ports to be recorded as []Port, got %+v", spec.fields["Ports"])
+	}
+
+	// Simulate an upgrade of the module
+	to := make(map[string]sourceType)
+	for key, shape := range from {
+		to[key] = shape
+	}
+	fields := make(map[string]sourceField)
+	for name, field := range spec.fields {
+		fields[name] = field
+	}
+	delete(fields, "Enabled")
+	fields["Replicas"] = sourceField{typ: "int64", tag: `json:"replicas"`}
+	fields["Name"] = sourceField{typ: "string", tag: `json:"name"`}
+	fields["Paused"] = sourceField{typ: "bool", tag: `json:"paused,omitempty"`}
+	order := append(slices.DeleteFunc(slices.Clone(spec.order), func(name string) bool { return name == "Enabled" }), "Paused")
+	to["example.com/fixture/crd.Spec"] = sourceType{underlying: "struct", fields: fields, order: order}
+	to["example.com/fixture/crd.Phase"] = sourceType{underlying: "int"}
+	to["example.com/fixture/crd.Mode"] = sourceType{underlying: "string"}
+
+	got := diffSourceTypes(from, to)
+	want := []SourceChange{
+		{Type: "example.com/fixture/crd.Mode", Change: "added", To: "string"},
+		{Type: "example.com/fixture/crd.Phase", Change: "retyped", From: "string", To: "int"},
+		{Type: "example.com/fixture/crd.Spec", Field: "Replicas", Change: "retyped", From: "int32", To: "int64"},
+		{Type: "example.com/fixture/crd.Spec", Field: "Name", Change: "tag", From: `json:"name,omitempty"`, To: `json:"name"`},
+		{Type: "example.com/fixture/crd.Spec", Field: "Paused", Change: "added", To: "bool"},
+		{Type: "example.com/fixture/crd.Spec", Field: "Enabled", Change: "removed", From: "bool"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected changes:\n got: %+v\nwant: %+v", got, want)
+	}
+	if changes := diffSourceTypes(from, from); len(changes) != 0 {
+		t.Errorf("Expected no changes between identical versions, got %+v", changes)
+	}
+}
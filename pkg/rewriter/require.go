@@ -0,0 +1,163 @@
+package rewriter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// requireMissing makes source packages that the consuming module doesn't
+// require loadable, by running go get against a temporary copy of its go.mod.
+// Packages are then loaded with -modfile pointing at the copy, so the real
+// go.mod and go.sum are left alone. versions maps package paths to the
+// version to get; packages without one get the latest.
+func (r *RecursiveRewriter) requireMissing(versions map[string]string) error {
+	missing, err := r.missingPackages(versions)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	modfile, err := r.tempModFile(fmt.Sprintf("packages %s aren't required by any module", strings.Join(missing, ", ")))
+	if err != nil {
+		return err
+	}
+
+	args := []string{"get", "-modfile=" + modfile}
+	for _, pkgPath := range missing {
+		version := versions[pkgPath]
+		if version == "" {
+			version = "latest"
+		}
+		args = append(args, pkgPath+"@"+version)
+	}
+	slog.Info("Requiring missing source packages in a temporary go.mod", "packages", missing)
+	return r.goGet(args)
+}
+
+// pinModule loads packages of modulePath at version, by getting it into a
+// temporary copy of the consuming module's go.mod, like requireMissing
+func (r *RecursiveRewriter) pinModule(modulePath, version string) error {
+	modfile, err := r.tempModFile(fmt.Sprintf("%s@%s has to be pinned", modulePath, version))
+	if err != nil {
+		return err
+	}
+	slog.Info("Pinning source module in a temporary go.mod", "module", modulePath, "version", version)
+	return r.goGet([]string{"get", "-modfile=" + modfile, modulePath + "@" + version})
+}
+
+// tempModFile returns the temporary copy of the consuming module's go.mod
+// that packages are loaded with, creating it and passing it to the go
+// command through -modfile on first use. what describes the need for it in
+// errors.
+func (r *RecursiveRewriter) tempModFile(what string) (string, error) {
+	for _, flag := range r.buildFlags {
+		if modfile, ok := strings.CutPrefix(flag, "-modfile="); ok {
+			return modfile, nil
+		}
+	}
+
+	// The go command rejects -modfile in workspace mode
+	goWork, err := FindGoWork(r.config.Dir)
+	if err != nil {
+		return "", err
+	}
+	if goWork != "" {
+		return "", fmt.Errorf("%s, but the workspace in %s can't use a temporary go.mod; go get it in one of the workspace's modules instead, or set GOWORK=off", what, goWork)
+	}
+
+	goMod, err := goEnv(r.config.Dir, "GOMOD")
+	if err != nil {
+		return "", err
+	}
+	if goMod == "" || goMod == os.DevNull {
+		return "", fmt.Errorf("%s, and there's no go.mod to copy", what)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "package-rewriter-")
+	if err != nil {
+		return "", err
+	}
+	r.tmpDirs = append(r.tmpDirs, tmpDir)
+
+	// go looks for the checksums of -modfile=x.mod in x.sum
+	modfile := filepath.Join(tmpDir, "go.mod")
+	for src, dst := range map[string]string{goMod: modfile, strings.TrimSuffix(goMod, ".mod") + ".sum": filepath.Join(tmpDir, "go.sum")} {
+		content, err := os.ReadFile(src)
+		if err != nil {
+			if os.IsNotExist(err) && strings.HasSuffix(src, ".sum") {
+				continue
+			}
+			return "", err
+		}
+		if err := os.WriteFile(dst, content, 0o644); err != nil {
+			return "", err
+		}
+	}
+
+	r.modDir = filepath.Dir(goMod)
+	r.buildFlags = append(r.buildFlags, "-modfile="+modfile)
+	return modfile, nil
+}
+
+// goGet runs the go command with args in the consuming module
+func (r *RecursiveRewriter) goGet(args []string) error {
+	_, err := r.goCommand(r.modDir, args...).run(context.Background())
+	return err
+}
+
+// missingPackages returns the packages that can't be loaded because no
+// required module provides them
+func (r *RecursiveRewriter) missingPackages(versions map[string]string) ([]string, error) {
+	var pkgPaths []string
+	for pkgPath := range versions {
+		if !r.isStdlib(pkgPath) {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	if len(pkgPaths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(pkgPaths)
+
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       packages.NeedName | packages.NeedModule,
+		Dir:        r.config.Dir,
+		BuildFlags: r.buildFlags,
+		Env:        r.goEnviron(),
+	}, pkgPaths...)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, pkg := range pkgs {
+		if pkg.Module == nil && len(pkg.Errors) > 0 {
+			missing = append(missing, pkg.PkgPath)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// cleanup removes the temporary files the rewriter created
+func (r *RecursiveRewriter) cleanup() {
+	for _, dir := range r.tmpDirs {
+		os.RemoveAll(dir)
+	}
+	r.tmpDirs = nil
+}
+
+// goEnv returns the value of a go env variable as seen from dir
+func goEnv(dir, name string) (string, error) {
+	output, err := goCommand{dir: dir, args: []string{"env", name}}.run(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
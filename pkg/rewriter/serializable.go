@@ -0,0 +1,97 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log/slog"
+)
+
+// NonSerializablePolicy controls what happens to struct fields that can't be
+// marshaled (channels, functions, and contexts), which are meaningless in a
+// type that's only used for encoding
+type NonSerializablePolicy string
+
+const (
+	// NonSerializableKeep copies the field as is (the default)
+	NonSerializableKeep NonSerializablePolicy = "keep"
+	// NonSerializableStrip leaves the field out of the type, with a warning
+	NonSerializableStrip NonSerializablePolicy = "strip"
+	// NonSerializableFail stops extraction of the type with an error
+	NonSerializableFail NonSerializablePolicy = "fail"
+)
+
+// checkNonSerializableFields applies the NonSerializablePolicy to the fields
+// of a struct type, including those of nested struct types, before it's
+// walked for dependencies
+func (r *RecursiveRewriter) checkNonSerializableFields(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) error {
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok || pkgInfo.Pkg.TypesInfo == nil {
+		return nil
+	}
+	return r.checkNonSerializableStruct(pkgInfo, typeRef, st, typeRef.String())
+}
+
+func (r *RecursiveRewriter) checkNonSerializableStruct(pkgInfo *PackageInfo, typeRef TypeRef, st *ast.StructType, path string) error {
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		name := embeddedFieldName(field.Type)
+		if len(field.Names) > 0 {
+			name = field.Names[0].Name
+		}
+		fieldPath := path + "." + name
+
+		kind, err := r.nonSerializableKind(pkgInfo, typeRef, field.Type, fieldPath)
+		if err != nil {
+			return err
+		}
+		if kind == "" || r.config.NonSerializableFields == NonSerializableKeep || r.config.NonSerializableFields == "" {
+			kept = append(kept, field)
+			continue
+		}
+		if r.config.NonSerializableFields == NonSerializableFail {
+			return fmt.Errorf("field %s holds a %s, which can't be serialized (set nonSerializableFields to keep or strip it)", fieldPath, kind)
+		}
+		slog.Warn("Stripped field that can't be serialized", "field", fieldPath, "kind", kind)
+		for _, ident := range field.Names {
+			r.recordFieldChange(typeRef, path+"."+ident.Name, fieldRemoved, types.ExprString(field.Type), "", "holds a "+kind+", which can't be serialized")
+		}
+		if len(field.Names) == 0 {
+			r.recordFieldChange(typeRef, fieldPath, fieldRemoved, types.ExprString(field.Type), "", "holds a "+kind+", which can't be serialized")
+		}
+	}
+	st.Fields.List = kept
+	return nil
+}
+
+// nonSerializableKind describes what makes a field's type unserializable
+// ("channel", "function", or "context.Context"), or returns "" if nothing
+// does. Nested struct types are checked field by field instead, and the
+// methods of interface types don't count.
+func (r *RecursiveRewriter) nonSerializableKind(pkgInfo *PackageInfo, typeRef TypeRef, expr ast.Expr, path string) (string, error) {
+	var kind string
+	var err error
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if kind != "" || err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.StructType:
+			err = r.checkNonSerializableStruct(pkgInfo, typeRef, n, path)
+			return false
+		case *ast.InterfaceType:
+			return false
+		case *ast.ChanType:
+			kind = "channel"
+		case *ast.FuncType:
+			kind = "function"
+		case *ast.SelectorExpr:
+			if obj, ok := pkgInfo.Pkg.TypesInfo.Uses[n.Sel].(*types.TypeName); ok && obj.Pkg() != nil && obj.Pkg().Path() == "context" && obj.Name() == "Context" {
+				kind = "context.Context"
+			}
+			return false
+		}
+		return true
+	})
+	return kind, err
+}
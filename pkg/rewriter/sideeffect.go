@@ -0,0 +1,116 @@
+package rewriter
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// SideEffectImportPolicy controls what happens to the blank imports (import
+// _ "path") of the source files declarations are copied from, which
+// packages use to register codecs, hashes, or drivers at init time
+type SideEffectImportPolicy string
+
+const (
+	// SideEffectImportsWarn drops them, logging each one (the default)
+	SideEffectImportsWarn SideEffectImportPolicy = "warn"
+	// SideEffectImportsKeep imports them from the generated package too,
+	// requiring their modules as real dependencies
+	SideEffectImportsKeep SideEffectImportPolicy = "keep"
+	// SideEffectImportsDrop drops them silently
+	SideEffectImportsDrop SideEffectImportPolicy = "drop"
+)
+
+// collectSideEffectImports applies the SideEffectImportPolicy, and the
+// SideEffectImportMap entries that override it, to the blank imports of the
+// files each generated package's declarations came from. Kept imports are
+// recorded with the "_" alias.
+func (r *RecursiveRewriter) collectSideEffectImports() error {
+	var pkgPaths []string
+	for pkgPath, pkgInfo := range r.packages {
+		// Packages copied verbatim keep their imports anyway
+		if pkgInfo.hasOutput() && !pkgInfo.Verbatim {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+		seen := make(map[string]bool)
+		for _, name := range sortedDeclNames(pkgInfo) {
+			file := pkgInfo.Decls[name].File
+			if file == nil {
+				continue
+			}
+			filename := filepath.Base(r.fset.File(file.Pos()).Name())
+			for _, imp := range file.Imports {
+				if imp.Name == nil || imp.Name.Name != "_" {
+					continue
+				}
+				importPath, err := strconv.Unquote(imp.Path.Value)
+				if err != nil || seen[importPath] {
+					continue
+				}
+				seen[importPath] = true
+
+				target, mapped := r.config.SideEffectImportMap[importPath]
+				switch {
+				case mapped && target == "":
+					slog.Debug("Dropping mapped side-effect import", "package", pkgPath, "import", importPath)
+					continue
+				case mapped:
+					slog.Debug("Mapping side-effect import", "package", pkgPath, "import", importPath, "to", target)
+				case r.config.SideEffectImports == SideEffectImportsKeep:
+					target = importPath
+				case r.config.SideEffectImports == SideEffectImportsDrop:
+					continue
+				default:
+					slog.Warn("Dropping side-effect import; set sideEffectImports to keep it or map it in sideEffectImportMap",
+						"package", pkgPath, "file", filename, "import", importPath)
+					continue
+				}
+
+				if err := r.resolveSideEffectImport(target); err != nil {
+					return fmt.Errorf("can't keep side-effect import %s of %s (%s): %w; map it in sideEffectImportMap or drop it", target, pkgPath, filename, err)
+				}
+				r.recordImport(pkgInfo, target, "_")
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSideEffectImport makes sure generated code can import a package for
+// its side effects: from the standard library, from the generated code, or
+// from a versioned module required as a real dependency
+func (r *RecursiveRewriter) resolveSideEffectImport(importPath string) error {
+	if r.isStdlib(importPath) || r.external[importPath] != nil {
+		return nil
+	}
+	if pkgInfo := r.packages[importPath]; pkgInfo != nil && pkgInfo.hasOutput() {
+		return nil
+	}
+
+	pkgInfo, err := r.consultPackageInfo(importPath, consultMode)
+	if err != nil {
+		return err
+	}
+	mod := pkgInfo.Pkg.Module
+	if mod == nil || (mod.Version == "" && r.config.ImportPrefix == "") {
+		return fmt.Errorf("%s isn't from a versioned module dependency", importPath)
+	}
+	if r.config.ImportPrefix == "" {
+		// The generated module replaces the source module, which has no
+		// copy of the package
+		for _, other := range r.packages {
+			if other.hasOutput() && other.ModulePath == mod.Path {
+				return fmt.Errorf("%s is in %s, which is replaced by generated code", importPath, mod.Path)
+			}
+		}
+	}
+	r.external[importPath] = mod
+	return nil
+}
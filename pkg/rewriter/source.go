@@ -0,0 +1,157 @@
+package rewriter
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sourceDecls prints declarations for types.go the way format.Node prints
+// them in a file, each after a blank line, copying them from their source
+// files where possible
+func (r *RecursiveRewriter) sourceDecls(decls []ast.Decl) (string, error) {
+	sources := make(map[string][]byte) // source file contents, nil if unreadable
+	var buf strings.Builder
+	for _, decl := range decls {
+		text, ok := r.sourceText(decl, sources)
+		if !ok {
+			var node bytes.Buffer
+			if err := format.Node(&node, r.fset, decl); err != nil {
+				return "", err
+			}
+			text = node.String()
+		}
+		buf.WriteString("\n" + text + "\n")
+	}
+	return buf.String(), nil
+}
+
+// sourceText returns a declaration's original source, from its doc comment
+// to the end of its last line, with the identifiers renamed since it was
+// parsed patched in. It returns false if the declaration was changed in any
+// other way (fields pruned, types substituted, comments added), so its
+// source no longer says the same thing as its syntax tree.
+func (r *RecursiveRewriter) sourceText(decl ast.Decl, sources map[string][]byte) (string, bool) {
+	start, end := decl.Pos(), decl.End()
+	switch d := decl.(type) {
+	case *ast.GenDecl:
+		if d.Doc != nil {
+			start = d.Doc.Pos()
+		}
+	case *ast.FuncDecl:
+		if d.Doc != nil {
+			start = d.Doc.Pos()
+		}
+	}
+	if !start.IsValid() || !end.IsValid() {
+		return "", false
+	}
+	tf := r.fset.File(start)
+	if tf == nil || r.fset.File(end) != tf {
+		return "", false
+	}
+	src, read := sources[tf.Name()]
+	if !read {
+		content, err := os.ReadFile(tf.Name())
+		if err == nil && len(content) == tf.Size() {
+			src = content
+		}
+		sources[tf.Name()] = src
+	}
+	if src == nil {
+		return "", false
+	}
+	startOff, endOff := tf.Offset(start), tf.Offset(end)
+
+	// Keep a comment trailing the declaration on its last line
+	line, _, _ := bytes.Cut(src[endOff:], []byte("\n"))
+	if rest := bytes.TrimSpace(line); bytes.HasPrefix(rest, []byte("//")) {
+		endOff += len(bytes.TrimRight(line, " \t\r"))
+	}
+
+	type edit struct {
+		start, end int
+		name       string
+	}
+	var edits []edit
+	ok := true
+	ast.Inspect(decl, func(n ast.Node) bool {
+		ident, isIdent := n.(*ast.Ident)
+		if !ok || !isIdent {
+			return ok
+		}
+		if !ident.Pos().IsValid() || r.fset.File(ident.Pos()) != tf {
+			ok = false
+			return false
+		}
+		off := tf.Offset(ident.Pos())
+		if off < startOff || off >= endOff {
+			ok = false
+			return false
+		}
+		if name := identAt(src, off); name != ident.Name {
+			edits = append(edits, edit{start: off, end: off + len(name), name: ident.Name})
+		}
+		return true
+	})
+	if !ok {
+		return "", false
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var text strings.Builder
+	pos := startOff
+	for _, e := range edits {
+		if e.start < pos {
+			return "", false
+		}
+		text.Write(src[pos:e.start])
+		text.WriteString(e.name)
+		pos = e.end
+	}
+	text.Write(src[pos:endOff])
+
+	if !r.sameDecl(decl, text.String()) {
+		return "", false
+	}
+	return text.String(), true
+}
+
+// identAt returns the identifier starting at offset off of src
+func identAt(src []byte, off int) string {
+	end := off
+	for end < len(src) {
+		ch, size := utf8.DecodeRune(src[end:])
+		if ch != '_' && !unicode.IsLetter(ch) && !unicode.IsDigit(ch) {
+			break
+		}
+		end += size
+	}
+	return string(src[off:end])
+}
+
+// sameDecl reports whether text parses to a declaration that prints the same
+// as decl
+func (r *RecursiveRewriter) sameDecl(decl ast.Decl, text string) bool {
+	var want bytes.Buffer
+	if err := format.Node(&want, r.fset, decl); err != nil {
+		return false
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", "package p\n\n"+text, parser.ParseComments)
+	if err != nil || len(file.Decls) != 1 {
+		return false
+	}
+	var got bytes.Buffer
+	if err := format.Node(&got, fset, file.Decls[0]); err != nil {
+		return false
+	}
+	return bytes.Equal(want.Bytes(), got.Bytes())
+}
@@ -0,0 +1,169 @@
+package rewriter
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRegenerationIsStable regenerates each configuration several times from
+// unchanged sources and checks every run writes byte-identical files, so
+// diffs of generated code only ever reflect real changes. Extraction walks
+// maps in many places, so repeated runs also shake out ordering that depends
+// on map iteration.
+func TestRegenerationIsStable(t *testing.T) {
+	const runs = 3
+	copyMethods := true
+	tests := []struct {
+		name      string
+		configure func(r *RecursiveRewriter)
+		roots     []TypeRef
+	}{
+		{
+			name: "import aliases",
+			roots: []TypeRef{
+				{PackagePath: "example.com/fixture/aliases", TypeName: "A"},
+				{PackagePath: "example.com/fixture/aliases", TypeName: "B"},
+				{PackagePath: "example.com/fixture/aliases", TypeName: "C"},
+				{PackagePath: "example.com/fixture/aliases", TypeName: "D"},
+				{PackagePath: "example.com/fixture/aliases", TypeName: "E"},
+			},
+		},
+		{
+			name:  "import groups",
+			roots: []TypeRef{{PackagePath: "example.com/fixture/grouped", TypeName: "Mixed"}},
+		},
+		{
+			name: "type options and field report",
+			configure: func(r *RecursiveRewriter) {
+				r.config.FieldReport = true
+				r.config.SuspectFields = SuspectFieldsReplace
+				r.config.NonSerializableFields = NonSerializableStrip
+				r.typeOptions["example.com/fixture/typeopts.Stamp"] = TypeOptions{Substitute: "time.Time"}
+				r.typeOptions["example.com/fixture/typeopts.Event"] = TypeOptions{Prune: []string{"Response", "Trace"}, Rename: "Record", CopyMethods: &copyMethods}
+			},
+			roots: []TypeRef{
+				{PackagePath: "example.com/fixture/typeopts", TypeName: "Sink"},
+				{PackagePath: "example.com/fixture/suspect", TypeName: "Cache"},
+				{PackagePath: "example.com/fixture/wire", TypeName: "Job"},
+			},
+		},
+		{
+			name: "markers",
+			configure: func(r *RecursiveRewriter) {
+				r.config.Validation = true
+				r.config.Defaults = true
+				r.config.GVK = true
+			},
+			roots: []TypeRef{
+				{PackagePath: "example.com/fixture/crd", TypeName: "Widget"},
+				{PackagePath: "example.com/fixture/k8s/apps/v1", TypeName: "DeploymentList"},
+				{PackagePath: "example.com/fixture/k8s/batch/v2", TypeName: "Job"},
+			},
+		},
+		{
+			name: "alias flavor and bazel",
+			configure: func(r *RecursiveRewriter) {
+				r.config.ImportPrefix = "example.com/consumer/generated"
+				r.config.AliasTag = "upstream"
+				r.config.Bazel = true
+			},
+			roots: []TypeRef{
+				{PackagePath: "example.com/fixture/chain/a", TypeName: "Pair"},
+				{PackagePath: "example.com/fixture/ifaces", TypeName: "Holder"},
+			},
+		},
+		{
+			name: "preserved source",
+			configure: func(r *RecursiveRewriter) {
+				r.config.PreserveSource = true
+				r.typeOptions["example.com/fixture/commented.Schedule"] = TypeOptions{Rename: "Timing"}
+			},
+			roots: []TypeRef{
+				{PackagePath: "example.com/fixture/commented", TypeName: "Job"},
+				{PackagePath: "example.com/fixture/commented", TypeName: "Next"},
+			},
+		},
+		{
+			name:      "minified",
+			configure: func(r *RecursiveRewriter) { r.config.Minify = true },
+			roots:     []TypeRef{{PackagePath: "example.com/fixture/consts", TypeName: "Buffer"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every run writes to the same directory, in case paths end up
+			// in the output
+			workspace := t.TempDir()
+			if err := os.WriteFile(filepath.Join(workspace, "MODULE.bazel"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			outputDir := filepath.Join(workspace, "generated")
+
+			var first map[string]string
+			for run := 0; run < runs; run++ {
+				if err := os.RemoveAll(outputDir); err != nil {
+					t.Fatal(err)
+				}
+				r := newFixtureRewriter(t)
+				r.config.OutputDir = outputDir
+				if tt.configure != nil {
+					tt.configure(r)
+				}
+				extractFixture(t, r, tt.roots...)
+				if err := r.generateOutput(); err != nil {
+					t.Fatalf("generateOutput failed: %v", err)
+				}
+
+				files := readTree(t, outputDir)
+				if first == nil {
+					first = files
+					continue
+				}
+				for path, want := range first {
+					if got, ok := files[path]; !ok {
+						t.Errorf("Run %d didn't write %s", run+1, path)
+					} else if got != want {
+						t.Errorf("Run %d wrote a different %s:\n got:\n%s\nwant:\n%s", run+1, path, got, want)
+					}
+				}
+				for path := range files {
+					if _, ok := first[path]; !ok {
+						t.Errorf("Run %d wrote an extra file %s", run+1, path)
+					}
+				}
+			}
+		})
+	}
+}
+
+// readTree returns the contents of every file under dir, keyed by path
+// relative to it
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("Nothing was generated in %s", dir)
+	}
+	return files
+}
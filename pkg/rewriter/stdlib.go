@@ -0,0 +1,66 @@
+package rewriter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+var (
+	stdlibMu    sync.Mutex
+	stdlibCache = make(map[string]map[string]bool) // directory to the standard library seen from it
+)
+
+// stdlibPackages returns the packages of the standard library of the
+// toolchain the go command selects in dir, as listed by go list std, or nil
+// if they can't be listed. The list is cached for the life of the process.
+func stdlibPackages(dir string) map[string]bool {
+	stdlibMu.Lock()
+	defer stdlibMu.Unlock()
+	if std, ok := stdlibCache[dir]; ok {
+		return std
+	}
+
+	output, err := goCommand{dir: dir, args: []string{"list", "-e", "-f", "{{.ImportPath}}", "std"}}.run(context.Background())
+	var std map[string]bool
+	if err != nil {
+		slog.Warn("Failed to list the standard library; guessing from package paths", "error", err)
+	} else {
+		std = make(map[string]bool)
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			std[scanner.Text()] = true
+		}
+	}
+	stdlibCache[dir] = std
+	return std
+}
+
+// isStdlib reports whether a package (or module) is part of the standard
+// library, or is treated like it by the Stdlib config. It asks the toolchain
+// rather than guessing from the path, since a future standard library
+// package may have a dot in its first element and modules need not.
+func (r *RecursiveRewriter) isStdlib(pkgPath string) bool {
+	if pkgPath == "C" || r.isConfiguredStdlib(pkgPath) {
+		return true
+	}
+	if std := stdlibPackages(r.config.Dir); std != nil {
+		return std[pkgPath]
+	}
+	first, _, _ := strings.Cut(pkgPath, "/")
+	return !strings.Contains(first, ".")
+}
+
+// isConfiguredStdlib reports whether a package matches one of the Stdlib
+// entries, either exactly or as a parent path
+func (r *RecursiveRewriter) isConfiguredStdlib(pkgPath string) bool {
+	for _, entry := range r.config.Stdlib {
+		if pkgPath == entry || strings.HasPrefix(pkgPath, entry+"/") {
+			return true
+		}
+	}
+	return false
+}
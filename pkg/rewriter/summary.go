@@ -0,0 +1,246 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Summary compares the generated code with the upstream dependency it
+// stands in for
+type Summary struct {
+	Decls    int // declarations extracted, not counting packages copied verbatim
+	Packages int // packages generated
+	Modules  int // modules generated (none under an import prefix)
+	Lines    int // lines of Go code generated
+	Requires int // modules the generated code still requires, because they were kept external
+
+	// StrippedDirectives are the compiler directives removed from
+	// generated declarations, sorted by declaration
+	StrippedDirectives []StrippedDirective
+
+	// The transitive dependencies of the packages the roots were extracted
+	// from, outside the standard library: what depending on them directly
+	// would have pulled in
+	UpstreamPackages int
+	UpstreamModules  int
+	UpstreamLines    int
+}
+
+// Resolution is how an import of generated code is resolved at build time
+type Resolution string
+
+const (
+	ResolvedExtracted   Resolution = "extracted"     // generated from the upstream package
+	ResolvedExternal    Resolution = "kept-external" // required as a real dependency, or from a shim module
+	ResolvedSubstituted Resolution = "substituted"   // provides a substitute type, or is imported from a substitute package, from the standard library or a required module
+	ResolvedStdlib      Resolution = "stdlib"        // the standard library
+	ResolvedUnknown     Resolution = "unresolved"    // none of the above, which the generated code won't build with
+)
+
+// ReferencedPackage is a package that is generated or imported by generated
+// code, and how it's resolved
+type ReferencedPackage struct {
+	Path       string
+	ImportPath string // path generated code imports it from, if different
+	Resolution Resolution
+	Module     string // module@version required for it, if kept external or substituted
+}
+
+// writeGenerated writes a generated Go file, minified if configured, counting
+// its lines
+func (r *RecursiveRewriter) writeGenerated(path string, content []byte) error {
+	if r.config.Minify {
+		minified, err := minifySource(content)
+		if err != nil {
+			return fmt.Errorf("failed to minify %s: %w", path, err)
+		}
+		content = minified
+	}
+	if err := r.writeOutputFile(path, content); err != nil {
+		return err
+	}
+	r.generatedLines += bytes.Count(content, []byte("\n"))
+	return nil
+}
+
+// summarize measures the generated output and the upstream dependency
+// closure of the root packages
+func (r *RecursiveRewriter) summarize() (*Summary, error) {
+	summary := &Summary{Lines: r.generatedLines, StrippedDirectives: r.extractedDirectives()}
+
+	modules := make(map[string]bool)
+	requires := make(map[string]bool)
+	var roots []string
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() {
+			continue
+		}
+		summary.Packages++
+		summary.Decls += len(pkgInfo.Decls)
+		modules[pkgInfo.ModulePath] = true
+		for importPath := range pkgInfo.Imports {
+			if mod := r.external[importPath]; mod != nil {
+				requires[mod.Path] = true
+			}
+		}
+
+		// Roots are packages copied verbatim and those of the declarations
+		// nothing else led to
+		isRoot := pkgInfo.Verbatim
+		for name := range pkgInfo.Decls {
+			if _, hasParent := r.parents[TypeRef{PackagePath: pkgPath, TypeName: name}.String()]; !hasParent {
+				isRoot = true
+			}
+		}
+		if isRoot {
+			roots = append(roots, pkgPath)
+		}
+	}
+	switch {
+	case r.config.Publish != nil, r.config.Layout == LayoutUmbrella:
+		summary.Modules = 1
+	case r.config.ImportPrefix == "":
+		summary.Modules = len(modules)
+	}
+	summary.Requires = len(requires)
+
+	if len(roots) == 0 {
+		return summary, nil
+	}
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:        r.config.Dir,
+		BuildFlags: r.buildFlags,
+		Env:        r.goEnviron(),
+	}, roots...)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamModules := make(map[string]bool)
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		if r.isStdlib(pkg.PkgPath) {
+			return
+		}
+		summary.UpstreamPackages++
+		if pkg.Module != nil {
+			upstreamModules[pkg.Module.Path] = true
+		}
+		for _, filename := range pkg.GoFiles {
+			if content, err := os.ReadFile(filename); err == nil {
+				summary.UpstreamLines += bytes.Count(content, []byte("\n"))
+			}
+		}
+	})
+	summary.UpstreamModules = len(upstreamModules)
+	return summary, nil
+}
+
+// referencedPackages classifies the generated packages and every package
+// they import by how generated code resolves them, sorted by path
+func (r *RecursiveRewriter) referencedPackages() []ReferencedPackage {
+	substituted := make(map[string]bool)
+	for _, replacement := range r.substitutes {
+		substituted[replacement.PackagePath] = true
+	}
+	for pkgPath := range r.shimmed {
+		if _, ok := r.packageSubstitute(pkgPath); ok {
+			substituted[pkgPath] = true
+		}
+	}
+
+	paths := make(map[string]bool)
+	for pkgPath, pkgInfo := range r.packages {
+		if !pkgInfo.hasOutput() {
+			continue
+		}
+		paths[pkgPath] = true
+		for importPath := range pkgInfo.Imports {
+			paths[importPath] = true
+		}
+		if pkgInfo.Verbatim {
+			// Copied files keep the imports of their source
+			for importPath := range pkgInfo.Pkg.Imports {
+				paths[importPath] = true
+			}
+		}
+	}
+
+	var referenced []ReferencedPackage
+	for pkgPath := range paths {
+		ref := ReferencedPackage{Path: pkgPath, Resolution: ResolvedUnknown}
+		mod := r.external[pkgPath]
+		switch pkgInfo := r.packages[pkgPath]; {
+		case pkgInfo != nil && pkgInfo.hasOutput():
+			ref.Resolution = ResolvedExtracted
+		case substituted[pkgPath]:
+			ref.Resolution = ResolvedSubstituted
+		case r.isStdlib(pkgPath) || pkgPath == "C":
+			ref.Resolution = ResolvedStdlib
+		case mod != nil:
+			ref.Resolution = ResolvedExternal
+		}
+		if importPath := r.importPath(pkgPath); importPath != pkgPath {
+			ref.ImportPath = importPath
+		}
+		if mod != nil && ref.Resolution != ResolvedExtracted {
+			ref.Module = mod.Path + "@" + mod.Version
+		}
+		referenced = append(referenced, ref)
+	}
+	sort.Slice(referenced, func(i, j int) bool { return referenced[i].Path < referenced[j].Path })
+	return referenced
+}
+
+// logReferencedPackages reports how generated code resolves each package it
+// references, grouped by resolution
+func (r *RecursiveRewriter) logReferencedPackages() {
+	byResolution := make(map[Resolution][]string)
+	for _, ref := range r.referencedPackages() {
+		entry := ref.Path
+		if ref.ImportPath != "" {
+			entry += " as " + ref.ImportPath
+		}
+		if ref.Module != "" {
+			entry += " (" + ref.Module + ")"
+		}
+		byResolution[ref.Resolution] = append(byResolution[ref.Resolution], entry)
+	}
+	for _, resolution := range []Resolution{ResolvedExtracted, ResolvedExternal, ResolvedSubstituted, ResolvedStdlib} {
+		if pkgs := byResolution[resolution]; len(pkgs) > 0 {
+			slog.Info("Referenced packages", "resolution", resolution, "packages", pkgs)
+		}
+	}
+	if pkgs := byResolution[ResolvedUnknown]; len(pkgs) > 0 {
+		slog.Warn("Referenced packages that generated code can't resolve", "packages", pkgs)
+	}
+}
+
+// logSummary reports how much smaller the generated code is than the
+// upstream dependency
+func (r *RecursiveRewriter) logSummary() {
+	summary, err := r.summarize()
+	if err != nil {
+		slog.Warn("Failed to measure the upstream dependency", "error", err)
+		return
+	}
+
+	slog.Info("Generated code",
+		"decls", summary.Decls,
+		"packages", summary.Packages,
+		"modules", summary.Modules,
+		"lines", summary.Lines,
+		"requires", summary.Requires)
+	slog.Info("Upstream dependency avoided",
+		"packages", summary.UpstreamPackages,
+		"modules", summary.UpstreamModules,
+		"lines", summary.UpstreamLines)
+	for _, stripped := range summary.StrippedDirectives {
+		slog.Info("Stripped compiler directive", "declaration", stripped.Decl, "directive", stripped.Directive)
+	}
+}
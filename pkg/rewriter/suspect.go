@@ -0,0 +1,129 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"log/slog"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// SuspectFieldPolicy controls what happens to struct fields whose types hold
+// pointers, reflection state, or locks, which rarely belong in a wire type
+type SuspectFieldPolicy string
+
+const (
+	// SuspectFieldsKeep copies the field as is and logs a warning (the default)
+	SuspectFieldsKeep SuspectFieldPolicy = "keep"
+	// SuspectFieldsReplace gives the field the SuspectFieldReplacement type
+	SuspectFieldsReplace SuspectFieldPolicy = "replace"
+	// SuspectFieldsFail stops extraction of the type with an error
+	SuspectFieldsFail SuspectFieldPolicy = "fail"
+)
+
+// defaultSuspectFieldReplacement is the type suspect fields are replaced
+// with unless configured otherwise: it's zero-sized and has no dependencies
+const defaultSuspectFieldReplacement = "struct{}"
+
+// suspectFieldTypes are the types flagged by the SuspectFieldPolicy
+var suspectFieldTypes = map[string]bool{
+	"unsafe.Pointer": true,
+	"reflect.Value":  true,
+	"reflect.Type":   true,
+	"sync.Mutex":     true,
+	"sync.RWMutex":   true,
+	"sync.Once":      true,
+	"sync.WaitGroup": true,
+}
+
+// checkSuspectFields applies the SuspectFieldPolicy to the fields of a struct
+// type, including those of nested struct types, before it's walked for
+// dependencies. Fields are named by their path from the type (e.g.,
+// Cache.state.mu).
+func (r *RecursiveRewriter) checkSuspectFields(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) error {
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok || pkgInfo.Pkg.TypesInfo == nil {
+		return nil
+	}
+	return r.checkSuspectStruct(pkgInfo, typeRef, st, typeRef.String())
+}
+
+func (r *RecursiveRewriter) checkSuspectStruct(pkgInfo *PackageInfo, typeRef TypeRef, st *ast.StructType, path string) error {
+	for _, field := range st.Fields.List {
+		name := embeddedFieldName(field.Type)
+		if len(field.Names) > 0 {
+			name = field.Names[0].Name
+		}
+		fieldPath := path + "." + name
+
+		var err error
+		replaced := false
+		from := types.ExprString(field.Type)
+		field.Type = astutil.Apply(field.Type, func(c *astutil.Cursor) bool {
+			if err != nil {
+				return false
+			}
+			switch n := c.Node().(type) {
+			case *ast.StructType:
+				err = r.checkSuspectStruct(pkgInfo, typeRef, n, fieldPath)
+				return false
+			case *ast.SelectorExpr:
+				suspect := suspectFieldType(pkgInfo.Pkg.TypesInfo, n)
+				if suspect == "" {
+					return false
+				}
+				switch r.config.SuspectFields {
+				case SuspectFieldsFail:
+					err = fmt.Errorf("field %s has type %s (set suspectFields to keep or replace it)", fieldPath, suspect)
+				case SuspectFieldsReplace:
+					replacement, parseErr := parser.ParseExpr(r.suspectFieldReplacement())
+					if parseErr != nil {
+						err = fmt.Errorf("invalid suspect field replacement: %w", parseErr)
+						return false
+					}
+					c.Replace(replacement)
+					replaced = true
+					if len(field.Names) == 0 {
+						// Only named types can be embedded
+						field.Names = []*ast.Ident{ast.NewIdent("_")}
+					}
+					slog.Warn("Replaced suspect field type", "field", fieldPath, "type", suspect, "replacement", r.suspectFieldReplacement())
+				default:
+					slog.Warn("Copying field with a suspect type", "field", fieldPath, "type", suspect)
+				}
+				return false
+			}
+			return true
+		}, nil).(ast.Expr)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			r.recordFieldChange(typeRef, fieldPath, fieldRetyped, from, types.ExprString(field.Type), "suspect field type replaced")
+		}
+	}
+	return nil
+}
+
+// suspectFieldType returns the qualified name of the suspect type sel refers
+// to, or "" if it isn't one
+func suspectFieldType(info *types.Info, sel *ast.SelectorExpr) string {
+	obj, ok := info.Uses[sel.Sel].(*types.TypeName)
+	if !ok || obj.Pkg() == nil {
+		return ""
+	}
+	name := obj.Pkg().Path() + "." + obj.Name()
+	if !suspectFieldTypes[name] {
+		return ""
+	}
+	return name
+}
+
+func (r *RecursiveRewriter) suspectFieldReplacement() string {
+	if r.config.SuspectFieldReplacement != "" {
+		return r.config.SuspectFieldReplacement
+	}
+	return defaultSuspectFieldReplacement
+}
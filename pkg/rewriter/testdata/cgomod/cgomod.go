@@ -0,0 +1,8 @@
+package cgomod
+
+// #include <stdlib.h>
+import "C"
+
+type Handle struct {
+	ID int
+}
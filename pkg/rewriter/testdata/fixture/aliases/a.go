@@ -0,0 +1,7 @@
+package aliases
+
+import meta "example.com/fixture/k8s/meta"
+
+type A struct {
+	Object meta.ObjectMeta
+}
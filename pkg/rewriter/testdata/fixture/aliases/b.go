@@ -0,0 +1,7 @@
+package aliases
+
+import m "example.com/fixture/k8s/meta"
+
+type B struct {
+	m.TypeMeta
+}
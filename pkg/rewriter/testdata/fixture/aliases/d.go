@@ -0,0 +1,8 @@
+package aliases
+
+import other "example.com/fixture/chain/c"
+
+// D imports chain/c under the name of another imported package
+type D struct {
+	Record other.C
+}
@@ -0,0 +1,12 @@
+package aliases
+
+import "example.com/fixture/other"
+
+type E struct {
+	Request other.Request
+}
+
+func Describe(e E) string {
+	m := e.Request.Name
+	return m
+}
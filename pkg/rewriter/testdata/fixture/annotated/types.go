@@ -0,0 +1,33 @@
+package annotated
+
+import (
+	"example.com/fixture/annotated/vault"
+	"example.com/fixture/other"
+)
+
+// Stamp is used as time.Time by generated code
+// +rewriter:substitute=time.Time
+type Stamp struct {
+	Seconds int64
+}
+
+// Internal is never extracted, nor are the fields using it
+// +rewriter:skip
+type Internal struct {
+	Handle uintptr
+}
+
+type Job struct {
+	Name    string
+	Started Stamp
+	Owner   *Internal
+	Token   *vault.Token
+	// Request is only used by the controller
+	// +rewriter:skip
+	Request  other.Request
+	Response other.Response // +rewriter:skip
+	Retry    struct {
+		Limit int
+		State map[string]Internal
+	}
+}
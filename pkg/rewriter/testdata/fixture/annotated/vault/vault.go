@@ -0,0 +1,7 @@
+package vault
+
+// Token is only ever referenced by fields that aren't extracted
+// +rewriter:skip
+type Token struct {
+	Value string
+}
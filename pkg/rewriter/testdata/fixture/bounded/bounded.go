@@ -0,0 +1,21 @@
+package bounded
+
+import "example.com/tiny"
+
+// Range holds the bounds of an interval
+type Range[T tiny.Ordered] struct {
+	Min T
+	Max T
+}
+
+// Clamp limits v to the range
+func Clamp[T tiny.Ordered](v T, r Range[T]) T {
+	return min(max(v, r.Min), r.Max)
+}
+
+// Mid returns the midpoint of a and b
+func Mid(a, b int) int {
+	type pair[T tiny.Ordered] struct{ a, b T }
+	p := pair[int]{a, b}
+	return (p.a + p.b) / 2
+}
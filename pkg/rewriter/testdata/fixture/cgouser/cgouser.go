@@ -0,0 +1,7 @@
+package cgouser
+
+import "example.com/cgomod"
+
+type Wrapper struct {
+	Handle cgomod.Handle
+}
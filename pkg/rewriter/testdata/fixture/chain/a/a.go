@@ -0,0 +1,19 @@
+package a
+
+import (
+	"example.com/fixture/chain/b"
+	"example.com/fixture/chain/c"
+)
+
+type A = b.B
+
+// Severity is defined on c.Level through b's alias
+type Severity b.Level
+
+// Pair reaches C directly and through both aliases
+type Pair struct {
+	First  A
+	Second *b.B
+	Third  []c.C
+	Level  Severity
+}
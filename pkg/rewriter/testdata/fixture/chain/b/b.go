@@ -0,0 +1,7 @@
+package b
+
+import "example.com/fixture/chain/c"
+
+type B = c.C
+
+type Level = c.Level
@@ -0,0 +1,12 @@
+package c
+
+type C struct {
+	Name string
+}
+
+type Level int
+
+const (
+	LevelLow Level = iota
+	LevelHigh
+)
@@ -0,0 +1,11 @@
+package collapser
+
+import "example.com/tiny"
+
+type Pair string
+
+type Holder struct {
+	Tag   tiny.Label
+	Entry tiny.Pair
+	Own   Pair
+}
@@ -0,0 +1,27 @@
+// Package commented has comments that a declaration's syntax tree doesn't
+// keep track of.
+package commented
+
+// Schedule says when a job runs.
+type Schedule struct {
+	// Every is how often the job runs, in seconds
+	Every int `json:"every"`
+
+	// This comment isn't attached to a field, so it's lost when the
+	// declaration is printed from its syntax tree.
+
+	Jitter int `json:"jitter"` // added to Every
+}
+
+// Job is scheduled work.
+type Job struct {
+	Name     string   `json:"name"`
+	Schedule Schedule `json:"schedule"`
+	Trace    bool     `json:"trace"`
+}
+
+// Next returns when a job on the schedule runs after now.
+func Next(s Schedule, now int) int {
+	// Jitter delays every run, including the first
+	return now + s.Every + s.Jitter
+}
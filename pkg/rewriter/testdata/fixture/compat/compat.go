@@ -0,0 +1,18 @@
+package compat
+
+type Bag struct {
+	Items []any
+	Count int
+}
+
+type Box[T any] struct {
+	Value T
+}
+
+func Sum(n int) int {
+	total := 0
+	for i := range n {
+		total += i
+	}
+	return total
+}
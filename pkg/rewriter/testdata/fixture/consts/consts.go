@@ -0,0 +1,45 @@
+package consts
+
+type Level int
+
+type Mode string
+
+// Levels mix typed and untyped specs, restarting the expression midway
+const (
+	_           = iota
+	Debug Level = iota
+	Info
+	Warn
+	MaxLevel = iota + 10
+	Limit
+)
+
+// Sizes repeat an untyped expression implicitly
+const (
+	KB = 1 << (10 * (iota + 1))
+	MB
+	GB
+)
+
+const (
+	ModeA Mode = "a"
+	ModeB
+	ModeCount = iota
+)
+
+func Describe(l Level) string {
+	if l > Warn || int(l) > Limit {
+		return "unknown"
+	}
+	return string(ModeB)
+}
+
+func Size() int {
+	return MB
+}
+
+type Buffer struct{}
+
+func (Buffer) Cap() int {
+	return GB
+}
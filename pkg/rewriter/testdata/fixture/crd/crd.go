@@ -0,0 +1,63 @@
+package crd
+
+// +kubebuilder:validation:Enum=Pending;Running;Failed
+// +kubebuilder:default=Pending
+type Phase string
+
+type Port struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Number int `json:"number"`
+
+	// +kubebuilder:default=TCP
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type Spec struct {
+	// Replicas is the number of copies to run
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:ExclusiveMaximum=true
+	// +kubebuilder:validation:Maximum=10
+	// +kubebuilder:default=1
+	Replicas int32 `json:"replicas"`
+
+	// +kubebuilder:validation:Pattern=`^[a-z][a-z0-9-]*$`
+	// +kubebuilder:validation:MaxLength=8
+	Name string `json:"name,omitempty"`
+
+	// +kubebuilder:validation:Enum=Always;Never
+	// +kubebuilder:default=Always
+	Policy *string `json:"policy,omitempty"`
+
+	// +kubebuilder:validation:MinItems=1
+	// +listType=map
+	// +listMapKey=number
+	Ports []Port          `json:"ports"`
+	Named map[string]Port `json:"named,omitempty"`
+	Phase Phase           `json:"phase,omitempty"`
+
+	// +kubebuilder:default={"app":"web"}
+	// +mapType=granular
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +kubebuilder:default=true
+	Enabled bool `json:"enabled,omitempty"`
+
+	// +listType=set
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// +structType=atomic
+type Status struct {
+	Message string `json:"message,omitempty"`
+}
+
+// Widget is a resource with a desired and an observed state
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=".spec.replicas"
+// +kubebuilder:validation:XValidation:rule="self.spec.replicas <= 5 || has(self.spec.name)",message="large widgets need a name"
+type Widget struct {
+	Spec Spec `json:"spec"`
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +nullable
+	Status *Status `json:"status,omitempty"`
+}
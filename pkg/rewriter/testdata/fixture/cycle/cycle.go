@@ -0,0 +1,14 @@
+package cycle
+
+import "example.com/fixture/other"
+
+// Node and Edge refer to each other, and Node to itself
+type Node struct {
+	Children []*Node
+	Edges    []Edge
+	Request  other.Request
+}
+
+type Edge struct {
+	From, To *Node
+}
@@ -0,0 +1,11 @@
+package directives
+
+import _ "unsafe"
+
+// Now returns the current time.
+//
+//go:linkname Now
+//go:nosplit
+func Now() int64 {
+	return 0
+}
@@ -0,0 +1,32 @@
+package errs
+
+import "errors"
+
+var ErrNotFound = errors.New("not found")
+
+// LookupError wraps the cause of a failed lookup
+type LookupError struct {
+	Key string
+	Err error
+}
+
+func (e *LookupError) Error() string {
+	return "lookup " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LookupError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func (e *LookupError) Retryable() bool {
+	return false
+}
+
+type Result struct {
+	Value string
+	Err   *LookupError
+}
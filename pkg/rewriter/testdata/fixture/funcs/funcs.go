@@ -0,0 +1,53 @@
+package funcs
+
+import (
+	"errors"
+	"strings"
+
+	"example.com/fixture/other"
+)
+
+const Prefix = "app-"
+
+const (
+	Low Level = iota
+	High
+)
+
+var defaultName = "default"
+
+// ErrNoName is returned by Config.Validate
+var ErrNoName = errors.New("name is required")
+
+type Level int
+
+type (
+	Config struct {
+		Name  string
+		Level Level
+	}
+
+	Unused struct {
+		Request other.Request
+	}
+)
+
+func ParseName(s string) Config {
+	return Config{Name: normalize(s), Level: High}
+}
+
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return ErrNoName
+	}
+	return nil
+}
+
+func normalize(s string) string {
+	if s == "" {
+		return defaultName
+	}
+	return Prefix + strings.ToLower(s) + other.Suffix()
+}
+
+func Unrelated() {}
@@ -0,0 +1,17 @@
+module example.com/fixture
+
+go 1.22
+
+toolchain go1.22.5
+
+require (
+	example.com/cgomod v0.0.0
+	example.com/shimmed v0.0.0
+	example.com/tiny v0.0.0
+)
+
+replace (
+	example.com/cgomod => ../cgomod
+	example.com/shimmed => ../shimmed
+	example.com/tiny => ../tiny
+)
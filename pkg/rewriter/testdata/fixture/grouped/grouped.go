@@ -0,0 +1,16 @@
+package grouped
+
+import (
+	"example.com/fixture/chain/c"
+	"example.com/fixture/other"
+	"example.com/shimmed/api"
+	"time"
+)
+
+type Mixed struct {
+	Record  c.C
+	Request other.Request
+	Spec    api.Spec
+	At      time.Time
+	Every   time.Duration
+}
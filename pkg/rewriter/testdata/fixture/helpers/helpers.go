@@ -0,0 +1,14 @@
+package helpers
+
+import "time"
+
+// Pair is small enough to be inlined
+type Pair struct {
+	Key   string        `json:"key"`
+	Value time.Duration `json:"value"`
+}
+
+// Wide refers to another type of its package
+type Wide struct {
+	Pairs []Pair
+}
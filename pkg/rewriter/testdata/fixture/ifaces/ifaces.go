@@ -0,0 +1,37 @@
+package ifaces
+
+import (
+	"context"
+
+	"example.com/fixture/other"
+)
+
+type Holder struct {
+	Handler Handler
+	Items   List[Item]
+}
+
+type Handler interface {
+	other.Closer
+	Handle(ctx context.Context, req *other.Request) (Result, error)
+}
+
+type Result struct {
+	Response other.Response
+}
+
+type Item struct{}
+
+type Number interface {
+	~string | Unit
+}
+
+type Unit int
+
+type List[T any] struct {
+	Values []T
+}
+
+type Sum[N Number] struct {
+	Total N
+}
@@ -0,0 +1,15 @@
+package inliner
+
+import "example.com/fixture/helpers"
+
+type Pair string
+
+type Config struct {
+	Limit  helpers.Pair
+	Extra  []*helpers.Pair
+	Tagged Pair
+}
+
+type Broad struct {
+	Wide helpers.Wide
+}
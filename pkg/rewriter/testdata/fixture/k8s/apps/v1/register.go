@@ -0,0 +1,10 @@
+package v1
+
+import "example.com/fixture/k8s/schema"
+
+const GroupName = "apps.example.com"
+
+// DeploymentKind is used by code that's copied along with Deployment
+const DeploymentKind = "Deployment"
+
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
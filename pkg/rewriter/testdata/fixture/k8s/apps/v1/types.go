@@ -0,0 +1,25 @@
+package v1
+
+import "example.com/fixture/k8s/meta"
+
+type Deployment struct {
+	meta.TypeMeta   `json:",inline"`
+	meta.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DeploymentSpec `json:"spec"`
+}
+
+func (d *Deployment) Describe() string {
+	return DeploymentKind + "/" + d.Name
+}
+
+type DeploymentList struct {
+	meta.TypeMeta `json:",inline"`
+	meta.ListMeta `json:"metadata,omitempty"`
+
+	Items []Deployment `json:"items"`
+}
+
+type DeploymentSpec struct {
+	Replicas int32 `json:"replicas"`
+}
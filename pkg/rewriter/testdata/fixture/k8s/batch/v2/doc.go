@@ -0,0 +1,2 @@
+// +groupName=batch.example.com
+package v2
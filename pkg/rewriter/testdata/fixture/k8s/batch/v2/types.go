@@ -0,0 +1,8 @@
+package v2
+
+import "example.com/fixture/k8s/meta"
+
+type Job struct {
+	meta.TypeMeta   `json:",inline"`
+	meta.ObjectMeta `json:"metadata,omitempty"`
+}
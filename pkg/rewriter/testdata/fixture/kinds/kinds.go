@@ -0,0 +1,11 @@
+package kinds
+
+// Kind is the underlying type of phases.Phase
+type Kind string
+
+const (
+	KindPending Kind = "Pending"
+	KindDone    Kind = "Done"
+)
+
+const MaxKinds = 2
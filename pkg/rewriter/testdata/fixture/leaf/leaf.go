@@ -0,0 +1,16 @@
+package leaf
+
+import "example.com/fixture/other"
+
+type Phase string
+
+const PhaseRunning Phase = "Running"
+
+func (p Phase) Done() bool {
+	return p != PhaseRunning
+}
+
+type Operation struct {
+	Phase   Phase
+	Request other.Request
+}
@@ -0,0 +1,3 @@
+package leaf
+
+const newline = "\n"
@@ -0,0 +1,8 @@
+package leaf
+
+import "example.com/fixture/other"
+
+const newline = "\r\n"
+
+// lastResponse is only kept on Windows
+var lastResponse other.Response
@@ -0,0 +1,6 @@
+package leaf
+
+func (o *Operation) DeepCopy() *Operation {
+	out := *o
+	return &out
+}
@@ -0,0 +1,22 @@
+package leaky
+
+type Public struct {
+	Name   string
+	count  int
+	Detail *detail
+	Items  map[string][]item
+	Shared Shared
+}
+
+type Shared struct {
+	ID     string
+	secret string
+}
+
+type List []item
+
+type detail struct {
+	Note string
+}
+
+type item struct{}
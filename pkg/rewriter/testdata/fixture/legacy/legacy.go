@@ -0,0 +1,25 @@
+package legacy
+
+import "example.com/fixture/other"
+
+type Options struct {
+	Name string
+
+	// Timeout is how long to wait.
+	//
+	// Deprecated: use Deadline instead.
+	Timeout  int
+	Deadline int64
+
+	// Deprecated: requests are no longer recorded.
+	other.Request
+
+	Retry struct {
+		Attempts int
+		Backoff  int // Deprecated: backoff is computed.
+	}
+
+	// Notes mentions that nothing here is Deprecated: only whole paragraphs
+	// starting with it count.
+	Notes string
+}
@@ -0,0 +1,47 @@
+package marshal
+
+import (
+	"strconv"
+	"time"
+)
+
+// Level marshals as its name rather than its number
+type Level int
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(l.String())), nil
+}
+
+func (l Level) String() string {
+	if l > 0 {
+		return "debug"
+	}
+	return "info"
+}
+
+// Label is substituted with a struct type in tests
+type Label string
+
+type Settings struct {
+	Level  Level             `json:"level"`
+	Levels map[string]*Level `json:"levels,omitempty"`
+	Label  Label             `json:"label,omitempty"`
+	Extra  struct {
+		Fallback Level `json:"fallback"`
+	} `json:"extra"`
+	Name string `json:"name"`
+}
+
+// Time marshals at second precision, standing in for metav1.Time
+type Time struct {
+	time.Time
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(t.UTC().Format(time.RFC3339))), nil
+}
+
+type Event struct {
+	At      Time  `json:"at"`
+	Expires *Time `json:"expires,omitempty"`
+}
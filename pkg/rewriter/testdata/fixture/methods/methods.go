@@ -0,0 +1,33 @@
+package methods
+
+import "example.com/fixture/other"
+
+type Store struct {
+	items []other.Request
+}
+
+func (s *Store) Add(req other.Request) {
+	s.items = append(s.items, req)
+	s.touch()
+}
+
+func (s *Store) touch() {}
+
+func (s *Store) Count() int {
+	return len(s.items)
+}
+
+func (s *Store) Fast() int {
+	return fastCount(s)
+}
+
+func (s *Store) Total() int {
+	return s.Fast() + s.Count()
+}
+
+// fastCount is implemented in assembly
+func fastCount(s *Store) int
+
+func Describe(s *Store) int {
+	return s.Count()
+}
@@ -0,0 +1,21 @@
+package other
+
+type Request struct {
+	Name string
+}
+
+type Response struct {
+	Code int
+}
+
+type Closer interface {
+	Close() error
+}
+
+type Unused struct{}
+
+var suffix = "-x"
+
+func Suffix() string {
+	return suffix
+}
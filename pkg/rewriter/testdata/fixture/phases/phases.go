@@ -0,0 +1,9 @@
+package phases
+
+import "example.com/fixture/kinds"
+
+type Phase kinds.Kind
+
+type Status struct {
+	Phase Phase
+}
@@ -0,0 +1,12 @@
+package pkgsubst
+
+import "example.com/fixture/slimtime"
+
+type Schedule struct {
+	Every slimtime.Duration
+	In    []slimtime.Month
+}
+
+type Zoned struct {
+	Zone slimtime.Zone
+}
@@ -0,0 +1,8 @@
+package shimuser
+
+import "example.com/shimmed/api"
+
+type Deployment struct {
+	Name string
+	Spec api.Spec
+}
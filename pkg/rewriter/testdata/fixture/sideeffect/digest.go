@@ -0,0 +1,12 @@
+package sideeffect
+
+import (
+	_ "crypto/sha256" // registers SHA-256 with crypto
+	_ "example.com/fixture/sideeffect/register"
+)
+
+// Digest is a checksum computed with a registered hash
+type Digest struct {
+	Algorithm string `json:"algorithm"`
+	Sum       []byte `json:"sum"`
+}
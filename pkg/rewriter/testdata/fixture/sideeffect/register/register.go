@@ -0,0 +1,9 @@
+// Package register registers the fixture's codecs at init time
+package register
+
+// Codecs lists the registered codecs
+var Codecs []string
+
+func init() {
+	Codecs = append(Codecs, "digest")
+}
@@ -0,0 +1,10 @@
+// Package slimtime mirrors a few types of package time
+package slimtime
+
+type Duration int64
+
+type Month int
+
+type Zone struct {
+	Name string
+}
@@ -0,0 +1,16 @@
+package suspect
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+type Cache struct {
+	sync.Mutex
+	Name  string
+	state struct {
+		ptr unsafe.Pointer
+	}
+	Handlers map[string]*reflect.Value
+}
@@ -0,0 +1,26 @@
+package typeopts
+
+import "example.com/fixture/other"
+
+// Stamp is substituted with time.Time
+type Stamp struct {
+	Seconds int64
+}
+
+// Event is renamed to Record
+type Event struct {
+	Name         string
+	At           Stamp
+	Request      other.Request
+	Response     other.Response
+	Debug, Trace bool
+}
+
+func (e Event) Label() string {
+	return e.Name
+}
+
+type Sink struct {
+	Events []Event
+	Last   *Stamp
+}
@@ -0,0 +1,16 @@
+package wire
+
+import "context"
+
+type Job struct {
+	Name   string
+	Done   chan struct{}
+	OnDone func(error)
+	ctx    context.Context
+	Hooks  []func()
+	Meta   struct {
+		Cancel func()
+		Key    string
+	}
+	Runner interface{ Run() error }
+}
@@ -0,0 +1,12 @@
+module example.com/legacy
+
+go 1.16
+
+require (
+	github.com/pkg/errors v0.9.1
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
+)
+
+retract v1.0.0 // published by mistake
+
+replace github.com/pkg/errors => ../errors
\ No newline at end of file
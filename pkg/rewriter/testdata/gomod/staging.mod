@@ -0,0 +1,33 @@
+// This is a generated file. Do not edit directly.
+// Run hack/pin-dependency.sh to change pinned dependency versions.
+// Run hack/update-vendor.sh to update go.mod files and the vendor directory.
+
+module k8s.io/kubernetes
+
+go 1.24.0
+
+godebug default=go1.24
+
+require (
+	github.com/spf13/cobra v1.9.1
+	go.etcd.io/etcd/client/v3 v3.5.21 // pinned for the 1.33 release
+	k8s.io/api v0.0.0
+	k8s.io/apimachinery v0.0.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/docker/docker v26.1.4+incompatible // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+exclude github.com/docker/docker v26.0.0+incompatible
+
+replace (
+	k8s.io/api => ./staging/src/k8s.io/api
+	// apimachinery is developed in staging
+	k8s.io/apimachinery => ./staging/src/k8s.io/apimachinery
+	k8s.io/klog/v2 v2.130.0 => k8s.io/klog/v2 v2.130.1
+)
+
+tool golang.org/x/tools/cmd/stringer
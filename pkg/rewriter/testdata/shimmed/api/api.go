@@ -0,0 +1,5 @@
+package api
+
+type Spec struct {
+	Replicas int
+}
@@ -0,0 +1,3 @@
+module example.com/shimmed
+
+go 1.21
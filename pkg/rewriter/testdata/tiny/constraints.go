@@ -0,0 +1,6 @@
+package tiny
+
+// Ordered is satisfied by the types whose values can be compared with <
+type Ordered interface {
+	~int | ~int64 | ~float64 | ~string
+}
@@ -0,0 +1,8 @@
+package tiny
+
+type Label string
+
+type Pair struct {
+	Key   Label
+	Value string
+}
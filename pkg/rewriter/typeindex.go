@@ -0,0 +1,105 @@
+package rewriter
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// typeIndexFile is written to the output directory by the index emitter
+const typeIndexFile = "type-index.json"
+
+// IndexEntry locates an extracted type in the generated code
+type IndexEntry struct {
+	Source     string `json:"source"`     // upstream type (import/path.Name)
+	ImportPath string `json:"importPath"` // package consumers import it from
+	Name       string `json:"name"`       // name in generated code, after renames
+	File       string `json:"file"`       // declaring file, relative to the output directory
+}
+
+// IndexEmitter writes type-index.json, mapping each extracted type to where
+// it's generated, for code generators and editors that look up the
+// generated counterpart of an upstream type. A type inlined into several
+// packages has an entry for each copy.
+type IndexEmitter struct{}
+
+// Name returns "index"
+func (IndexEmitter) Name() string { return "index" }
+
+// Emit writes type-index.json
+func (IndexEmitter) Emit(out *Output) error {
+	entries := []IndexEntry{}
+	for _, pkgInfo := range out.Packages {
+		entries = append(entries, out.r.indexEntries(pkgInfo)...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		return entries[i].ImportPath < entries[j].ImportPath
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(typeIndexFile, append(data, '\n'))
+}
+
+// indexEntries returns the index entries of the types a package declares:
+// those copied to types.go, including the ones collapsed or inlined into
+// it, or those of the files copied verbatim
+func (r *RecursiveRewriter) indexEntries(pkgInfo *PackageInfo) []IndexEntry {
+	importPath := r.importPath(pkgInfo.Pkg.PkgPath)
+	dir := filepath.ToSlash(pkgInfo.OutputSubdir)
+
+	var entries []IndexEntry
+	if pkgInfo.Verbatim {
+		if pkgInfo.Pkg.Types == nil {
+			return nil
+		}
+		scope := pkgInfo.Pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			filename := r.fset.Position(obj.Pos()).Filename
+			if filename == "" || r.isExcludedFile(pkgInfo, filename) {
+				continue
+			}
+			entries = append(entries, IndexEntry{
+				Source:     TypeRef{PackagePath: pkgInfo.Pkg.PkgPath, TypeName: name}.String(),
+				ImportPath: importPath,
+				Name:       name,
+				File:       path.Join(dir, filepath.Base(filename)),
+			})
+		}
+		return entries
+	}
+
+	inlined := make(map[string]string) // source type of each inlined copy, by its name here
+	for source, name := range pkgInfo.Inlined {
+		inlined[name] = source
+	}
+	for _, name := range sortedDeclNames(pkgInfo) {
+		declInfo := pkgInfo.Decls[name]
+		if genDecl, ok := declInfo.Decl.(*ast.GenDecl); !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		entry := IndexEntry{
+			Source:     TypeRef{PackagePath: declInfo.PackagePath, TypeName: declInfo.Name}.String(),
+			ImportPath: importPath,
+			Name:       r.renamedType(declInfo.PackagePath, declInfo.Name),
+			File:       path.Join(dir, "types.go"),
+		}
+		if source, ok := inlined[name]; ok {
+			entry.Source, entry.Name = source, name
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,430 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// TypeOptions adjust how a single type is extracted
+type TypeOptions struct {
+	Prune       []string // struct fields left out of the type, along with their dependencies
+	Fields      []string // struct fields the type is reduced to, by Go or JSON name; "spec.project" selects within a field's type
+	DropStatus  bool     // leave out the Status field, along with its dependencies, as for a CRD only built and submitted
+	Substitute  string   // existing type ("import/path.Name") used wherever the type is referenced, instead of extracting it
+	CopyMethods *bool    // overrides Config.CopyMethods for this type
+	Rename      string   // name of the type in generated code
+	Wrap        bool     // replace the type with a small wrapper reproducing its wire format, holding Substitute if set
+}
+
+// setTypeOptions records the options for a type. A substituted type's
+// replacement is loaded up front so its package can be imported by the
+// generated code.
+func (r *RecursiveRewriter) setTypeOptions(typeRef TypeRef, opts TypeOptions) error {
+	r.typeOptions[typeRef.String()] = opts
+	if opts.Wrap {
+		// References keep pointing at the type, which the wrapper declares
+		return checkWrapper(typeRef, opts)
+	}
+	if opts.Substitute == "" {
+		return nil
+	}
+
+	i := strings.LastIndex(opts.Substitute, ".")
+	if i <= 0 || strings.LastIndex(opts.Substitute, "/") > i {
+		return fmt.Errorf("invalid substitute %q for %s (use: import/path.TypeName)", opts.Substitute, typeRef)
+	}
+	replacement := TypeRef{PackagePath: opts.Substitute[:i], TypeName: opts.Substitute[i+1:]}
+
+	pkgInfo, err := r.consultPackageInfo(replacement.PackagePath, r.typesMode)
+	if err != nil {
+		return fmt.Errorf("failed to load substitute for %s: %w", typeRef, err)
+	}
+	if _, ok := pkgInfo.Pkg.Types.Scope().Lookup(replacement.TypeName).(*types.TypeName); !ok {
+		return fmt.Errorf("substitute %s for %s is not a type", replacement, typeRef)
+	}
+
+	// The replacement's package is imported as a real dependency
+	if !r.isStdlib(replacement.PackagePath) {
+		mod := pkgInfo.Pkg.Module
+		if mod == nil || (mod.Version == "" && r.config.ImportPrefix == "") {
+			return fmt.Errorf("substitute %s for %s must come from the standard library or a versioned module dependency", replacement, typeRef)
+		}
+		r.external[replacement.PackagePath] = mod
+	}
+
+	r.substitutes[typeRef.String()] = replacement
+	return nil
+}
+
+// packageSubstitute returns the import path that replaces pkgPath, by the
+// longest SubstitutePackages entry matching it, either exactly or as a parent
+// path. Packages beneath an entry are found at the same relative path under
+// its replacement.
+func (r *RecursiveRewriter) packageSubstitute(pkgPath string) (string, bool) {
+	match := ""
+	for source := range r.config.SubstitutePackages {
+		if (pkgPath == source || strings.HasPrefix(pkgPath, source+"/")) && len(source) > len(match) {
+			match = source
+		}
+	}
+	if match == "" {
+		return "", false
+	}
+	return r.config.SubstitutePackages[match] + strings.TrimPrefix(pkgPath, match), true
+}
+
+// substitutePackage stops recursion at a package substituted as a whole:
+// generated code imports the replacement instead, which must declare
+// whatever is referenced from the source package under the same names
+func (r *RecursiveRewriter) substitutePackage(typeRef TypeRef, importPath string) error {
+	pkgInfo, err := r.consultPackageInfo(importPath, r.typesMode)
+	if err != nil {
+		return fmt.Errorf("failed to load substitute package for %s: %w", typeRef.PackagePath, err)
+	}
+	name, methodName, isMethod := strings.Cut(typeRef.TypeName, ".")
+	obj := pkgInfo.Pkg.Types.Scope().Lookup(name)
+	if obj != nil && isMethod {
+		obj, _, _ = types.LookupFieldOrMethod(obj.Type(), true, obj.Pkg(), methodName)
+	}
+	if obj == nil {
+		return fmt.Errorf("substitute package %s doesn't declare %s (reached via %s)", importPath, typeRef.TypeName, r.dependencyPath(typeRef))
+	}
+
+	if !r.isStdlib(importPath) {
+		mod := pkgInfo.Pkg.Module
+		if mod == nil || (mod.Version == "" && r.config.ImportPrefix == "") {
+			return fmt.Errorf("substitute package %s for %s must come from the standard library or a versioned module dependency, or from your module with importPrefix", importPath, typeRef.PackagePath)
+		}
+		r.external[typeRef.PackagePath] = mod
+	}
+	if r.shimmed[typeRef.PackagePath] == "" {
+		slog.Info("Substituting package", "package", typeRef.PackagePath, "substitute", importPath)
+	}
+	r.shimmed[typeRef.PackagePath] = importPath
+	return nil
+}
+
+// copyMethods reports whether the methods of typeRef are copied with it
+func (r *RecursiveRewriter) copyMethods(typeRef TypeRef) bool {
+	if copyMethods := r.typeOptions[typeRef.String()].CopyMethods; copyMethods != nil {
+		return *copyMethods
+	}
+	return r.config.CopyMethods
+}
+
+// substituteTypes replaces references to substituted types within node with
+// their replacements. It runs before node is walked for dependencies, so the
+// substituted types are never queued.
+func (r *RecursiveRewriter) substituteTypes(pkgInfo *PackageInfo, node ast.Node) {
+	info := pkgInfo.Pkg.TypesInfo
+	if len(r.substitutes) == 0 || info == nil {
+		return
+	}
+
+	astutil.Apply(node, func(c *astutil.Cursor) bool {
+		var ident *ast.Ident
+		switch n := c.Node().(type) {
+		case *ast.SelectorExpr:
+			ident = n.Sel
+		case *ast.Ident:
+			ident = n
+		default:
+			return true
+		}
+
+		obj, ok := info.Uses[ident].(*types.TypeName)
+		if !ok || obj.Pkg() == nil {
+			return true
+		}
+		replacement, ok := r.substitutes[TypeRef{PackagePath: obj.Pkg().Path(), TypeName: obj.Name()}.String()]
+		if !ok {
+			return true
+		}
+
+		name := r.packages[replacement.PackagePath].Pkg.Name
+		c.Replace(&ast.SelectorExpr{
+			X:   &ast.Ident{NamePos: ident.Pos(), Name: name},
+			Sel: &ast.Ident{NamePos: ident.Pos(), Name: replacement.TypeName},
+		})
+		r.recordImport(pkgInfo, replacement.PackagePath, name)
+		return false
+	}, nil)
+}
+
+// pruneFields removes the fields configured to be pruned from a struct type,
+// and its Status field with DropStatus, before it's walked for dependencies
+func (r *RecursiveRewriter) pruneFields(typeRef TypeRef, spec *ast.TypeSpec) error {
+	opts := r.typeOptions[typeRef.String()]
+	prune := opts.Prune
+	if opts.DropStatus && !slices.Contains(prune, "Status") {
+		prune = append(slices.Clone(prune), "Status")
+	}
+	if len(prune) == 0 {
+		return nil
+	}
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return fmt.Errorf("can't prune fields of %s: not a struct type", typeRef)
+	}
+
+	pruned := make(map[string]bool)
+	for _, name := range prune {
+		pruned[name] = false
+	}
+
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		if len(field.Names) == 0 {
+			// Embedded fields are named after their type
+			if name := embeddedFieldName(field.Type); name != "" {
+				if _, ok := pruned[name]; ok {
+					pruned[name] = true
+					r.recordFieldChange(typeRef, name, fieldRemoved, types.ExprString(field.Type), "", "pruned")
+					continue
+				}
+			}
+			kept = append(kept, field)
+			continue
+		}
+
+		var names []*ast.Ident
+		for _, ident := range field.Names {
+			if _, ok := pruned[ident.Name]; ok {
+				pruned[ident.Name] = true
+				r.recordFieldChange(typeRef, ident.Name, fieldRemoved, types.ExprString(field.Type), "", "pruned")
+				continue
+			}
+			names = append(names, ident)
+		}
+		if len(names) > 0 {
+			field.Names = names
+			kept = append(kept, field)
+		}
+	}
+
+	for _, name := range prune {
+		if !pruned[name] {
+			if name == "Status" && opts.DropStatus {
+				return fmt.Errorf("can't drop the status of %s: it has no Status field", typeRef)
+			}
+			return fmt.Errorf("can't prune field %s of %s: no such field", name, typeRef)
+		}
+	}
+	st.Fields.List = kept
+	return nil
+}
+
+// selectFields reduces a struct type to the fields its Fields option
+// selects, before it's walked for dependencies, so everything else is left
+// out along with its dependencies. A nested path selects fields of the
+// field's type in turn, wherever that type is used.
+func (r *RecursiveRewriter) selectFields(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) error {
+	opts := r.typeOptions[typeRef.String()]
+	if len(opts.Fields) == 0 {
+		return nil
+	}
+	if len(opts.Prune) > 0 || opts.DropStatus {
+		return fmt.Errorf("can't both prune and select fields of %s", typeRef)
+	}
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return fmt.Errorf("can't select fields of %s: not a struct type", typeRef)
+	}
+
+	// The paths selected within each field; nil keeps the field whole
+	selected := make(map[string][]string)
+	whole := make(map[string]bool)
+	for _, path := range opts.Fields {
+		if !strings.Contains(path, ".") {
+			selected[path], whole[path] = nil, true
+		}
+	}
+	for _, path := range opts.Fields {
+		if name, rest, ok := strings.Cut(path, "."); ok && !whole[name] {
+			selected[name] = append(selected[name], rest)
+		}
+	}
+
+	found := make(map[string]bool)
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		names := field.Names
+		if len(names) == 0 {
+			// Embedded fields are named after their type
+			names = []*ast.Ident{{Name: embeddedFieldName(field.Type)}}
+		}
+		var keptNames []*ast.Ident
+		for _, ident := range names {
+			// A field is selected by its Go name or its JSON name
+			jsonName, _ := jsonField(field, ident.Name)
+			var rest []string
+			keep, partial := false, true
+			for _, key := range []string{ident.Name, jsonName} {
+				if paths, ok := selected[key]; ok && !found[key] {
+					found[key], keep = true, true
+					partial = partial && !whole[key]
+					rest = append(rest, paths...)
+				}
+			}
+			if !keep {
+				r.recordFieldChange(typeRef, ident.Name, fieldRemoved, types.ExprString(field.Type), "", "not selected")
+				continue
+			}
+			if partial {
+				if err := r.selectWithin(pkgInfo, typeRef, ident.Name, field.Type, rest); err != nil {
+					return err
+				}
+			}
+			keptNames = append(keptNames, ident)
+		}
+		if len(keptNames) == 0 {
+			continue
+		}
+		if len(field.Names) > 0 {
+			field.Names = keptNames
+		}
+		kept = append(kept, field)
+	}
+
+	for _, path := range opts.Fields {
+		if name, _, _ := strings.Cut(path, "."); !found[name] {
+			return fmt.Errorf("can't select field %s of %s: no such field", name, typeRef)
+		}
+	}
+	st.Fields.List = kept
+	return nil
+}
+
+// selectWithin selects paths of the struct type of a selected field, through
+// pointers, slices, arrays, and maps, before that type is extracted
+func (r *RecursiveRewriter) selectWithin(pkgInfo *PackageInfo, typeRef TypeRef, fieldName string, expr ast.Expr, paths []string) error {
+	if pkgInfo.Unchecked {
+		// Without types, explore keeps the field whole
+		return nil
+	}
+	t := pkgInfo.Pkg.TypesInfo.TypeOf(expr)
+	for done := false; !done; {
+		switch u := t.(type) {
+		case *types.Pointer:
+			t = u.Elem()
+		case *types.Slice:
+			t = u.Elem()
+		case *types.Array:
+			t = u.Elem()
+		case *types.Map:
+			t = u.Elem()
+		default:
+			done = true
+		}
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return fmt.Errorf("can't select fields within %s.%s: its type isn't a named struct type", typeRef, fieldName)
+	}
+	if _, ok := named.Underlying().(*types.Struct); !ok {
+		return fmt.Errorf("can't select fields within %s.%s: its type isn't a named struct type", typeRef, fieldName)
+	}
+	obj := named.Origin().Obj()
+	ref := TypeRef{PackagePath: obj.Pkg().Path(), TypeName: obj.Name()}
+	if r.isStdlib(ref.PackagePath) || r.isKeptExternal(ref.PackagePath) {
+		return fmt.Errorf("can't select fields within %s.%s: %s isn't extracted", typeRef, fieldName, ref)
+	}
+
+	opts := r.typeOptions[ref.String()]
+	added := false
+	for _, path := range paths {
+		if !slices.Contains(opts.Fields, path) {
+			opts.Fields = append(opts.Fields, path)
+			added = true
+		}
+	}
+	if added && r.processedTypes[ref.String()] {
+		return fmt.Errorf("can't select fields within %s.%s: %s was already extracted with other fields (reached via %s)", typeRef, fieldName, ref, r.dependencyPath(ref))
+	}
+	r.typeOptions[ref.String()] = opts
+	return nil
+}
+
+// embeddedFieldName returns the implicit name of an embedded field
+func embeddedFieldName(expr ast.Expr) string {
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			expr = t.X
+		case *ast.SelectorExpr:
+			return t.Sel.Name
+		case *ast.IndexExpr:
+			expr = t.X
+		case *ast.IndexListExpr:
+			expr = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// renamedType returns the name a type has in generated code
+func (r *RecursiveRewriter) renamedType(pkgPath, name string) string {
+	if rename := r.typeOptions[TypeRef{PackagePath: pkgPath, TypeName: name}.String()].Rename; rename != "" {
+		return rename
+	}
+	return name
+}
+
+// applyRenames gives renamed types their new names, updating their
+// declarations and every reference to them in the generated code
+func (r *RecursiveRewriter) applyRenames() error {
+	renamed := false
+	for key, opts := range r.typeOptions {
+		if opts.Rename == "" {
+			continue
+		}
+		renamed = true
+		if !token.IsIdentifier(opts.Rename) {
+			return fmt.Errorf("invalid rename %q for %s", opts.Rename, key)
+		}
+		pkgPath := key[:strings.LastIndex(key, ".")]
+		if pkgInfo, exists := r.packages[pkgPath]; exists && pkgInfo.Decls[opts.Rename] != nil {
+			return fmt.Errorf("can't rename %s to %s: the package already declares %s", key, opts.Rename, opts.Rename)
+		}
+	}
+	if !renamed {
+		return nil
+	}
+
+	for _, pkgInfo := range r.packages {
+		info := pkgInfo.Pkg.TypesInfo
+		if pkgInfo.Verbatim || info == nil {
+			continue
+		}
+		for _, declInfo := range pkgInfo.Decls {
+			ast.Inspect(declInfo.Decl, func(n ast.Node) bool {
+				ident, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				obj := info.Defs[ident]
+				if obj == nil {
+					obj = info.Uses[ident]
+				}
+				// Only package-level types can be renamed, not type parameters
+				if tn, ok := obj.(*types.TypeName); ok && tn.Pkg() != nil && tn.Parent() == tn.Pkg().Scope() {
+					if name := r.renamedType(tn.Pkg().Path(), tn.Name()); name != tn.Name() {
+						ident.Name = name
+					}
+				}
+				return true
+			})
+		}
+	}
+	return nil
+}
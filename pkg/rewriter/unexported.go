@@ -0,0 +1,99 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"log/slog"
+)
+
+// UnexportedPolicy controls what happens when an exported type exposes
+// package-internal details: unexported fields, or fields referring to
+// unexported types
+type UnexportedPolicy string
+
+const (
+	// UnexportedKeep extracts unexported fields and types like any other (the
+	// default)
+	UnexportedKeep UnexportedPolicy = "keep"
+	// UnexportedPrune leaves such fields out of the type, with a warning,
+	// so the closure only has exported types
+	UnexportedPrune UnexportedPolicy = "prune"
+	// UnexportedFail stops extraction of the type with an error
+	UnexportedFail UnexportedPolicy = "fail"
+)
+
+// checkUnexported applies the UnexportedPolicy to an exported type before it's
+// walked for dependencies. Struct types can have their leaking fields pruned;
+// other types that refer to unexported types can only fail.
+func (r *RecursiveRewriter) checkUnexported(pkgInfo *PackageInfo, typeRef TypeRef, spec *ast.TypeSpec) error {
+	if r.config.Unexported != UnexportedPrune && r.config.Unexported != UnexportedFail {
+		return nil
+	}
+	info := pkgInfo.Pkg.TypesInfo
+	if !spec.Name.IsExported() || info == nil {
+		return nil
+	}
+
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		if unexported := unexportedTypeRef(info, spec.Type); unexported != "" {
+			return fmt.Errorf("%s refers to unexported type %s (unexported: %s)", typeRef, unexported, r.config.Unexported)
+		}
+		return nil
+	}
+
+	var kept []*ast.Field
+	for _, field := range st.Fields.List {
+		name := embeddedFieldName(field.Type)
+		if len(field.Names) > 0 {
+			name = field.Names[0].Name
+		}
+		reason := ""
+		if !token.IsExported(name) {
+			reason = "unexported field"
+		} else if unexported := unexportedTypeRef(info, field.Type); unexported != "" {
+			reason = "refers to unexported type " + unexported
+		}
+		if reason == "" {
+			kept = append(kept, field)
+			continue
+		}
+		fieldPath := typeRef.String() + "." + name
+		if r.config.Unexported == UnexportedFail {
+			return fmt.Errorf("field %s exposes package internals: %s (set unexported to keep or prune it)", fieldPath, reason)
+		}
+		slog.Warn("Pruned field exposing package internals", "field", fieldPath, "reason", reason)
+		names := []string{name}
+		if len(field.Names) > 1 {
+			names = names[:0]
+			for _, ident := range field.Names {
+				names = append(names, ident.Name)
+			}
+		}
+		for _, name := range names {
+			r.recordFieldChange(typeRef, name, fieldRemoved, types.ExprString(field.Type), "", reason)
+		}
+	}
+	st.Fields.List = kept
+	return nil
+}
+
+// unexportedTypeRef returns the name of an unexported package-level type
+// that expr refers to, or "" if it doesn't refer to one
+func unexportedTypeRef(info *types.Info, expr ast.Expr) string {
+	var found string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok || found != "" {
+			return found == ""
+		}
+		obj, ok := info.Uses[ident].(*types.TypeName)
+		if ok && obj.Pkg() != nil && obj.Parent() == obj.Pkg().Scope() && !obj.Exported() {
+			found = obj.Name()
+		}
+		return true
+	})
+	return found
+}
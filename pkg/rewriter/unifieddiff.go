@@ -0,0 +1,115 @@
+package rewriter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffLine is a line of an edit script: kept (' '), removed ('-'), or added
+// ('+'), with the lines of old and new before it
+type diffLine struct {
+	op   byte
+	text string
+	i, j int
+}
+
+// unifiedDiff returns the changes from old to new as a unified diff of the
+// file at path, or "" if there are none. It's quadratic in the number of
+// lines, which is fine for files like go.mod.
+func unifiedDiff(path string, old, new []byte) string {
+	a, b := splitLines(string(old)), splitLines(string(new))
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []diffLine
+	var changes []int
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffLine{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, len(edits))
+			edits = append(edits, diffLine{'-', a[i], i, j})
+			i++
+		default:
+			changes = append(changes, len(edits))
+			edits = append(edits, diffLine{'+', b[j], i, j})
+			j++
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", path, path)
+	for len(changes) > 0 {
+		// A hunk takes in the changes whose context overlaps
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext+1 {
+			last++
+		}
+		start := max(0, changes[0]-diffContext)
+		end := min(len(edits), changes[last]+diffContext+1)
+		changes = changes[last+1:]
+
+		var oldCount, newCount int
+		for _, edit := range edits[start:end] {
+			if edit.op != '+' {
+				oldCount++
+			}
+			if edit.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(edits[start].i, oldCount), hunkRange(edits[start].j, newCount))
+		for _, edit := range edits[start:end] {
+			buf.WriteByte(edit.op)
+			buf.WriteString(edit.text)
+			if !strings.HasSuffix(edit.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+// hunkRange formats the lines a hunk covers, given the number of lines
+// before it: a range without lines starts at the line before it
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines splits s into lines, keeping their newlines
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
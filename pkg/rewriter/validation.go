@@ -0,0 +1,321 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/types"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// validationFile is written next to types.go in packages with validated types
+const validationFile = "validation.go"
+
+// validationGen accumulates the Validate methods of one package
+type validationGen struct {
+	r         *RecursiveRewriter
+	pkgInfo   *PackageInfo
+	validated map[*types.TypeName]bool // types that get a Validate method
+	body      strings.Builder
+	patterns  []string // regular expressions, declared as package variables
+	imports   map[string]bool
+}
+
+// generateValidation writes Validate methods for the package's types that
+// carry +kubebuilder:validation markers, checking enum membership, bounds,
+// lengths, item counts, and patterns the way the API server would. Struct
+// types also validate their fields of validated types, so a root's Validate
+// covers everything below it.
+func (r *RecursiveRewriter) generateValidation(pkgInfo *PackageInfo, outputPath string) error {
+	g := &validationGen{r: r, pkgInfo: pkgInfo, validated: make(map[*types.TypeName]bool), imports: map[string]bool{"fmt": true}}
+	marked := r.markedTypes(pkgInfo)
+
+	// A type is validated if it has constraints of its own or a field of a
+	// validated type, so iterate until no more types are added
+	for changed := true; changed; {
+		changed = false
+		for _, mt := range marked {
+			if g.validated[mt.obj] || pkgInfo.Decls[mt.obj.Name()+".Validate"] != nil {
+				continue
+			}
+			if g.hasConstraints(mt) {
+				g.validated[mt.obj] = true
+				changed = true
+			}
+		}
+	}
+	if len(g.validated) == 0 {
+		return nil
+	}
+
+	for _, mt := range marked {
+		if g.validated[mt.obj] {
+			g.writeType(mt)
+		}
+	}
+
+	var buf bytes.Buffer
+	r.writeMarkerFileHeader(&buf, pkgInfo, g.imports)
+	if len(g.patterns) > 0 {
+		buf.WriteString("\nvar (\n")
+		for i, pattern := range g.patterns {
+			fmt.Fprintf(&buf, "\tvalidationPattern%d = regexp.MustCompile(%s)\n", i, goStringLiteral(pattern))
+		}
+		buf.WriteString(")\n")
+	}
+	buf.WriteString(g.body.String())
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to format validation for %s: %w", pkgInfo.Pkg.PkgPath, err)
+	}
+	outputFile := filepath.Join(outputPath, validationFile)
+	if err := r.writeGenerated(outputFile, formatted); err != nil {
+		return err
+	}
+	slog.Info("Generated", "file", outputFile, "types", len(g.validated))
+	return nil
+}
+
+// hasConstraints reports whether mt needs a Validate method
+func (g *validationGen) hasConstraints(mt *markedType) bool {
+	if len(mt.fields) == 0 {
+		return len(g.scalarChecks(mt.markers, mt.obj.Type(), "in", "")) > 0
+	}
+	for _, f := range mt.fields {
+		if len(g.fieldChecks(f)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *validationGen) writeType(mt *markedType) {
+	fmt.Fprintf(&g.body, "\n// Validate checks %s against its kubebuilder validation markers\n", mt.name)
+	if len(mt.fields) == 0 {
+		fmt.Fprintf(&g.body, "func (in %s) Validate() error {\n", mt.name)
+		for _, check := range g.scalarChecks(mt.markers, mt.obj.Type(), "in", "") {
+			g.body.WriteString(check)
+		}
+	} else {
+		fmt.Fprintf(&g.body, "func (in *%s) Validate() error {\n", mt.name)
+		for _, f := range mt.fields {
+			for _, check := range g.fieldChecks(f) {
+				g.body.WriteString(check)
+			}
+		}
+	}
+	g.body.WriteString("\treturn nil\n}\n")
+}
+
+// fieldChecks returns the statements validating a struct field
+func (g *validationGen) fieldChecks(f markedField) []string {
+	if f.typ == nil {
+		// The field's type was substituted or replaced
+		return nil
+	}
+	expr := "in." + f.goName
+	var checks []string
+
+	// Item counts apply to the collection itself
+	if isCollection(f.typ) {
+		if value, ok := f.markers.Validation["MinItems"]; ok && isInteger(value) {
+			checks = append(checks, fmt.Sprintf("\tif len(%s) < %s {\n\t\treturn fmt.Errorf(\"%s: must have at least %s item(s), got %%d\", len(%s))\n\t}\n", expr, value, f.jsonName, value, expr))
+		}
+		if value, ok := f.markers.Validation["MaxItems"]; ok && isInteger(value) {
+			checks = append(checks, fmt.Sprintf("\tif len(%s) > %s {\n\t\treturn fmt.Errorf(\"%s: must have at most %s item(s), got %%d\", len(%s))\n\t}\n", expr, value, f.jsonName, value, expr))
+		}
+	}
+
+	switch t := types.Unalias(f.typ).(type) {
+	case *types.Pointer:
+		inner := g.scalarChecks(f.markers, t.Elem(), "(*"+expr+")", f.jsonName)
+		inner = append(inner, g.nestedCheck(t.Elem(), expr, f.jsonName)...)
+		if len(inner) > 0 {
+			checks = append(checks, fmt.Sprintf("\tif %s != nil {\n%s\t}\n", expr, indent(strings.Join(inner, ""))))
+		}
+	case *types.Slice:
+		if nested := g.nestedCheck(t.Elem(), expr+"[i]", f.jsonName+"[%d]"); len(nested) > 0 {
+			checks = append(checks, fmt.Sprintf("\tfor i := range %s {\n%s\t}\n", expr, indent(strings.Join(nested, ""))))
+		}
+	case *types.Map:
+		if nested := g.nestedCheck(t.Elem(), "value", f.jsonName+"[%v]"); len(nested) > 0 {
+			checks = append(checks, fmt.Sprintf("\tfor key, value := range %s {\n%s\t}\n", expr, indent(strings.Join(nested, ""))))
+		}
+	default:
+		scalar := g.scalarChecks(f.markers, f.typ, expr, f.jsonName)
+		if basic, ok := f.typ.Underlying().(*types.Basic); ok && f.omitEmpty && len(scalar) > 0 {
+			// An empty value is omitted, so the API server never sees it
+			zero := "0"
+			if basic.Info()&types.IsString != 0 {
+				zero = `""`
+			}
+			scalar = []string{fmt.Sprintf("\tif %s != %s {\n%s\t}\n", expr, zero, indent(strings.Join(scalar, "")))}
+		}
+		checks = append(checks, scalar...)
+		checks = append(checks, g.nestedCheck(f.typ, expr, f.jsonName)...)
+	}
+	return checks
+}
+
+// nestedCheck returns the statement calling the Validate method of a value
+// of a validated type, wrapping its error with the field's path. path may
+// contain a %d or %v verb for the index or key of a collection element.
+func (g *validationGen) nestedCheck(t types.Type, expr, path string) []string {
+	nilCheck := ""
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+		nilCheck = expr
+	}
+	named, ok := types.Unalias(t).(*types.Named)
+	if !ok || !g.validated[named.Obj()] {
+		return nil
+	}
+
+	args := ""
+	switch {
+	case strings.HasSuffix(path, "[%d]"):
+		args = ", i"
+	case strings.HasSuffix(path, "[%v]"):
+		args = ", key"
+	}
+	call := expr
+	if _, isStruct := named.Underlying().(*types.Struct); isStruct && expr == "value" && nilCheck == "" {
+		// Map values aren't addressable, and struct types validate through a
+		// pointer receiver
+		call = "(&value)"
+	}
+	check := fmt.Sprintf("\tif err := %s.Validate(); err != nil {\n\t\treturn fmt.Errorf(\"%s: %%w\"%s, err)\n\t}\n", call, path, args)
+	if nilCheck != "" {
+		check = fmt.Sprintf("\tif %s != nil {\n%s\t}\n", nilCheck, indent(check))
+	}
+	return []string{check}
+}
+
+// scalarChecks returns the statements checking a string or numeric value
+// against the enum, bound, length, and pattern markers
+func (g *validationGen) scalarChecks(m Markers, t types.Type, expr, path string) []string {
+	basic, ok := t.Underlying().(*types.Basic)
+	if !ok || len(m.Validation) == 0 {
+		return nil
+	}
+	isString := basic.Info()&types.IsString != 0
+	isNumeric := basic.Info()&types.IsNumeric != 0
+	isInt := basic.Info()&types.IsInteger != 0
+	prefix := ""
+	if path != "" {
+		prefix = path + ": "
+	}
+	var checks []string
+
+	if value, ok := m.Validation["Enum"]; ok && (isString || isNumeric) {
+		var cases, names []string
+		for _, v := range strings.Split(value, ";") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			names = append(names, markerString(v))
+			if isString {
+				v = strconv.Quote(markerString(v))
+			} else if _, err := strconv.ParseFloat(v, 64); err != nil || (isInt && !isInteger(v)) {
+				names = names[:len(names)-1]
+				continue
+			}
+			cases = append(cases, v)
+		}
+		if len(cases) > 0 {
+			checks = append(checks, fmt.Sprintf("\tswitch %s {\n\tcase %s:\n\tdefault:\n\t\treturn fmt.Errorf(\"%sunsupported value %%v, must be one of %%s\", %s, %s)\n\t}\n",
+				expr, strings.Join(cases, ", "), prefix, expr, strconv.Quote(strings.Join(names, ", "))))
+		}
+	}
+
+	if isNumeric {
+		for _, bound := range []struct{ marker, exclusive, op, desc string }{
+			{"Minimum", "ExclusiveMinimum", "<", "at least"},
+			{"Maximum", "ExclusiveMaximum", ">", "at most"},
+		} {
+			value, ok := m.Validation[bound.marker]
+			if !ok {
+				continue
+			}
+			if _, err := strconv.ParseFloat(value, 64); err != nil || (isInt && !isInteger(value)) {
+				slog.Warn("Ignoring bound that doesn't fit the field's type", "field", path, "marker", bound.marker, "value", value)
+				continue
+			}
+			op, desc := bound.op, bound.desc
+			if m.Validation[bound.exclusive] == "true" {
+				op += "="
+				desc = strings.NewReplacer("at least", "greater than", "at most", "less than").Replace(desc)
+			}
+			checks = append(checks, fmt.Sprintf("\tif %s %s %s {\n\t\treturn fmt.Errorf(\"%smust be %s %s, got %%v\", %s)\n\t}\n", expr, op, value, prefix, desc, value, expr))
+		}
+	}
+
+	if isString {
+		for _, length := range []struct{ marker, op, desc string }{
+			{"MinLength", "<", "at least"},
+			{"MaxLength", ">", "at most"},
+		} {
+			if value, ok := m.Validation[length.marker]; ok && isInteger(value) {
+				g.imports["unicode/utf8"] = true
+				checks = append(checks, fmt.Sprintf("\tif utf8.RuneCountInString(string(%s)) %s %s {\n\t\treturn fmt.Errorf(\"%smust be %s %s characters long\")\n\t}\n", expr, length.op, value, prefix, length.desc, value))
+			}
+		}
+		if value, ok := m.Validation["Pattern"]; ok {
+			pattern := markerString(value)
+			g.imports["regexp"] = true
+			name := g.patternVar(pattern)
+			checks = append(checks, fmt.Sprintf("\tif !%s.MatchString(string(%s)) {\n\t\treturn fmt.Errorf(\"%smust match %%s, got %%q\", %s.String(), %s)\n\t}\n", name, expr, prefix, name, expr))
+		}
+	}
+	return checks
+}
+
+// patternVar returns the name of the package variable holding a compiled
+// pattern, declaring it the first time
+func (g *validationGen) patternVar(pattern string) string {
+	for i, p := range g.patterns {
+		if p == pattern {
+			return fmt.Sprintf("validationPattern%d", i)
+		}
+	}
+	g.patterns = append(g.patterns, pattern)
+	return fmt.Sprintf("validationPattern%d", len(g.patterns)-1)
+}
+
+func isCollection(t types.Type) bool {
+	switch t.Underlying().(type) {
+	case *types.Slice, *types.Map:
+		return true
+	}
+	return false
+}
+
+func isInteger(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// goStringLiteral quotes s as a raw string when possible, which keeps
+// regular expressions readable
+func goStringLiteral(s string) string {
+	if !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// indent indents generated statements by one more tab
+func indent(code string) string {
+	lines := strings.SplitAfter(code, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "\t" + line
+		}
+	}
+	return strings.Join(lines, "")
+}
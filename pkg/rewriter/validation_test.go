@@ -0,0 +1,200 @@
+package rewriter
+
+import (
+	"go/ast"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateValidation(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Validation = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	crdDir := filepath.Join(r.config.OutputDir, "example.com/fixture/crd")
+	validation, err := os.ReadFile(filepath.Join(crdDir, validationFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"func (in Phase) Validate() error", "func (in *Widget) Validate() error", "regexp.MustCompile(`^[a-z][a-z0-9-]*$`)"} {
+		if !strings.Contains(string(validation), want) {
+			t.Errorf("Expected %q in %s:\n%s", want, validationFile, validation)
+		}
+	}
+	if strings.Contains(string(validation), "Status) Validate") {
+		t.Errorf("Expected no Validate method for Status, which has no markers:\n%s", validation)
+	}
+
+	// Exercise the generated methods in the generated module
+	test := `package crd
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	never, sometimes := "Never", "Sometimes"
+	valid := Spec{Replicas: 3, Name: "web", Policy: &never, Ports: []Port{{Number: 80}}, Phase: "Running"}
+	for _, tc := range []struct {
+		mutate func(*Spec)
+		want   string
+	}{
+		{func(*Spec) {}, ""},
+		{func(s *Spec) { s.Replicas = 0 }, "spec: replicas: must be at least 1, got 0"},
+		{func(s *Spec) { s.Replicas = 10 }, "spec: replicas: must be less than 10, got 10"},
+		{func(s *Spec) { s.Name = "Web" }, "spec: name: must match"},
+		{func(s *Spec) { s.Name = "webserver" }, "spec: name: must be at most 8 characters long"},
+		{func(s *Spec) { s.Policy = &sometimes }, "spec: policy: unsupported value Sometimes"},
+		{func(s *Spec) { s.Ports = nil }, "spec: ports: must have at least 1 item(s), got 0"},
+		{func(s *Spec) { s.Ports[0].Number = 70000 }, "spec: ports[0]: number: must be at most 65535, got 70000"},
+		{func(s *Spec) { s.Named = map[string]Port{"http": {}} }, "spec: named[http]: number: must be at least 1, got 0"},
+		{func(s *Spec) { s.Phase = "Done" }, "spec: phase: unsupported value Done"},
+	} {
+		spec := valid
+		spec.Ports = append([]Port(nil), valid.Ports...)
+		tc.mutate(&spec)
+		err := (&Widget{Spec: spec}).Validate()
+		if got := ""; err != nil {
+			got = err.Error()
+			if tc.want == "" || len(got) < len(tc.want) || got[:len(tc.want)] != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		} else if tc.want != "" {
+			t.Errorf("got no error, want %q", tc.want)
+		}
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(crdDir, "validation_test.go"), []byte(test), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", "./crd")
+	cmd.Dir = filepath.Dir(crdDir)
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated validation failed: %v\n%s\n%s", err, output, validation)
+	}
+}
+
+func TestGenerateDefaults(t *testing.T) {
+	r := newFixtureRewriter(t)
+	r.config.Defaults = true
+	extractFixture(t, r, TypeRef{PackagePath: "example.com/fixture/crd", TypeName: "Widget"})
+	if err := r.generateOutput(); err != nil {
+		t.Fatalf("generateOutput failed: %v", err)
+	}
+
+	crdDir := filepath.Join(r.config.OutputDir, "example.com/fixture/crd")
+	defaults, err := os.ReadFile(filepath.Join(crdDir, defaultsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(defaults), "Status) Default") {
+		t.Errorf("Expected no Default method for Status, which has no markers:\n%s", defaults)
+	}
+	if _, err := os.Stat(filepath.Join(crdDir, validationFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no %s without validation enabled", validationFile)
+	}
+
+	// Exercise the generated methods in the generated module
+	test := `package crd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	w := Widget{Spec: Spec{
+		Replicas: 3,
+		Ports:    []Port{{Number: 80}, {Number: 53, Protocol: "UDP"}},
+		Named:    map[string]Port{"http": {Number: 80}},
+	}}
+	w.Default()
+
+	always := "Always"
+	want := Widget{Spec: Spec{
+		Replicas: 3,
+		Policy:   &always,
+		Ports:    []Port{{Number: 80, Protocol: "TCP"}, {Number: 53, Protocol: "UDP"}},
+		Named:    map[string]Port{"http": {Number: 80, Protocol: "TCP"}},
+		Phase:    "Pending",
+		Labels:   map[string]string{"app": "web"},
+		Enabled:  true,
+	}}
+	if !reflect.DeepEqual(w, want) {
+		t.Errorf("got %+v, want %+v", w, want)
+	}
+
+	var empty Spec
+	empty.Default()
+	if empty.Replicas != 1 {
+		t.Errorf("got %d replicas, want 1", empty.Replicas)
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(crdDir, "defaults_test.go"), []byte(test), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", "./crd")
+	cmd.Dir = filepath.Dir(crdDir)
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off", "GOTOOLCHAIN=local")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Generated defaults failed: %v\n%s\n%s", err, output, defaults)
+	}
+}
+
+func TestParseMarkers(t *testing.T) {
+	doc := &ast.CommentGroup{List: []*ast.Comment{
+		{Text: "// Ports are the exposed ports."},
+		{Text: "// +kubebuilder:validation:MinItems=1"},
+		{Text: "// +kubebuilder:validation:Optional"},
+		{Text: "// +kubebuilder:default={\"port\":80}"},
+		{Text: "// +kubebuilder:pruning:PreserveUnknownFields"},
+		{Text: "// +listType=map"},
+		{Text: "// +listMapKey=port"},
+		{Text: "// +listMapKey=protocol"},
+		{Text: "// +mapType=granular"},
+		{Text: "// +nullable"},
+		{Text: `// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=".metadata.creationTimestamp"`},
+		{Text: `// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status"`},
+		{Text: `// +kubebuilder:validation:XValidation:rule="self.min <= self.max",message="min must not exceed max, or equal it"`},
+		{Text: "// +kubebuilder:resource:scope=Cluster,shortName={pl,pls}"},
+		{Text: "// +genclient"},
+	}}
+	got := ParseMarkers(doc)
+	want := Markers{
+		Validation: map[string]string{
+			"MinItems":    "1",
+			"XValidation": `rule="self.min <= self.max",message="min must not exceed max, or equal it"`,
+		},
+		Default:               `{"port":80}`,
+		HasDefault:            true,
+		Optional:              true,
+		Nullable:              true,
+		PreserveUnknownFields: true,
+		ListType:              "map",
+		ListMapKeys:           []string{"port", "protocol"},
+		MapType:               "granular",
+		Other: map[string]string{
+			"printcolumn": `name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status"`,
+			"resource":    "scope=Cluster,shortName={pl,pls}",
+		},
+		Args: map[string][]MarkerArgs{
+			"printcolumn": {
+				{"name": "Age", "type": "date", "JSONPath": ".metadata.creationTimestamp"},
+				{"name": "Ready", "type": "string", "JSONPath": `.status.conditions[?(@.type=="Ready")].status`},
+			},
+			"validation:XValidation": {{"rule": "self.min <= self.max", "message": "min must not exceed max, or equal it"}},
+			"resource":               {{"scope": "Cluster", "shortName": "{pl,pls}"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMarkers:\n got: %+v\nwant: %+v", got, want)
+	}
+}
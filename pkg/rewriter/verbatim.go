@@ -0,0 +1,158 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// queuePackageCopy marks a package to be copied verbatim and queues the
+// dependencies of all of its declarations, so the copied files' imports of
+// other non-stdlib packages are extracted too
+func (r *RecursiveRewriter) queuePackageCopy(pkgPath string, excludeFiles []string) error {
+	for _, pattern := range excludeFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q for package %s: %w", pattern, pkgPath, err)
+		}
+	}
+
+	pkgInfo, err := r.loadPackageInfo(pkgPath)
+	if err != nil {
+		return err
+	}
+	pkgInfo.Verbatim = true
+	pkgInfo.ExcludeFiles = excludeFiles
+
+	for _, file := range pkgInfo.Pkg.Syntax {
+		if r.isExcludedFile(pkgInfo, r.fset.File(file.Pos()).Name()) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+				continue
+			}
+			r.walkExprForDeps(pkgInfo, nil, decl)
+		}
+	}
+	for _, filename := range r.ignoredGoFiles(pkgInfo) {
+		if err := r.queueIgnoredFileDeps(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignoredGoFiles returns the package's Go files that build constraints leave
+// out on this platform, such as those for other operating systems, or cgo
+// files without cgo. A verbatim copy keeps them so the package still builds
+// everywhere.
+func (r *RecursiveRewriter) ignoredGoFiles(pkgInfo *PackageInfo) []string {
+	var files []string
+	for _, filename := range pkgInfo.Pkg.IgnoredFiles {
+		if strings.HasSuffix(filename, ".go") && !strings.HasSuffix(filename, "_test.go") && !r.isExcludedFile(pkgInfo, filename) {
+			files = append(files, filename)
+		}
+	}
+	return files
+}
+
+// queueIgnoredFileDeps queues what an ignored file of a copied package refers
+// to in other packages. The file isn't type-checked, so references are found
+// from its syntax, through its imports.
+func (r *RecursiveRewriter) queueIgnoredFileDeps(filename string) error {
+	file, err := parser.ParseFile(r.fset, filename, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	imported := make(map[string]string) // key: name in the file, value: import path
+	for _, imp := range file.Imports {
+		importPath, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || importPath == "C" || r.isStdlib(importPath) {
+			continue
+		}
+		if imp.Name != nil {
+			imported[imp.Name.Name] = importPath
+			continue
+		}
+		dep, err := r.consultPackageInfo(importPath, consultMode)
+		if err != nil {
+			return err
+		}
+		imported[dep.Pkg.Name] = importPath
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok && imported[ident.Name] != "" {
+				r.queueType(imported[ident.Name], sel.Sel.Name)
+			}
+		}
+		return true
+	})
+	return nil
+}
+
+func (r *RecursiveRewriter) isVerbatim(pkgPath string) bool {
+	pkgInfo, exists := r.packages[pkgPath]
+	return exists && pkgInfo.Verbatim
+}
+
+func (r *RecursiveRewriter) isExcludedFile(pkgInfo *PackageInfo, filename string) bool {
+	for _, pattern := range pkgInfo.ExcludeFiles {
+		if matched, _ := filepath.Match(pattern, filepath.Base(filename)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// copyVerbatimFiles writes the package's Go files to outputPath unmodified,
+// apart from a generated-code header. Cgo files, and files for other
+// platforms, are copied too.
+func (r *RecursiveRewriter) copyVerbatimFiles(pkgInfo *PackageInfo, outputPath string) error {
+	copied := 0
+	for _, filename := range append(slices.Clone(pkgInfo.Pkg.GoFiles), r.ignoredGoFiles(pkgInfo)...) {
+		if r.isExcludedFile(pkgInfo, filename) {
+			slog.Debug("Excluding file from verbatim copy", "package", pkgInfo.Pkg.PkgPath, "file", filename)
+			continue
+		}
+
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+
+		content, err = r.rewriteFileImports(filename, content)
+		if err != nil {
+			return err
+		}
+
+		header := generatedHeader(pkgInfo.Pkg.PkgPath+"/"+filepath.Base(filename)) + "\n"
+		content = append([]byte(header), content...)
+		if r.config.AliasTag != "" {
+			content = excludeFromAliasBuild(content, r.config.AliasTag)
+		}
+
+		outputFile := filepath.Join(outputPath, filepath.Base(filename))
+		if err := r.writeGenerated(outputFile, content); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	slog.Info("Generated", "dir", outputPath, "verbatimFiles", copied)
+	return nil
+}
+
+// hasOutput reports whether anything is generated for the package
+func (p *PackageInfo) hasOutput() bool {
+	return len(p.Decls) > 0 || p.Verbatim
+}
@@ -0,0 +1,62 @@
+package rewriter
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// modulePath is the module the rewriter is built from, looked up in the
+// build info of whatever binary links it
+const modulePath = "github.com/benmoss/package-rewriter"
+
+// Version returns the version of the rewriter in the running binary: its
+// module version when built with go install or as a dependency, the VCS
+// revision of a build from a checkout, or "(devel)" if neither is known
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	mod := &info.Main
+	if mod.Path != modulePath {
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				mod = dep
+				break
+			}
+		}
+	}
+	if mod.Replace != nil {
+		mod = mod.Replace
+	}
+	if mod.Version != "" && mod.Version != "(devel)" {
+		return mod.Version
+	}
+
+	// Builds from a checkout record the commit instead
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" || info.Main.Path != modulePath {
+		return "(devel)"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return "(devel) " + revision
+}
+
+// generatedHeader returns the comment generated Go files start with, naming
+// the rewriter version and what the file was generated from
+func generatedHeader(source string) string {
+	return fmt.Sprintf("// Code generated by package-rewriter %s. DO NOT EDIT.\n// Source: %s\n", Version(), source)
+}
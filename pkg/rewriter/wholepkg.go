@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"log/slog"
+	"sort"
+)
+
+// expandWholePackages queues every type of each package whose extracted
+// share of types has reached the configured threshold, so the generated
+// package mirrors upstream instead of being a cherry-picked subset. It
+// reports whether any types were queued.
+func (r *RecursiveRewriter) expandWholePackages() bool {
+	if r.config.WholePackage <= 0 {
+		return false
+	}
+
+	var pkgPaths []string
+	for pkgPath := range r.packages {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	queued := false
+	for _, pkgPath := range pkgPaths {
+		pkgInfo := r.packages[pkgPath]
+		if pkgInfo.WholePackage || len(pkgInfo.Decls) == 0 {
+			continue
+		}
+
+		all := packageTypeNames(pkgInfo)
+		extracted := 0
+		for _, name := range all {
+			if _, ok := pkgInfo.Decls[name]; ok {
+				extracted++
+			}
+		}
+		if len(all) == 0 || extracted*100 < r.config.WholePackage*len(all) {
+			continue
+		}
+
+		slog.Info("Copying all types of package",
+			"package", pkgPath,
+			"extracted", extracted,
+			"total", len(all),
+			"threshold", r.config.WholePackage)
+		pkgInfo.WholePackage = true
+		for _, name := range all {
+			if _, ok := pkgInfo.Decls[name]; !ok {
+				r.queueType(pkgPath, name)
+				queued = true
+			}
+		}
+	}
+	return queued
+}
+
+// packageTypeNames returns the names of all top-level types declared in a
+// package, except those annotated to be skipped or substituted
+func packageTypeNames(pkgInfo *PackageInfo) []string {
+	var names []string
+	for _, f := range pkgInfo.Pkg.Syntax {
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if a := declAnnotations(gd, ts); a.skip || a.substitute != "" {
+					continue
+				}
+				names = append(names, ts.Name.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,222 @@
+package rewriter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// FindGoWork returns the go.work file the go command uses in dir (the
+// current directory if empty), or "" outside a workspace or with GOWORK=off
+func FindGoWork(dir string) (string, error) {
+	goWork, err := goEnv(dir, "GOWORK")
+	if err != nil {
+		return "", err
+	}
+	if goWork == "off" {
+		return "", nil
+	}
+	return goWork, nil
+}
+
+// GoWorkManager handles reading and writing go.work files
+type GoWorkManager struct {
+	path string
+	file *modfile.WorkFile
+}
+
+// NewGoWorkManager creates a new go.work manager
+func NewGoWorkManager(path string) (*GoWorkManager, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read go.work: %w", err)
+	}
+
+	file, err := modfile.ParseWork(path, content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse go.work: %w", err)
+	}
+
+	return &GoWorkManager{path: path, file: file}, nil
+}
+
+// relPath returns path relative to the go.work file, as use directives
+// are written
+func (m *GoWorkManager) relPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(filepath.Dir(m.path), abs)
+	if err != nil {
+		return abs
+	}
+	rel = filepath.ToSlash(rel)
+	if !strings.HasPrefix(rel, ".") {
+		rel = "./" + rel
+	}
+	return rel
+}
+
+// absPath resolves a use directive's path
+func (m *GoWorkManager) absPath(diskPath string) string {
+	if filepath.IsAbs(diskPath) {
+		return filepath.Clean(diskPath)
+	}
+	return filepath.Join(filepath.Dir(m.path), filepath.FromSlash(diskPath))
+}
+
+// UsesUnder returns the use directives for module directories inside dir
+func (m *GoWorkManager) UsesUnder(dir string) []string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	var uses []string
+	for _, use := range m.file.Use {
+		if rel, err := filepath.Rel(abs, m.absPath(use.Path)); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			uses = append(uses, use.Path)
+		}
+	}
+	return uses
+}
+
+// HasUse reports whether the workspace uses the module directory
+func (m *GoWorkManager) HasUse(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, use := range m.file.Use {
+		if m.absPath(use.Path) == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// AddUse adds a use directive for the module directory
+func (m *GoWorkManager) AddUse(dir string) error {
+	return m.file.AddUse(m.relPath(dir), "")
+}
+
+// AddReplace adds a replace directive pointing at a module version, which
+// applies to every module of the workspace
+func (m *GoWorkManager) AddReplace(modulePath string, target module.Version) error {
+	return m.file.AddReplace(modulePath, "", target.Path, target.Version)
+}
+
+// ReplacedModules returns the modules the workspace replaces
+func (m *GoWorkManager) ReplacedModules() []string {
+	var modulePaths []string
+	for _, replace := range m.file.Replace {
+		modulePaths = append(modulePaths, replace.Old.Path)
+	}
+	return modulePaths
+}
+
+// ModulePaths returns the paths of the modules the workspace uses, as their
+// go.mod files declare them
+func (m *GoWorkManager) ModulePaths() []string {
+	var modulePaths []string
+	for _, use := range m.file.Use {
+		content, err := os.ReadFile(filepath.Join(m.absPath(use.Path), "go.mod"))
+		if err != nil {
+			continue
+		}
+		if modulePath := modfile.ModulePath(content); modulePath != "" {
+			modulePaths = append(modulePaths, modulePath)
+		}
+	}
+	return modulePaths
+}
+
+// RemoveReplace removes the replace directive for the given module path
+func (m *GoWorkManager) RemoveReplace(modulePath string) error {
+	return m.file.DropReplace(modulePath, "")
+}
+
+// RemoveUse removes the use directive with the given path, as written in
+// go.work
+func (m *GoWorkManager) RemoveUse(diskPath string) error {
+	return m.file.DropUse(diskPath)
+}
+
+// Save writes the modified go.work back to disk
+func (m *GoWorkManager) Save() error {
+	m.file.SortBlocks()
+	m.file.Cleanup()
+	if err := os.WriteFile(m.path, modfile.Format(m.file.Syntax), 0644); err != nil {
+		return fmt.Errorf("failed to write go.work: %w", err)
+	}
+	return nil
+}
+
+// removeGeneratedUses drops the use directives for modules generated into
+// the output directory by earlier runs, and the replace directives for
+// modules replaced with a published version, so source packages are loaded
+// from the real modules rather than their trimmed copies
+func (r *RecursiveRewriter) removeGeneratedUses(goWork *GoWorkManager) error {
+	uses := goWork.UsesUnder(r.config.OutputDir)
+	var replaced []string
+	for _, modulePath := range goWork.ReplacedModules() {
+		if _, ok := r.config.ReplaceWith[modulePath]; ok {
+			replaced = append(replaced, modulePath)
+		}
+	}
+	if len(uses) == 0 && len(replaced) == 0 {
+		return nil
+	}
+	slog.Info("Removing directives for generated modules from go.work", "uses", len(uses), "replaces", len(replaced))
+	for _, use := range uses {
+		if err := goWork.RemoveUse(use); err != nil {
+			return fmt.Errorf("failed to remove use directive for %s: %w", use, err)
+		}
+	}
+	for _, modulePath := range replaced {
+		if err := goWork.RemoveReplace(modulePath); err != nil {
+			return fmt.Errorf("failed to remove replace directive for %s: %w", modulePath, err)
+		}
+	}
+	return goWork.Save()
+}
+
+// updateGoWorkUses adds a use directive for each generated module, which
+// resolves it to the generated code in every module of the workspace, or a
+// replace directive for those replaced with a published version. In a
+// workspace, replace directives in a module's go.mod would apply to the
+// other modules too, and two modules replacing the same module differently
+// would conflict, so go.mod is left alone.
+func (r *RecursiveRewriter) updateGoWorkUses(goWork *GoWorkManager) error {
+	modulePaths := r.generatedModules()
+
+	for _, modulePath := range modulePaths {
+		// A module replaced with a published version isn't in the workspace
+		if target, ok := r.replaceTarget(modulePath); ok {
+			if err := goWork.AddReplace(modulePath, target); err != nil {
+				return fmt.Errorf("failed to add replace directive for %s: %w", modulePath, err)
+			}
+			slog.Info("Added replace directive", "module", modulePath, "target", target.String())
+			continue
+		}
+		dir := filepath.Join(r.config.OutputDir, r.moduleDir(modulePath))
+		if goWork.HasUse(dir) {
+			continue
+		}
+		if err := goWork.AddUse(dir); err != nil {
+			return fmt.Errorf("failed to add use directive for %s: %w", modulePath, err)
+		}
+		slog.Info("Added use directive", "module", modulePath, "path", goWork.relPath(dir))
+	}
+
+	if err := goWork.Save(); err != nil {
+		return err
+	}
+	slog.Info("Updated go.work", "uses", len(modulePaths))
+	return nil
+}
@@ -0,0 +1,596 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// wireWrapper is a small stand-in for a type with custom marshaling, which
+// reproduces its wire format without its dependencies
+type wireWrapper struct {
+	holds  string // substitute the wrapper holds, which a configured substitute must match, if any
+	source string // declarations and their imports, without a package clause
+}
+
+// wireWrappers are the types that can be wrapped, by TypeRef key. Each
+// wrapper declares the type under its own name, along with the methods and
+// helpers generated code most often calls, in the order types.go lists
+// declarations (constants, variables, types, then functions, each by name),
+// so printing them keeps the blank lines between them.
+var wireWrappers = map[string]wireWrapper{
+	"k8s.io/apimachinery/pkg/apis/meta/v1.Time": {holds: "time.Time", source: `
+import (
+	"encoding/json"
+	"time"
+)
+
+// Time wraps time.Time, marshaling it as RFC 3339 at second precision and
+// the zero time as null, like k8s.io/apimachinery/pkg/apis/meta/v1.Time
+type Time struct {
+	time.Time ` + "`protobuf:\"-\"`" + `
+}
+
+// DeepCopy returns a copy of the receiver
+func (t *Time) DeepCopy() *Time {
+	if t == nil {
+		return nil
+	}
+	out := new(Time)
+	t.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (t *Time) DeepCopyInto(out *Time) {
+	*out = *t
+}
+
+// Equal reports whether t and u are both nil or the same instant
+func (t *Time) Equal(u *Time) bool {
+	if t == nil || u == nil {
+		return t == u
+	}
+	return t.Time.Equal(u.Time)
+}
+
+// IsZero reports whether t is nil or the zero time
+func (t *Time) IsZero() bool {
+	return t == nil || t.Time.IsZero()
+}
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339))
+}
+
+func (t *Time) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed.Local()
+	return nil
+}
+`},
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1.MicroTime": {holds: "time.Time", source: `
+import (
+	"encoding/json"
+	"time"
+)
+
+// RFC3339Micro is RFC 3339 with microsecond precision
+const RFC3339Micro = "2006-01-02T15:04:05.000000Z07:00"
+
+// MicroTime wraps time.Time, marshaling it as RFC 3339 at microsecond
+// precision and the zero time as null, like
+// k8s.io/apimachinery/pkg/apis/meta/v1.MicroTime
+type MicroTime struct {
+	time.Time ` + "`protobuf:\"-\"`" + `
+}
+
+// DeepCopy returns a copy of the receiver
+func (t *MicroTime) DeepCopy() *MicroTime {
+	if t == nil {
+		return nil
+	}
+	out := new(MicroTime)
+	t.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (t *MicroTime) DeepCopyInto(out *MicroTime) {
+	*out = *t
+}
+
+// Equal reports whether t and u are both nil or the same instant
+func (t *MicroTime) Equal(u *MicroTime) bool {
+	if t == nil || u == nil {
+		return t == u
+	}
+	return t.Time.Equal(u.Time)
+}
+
+// IsZero reports whether t is nil or the zero time
+func (t *MicroTime) IsZero() bool {
+	return t == nil || t.Time.IsZero()
+}
+
+func (t MicroTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(RFC3339Micro))
+}
+
+func (t *MicroTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(RFC3339Micro, str)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed.Local()
+	return nil
+}
+`},
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1.Duration": {holds: "time.Duration", source: `
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration wraps time.Duration, marshaling it as a string such as "1h2m3s"
+// rather than nanoseconds, like k8s.io/apimachinery/pkg/apis/meta/v1.Duration
+type Duration struct {
+	time.Duration ` + "`protobuf:\"varint,1,opt,name=duration,casttype=time.Duration\"`" + `
+}
+
+// DeepCopy returns a copy of the receiver
+func (d *Duration) DeepCopy() *Duration {
+	if d == nil {
+		return nil
+	}
+	out := new(Duration)
+	d.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (d *Duration) DeepCopyInto(out *Duration) {
+	*out = *d
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+`},
+
+	"k8s.io/apimachinery/pkg/util/intstr.IntOrString": {source: `
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Int means an IntOrString holds an int32
+const Int Type = 0
+
+// String means an IntOrString holds a string
+const String Type = 1
+
+// IntOrString holds an int32 or a string, marshaled as a JSON number or
+// string, like k8s.io/apimachinery/pkg/util/intstr.IntOrString
+type IntOrString struct {
+	Type   Type   ` + "`protobuf:\"varint,1,opt,name=type,casttype=Type\"`" + `
+	IntVal int32  ` + "`protobuf:\"varint,2,opt,name=intVal\"`" + `
+	StrVal string ` + "`protobuf:\"bytes,3,opt,name=strVal\"`" + `
+}
+
+// Type is the kind of value an IntOrString holds
+type Type int64
+
+// FromInt32 returns an IntOrString holding val
+func FromInt32(val int32) IntOrString {
+	return IntOrString{Type: Int, IntVal: val}
+}
+
+// FromString returns an IntOrString holding val
+func FromString(val string) IntOrString {
+	return IntOrString{Type: String, StrVal: val}
+}
+
+// DeepCopy returns a copy of the receiver
+func (intstr *IntOrString) DeepCopy() *IntOrString {
+	if intstr == nil {
+		return nil
+	}
+	out := new(IntOrString)
+	intstr.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (intstr *IntOrString) DeepCopyInto(out *IntOrString) {
+	*out = *intstr
+}
+
+func (intstr IntOrString) MarshalJSON() ([]byte, error) {
+	switch intstr.Type {
+	case Int:
+		return json.Marshal(intstr.IntVal)
+	case String:
+		return json.Marshal(intstr.StrVal)
+	default:
+		return []byte{}, fmt.Errorf("impossible IntOrString.Type")
+	}
+}
+
+// String returns the value held, formatted as a string
+func (intstr *IntOrString) String() string {
+	if intstr == nil {
+		return "<nil>"
+	}
+	if intstr.Type == String {
+		return intstr.StrVal
+	}
+	return strconv.Itoa(int(intstr.IntVal))
+}
+
+func (intstr *IntOrString) UnmarshalJSON(value []byte) error {
+	if len(value) > 0 && value[0] == '"' {
+		intstr.Type = String
+		return json.Unmarshal(value, &intstr.StrVal)
+	}
+	intstr.Type = Int
+	return json.Unmarshal(value, &intstr.IntVal)
+}
+`},
+
+	"k8s.io/apimachinery/pkg/runtime.RawExtension": {source: `
+import (
+	"bytes"
+	"errors"
+)
+
+// RawExtension holds serialized JSON, marshaled as it is, like
+// k8s.io/apimachinery/pkg/runtime.RawExtension. Unlike RawExtension, it has
+// no decoded Object, which would need the runtime package's scheme.
+type RawExtension struct {
+	// Raw is the serialized object
+	Raw []byte ` + "`json:\"-\" protobuf:\"bytes,1,opt,name=raw\"`" + `
+}
+
+// DeepCopy returns a copy of the receiver
+func (in *RawExtension) DeepCopy() *RawExtension {
+	if in == nil {
+		return nil
+	}
+	out := new(RawExtension)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *RawExtension) DeepCopyInto(out *RawExtension) {
+	*out = *in
+	if in.Raw != nil {
+		out.Raw = make([]byte, len(in.Raw))
+		copy(out.Raw, in.Raw)
+	}
+}
+
+func (re RawExtension) MarshalJSON() ([]byte, error) {
+	if re.Raw == nil {
+		return []byte("null"), nil
+	}
+	return re.Raw, nil
+}
+
+func (re *RawExtension) UnmarshalJSON(in []byte) error {
+	if re == nil {
+		return errors.New("runtime.RawExtension: UnmarshalJSON on nil pointer")
+	}
+	if !bytes.Equal(in, []byte("null")) {
+		re.Raw = append(re.Raw[0:0], in...)
+	}
+	return nil
+}
+`},
+
+	"k8s.io/apimachinery/pkg/api/resource.Quantity": {source: `
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// quantityPattern matches the quantities the API server accepts: a number
+// with an optional binary or decimal SI suffix, or a decimal exponent
+var quantityPattern = regexp.MustCompile(` + "`^[+-]?([0-9]+(\\.[0-9]*)?|\\.[0-9]+)([KMGTPE]i|[numkMGTPE]|[eE][+-]?[0-9]+)?$`" + `)
+
+// Quantity holds a quantity such as "100m" or "1Gi" as written, marshaled
+// as a JSON string and unmarshaled from a string or a number, like
+// k8s.io/apimachinery/pkg/api/resource.Quantity. Unlike Quantity, it doesn't
+// do arithmetic or canonicalize what it holds.
+type Quantity struct {
+	s string
+}
+
+// MustParse returns the quantity str represents, and panics if it isn't one
+func MustParse(str string) Quantity {
+	q, err := ParseQuantity(str)
+	if err != nil {
+		panic(fmt.Errorf("cannot parse '%v': %v", str, err))
+	}
+	return q
+}
+
+// ParseQuantity returns the quantity str represents
+func ParseQuantity(str string) (Quantity, error) {
+	if !quantityPattern.MatchString(str) {
+		return Quantity{}, fmt.Errorf("quantities must match the regular expression '%s'", quantityPattern)
+	}
+	return Quantity{s: str}, nil
+}
+
+// DeepCopy returns a copy of the receiver
+func (q Quantity) DeepCopy() Quantity {
+	return q
+}
+
+// DeepCopyInto copies the receiver into out
+func (q *Quantity) DeepCopyInto(out *Quantity) {
+	*out = *q
+}
+
+// Equal reports whether q and v were written the same way
+func (q Quantity) Equal(v Quantity) bool {
+	return q.String() == v.String()
+}
+
+func (q Quantity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.String())
+}
+
+// String returns the quantity as written, or "0" for the zero value
+func (q *Quantity) String() string {
+	if q == nil || q.s == "" {
+		return "0"
+	}
+	return q.s
+}
+
+func (q *Quantity) UnmarshalJSON(value []byte) error {
+	str := strings.TrimSpace(string(value))
+	if str == "null" {
+		q.s = ""
+		return nil
+	}
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		str = strings.TrimSpace(str[1 : len(str)-1])
+	}
+	parsed, err := ParseQuantity(str)
+	if err != nil {
+		return err
+	}
+	*q = parsed
+	return nil
+}
+`},
+
+	"github.com/aws/aws-lambda-go/events.SecondsEpochTime": {holds: "time.Time", source: `
+import (
+	"encoding/json"
+	"time"
+)
+
+// SecondsEpochTime wraps time.Time, marshaling it as a Unix time in
+// fractional seconds, like github.com/aws/aws-lambda-go/events.SecondsEpochTime
+type SecondsEpochTime struct {
+	time.Time
+}
+
+func (e SecondsEpochTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(float64(e.UnixNano()) / float64(time.Second))
+}
+
+func (e *SecondsEpochTime) UnmarshalJSON(b []byte) error {
+	var epoch float64
+	if err := json.Unmarshal(b, &epoch); err != nil {
+		return err
+	}
+	sec := int64(epoch)
+	*e = SecondsEpochTime{time.Unix(sec, int64((epoch-float64(sec))*float64(time.Second)))}
+	return nil
+}
+`},
+
+	"github.com/aws/aws-lambda-go/events.MilliSecondsEpochTime": {holds: "time.Time", source: `
+import (
+	"encoding/json"
+	"time"
+)
+
+// MilliSecondsEpochTime wraps time.Time, marshaling it as a Unix time in
+// whole milliseconds, like
+// github.com/aws/aws-lambda-go/events.MilliSecondsEpochTime
+type MilliSecondsEpochTime struct {
+	time.Time
+}
+
+func (e MilliSecondsEpochTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.UnixNano() / int64(time.Millisecond))
+}
+
+func (e *MilliSecondsEpochTime) UnmarshalJSON(b []byte) error {
+	var epoch int64
+	if err := json.Unmarshal(b, &epoch); err != nil {
+		return err
+	}
+	*e = MilliSecondsEpochTime{time.Unix(epoch/1000, (epoch%1000)*int64(time.Millisecond))}
+	return nil
+}
+`},
+
+	"google.golang.org/api/googleapi.Int64s":   quotedList("Int64s", "int64", "strconv.AppendInt(dst, v, 10)", "strconv.ParseInt(s, 10, 64)"),
+	"google.golang.org/api/googleapi.Int32s":   quotedList("Int32s", "int32", "strconv.AppendInt(dst, int64(v), 10)", "strconv.ParseInt(s, 10, 32)"),
+	"google.golang.org/api/googleapi.Uint64s":  quotedList("Uint64s", "uint64", "strconv.AppendUint(dst, v, 10)", "strconv.ParseUint(s, 10, 64)"),
+	"google.golang.org/api/googleapi.Uint32s":  quotedList("Uint32s", "uint32", "strconv.AppendUint(dst, uint64(v), 10)", "strconv.ParseUint(s, 10, 32)"),
+	"google.golang.org/api/googleapi.Float64s": quotedList("Float64s", "float64", "strconv.AppendFloat(dst, v, 'g', -1, 64)", "strconv.ParseFloat(s, 64)"),
+}
+
+// quotedList returns the wrapper of a google.golang.org/api/googleapi slice
+// type, which marshals its numbers as quoted strings so JavaScript clients
+// don't round them. appendValue appends v to dst, and parseValue parses s.
+func quotedList(name, elem, appendValue, parseValue string) wireWrapper {
+	return wireWrapper{source: fmt.Sprintf(`
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// %[1]s is a slice of %[2]s marshaled as a JSON array of quoted strings, like
+// google.golang.org/api/googleapi.%[1]s
+type %[1]s []%[2]s
+
+func (q %[1]s) MarshalJSON() ([]byte, error) {
+	dst := []byte{'['}
+	for i, v := range q {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = %[3]s
+		dst = append(dst, '"')
+	}
+	return append(dst, ']'), nil
+}
+
+func (q *%[1]s) UnmarshalJSON(raw []byte) error {
+	*q = (*q)[:0]
+	var ss []string
+	if err := json.Unmarshal(raw, &ss); err != nil {
+		return err
+	}
+	for _, s := range ss {
+		v, err := %[4]s
+		if err != nil {
+			return err
+		}
+		*q = append(*q, %[2]s(v))
+	}
+	return nil
+}
+`, name, elem, appendValue, parseValue)}
+}
+
+// checkWrapper checks that a type to wrap has a wrapper, holding its
+// substitute if one is configured
+func checkWrapper(typeRef TypeRef, opts TypeOptions) error {
+	wrapper, ok := wireWrappers[typeRef.String()]
+	if !ok {
+		var known []string
+		for key := range wireWrappers {
+			known = append(known, key)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("can't wrap %s: no wrapper reproduces its wire format (known: %s)", typeRef, strings.Join(known, ", "))
+	}
+	if opts.Substitute != "" && opts.Substitute != wrapper.holds {
+		holds := wrapper.holds
+		if holds == "" {
+			holds = "no substitute"
+		}
+		return fmt.Errorf("can't wrap %s around %s: its wrapper holds %s", typeRef, opts.Substitute, holds)
+	}
+	return nil
+}
+
+// extractWrapper adds the wrapper of a wrapped type to its package in place
+// of the upstream declaration, or checks that it has a method generated code
+// calls. The wrapper's declarations have no type information, so they're
+// left alone by the features that need it, such as validation.
+func (r *RecursiveRewriter) extractWrapper(pkgInfo *PackageInfo, typeRef TypeRef) error {
+	recv, method, isMethod := strings.Cut(typeRef.TypeName, ".")
+	wrapped := TypeRef{PackagePath: typeRef.PackagePath, TypeName: recv}
+	if pkgInfo.Decls[recv] == nil {
+		file, err := parser.ParseFile(r.fset, "wrapper for "+wrapped.String(), "package "+pkgInfo.Pkg.Name+"\n"+wireWrappers[wrapped.String()].source, parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("failed to parse the wrapper for %s: %w", wrapped, err)
+		}
+		for _, spec := range file.Imports {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			r.recordImport(pkgInfo, importPath, path.Base(importPath))
+		}
+		for _, decl := range file.Decls {
+			name, comment := "", (*ast.CommentGroup)(nil)
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				name, comment = d.Name.Name, d.Doc
+				if d.Recv != nil {
+					name = recv + "." + name
+				}
+			case *ast.GenDecl:
+				if d.Tok == token.IMPORT {
+					continue
+				}
+				switch spec := d.Specs[0].(type) {
+				case *ast.TypeSpec:
+					name = spec.Name.Name
+				case *ast.ValueSpec:
+					name = spec.Names[0].Name
+				}
+				comment = d.Doc
+			}
+			// The package's own declarations of the same name win
+			if pkgInfo.Decls[name] == nil {
+				pkgInfo.Decls[name] = &DeclInfo{Name: name, Decl: decl, File: file, Comment: comment, PackagePath: pkgInfo.Pkg.PkgPath}
+			}
+		}
+		slog.Info("Wrapped", "type", wrapped.String())
+	}
+	if isMethod && pkgInfo.Decls[typeRef.TypeName] == nil {
+		return fmt.Errorf("the wrapper for %s has no %s method (reached via %s)", wrapped, method, r.dependencyPath(typeRef))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/benmoss/package-rewriter/pkg/config"
+	"github.com/benmoss/package-rewriter/pkg/rewriter"
+)
+
+// extractRequest is the body of POST /extract
+type extractRequest struct {
+	// Dir is the module directory source packages are loaded from, and what
+	// includes in the config are relative to
+	Dir string `json:"dir"`
+	// Config is a config file's contents, as a JSON object or a YAML string
+	Config  json.RawMessage `json:"config"`
+	Profile string          `json:"profile,omitempty"`
+}
+
+// extractResponse is the reply to POST /extract: the generated files keyed
+// by their path relative to the output directory, or what went wrong
+type extractResponse struct {
+	Files map[string]string `json:"files,omitempty"`
+	Error string            `json:"error,omitempty"`
+	Code  rewriter.Code     `json:"code,omitempty"` // class of the error, if known
+}
+
+// serverOnlyFields are the config fields a request can't set: they run
+// programs, read files the request doesn't name, or change the module
+// requests are loaded from
+var serverOnlyFields = []string{"goEnv", "include", "autoRequire", "tidy", "codeowners"}
+
+// server runs extractions for clients, keeping loaded packages warm between
+// requests. Requests run concurrently, each into its own output directory.
+type server struct {
+	cache *rewriter.PackageCache
+}
+
+// runServe serves the extraction API until the process is stopped
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:7878", "Address to listen on: host:port, or unix:<path> for a unix socket")
+	fs.Parse(args)
+
+	network, address := "tcp", *listen
+	if path, ok := strings.CutPrefix(*listen, "unix:"); ok {
+		network, address = "unix", path
+		// A socket left behind by an earlier server would fail the listen
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	s := &server{cache: rewriter.NewPackageCache()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /extract", s.handleExtract)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	slog.Info("Serving", "network", network, "address", address)
+	return http.Serve(listener, mux)
+}
+
+func (s *server) handleExtract(w http.ResponseWriter, r *http.Request) {
+	// Browsers send an Origin with cross-origin requests, and only JSON
+	// requests need a preflight, so web pages can't reach the server
+	if r.Header.Get("Origin") != "" {
+		writeJSON(w, http.StatusForbidden, extractResponse{Error: "cross-origin requests aren't allowed"})
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, extractResponse{Error: "Content-Type must be application/json"})
+		return
+	}
+
+	var req extractRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, extractResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	files, err := s.extract(req)
+	if err != nil {
+		resp := extractResponse{Error: err.Error()}
+		if d, ok := rewriter.DiagnosticOf(err); ok {
+			resp.Code = d.Code
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, resp)
+		return
+	}
+	resp := extractResponse{Files: make(map[string]string)}
+	for name, content := range files {
+		resp.Files[name] = string(content)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// extract runs one request into a temporary output directory
+func (s *server) extract(req extractRequest) (map[string][]byte, error) {
+	if req.Dir == "" || !filepath.IsAbs(req.Dir) {
+		return nil, errors.New("dir must be an absolute path")
+	}
+	data := []byte(req.Config)
+	var text string
+	if json.Unmarshal(req.Config, &text) == nil {
+		data = []byte(text)
+	}
+	// JSON is YAML, so the config object is parsed like a config file
+	configPath := filepath.Join(req.Dir, "request.yaml")
+	cfg, err := config.ParseRequestConfig(configPath, data, req.Profile, serverOnlyFields)
+	if err != nil {
+		return nil, err
+	}
+	if err := addScannedNeeds(cfg, configPath); err != nil {
+		return nil, err
+	}
+
+	outputDir, err := os.MkdirTemp("", "package-rewriter-serve-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	configs := rewriterConfigs(cfg)
+	for _, c := range configs {
+		c.Dir = req.Dir
+		c.OutputDir = outputDir
+		c.Cache = s.cache
+	}
+	return rewriter.Extract(configs)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}